@@ -1,41 +1,23 @@
 package blockchain
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
-	"encoding/gob"
 	"fmt"
 	"log"
-	"math"
-	"math/big"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/duke-git/lancet/v2/slice"
-	"github.com/mkohlhaas/gobc/bcerror"
+	"github.com/mkohlhaas/gobc/wire"
 )
 
-// Difficulty is the proof of work difficulty.
-const Difficulty = 12
-
-// Target value for proof of work.
-var target *big.Int
-
 // Block of the blockchain.
+// The hash and the height are not part of the header; they are derived from it.
 type Block struct {
-	Timestamp    int64
+	BlockHeader
 	Hash         Hash
-	Transactions []*Transaction
-	PrevHash     Hash
-	Nonce        uint32
 	Height       uint64
-}
-
-// init updates the requirement target for proof of work.
-func init() {
-	target = big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
+	Transactions []*Transaction
 }
 
 // Returns hash of Merkle tree for block's transactions.
@@ -48,24 +30,42 @@ func (b *Block) hashTransactions() Hash {
 }
 
 // Creates a valid new block.
-func createBlock(txs []*Transaction, prevHash Hash, height uint64) *Block {
+// `bits` is the target in compact form.
+func createBlock(txs []*Transaction, prevHash Hash, height uint64, bits uint32) (*Block, error) {
+	return createBlockAt(time.Now().Unix(), txs, prevHash, height, bits)
+}
+
+// Creates a valid new block with `timestamp`.
+// The timestamp and the coinbase may change if the miner exhausts the nonce space.
+func createBlockAt(timestamp int64, txs []*Transaction, prevHash Hash, height uint64, bits uint32) (*Block, error) {
+	b := newBlock(timestamp, txs, prevHash, height, bits)
+	if err := b.runProof(context.Background()); err != nil {
+		return nil, err
+	}
+	log.Printf("New Block: %s\n", b)
+	return b, nil
+}
+
+// Returns a new block without proof of work.
+func newBlock(timestamp int64, txs []*Transaction, prevHash Hash, height uint64, bits uint32) *Block {
 	b := &Block{
-		Timestamp:    time.Now().Unix(),
-		Hash:         make(Hash, 0),
-		Transactions: txs,
-		PrevHash:     prevHash,
-		Nonce:        0,
+		BlockHeader: BlockHeader{
+			Version:   blockVersion,
+			PrevHash:  prevHash,
+			Timestamp: timestamp,
+			Bits:      bits,
+		},
 		Height:       height,
+		Transactions: txs,
 	}
-	b.RunProof()
-	log.Printf("New Block: %s\n", b)
+	b.MerkleRoot = b.hashTransactions()
 	return b
 }
 
-// Creates the legendary Genesis Block with only a coinbase transaction.
-func genesis(coinbase *Transaction) *Block {
-	prevHash := make(Hash, 0) // no previous hash
-	return createBlock([]*Transaction{coinbase}, prevHash, 0)
+// Creates the legendary Genesis Block of the active network with only a coinbase transaction.
+func genesis(coinbase *Transaction) (*Block, error) {
+	prevHash := make(Hash, 32) // no previous hash
+	return createBlockAt(Params.GenesisTimestamp, []*Transaction{coinbase}, prevHash, 0, Params.PowLimitBits)
 }
 
 // Returns true if block is the legendary Genesis block.
@@ -78,64 +78,75 @@ func (b *Block) isNotGenesisBlock() bool {
 	return !b.isGenesisBlock()
 }
 
-// Serialize block for storing in database.
+// Serialize block for sending it to other nodes.
+// Format: version, header, height, number of transactions, transactions.
 func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-	err := encoder.Encode(b)
-	bcerror.Handle(err)
-	return res.Bytes()
-}
-
-// DeserializeBlock block for retrieving from database.
-func DeserializeBlock(data []byte) *Block {
-	var b Block
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&b)
-	bcerror.Handle(err)
-	return &b
-}
-
-// RunProof runs proof of work.
-// Updates nonce and hash in the block.
-func (b *Block) RunProof() {
-	var nonce uint32
-	for nonce < math.MaxUint32 { // we expect to find a nonce (if not it takes too long anyways)
-		if b.IsValidBlockHeader() {
-			break // we found a nonce
-		}
-		nonce++
+	w := wire.NewWriter()
+	w.WriteVersion()
+	b.BlockHeader.encode(w)
+	w.WriteUint64(b.Height)
+	b.encodeTransactions(w)
+	return w.Bytes()
+}
+
+// DeserializeBlock block received from other nodes.
+// The hash is calculated from the header.
+func DeserializeBlock(data []byte) (*Block, error) {
+	r := wire.NewReader(data)
+	r.ReadVersion()
+	b := &Block{BlockHeader: decodeBlockHeader(r), Height: r.ReadUint64()}
+	b.Transactions = decodeTransactions(r)
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("deserializing block: %w", err)
 	}
-	b.Nonce = nonce
-	b.Hash = b.calcHash()
+	b.Hash = b.CalcHash()
+	return b, nil
 }
 
-// IsValidBlockHeader returns true if we have a valid block header.
-// Validates proof of work.
-func (b *Block) IsValidBlockHeader() bool {
-	hash := b.calcHash()
-	var intHash big.Int
-	intHash.SetBytes(hash)
-	return intHash.Cmp(target) == -1 // block's hash < target
+// Serialize block body for storing in database.
+// Format: version, number of transactions, transactions.
+func (b *Block) serializeBody() []byte {
+	w := wire.NewWriter()
+	w.WriteVersion()
+	b.encodeTransactions(w)
+	return w.Bytes()
 }
 
-// Sets block hash to Double SHA256 of block header.
-func (b *Block) calcHash() Hash {
-	data := slice.Concat(
-		[]byte(strconv.FormatInt(b.Timestamp, 10)),
-		b.PrevHash,
-		b.hashTransactions(),
-		toHex(int64(b.Nonce)),
-		toHex(int64(Difficulty))) // Difficulty is part of the hash!!!
-	return doubleHash256(data)
+// Deserialize block body for retrieving from database.
+func deserializeBody(data []byte) ([]*Transaction, error) {
+	r := wire.NewReader(data)
+	r.ReadVersion()
+	txs := decodeTransactions(r)
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("deserializing block body: %w", err)
+	}
+	return txs, nil
+}
+
+func (b *Block) encodeTransactions(w *wire.Writer) {
+	w.WriteVarInt(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		tx.encode(w)
+	}
+}
+
+func decodeTransactions(r *wire.Reader) []*Transaction {
+	var txs []*Transaction
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		txs = append(txs, decodeTransaction(r))
+	}
+	return txs
 }
 
 // Stringer for blocks.
 func (b *Block) String() string {
 	var sb strings.Builder
+	fmt.Fprintf(&sb, "Version: %d\n", b.Version)
 	fmt.Fprintf(&sb, "Timestamp: %d\n", b.Timestamp)
-	fmt.Fprintf(&sb, "Hash: %s\n", b.Hash)
-	fmt.Fprintf(&sb, "PrevHash: %s\n", b.PrevHash)
+	fmt.Fprintf(&sb, "Hash: %x\n", b.Hash)
+	fmt.Fprintf(&sb, "PrevHash: %x\n", b.PrevHash)
+	fmt.Fprintf(&sb, "MerkleRoot: %x\n", b.MerkleRoot)
+	fmt.Fprintf(&sb, "Bits: %08x\n", b.Bits)
 	fmt.Fprintf(&sb, "Nonce: %d\n", b.Nonce)
 	fmt.Fprintf(&sb, "Height: %d\n", b.Height)
 	fmt.Fprintf(&sb, "Transactions:\n")
@@ -151,8 +162,3 @@ func doubleHash256(data []byte) Hash {
 	hash1 := sha256.Sum256(hash[:])
 	return hash1[:]
 }
-
-// Convert int64 to hexadecimal.
-func toHex(num int64) []byte {
-	return []byte(strconv.FormatInt(num, 16))
-}
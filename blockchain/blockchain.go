@@ -2,16 +2,18 @@
 package blockchain
 
 import (
-	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger"
 	"github.com/mkohlhaas/gobc/bcerror"
@@ -23,15 +25,27 @@ type Hash []byte
 type BlockChain struct {
 	// DB stores key-value pairs:
 	// key:   block hash
-	// value: block
-	// Also entries for UTXOs with key prefix "utxo-"
+	// value: block body (transactions)
+	// Also entries for block headers with key prefix "hdr-" and UTXOs with key prefix "utxo-"
 	Database *badger.DB
-}
 
-const (
-	dbPath      = "./tmp/blocks_%s"
-	genesisData = "The Times 03/Jan/2009: Chancellor on brink of second bailout for banks."
-)
+	// chainMu serializes AddBlock: the comparison with the main chain and the switch
+	// of the last block must not interleave with another block.
+	chainMu sync.Mutex
+
+	subscribersMu sync.Mutex
+	subscribers   []func(ChainUpdate) // see Subscribe
+
+	MaxOrphanSize int           // limit of the total size of the orphan blocks in bytes
+	OrphanExpiry  time.Duration // orphan blocks older than this are removed
+
+	orphanMu      sync.Mutex
+	orphans       map[string]*orphanBlock // by block hash
+	orphansByPrev map[string][]*orphanBlock
+	orphanSize    int              // total size of the orphan blocks
+	orphanSeq     uint64           // sequence number of the last orphan block
+	now           func() time.Time // only tests change the clock
+}
 
 // lastHashEntry is the key in the database for the last block.
 var lastHashEntry = Hash("lhentry")
@@ -58,115 +72,168 @@ func (bc *BlockChain) getLastBlock() *Block {
 	return lastBlock
 }
 
-// AddBlock adds a block to the blockchain.
-func (bc *BlockChain) AddBlock(block *Block) {
-	lastBlock := bc.getLastBlock()
-	_, err := bc.GetBlock(block.Hash)
-	if err == nil {
-		fmt.Printf("Block %x already in the blockchain.\n", block.Hash)
-		return
+// Returns the last block without transactions.
+func (bc *BlockChain) getLastHeader() *Block {
+	lastHash := bc.getLastHash()
+	lastHeader, err := bc.getBlockHeader(lastHash)
+	bcerror.Handle(err)
+	return lastHeader
+}
+
+// AddBlock validates a block and adds it to the blockchain.
+// Blocks on side chains are stored as well. The chain with the most cumulative
+// proof of work becomes the main chain; if necessary the blockchain is reorganized.
+// Blocks becoming part of the main chain are connected, i.e. their transactions
+// are validated against the UTXO set and the UTXO set is updated.
+// Returns a RuleError if the block violates a consensus rule.
+func (bc *BlockChain) AddBlock(block *Block) error {
+	bc.chainMu.Lock()
+	defer bc.chainMu.Unlock()
+	if err := bc.restorePendingTip(); err != nil {
+		return err
 	}
-	// Write block into blockchain.
-	bc.Database.Update(func(txn *badger.Txn) error {
-		blockData := block.Serialize()
-		err = txn.Set(block.Hash, blockData)
-		bcerror.Handle(err)
-		// The new block should have a height bigger than the last block.
-		if block.Height > lastBlock.Height {
-			err = txn.Set(lastHashEntry, block.Hash)
-			bcerror.Handle(err)
+	if _, err := bc.getBlockHeader(block.Hash); err == nil {
+		return ruleError(ErrDuplicateBlock, "block %x already in the blockchain", block.Hash)
+	}
+	if err := checkBlockSanity(block); err != nil {
+		return err
+	}
+	prevBlock, err := bc.getBlockHeader(block.PrevHash)
+	if err != nil {
+		return ruleError(ErrOrphanBlock, "block %x: previous block %x unknown", block.Hash, block.PrevHash)
+	}
+	if bc.isInvalid(block.PrevHash) {
+		bc.markInvalid(block.Hash)
+		return ruleError(ErrInvalidAncestor, "block %x: previous block %x is invalid", block.Hash, block.PrevHash)
+	}
+	if block.Height != prevBlock.Height+1 {
+		return ruleError(ErrBadHeight, "block %x: height %d, expected %d", block.Hash, block.Height, prevBlock.Height+1)
+	}
+	if bits := bc.calcNextRequiredBits(prevBlock); block.Bits != bits {
+		return ruleError(ErrBadDifficulty, "block %x: bits %08x, expected %08x", block.Hash, block.Bits, bits)
+	}
+	// Without this bound a miner could backdate the blocks of a retarget interval and lower the difficulty.
+	if medianTime := bc.medianTimePast(block.PrevHash); block.Timestamp <= medianTime {
+		return ruleError(ErrTimeTooOld, "block %x: timestamp %d not after median time past %d", block.Hash, block.Timestamp, medianTime)
+	}
+	work := new(big.Int).Add(bc.chainWork(block.PrevHash), block.work())
+	err = bc.Database.Update(func(txn *badger.Txn) error {
+		if err := storeBlock(txn, block); err != nil {
+			return err
 		}
-		return nil
+		return txn.Set(prefixedKey(workPrefix, block.Hash), work.Bytes())
 	})
+	bcerror.Handle(err)
+	if work.Cmp(bc.chainWork(bc.getLastHash())) <= 0 {
+		fmt.Printf("Block %x is on a side chain.\n", block.Hash)
+		return nil
+	}
+	if err := bc.reorganize(block); err != nil {
+		return err
+	}
 	fmt.Printf("Added block %x.\n", block.Hash)
+	return nil
 }
 
 // BestHeight returns the height of the last block.
 func (bc *BlockChain) BestHeight() uint64 {
-	lastBlock := bc.getLastBlock()
-	return lastBlock.Height
+	lastHeader := bc.getLastHeader()
+	return lastHeader.Height
+}
+
+// BestHash returns the hash of the last block.
+func (bc *BlockChain) BestHash() Hash {
+	return bc.getLastHash()
+}
+
+// MedianTimePast returns the median time past of the last block. Lock times in seconds of transactions
+// for the next block are compared with it.
+func (bc *BlockChain) MedianTimePast() int64 {
+	return bc.medianTimePast(bc.getLastHash())
+}
+
+// Returns the median time past of block `hash`.
+func (bc *BlockChain) medianTimePast(hash Hash) int64 {
+	var medianTime int64
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		medianTime, err = medianTimePast(txn, hash)
+		return err
+	})
+	bcerror.Handle(err)
+	return medianTime
 }
 
 // GetBlock retrieves block from blockchain DB.
+// Combines the block header and the block body.
 func (bc *BlockChain) GetBlock(blockHash Hash) (*Block, error) {
 	var block *Block
-	var item *badger.Item
-	var err error
-	var blockData []byte
-	err = bc.Database.View(func(txn *badger.Txn) error {
-		if item, err = txn.Get(blockHash); err != nil {
-			return fmt.Errorf("block %s not found", blockHash)
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		if block, err = getBlockHeader(txn, blockHash); err != nil {
+			return err
 		}
-		err = item.Value(func(val []byte) error {
-			blockData = append([]byte{}, val...)
-			return nil
+		item, err := txn.Get(blockHash)
+		if err != nil {
+			return fmt.Errorf("body of block %x not found", blockHash)
+		}
+		return item.Value(func(val []byte) error {
+			block.Transactions, err = deserializeBody(val)
+			return err
 		})
-		block = DeserializeBlock(blockData)
-		return nil
 	})
-	return block, err
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
 }
 
-// GetBlockHashes returns all block hashes.
-func (bc *BlockChain) GetBlockHashes() []Hash {
-	var hashes []Hash
-	iter := bc.CreateBCIterator()
-	for iter.HasNext() {
-		block := iter.GetNext()
-		hashes = append(hashes, block.Hash)
-	}
-	return hashes
+// MineBlock creates a new block on top of the last block and adds it to the blockchain.
+// The first transaction must be the coinbase transaction.
+func (bc *BlockChain) MineBlock(transactions []*Transaction) (*Block, error) {
+	return bc.MineBlockContext(context.Background(), transactions)
 }
 
-// MineBlock creates a new block in the database.
-// The actual mining (proof of concept) happens in `CreateBlock(...)`.
-func (bc *BlockChain) MineBlock(transactions []*Transaction) *Block {
-	// Check validity of transactions.
-	for _, tx := range transactions {
-		if !bc.VerifyTransaction(tx) {
-			log.Panic("Invalid Transaction")
-		}
-	}
+// MineBlockContext is MineBlock but gives up when `ctx` is cancelled, e.g. because a new block arrived.
+// The block is only added to the blockchain if its proof of work was found.
+func (bc *BlockChain) MineBlockContext(ctx context.Context, transactions []*Transaction) (*Block, error) {
 	// Retrieve last height from blockchain.
-	lastHash := bc.getLastHash()
-	lastBlock := bc.getLastBlock()
-	lastHeight := lastBlock.Height
-	// Create new block in blockchain. CreateBlock() executes proof of work.
-	newBlock := createBlock(transactions, lastHash, lastHeight+1)
-	err := bc.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		bcerror.Handle(err)
-		err = txn.Set(lastHashEntry, newBlock.Hash)
-		return err
-	})
-	bcerror.Handle(err)
-	return newBlock
+	lastBlock := bc.getLastHeader()
+	// Create new block in blockchain and run proof of work.
+	bits := bc.calcNextRequiredBits(lastBlock)
+	newBlock := newBlock(nextBlockTime(bc.medianTimePast(lastBlock.Hash)), transactions, lastBlock.Hash, lastBlock.Height+1, bits)
+	if err := newBlock.runProof(ctx); err != nil {
+		return nil, err
+	}
+	log.Printf("New Block: %s\n", newBlock)
+	// Validates the transactions and updates the UTXO set.
+	if err := bc.AddBlock(newBlock); err != nil {
+		return nil, err
+	}
+	return newBlock, nil
 }
 
 // Returns UTXOs as a map: transaction ID -> transaction outputs.
+// Outputs keep their position in the transaction; spent outputs are null.
 func (bc *BlockChain) findUTXO() map[string]TxOutputs {
 	log.Println("Entering FindUTXO")
 	defer log.Println("Returning from FindUTXO")
 	UTXO := make(map[string]TxOutputs)  // map: transaction ID -> transaction outputs
 	spentTXOs := make(map[string][]int) // map: transaction ID -> indexes of spent output transactions
 
-	// iterate through entire blockchain
+	// iterate through entire blockchain (from last block to genesis block)
 	iter := bc.CreateBCIterator()
 	for iter.HasNext() {
 		block := iter.GetNext()
-		for _, tx := range block.Transactions {
+		// Transactions can spend outputs of earlier transactions in the same block.
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
 			txID := hex.EncodeToString(tx.ID)
-		Outputs:
-			for outIdx, out := range tx.Outputs {
-				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
-				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
+			outs := TxOutputs{Height: block.Height, Coinbase: tx.IsCoinbase(), Outputs: append([]TxOutput{}, tx.Outputs...)}
+			for _, spentOut := range spentTXOs[txID] {
+				outs.Outputs[spentOut].setNull()
+			}
+			if !outs.isFullySpent() {
 				UTXO[txID] = outs
 			}
 			// save spent TXOs
@@ -182,43 +249,49 @@ func (bc *BlockChain) findUTXO() map[string]TxOutputs {
 }
 
 // Find transaction by ID.
+// Looks up the transaction index.
 func (bc *BlockChain) findTransaction(ID []byte) (Transaction, error) {
-	iter := bc.CreateBCIterator()
-	for iter.HasNext() {
-		block := iter.GetNext()
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
-		}
+	tx, _, err := bc.GetTransaction(ID)
+	if err != nil {
+		return Transaction{}, err
 	}
-	return Transaction{}, errors.New("Transaction does not exist")
+	return *tx, nil
 }
 
-// / Signs transaction with private key.
-func (bc *BlockChain) signTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+// Signs transaction with private key.
+// The spent transactions are looked up in the transaction index.
+func (bc *BlockChain) signTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
 	// map: Transaction ID -> transaction
 	prevTXs := make(map[string]Transaction)
 	for _, in := range tx.Inputs {
 		prevTX, err := bc.findTransaction(in.ID)
-		bcerror.Handle(err)
+		if err != nil {
+			return fmt.Errorf("signing transaction %x: %w", tx.ID, err)
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 	tx.Sign(privKey, prevTXs)
+	return nil
 }
 
-// VerifyTransaction verifies transaction.
-func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
-	if tx.isCoinbase() {
-		return true
+// CalcFee returns the fee of a transaction of the memory pool: inputs minus outputs.
+// The spent outputs are looked up in the transaction index.
+func (bc *BlockChain) CalcFee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
 	}
-	prevTXs := make(map[string]Transaction)
+	var valuesIn []int
 	for _, in := range tx.Inputs {
 		prevTX, err := bc.findTransaction(in.ID)
-		bcerror.Handle(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		if err != nil {
+			return 0, err
+		}
+		if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return 0, fmt.Errorf("transaction %x: output %x:%d does not exist", tx.ID, in.ID, in.Out)
+		}
+		valuesIn = append(valuesIn, prevTX.Outputs[in.Out].Value)
 	}
-	return tx.verify(prevTXs)
+	return calcTransactionFee(tx, valuesIn)
 }
 
 // OpenBlockChain opens existing blockchain.
@@ -227,7 +300,7 @@ func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
 // Transactions are therefore not stored separately.
 // There are also entries for UTXOs which are prefixed by "utxo-".
 func OpenBlockChain(nodeID string) *BlockChain {
-	path := fmt.Sprintf(dbPath, nodeID)
+	path := Params.dbPath(nodeID)
 	if dbNotExists(path) {
 		fmt.Println("No blockchain found. Please create one first!")
 		runtime.Goexit()
@@ -235,13 +308,28 @@ func OpenBlockChain(nodeID string) *BlockChain {
 	opts := badger.DefaultOptions(path)
 	db, err := openDB(&opts)
 	bcerror.Handle(err)
-	return &BlockChain{db}
+	blockchain := newBlockChain(db)
+	err = migrateDB(blockchain)
+	bcerror.Handle(err)
+	return blockchain
+}
+
+// Returns a blockchain on `db` with an empty orphan pool.
+func newBlockChain(db *badger.DB) *BlockChain {
+	return &BlockChain{
+		Database:      db,
+		MaxOrphanSize: DefaultMaxOrphanSize,
+		OrphanExpiry:  DefaultOrphanExpiry,
+		orphans:       make(map[string]*orphanBlock),
+		orphansByPrev: make(map[string][]*orphanBlock),
+		now:           time.Now,
+	}
 }
 
 // CreateBlockChain creates a new blockchain for a specific node.
 // 'address' will get the mining reward.
 func CreateBlockChain(address, nodeID string) *BlockChain {
-	path := fmt.Sprintf(dbPath, nodeID)
+	path := Params.dbPath(nodeID)
 	if dbExists(path) {
 		fmt.Println("Blockchain already exists!")
 		runtime.Goexit()
@@ -249,25 +337,87 @@ func CreateBlockChain(address, nodeID string) *BlockChain {
 	opts := badger.DefaultOptions(path)
 	db, err := openDB(&opts)
 	bcerror.Handle(err)
-	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData)
-		genesis := genesis(cbtx)
+	blockchain := newBlockChain(db)
+	err = blockchain.writeGenesis(address)
+	bcerror.Handle(err)
+	fmt.Println("Genesis block created!")
+	return blockchain
+}
+
+// Writes the genesis block into an empty database.
+func (bc *BlockChain) writeGenesis(address string) error {
+	return bc.Database.Update(func(txn *badger.Txn) error {
+		cbtx := CoinbaseTx(address, BlockSubsidy(0), Params.GenesisData)
+		genesis, err := genesis(cbtx)
+		if err != nil {
+			return err
+		}
 		log.Printf("Genesis block: %+v", genesis)
-		err = txn.Set(genesis.Hash, genesis.Serialize())
+		err = storeBlock(txn, genesis)
+		bcerror.Handle(err)
+		err = txn.Set(prefixedKey(workPrefix, genesis.Hash), genesis.work().Bytes())
+		bcerror.Handle(err)
+		err = indexTransactions(txn, genesis)
+		bcerror.Handle(err)
+		err = indexHeight(txn, genesis)
+		bcerror.Handle(err)
+		err = txn.Set(dbVersionEntry, []byte{dbVersion})
 		bcerror.Handle(err)
 		err = txn.Set(lastHashEntry, genesis.Hash)
 		return err
 	})
-	bcerror.Handle(err)
-	blockchain := &BlockChain{db}
-	fmt.Println("Genesis block created!")
-	return blockchain
+}
+
+// Deletes all entries in the database with `prefix`.
+func (bc *BlockChain) deleteByPrefix(prefix []byte) {
+	// local function to delete keys.
+	deleteKeys := func(keysForDelete [][]byte) error {
+		fmt.Printf("DeleteByPrefix, key: %v\n", keysForDelete)
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			for _, key := range keysForDelete {
+				fmt.Printf("DeleteByPrefix, key: %v\n", key)
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return err
+	}
+
+	collectSize := 100_000
+	bc.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		keysForDelete := make([][]byte, 0, collectSize)
+		keysCollected := 0
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			keysForDelete = append(keysForDelete, key)
+			keysCollected++
+			if keysCollected == collectSize {
+				if err := deleteKeys(keysForDelete); err != nil {
+					log.Panic(err)
+				}
+				keysForDelete = make([][]byte, 0, collectSize)
+				keysCollected = 0
+			}
+		}
+		if keysCollected > 0 {
+			if err := deleteKeys(keysForDelete); err != nil {
+				log.Panic(err)
+			}
+		}
+		return nil
+	})
 }
 
 // Returns true if BadgerDB already exists in 'path'.
 func dbExists(path string) (exists bool) {
 	// BadgerDB creates a "MANIFEST" file automatically.
-	if _, err := os.Stat(path + "/MANIFEST"); os.IsExist(err) {
+	if _, err := os.Stat(path + "/MANIFEST"); err == nil {
 		exists = true
 	}
 	return
@@ -0,0 +1,99 @@
+package blockchain
+
+import (
+	"math/big"
+
+	"github.com/mkohlhaas/gobc/bcerror"
+)
+
+// https://en.bitcoin.it/wiki/Difficulty#How_is_difficulty_stored_in_blocks.3F
+// CompactToBig converts the compact representation "bits" of a target to a big integer.
+// The highest byte is the exponent (number of bytes of the target), the lower 3 bytes
+// are the mantissa. Bit 24 is the sign bit.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	negative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if negative {
+		target = target.Neg(target)
+	}
+	return target
+}
+
+// BigToCompact converts a target to its compact representation "bits".
+// Precision beyond the 3 most significant bytes is lost.
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(target.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tmp := new(big.Int).Abs(target)
+		mantissa = uint32(tmp.Rsh(tmp, 8*(exponent-3)).Bits()[0])
+	}
+	// The mantissa must not have its sign bit set.
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	compact := uint32(exponent<<24) | mantissa
+	if target.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// Returns the target for the block following a block with `oldBits` when the last
+// `RetargetInterval` blocks took `actualTimespan` seconds.
+// The adjustment is clamped by `RetargetAdjustmentFactor` and never exceeds the PoW limit.
+func calcRetarget(oldBits uint32, actualTimespan int64) uint32 {
+	targetTimespan := Params.targetTimespan()
+	minTimespan := targetTimespan / Params.RetargetAdjustmentFactor
+	maxTimespan := targetTimespan * Params.RetargetAdjustmentFactor
+	if actualTimespan < minTimespan {
+		actualTimespan = minTimespan
+	} else if actualTimespan > maxTimespan {
+		actualTimespan = maxTimespan
+	}
+	newTarget := CompactToBig(oldBits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+	if newTarget.Cmp(Params.PowLimit) > 0 {
+		newTarget.Set(Params.PowLimit)
+	}
+	return BigToCompact(newTarget)
+}
+
+// Returns the ancestor of `b` at `height` by following the previous hashes.
+// The ancestor is read without transactions.
+func (bc *BlockChain) ancestor(b *Block, height uint64) *Block {
+	for b.Height > height {
+		prev, err := bc.getBlockHeader(b.PrevHash)
+		bcerror.Handle(err)
+		b = prev
+	}
+	return b
+}
+
+// Returns the required target in compact form for the block following `prevBlock`.
+// The target changes only every `RetargetInterval` blocks.
+func (bc *BlockChain) calcNextRequiredBits(prevBlock *Block) uint32 {
+	if Params.NoRetargeting || (prevBlock.Height+1)%Params.RetargetInterval != 0 {
+		return prevBlock.Bits
+	}
+	// Like Bitcoin we look back `RetargetInterval - 1` blocks.
+	first := bc.ancestor(prevBlock, prevBlock.Height-(Params.RetargetInterval-1))
+	return calcRetarget(prevBlock.Bits, prevBlock.Timestamp-first.Timestamp)
+}
@@ -0,0 +1,51 @@
+package blockchain
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactConversion(t *testing.T) {
+	tests := []struct {
+		compact uint32
+		target  string // hexadecimal
+	}{
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"}, // Bitcoin's genesis block
+		{0x1b0404cb, "404cb000000000000000000000000000000000000000000000000"},
+		{0x05009234, "92340000"},
+		{0x04123456, "12345600"},
+		{0x03123456, "123456"},
+		{0x02123400, "1234"},
+		{0x01120000, "12"},
+	}
+	for _, test := range tests {
+		target := CompactToBig(test.compact)
+		assert.Equal(t, test.target, target.Text(16))
+		assert.Equal(t, test.compact, BigToCompact(target))
+	}
+	assert.Equal(t, uint32(0x02008000), BigToCompact(big.NewInt(0x80)))
+	assert.Equal(t, Params.PowLimit, CompactToBig(Params.PowLimitBits))
+}
+
+func TestCalcRetarget(t *testing.T) {
+	bits := BigToCompact(new(big.Int).Rsh(Params.PowLimit, 4))
+	target := CompactToBig(bits)
+
+	// On schedule: target stays the same.
+	assert.Equal(t, bits, calcRetarget(bits, Params.targetTimespan()))
+
+	// Twice as slow: target doubles.
+	doubled := new(big.Int).Mul(target, big.NewInt(2))
+	assert.Equal(t, BigToCompact(doubled), calcRetarget(bits, 2*Params.targetTimespan()))
+
+	// Way too fast: target shrinks by the adjustment factor only.
+	quarter := new(big.Int).Div(target, big.NewInt(Params.RetargetAdjustmentFactor))
+	assert.Equal(t, BigToCompact(quarter), calcRetarget(bits, 1))
+
+	// Way too slow: target grows by the adjustment factor only and never exceeds the proof of work limit.
+	assert.Equal(t, BigToCompact(new(big.Int).Mul(target, big.NewInt(Params.RetargetAdjustmentFactor))), calcRetarget(bits, 1000*Params.targetTimespan()))
+	easy := BigToCompact(new(big.Int).Rsh(Params.PowLimit, 1))
+	assert.Equal(t, Params.PowLimitBits, calcRetarget(easy, 1000*Params.targetTimespan()))
+}
@@ -0,0 +1,90 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Transaction with one input and two outputs for golden vector tests.
+func goldenTransaction() *Transaction {
+	return &Transaction{
+		ID: []byte{0xaa, 0xbb},
+		Inputs: []TxInput{{
+			ID:        []byte{0x01, 0x02, 0x03},
+			Out:       1,
+			ScriptSig: []byte{0x51, 0x61},
+			Sequence:  MaxRBFSequence,
+		}},
+		Outputs: []TxOutput{
+			{Value: 5, ScriptPubKey: []byte{0x71}},
+			{Value: -1, ScriptPubKey: nil},
+		},
+		LockTime: 0x01020304,
+	}
+}
+
+func TestTransactionGoldenVector(t *testing.T) {
+	golden := "01" + // version
+		"02aabb" + // ID
+		"01" + "03010203" + "01000000" + "025161" + "fdffffff" + // input: ID, out, unlocking script, sequence
+		"02" + "0500000000000000" + "0171" + // output 0: value, locking script
+		"ffffffffffffffff" + "00" + // output 1
+		"04030201" // lock time
+	data := goldenTransaction().Serialize()
+	assert.Equal(t, golden, hex.EncodeToString(data))
+	tx, err := DeserializeTransaction(data)
+	require.NoError(t, err)
+	assert.Equal(t, data, tx.Serialize())
+
+	coinbase := &Transaction{Inputs: []TxInput{{Out: noIndex, Sequence: MaxTxInSequenceNum}}, Outputs: []TxOutput{{Value: 20}}}
+	assert.Equal(t, "01"+"00"+"01"+"00"+"ffffffff"+"00"+"ffffffff"+"01"+"1400000000000000"+"00"+"00000000", hex.EncodeToString(coinbase.Serialize()))
+}
+
+func TestBlockGoldenVector(t *testing.T) {
+	b := &Block{
+		BlockHeader: BlockHeader{
+			Version:    1,
+			PrevHash:   bytes.Repeat([]byte{0xdd}, 32),
+			MerkleRoot: bytes.Repeat([]byte{0xee}, 32),
+			Timestamp:  0x0102030405,
+			Bits:       0x1f100000,
+			Nonce:      7,
+		},
+		Height:       9,
+		Transactions: []*Transaction{goldenTransaction()},
+	}
+	header := "01000000" + // header version
+		strings.Repeat("dd", 32) + strings.Repeat("ee", 32) + // previous hash, Merkle root
+		"0504030201000000" + // timestamp
+		"0000101f" + "07000000" // bits, nonce
+	transactions := "01" + // number of transactions
+		"02aabb010301020301000000025161fdffffff020500000000000000" + "0171ffffffffffffffff00" + "04030201"
+	assert.Len(t, b.BlockHeader.Serialize(), headerSize)
+	assert.Equal(t, header, hex.EncodeToString(b.BlockHeader.Serialize()))
+	assert.Equal(t, "01"+transactions, hex.EncodeToString(b.serializeBody()))
+
+	data := b.Serialize()
+	assert.Equal(t, "01"+header+"0900000000000000"+transactions, hex.EncodeToString(data))
+	decoded, err := DeserializeBlock(data)
+	require.NoError(t, err)
+	assert.Equal(t, data, decoded.Serialize())
+	assert.Equal(t, doubleHash256(b.BlockHeader.Serialize()), decoded.Hash)
+}
+
+func TestDeserializeRejectsMalformedData(t *testing.T) {
+	data := goldenTransaction().Serialize()
+	_, err := DeserializeTransaction(data[:len(data)-1])
+	assert.Error(t, err, "truncated")
+	_, err = DeserializeTransaction(append(data, 0))
+	assert.Error(t, err, "trailing bytes")
+	data[0] = 2
+	_, err = DeserializeTransaction(data)
+	assert.Error(t, err, "unknown version")
+	_, err = DeserializeBlock(nil)
+	assert.Error(t, err, "empty")
+}
@@ -0,0 +1,36 @@
+package blockchain
+
+import "fmt"
+
+// Generate mines `n` blocks with only a coinbase transaction paying to `address` on top of the last block.
+// Only networks which mine blocks on demand (regtest) support generating blocks.
+// Generated blocks are deterministic: the coinbase data is the height and every block is one second
+// younger than its predecessor. The blocks are connected one by one, i.e. the UTXO set is updated incrementally.
+// Returns the generated blocks.
+func (bc *BlockChain) Generate(n int, address string) ([]*Block, error) {
+	if !Params.MineBlocksOnDemand {
+		return nil, fmt.Errorf("generating blocks is not supported on %s", Params.Name)
+	}
+	if !Validate(address) {
+		return nil, fmt.Errorf("invalid address %s", address)
+	}
+	var blocks []*Block
+	for i := 0; i < n; i++ {
+		last := bc.getLastHeader()
+		height := last.Height + 1
+		cbTx := CoinbaseTx(address, BlockSubsidy(height), fmt.Sprintf("generated block %d", height))
+		timestamp := last.Timestamp + 1
+		if medianTime := bc.medianTimePast(last.Hash); timestamp <= medianTime {
+			timestamp = medianTime + 1
+		}
+		block, err := createBlockAt(timestamp, []*Transaction{cbTx}, last.Hash, height, bc.calcNextRequiredBits(last))
+		if err != nil {
+			return blocks, err
+		}
+		if err := bc.AddBlock(block); err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,51 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	selectParams(t, "regtest")
+	bc, w := newTestChain(t)
+	const maturity = 10
+	setCoinbaseMaturity(t, maturity)
+	address := string(w.Address())
+
+	blocks, err := bc.Generate(maturity, address)
+	require.NoError(t, err)
+	require.Len(t, blocks, maturity)
+	assert.Equal(t, uint64(maturity), bc.BestHeight())
+	assert.Equal(t, blocks[len(blocks)-1].Hash, bc.getLastHash())
+	balance := 0
+	for _, out := range (UTXOSet{bc}).FindUnspentTransactions(script.PayToPubKeyHash(PublicKeyHash(w.PublicKey))) {
+		balance += out.Value
+	}
+	assert.Equal(t, Params.Subsidy.Supply(maturity+1), balance)
+
+	// A transaction in the next block can spend the coinbases of the genesis block and block 1.
+	acc, _ := UTXOSet{bc}.FindSpendableOutputs(script.PayToPubKeyHash(PublicKeyHash(w.PublicKey)), balance)
+	assert.Equal(t, BlockSubsidy(0)+BlockSubsidy(1), acc)
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	selectParams(t, "regtest")
+	w := MakeWallet()
+	var tips []Hash
+	for i := 0; i < 2; i++ {
+		bc := newTestChainFor(t, string(w.Address()))
+		blocks, err := bc.Generate(3, string(w.Address()))
+		require.NoError(t, err)
+		tips = append(tips, blocks[2].Hash)
+	}
+	assert.Equal(t, tips[0], tips[1])
+}
+
+func TestGenerateOnlyOnRegtest(t *testing.T) {
+	bc, w := newTestChain(t)
+	_, err := bc.Generate(1, string(w.Address()))
+	assert.Error(t, err)
+}
@@ -0,0 +1,155 @@
+package blockchain
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+	"github.com/mkohlhaas/gobc/wire"
+)
+
+// blockVersion is the version of the blocks we create.
+const blockVersion = 1
+
+// headerSize is the size of a serialized block header in bytes.
+const headerSize = 4 + 32 + 32 + 8 + 4 + 4
+
+// Headers of all blocks (main chain and side chains) are stored separately from the block bodies.
+// key:   prefix + block hash
+// value: version, block header, height
+// The block body (the transactions) is stored with the block hash as key.
+var headerPrefix = []byte("hdr-")
+
+// BlockHeader contains everything which is hashed for the proof of work.
+// The transactions are committed to by the Merkle root.
+type BlockHeader struct {
+	Version    uint32
+	PrevHash   Hash // all zeros for the genesis block
+	MerkleRoot Hash // root of the Merkle tree of the block's transactions
+	Timestamp  int64
+	Bits       uint32 // target for proof of work in compact form
+	Nonce      uint32
+}
+
+// Serialize block header.
+// Format: version, previous hash (32 bytes), Merkle root (32 bytes), timestamp, bits, nonce.
+// The header has a fixed size of `headerSize` bytes; the nonce comes last.
+func (h *BlockHeader) Serialize() []byte {
+	w := wire.NewWriter()
+	h.encode(w)
+	return w.Bytes()
+}
+
+func (h *BlockHeader) encode(w *wire.Writer) {
+	w.WriteUint32(h.Version)
+	w.WriteFixedBytes(h.PrevHash, 32)
+	w.WriteFixedBytes(h.MerkleRoot, 32)
+	w.WriteInt64(h.Timestamp)
+	w.WriteUint32(h.Bits)
+	w.WriteUint32(h.Nonce)
+}
+
+func decodeBlockHeader(r *wire.Reader) BlockHeader {
+	return BlockHeader{
+		Version:    r.ReadUint32(),
+		PrevHash:   r.ReadFixedBytes(32),
+		MerkleRoot: r.ReadFixedBytes(32),
+		Timestamp:  r.ReadInt64(),
+		Bits:       r.ReadUint32(),
+		Nonce:      r.ReadUint32(),
+	}
+}
+
+// CalcHash returns the block hash: Double SHA256 of the serialized header.
+func (h *BlockHeader) CalcHash() Hash {
+	return doubleHash256(h.Serialize())
+}
+
+// IsValidBlockHeader returns true if we have a valid block header.
+// Validates proof of work against the target in the header.
+func (h *BlockHeader) IsValidBlockHeader() bool {
+	target := CompactToBig(h.Bits)
+	if target.Sign() <= 0 || target.Cmp(Params.PowLimit) > 0 {
+		return false
+	}
+	var intHash big.Int
+	intHash.SetBytes(h.CalcHash())
+	return intHash.Cmp(target) == -1 // block's hash < target
+}
+
+// Returns the expected number of hashes needed to mine the block: 2^256 / (target+1).
+func (h *BlockHeader) work() *big.Int {
+	target := CompactToBig(h.Bits)
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// Serialize the header entry of block `b` for storing in database.
+func (b *Block) serializeHeader() []byte {
+	w := wire.NewWriter()
+	w.WriteVersion()
+	b.BlockHeader.encode(w)
+	w.WriteUint64(b.Height)
+	return w.Bytes()
+}
+
+// Deserialize a header entry. Returns a block without transactions.
+func deserializeHeader(data []byte) (*Block, error) {
+	r := wire.NewReader(data)
+	r.ReadVersion()
+	b := &Block{BlockHeader: decodeBlockHeader(r), Height: r.ReadUint64()}
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("deserializing block header: %w", err)
+	}
+	return b, nil
+}
+
+// Stores header and body of block `b`.
+func storeBlock(txn *badger.Txn, b *Block) error {
+	if err := txn.Set(prefixedKey(headerPrefix, b.Hash), b.serializeHeader()); err != nil {
+		return err
+	}
+	return txn.Set(b.Hash, b.serializeBody())
+}
+
+// Returns the header of block `hash` and its height as a block without transactions.
+// The block body is not read.
+func getBlockHeader(txn *badger.Txn, hash Hash) (*Block, error) {
+	item, err := txn.Get(prefixedKey(headerPrefix, hash))
+	if err != nil {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	var b *Block
+	err = item.Value(func(val []byte) error {
+		b, err = deserializeHeader(val)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.Hash = append(Hash{}, hash...)
+	return b, nil
+}
+
+// GetBlockHeader returns the header of block `hash` and the block's height.
+func (bc *BlockChain) GetBlockHeader(hash Hash) (*BlockHeader, uint64, error) {
+	b, err := bc.getBlockHeader(hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &b.BlockHeader, b.Height, nil
+}
+
+// Returns block `hash` without transactions; only the header is read from the database.
+func (bc *BlockChain) getBlockHeader(hash Hash) (*Block, error) {
+	var b *Block
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		b, err = getBlockHeader(txn, hash)
+		return err
+	})
+	return b, err
+}
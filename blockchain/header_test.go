@@ -0,0 +1,24 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeadersAreStoredSeparately(t *testing.T) {
+	bc, w := newTestChain(t)
+	block, err := bc.MineBlock([]*Transaction{CoinbaseTx(string(w.Address()), BlockSubsidy(1))})
+	require.NoError(t, err)
+
+	header, height, err := bc.GetBlockHeader(block.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, block.BlockHeader, *header)
+	assert.Equal(t, uint64(1), height)
+	assert.Equal(t, block.Hash, header.CalcHash())
+
+	stored, err := bc.GetBlock(block.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, block.Serialize(), stored.Serialize())
+}
@@ -0,0 +1,84 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+	"github.com/mkohlhaas/gobc/bcerror"
+)
+
+// Height index for the blocks of the main chain.
+// key:   prefix + height (8 bytes, big endian)
+// value: block hash
+var heightPrefix = []byte("height-")
+
+// Returns the database key of the height index for `height`.
+func heightKey(height uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, height)
+	return prefixedKey(heightPrefix, key)
+}
+
+// Adds block `b` to the height index.
+func indexHeight(txn *badger.Txn, b *Block) error {
+	return txn.Set(heightKey(b.Height), b.Hash)
+}
+
+// Removes block `b` from the height index.
+func unindexHeight(txn *badger.Txn, b *Block) error {
+	return txn.Delete(heightKey(b.Height))
+}
+
+// Returns the hash of the main chain's block at `height`.
+func hashByHeight(txn *badger.Txn, height uint64) (Hash, error) {
+	item, err := txn.Get(heightKey(height))
+	if err != nil {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	return item.ValueCopy(nil)
+}
+
+// GetBlockByHeight returns the main chain's block at `height`.
+func (bc *BlockChain) GetBlockByHeight(height uint64) (*Block, error) {
+	var hash Hash
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		hash, err = hashByHeight(txn, height)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bc.GetBlock(hash)
+}
+
+// GetBlockHashes returns the hashes of the main chain's blocks from height `from` to height `to` (inclusive).
+func (bc *BlockChain) GetBlockHashes(from, to uint64) []Hash {
+	var hashes []Hash
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		for height := from; height <= to; height++ {
+			hash, err := hashByHeight(txn, height)
+			if err != nil {
+				break
+			}
+			hashes = append(hashes, hash)
+		}
+		return nil
+	})
+	bcerror.Handle(err)
+	return hashes
+}
+
+// ReindexHeights rebuilds the height index from the main chain.
+func (bc *BlockChain) ReindexHeights() {
+	bc.deleteByPrefix(heightPrefix)
+	iter := bc.CreateBCIterator()
+	for iter.HasNext() {
+		block := iter.GetNext()
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			return indexHeight(txn, block)
+		})
+		bcerror.Handle(err)
+	}
+}
@@ -0,0 +1,33 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeightIndex(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	genesis := bc.getLastBlock()
+	a1, err := bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1))})
+	require.NoError(t, err)
+	assert.Equal(t, []Hash{genesis.Hash, a1.Hash}, bc.GetBlockHashes(0, 10))
+
+	// Reorganization replaces the main chain's entries.
+	b1 := mineOn(t, genesis, CoinbaseTx(address, BlockSubsidy(1)))
+	require.NoError(t, bc.AddBlock(b1))
+	b2 := mineOn(t, b1, CoinbaseTx(address, BlockSubsidy(1)))
+	require.NoError(t, bc.AddBlock(b2))
+	assert.Equal(t, []Hash{genesis.Hash, b1.Hash, b2.Hash}, bc.GetBlockHashes(0, bc.BestHeight()))
+	assert.Equal(t, []Hash{b1.Hash}, bc.GetBlockHashes(1, 1))
+	block, err := bc.GetBlockByHeight(2)
+	require.NoError(t, err)
+	assert.Equal(t, b2.Hash, block.Hash)
+	_, err = bc.GetBlockByHeight(3)
+	assert.Error(t, err)
+
+	bc.ReindexHeights()
+	assert.Equal(t, []Hash{genesis.Hash, b1.Hash, b2.Hash}, bc.GetBlockHashes(0, bc.BestHeight()))
+}
@@ -0,0 +1,176 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/mkohlhaas/gobc/bcerror"
+	"github.com/mkohlhaas/gobc/script"
+)
+
+// Hash time-locked contracts (HTLC) are paid to the script address of their contract script.
+// The recipient spends the output by revealing the secret, the sender gets a refund after the lock time.
+// Two contracts with the same secret hash on two blockchains make an atomic swap: redeeming one reveals
+// the secret for the other, and if nobody redeems both senders are refunded.
+
+// Contract is a hash time-locked contract paid by output `Out` of transaction `TxID`.
+type Contract struct {
+	*script.HashTimeLock
+	Script script.Script
+	TxID   Hash
+	Out    int
+	Value  int
+	Spent  bool // redeemed or refunded in the main chain
+}
+
+// NewSecret returns a random secret for a contract and its SHA-256 hash.
+func NewSecret() (secret, secretHash []byte) {
+	secret = make([]byte, script.SecretSize)
+	_, err := rand.Read(secret)
+	bcerror.Handle(err)
+	hash := sha256.Sum256(secret)
+	return secret, hash[:]
+}
+
+// NewContract returns the contract script paying to wallet address `to` for the secret of `secretHash`
+// and refunding to wallet `w` after `lockTime` (a block height or Unix time).
+func NewContract(w *Wallet, to string, secretHash []byte, lockTime uint32) (script.Script, error) {
+	if !Validate(to) || Base58Decode([]byte(to))[0] != Params.PubKeyHashAddrID {
+		return nil, fmt.Errorf("%s is not a wallet address", to)
+	}
+	if len(secretHash) != sha256.Size {
+		return nil, fmt.Errorf("secret hash %x is not a SHA-256 hash", secretHash)
+	}
+	if lockTime == 0 {
+		return nil, fmt.Errorf("contract without lock time")
+	}
+	c := &script.HashTimeLock{
+		SecretHash:   secretHash,
+		RecipientPKH: PKHFrom([]byte(to)),
+		RefundPKH:    PublicKeyHash(w.PublicKey),
+		LockTime:     int64(lockTime),
+	}
+	return c.Script(), nil
+}
+
+// FindContract returns the contract `contract` paid by transaction `txID`.
+// The transaction is looked up in the transaction index, so it must be confirmed.
+// Whether the contract is spent is looked up in the UTXO set.
+func (bc *BlockChain) FindContract(contract script.Script, txID Hash) (*Contract, error) {
+	c := contract.HashTimeLock()
+	if c == nil {
+		return nil, fmt.Errorf("%s is not a hash time-locked contract", contract)
+	}
+	tx, err := bc.findTransaction(txID)
+	if err != nil {
+		return nil, err
+	}
+	locking := script.PayToScriptHash(contract.Hash160())
+	for i, out := range tx.Outputs {
+		if !bytes.Equal(out.ScriptPubKey, locking) {
+			continue
+		}
+		found := &Contract{HashTimeLock: c, Script: contract, TxID: tx.ID, Out: i, Value: out.Value}
+		err := bc.Database.View(func(txn *badger.Txn) error {
+			found.Spent = newUTXOView(txn).output(TxInput{ID: tx.ID, Out: i}) == nil
+			return nil
+		})
+		bcerror.Handle(err)
+		return found, nil
+	}
+	return nil, fmt.Errorf("transaction %x does not pay to contract %s", txID, ScriptToAddress(contract))
+}
+
+// RecipientAddress returns the address the contract pays to when it is redeemed.
+func (c *Contract) RecipientAddress() string {
+	return string(encodeAddress(Params.PubKeyHashAddrID, c.RecipientPKH))
+}
+
+// RefundAddress returns the address the contract pays to when it is refunded.
+func (c *Contract) RefundAddress() string {
+	return string(encodeAddress(Params.PubKeyHashAddrID, c.RefundPKH))
+}
+
+// LockTimeString returns the lock time of the contract as block height or UTC time.
+func (c *Contract) LockTimeString() string {
+	return FormatLockTime(c.LockTime)
+}
+
+// FormatLockTime returns `lockTime` as block height or UTC time.
+func FormatLockTime(lockTime int64) string {
+	if lockTime < int64(LockTimeThreshold) {
+		return fmt.Sprintf("block %d", lockTime)
+	}
+	return time.Unix(lockTime, 0).UTC().Format(time.RFC3339)
+}
+
+// RedeemContract returns a transaction of the recipient `w` spending contract `c` with `secret`.
+// The contract value minus `fee` is paid to `w`.
+func RedeemContract(w *Wallet, c *Contract, secret []byte, fee int) (*Transaction, error) {
+	if !bytes.Equal(PublicKeyHash(w.PublicKey), c.RecipientPKH) {
+		return nil, fmt.Errorf("wallet %s is not the recipient of contract %s", w.Address(), ScriptToAddress(c.Script))
+	}
+	if hash := sha256.Sum256(secret); len(secret) != script.SecretSize || !bytes.Equal(hash[:], c.SecretHash) {
+		return nil, fmt.Errorf("%x is not the secret of contract %s", secret, ScriptToAddress(c.Script))
+	}
+	tx, err := c.spend(w, fee, 0, MaxTxInSequenceNum)
+	if err != nil {
+		return nil, err
+	}
+	sig := tx.signInput(w.PrivateKey, 0, c.Script, c.Value, SigHashAll)
+	tx.Inputs[0].ScriptSig = script.HashTimeLockRedeem(sig, w.PublicKey, secret, c.Script)
+	return tx, nil
+}
+
+// RefundContract returns a transaction of the sender `w` spending contract `c` after its lock time.
+// The contract value minus `fee` is paid back to `w`.
+// A lock time in seconds has passed when the median time past of the last block is past it, so only new
+// blocks unlock the contract. On regtest, where blocks are mined on demand, blocks must be mined after the
+// lock time; blocks of Generate are one second apart and hardly advance the median time past.
+func (bc *BlockChain) RefundContract(w *Wallet, c *Contract, fee int) (*Transaction, error) {
+	if !bytes.Equal(PublicKeyHash(w.PublicKey), c.RefundPKH) {
+		return nil, fmt.Errorf("wallet %s is not the sender of contract %s", w.Address(), ScriptToAddress(c.Script))
+	}
+	// The input must not be final, otherwise the lock time is ignored and OP_CHECKLOCKTIMEVERIFY fails.
+	tx, err := c.spend(w, fee, uint32(c.LockTime), MaxRBFSequence)
+	if err != nil {
+		return nil, err
+	}
+	if !tx.isFinal(bc.BestHeight()+1, bc.MedianTimePast()) {
+		return nil, fmt.Errorf("contract %s is locked until %s; last block %d, median time past %s", ScriptToAddress(c.Script),
+			c.LockTimeString(), bc.BestHeight(), time.Unix(bc.MedianTimePast(), 0).UTC().Format(time.RFC3339))
+	}
+	sig := tx.signInput(w.PrivateKey, 0, c.Script, c.Value, SigHashAll)
+	tx.Inputs[0].ScriptSig = script.HashTimeLockRefund(sig, w.PublicKey, c.Script)
+	return tx, nil
+}
+
+// Returns an unsigned transaction paying the value of contract `c` minus `fee` to `w`.
+func (c *Contract) spend(w *Wallet, fee int, lockTime, sequence uint32) (*Transaction, error) {
+	if fee < 0 || fee >= c.Value {
+		return nil, fmt.Errorf("fee %d does not fit contract value %d", fee, c.Value)
+	}
+	tx := &Transaction{
+		Inputs:   []TxInput{{ID: c.TxID, Out: c.Out, Sequence: sequence}},
+		Outputs:  []TxOutput{*newTXOutput(c.Value-fee, string(w.Address()))},
+		LockTime: lockTime,
+	}
+	tx.ID = tx.calcTransactionID()
+	return tx, nil
+}
+
+// ExtractSecret returns the secret of `secretHash` revealed by an input of `tx` redeeming a contract.
+func ExtractSecret(tx *Transaction, secretHash []byte) ([]byte, error) {
+	for _, in := range tx.Inputs {
+		for _, data := range in.ScriptSig.PushedData() {
+			if hash := sha256.Sum256(data); bytes.Equal(hash[:], secretHash) {
+				return data, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("transaction %x does not reveal the secret of %x", tx.ID, secretHash)
+}
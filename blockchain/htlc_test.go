@@ -0,0 +1,133 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns the sum of the unspent outputs of `w` on `bc`.
+func balance(bc *BlockChain, w *Wallet) int {
+	sum := 0
+	for _, out := range (&UTXOSet{bc}).FindUnspentTransactions(LockingScript(string(w.Address()))) {
+		sum += out.Value
+	}
+	return sum
+}
+
+// Funds `contract` of wallet `w` with `amount` in a new block and returns the contract.
+func fundContract(t *testing.T, bc *BlockChain, w *Wallet, contract []byte, amount int) *Contract {
+	tx := newTestTransaction(t, w, string(ScriptToAddress(contract)), amount, 1, &UTXOSet{bc})
+	_, err := bc.MineBlock([]*Transaction{CoinbaseTx(string(w.Address()), BlockSubsidy(bc.BestHeight()+1)+1), tx})
+	require.NoError(t, err)
+	c, err := bc.FindContract(contract, tx.ID)
+	require.NoError(t, err)
+	return c
+}
+
+func TestAtomicSwap(t *testing.T) {
+	alice, bob := MakeWallet(), MakeWallet()
+	chainA := newTestChainFor(t, string(alice.Address()))
+	chainB := newTestChainFor(t, string(bob.Address()))
+	now := time.Now().Unix()
+
+	// Alice initiates on chain A with a secret only she knows.
+	secret, secretHash := NewSecret()
+	contractA, err := NewContract(alice, string(bob.Address()), secretHash, uint32(now+48*3600))
+	require.NoError(t, err)
+	cA := fundContract(t, chainA, alice, contractA, 10)
+	assert.Equal(t, 10, cA.Value)
+	assert.Equal(t, string(bob.Address()), cA.RecipientAddress())
+	assert.Equal(t, string(alice.Address()), cA.RefundAddress())
+
+	// Bob audits the contract and participates on chain B with the same secret hash and a shorter lock time.
+	contractB, err := NewContract(bob, string(alice.Address()), cA.SecretHash, uint32(now+24*3600))
+	require.NoError(t, err)
+	cB := fundContract(t, chainB, bob, contractB, 15)
+
+	// Alice redeems on chain B and reveals the secret.
+	_, err = RedeemContract(alice, cB, secretHash, 1)
+	assert.Error(t, err, "wrong secret")
+	_, err = RedeemContract(bob, cB, secret, 1)
+	assert.Error(t, err, "not the recipient")
+	redeemB, err := RedeemContract(alice, cB, secret, 1)
+	require.NoError(t, err)
+	fee, err := chainB.CheckTransaction(redeemB, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, fee)
+	_, err = chainB.MineBlock([]*Transaction{CoinbaseTx(string(bob.Address()), BlockSubsidy(chainB.BestHeight()+1)+1), redeemB})
+	require.NoError(t, err)
+	assert.Equal(t, 14, balance(chainB, alice))
+
+	// Bob takes the secret from Alice's transaction and redeems on chain A.
+	revealed, err := ExtractSecret(redeemB, secretHash)
+	require.NoError(t, err)
+	assert.Equal(t, secret, revealed)
+	redeemA, err := RedeemContract(bob, cA, revealed, 1)
+	require.NoError(t, err)
+	_, err = chainA.MineBlock([]*Transaction{CoinbaseTx(string(alice.Address()), BlockSubsidy(chainA.BestHeight()+1)+1), redeemA})
+	require.NoError(t, err)
+	assert.Equal(t, 9, balance(chainA, bob))
+	cA, err = chainA.FindContract(contractA, cA.TxID)
+	require.NoError(t, err)
+	assert.True(t, cA.Spent)
+
+	funding, err := chainA.findTransaction(cA.TxID)
+	require.NoError(t, err)
+	_, err = ExtractSecret(&funding, secretHash)
+	assert.Error(t, err)
+}
+
+func TestRefundContract(t *testing.T) {
+	bc, alice := newTestChain(t)
+	bob := MakeWallet()
+	lockTime := time.Now().Unix() + 3600
+	_, secretHash := NewSecret()
+	contract, err := NewContract(alice, string(bob.Address()), secretHash, uint32(lockTime))
+	require.NoError(t, err)
+	c := fundContract(t, bc, alice, contract, 10)
+	assert.False(t, c.Spent)
+
+	_, err = bc.RefundContract(alice, c, 1)
+	assert.ErrorContains(t, err, "locked until")
+	for bc.MedianTimePast() <= lockTime {
+		require.NoError(t, mineAt(t, bc, lockTime+1, CoinbaseTx(string(alice.Address()), BlockSubsidy(bc.BestHeight()+1))))
+	}
+	_, err = bc.RefundContract(bob, c, 1)
+	assert.Error(t, err, "not the sender")
+	refund, err := bc.RefundContract(alice, c, 1)
+	require.NoError(t, err)
+	fee, err := bc.CheckTransaction(refund, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, fee)
+
+	before := balance(bc, alice)
+	require.NoError(t, mineAt(t, bc, lockTime+2, CoinbaseTx(string(alice.Address()), BlockSubsidy(bc.BestHeight()+1)+1), refund))
+	assert.Equal(t, before+BlockSubsidy(bc.BestHeight())+10, balance(bc, alice))
+}
+
+func TestRefundContractWithHeightLock(t *testing.T) {
+	selectParams(t, "regtest")
+	bc, alice := newTestChain(t)
+	lockTime := bc.BestHeight() + 3
+	_, secretHash := NewSecret()
+	contract, err := NewContract(alice, string(MakeWallet().Address()), secretHash, uint32(lockTime))
+	require.NoError(t, err)
+	c := fundContract(t, bc, alice, contract, 10)
+	assert.Equal(t, fmt.Sprintf("block %d", lockTime), c.LockTimeString())
+
+	// The refund can go into the first block above the lock time.
+	_, err = bc.Generate(int(lockTime-bc.BestHeight()-1), string(alice.Address()))
+	require.NoError(t, err)
+	_, err = bc.RefundContract(alice, c, 1)
+	assert.ErrorContains(t, err, "locked until")
+	_, err = bc.Generate(1, string(alice.Address()))
+	require.NoError(t, err)
+	refund, err := bc.RefundContract(alice, c, 1)
+	require.NoError(t, err)
+	_, err = bc.CheckTransaction(refund, nil)
+	assert.NoError(t, err)
+}
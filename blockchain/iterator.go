@@ -23,13 +23,20 @@ func (bc *BlockChain) CreateBCIterator() iterator {
 	}
 }
 
+// HasNext returns true if there are blocks left, i.e. we have not yet returned the genesis block.
 func (iter *blockChainIterator) HasNext() bool {
-	return iter.currentBlock.isNotGenesisBlock()
+	return iter.currentBlock != nil
 }
 
+// GetNext returns the current block and moves on to its predecessor.
 func (iter *blockChainIterator) GetNext() *Block {
-	nextBlock, err := iter.blockchain.GetBlock(iter.currentBlock.PrevHash)
+	block := iter.currentBlock
+	if block.isGenesisBlock() {
+		iter.currentBlock = nil
+		return block
+	}
+	prevBlock, err := iter.blockchain.GetBlock(block.PrevHash)
 	bcerror.Handle(err)
-	iter.currentBlock = nextBlock
-	return nextBlock
+	iter.currentBlock = prevBlock
+	return block
 }
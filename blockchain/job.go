@@ -0,0 +1,131 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+// Sizes of the two parts of the extra-nonce of a mining job.
+// The job server assigns the first part to a worker; the worker rolls the second part.
+const (
+	ExtraNonce1Size = 4
+	ExtraNonce2Size = 4
+	ExtraNonceSize  = ExtraNonce1Size + ExtraNonce2Size
+)
+
+// MiningJob is the work of a block template for external miners.
+// A worker appends its extra-nonce to the coinbase data, calculates the Merkle root with the
+// Merkle branch of the coinbase and searches a nonce for the resulting header.
+// The transactions of the block are not needed for mining.
+type MiningJob struct {
+	Version      uint32
+	PrevHash     Hash
+	Height       uint64
+	Timestamp    int64
+	Bits         uint32
+	Coinbase     *Transaction // coinbase without extra-nonce
+	MerkleBranch []Hash       // hashes combined with the coinbase hash to get the Merkle root
+}
+
+// Job returns the mining job of the template.
+func (t *BlockTemplate) Job() *MiningJob {
+	b := t.Block
+	var leaves []serializedTransaction
+	for _, tx := range b.Transactions {
+		leaves = append(leaves, tx.Serialize())
+	}
+	return &MiningJob{
+		Version:      b.Version,
+		PrevHash:     b.PrevHash,
+		Height:       b.Height,
+		Timestamp:    b.Timestamp,
+		Bits:         b.Bits,
+		Coinbase:     b.Transactions[0],
+		MerkleBranch: calcMerkleBranch(leaves),
+	}
+}
+
+// Returns the hashes needed to calculate the Merkle root from the first leaf.
+// The branch does not depend on the first leaf.
+func calcMerkleBranch(leaves []serializedTransaction) []Hash {
+	var level []Hash
+	for _, leaf := range leaves {
+		hash := sha256.Sum256(leaf)
+		level = append(level, hash[:])
+	}
+	var branch []Hash
+	for len(level) > 1 {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+		branch = append(branch, level[1])
+		var next []Hash
+		for i := 0; i < len(level); i += 2 {
+			hash := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, hash[:])
+		}
+		level = next
+	}
+	return branch
+}
+
+// CoinbaseWithExtraNonce returns the coinbase of the job with `extraNonce` appended to its data.
+func (j *MiningJob) CoinbaseWithExtraNonce(extraNonce []byte) (*Transaction, error) {
+	if len(extraNonce) != ExtraNonceSize {
+		return nil, fmt.Errorf("extra-nonce must have %d bytes, has %d", ExtraNonceSize, len(extraNonce))
+	}
+	cb := *j.Coinbase
+	cb.Inputs = append([]TxInput{}, j.Coinbase.Inputs...)
+	cb.Inputs[0].ScriptSig = append(append([]byte{}, cb.Inputs[0].ScriptSig...), extraNonce...)
+	cb.ID = cb.calcTransactionID()
+	return &cb, nil
+}
+
+// Header returns the block header of the job for `extraNonce`, `timestamp` and `nonce`.
+func (j *MiningJob) Header(extraNonce []byte, timestamp int64, nonce uint32) (BlockHeader, error) {
+	cb, err := j.CoinbaseWithExtraNonce(extraNonce)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+	hash := sha256.Sum256(cb.Serialize())
+	root := hash[:]
+	for _, h := range j.MerkleBranch {
+		hash = sha256.Sum256(append(append([]byte{}, root...), h...))
+		root = hash[:]
+	}
+	return BlockHeader{
+		Version:    j.Version,
+		PrevHash:   j.PrevHash,
+		MerkleRoot: root,
+		Timestamp:  timestamp,
+		Bits:       j.Bits,
+		Nonce:      nonce,
+	}, nil
+}
+
+// Target returns the target of the job's block.
+func (j *MiningJob) Target() *big.Int {
+	return CompactToBig(j.Bits)
+}
+
+// Solution returns the block of template `t` with the solution found by a worker for the job of `t`.
+// The proof of work is not checked.
+func (t *BlockTemplate) Solution(extraNonce []byte, timestamp int64, nonce uint32) (*Block, error) {
+	job := t.Job()
+	cb, err := job.CoinbaseWithExtraNonce(extraNonce)
+	if err != nil {
+		return nil, err
+	}
+	header, err := job.Header(extraNonce, timestamp, nonce)
+	if err != nil {
+		return nil, err
+	}
+	b := &Block{
+		BlockHeader:  header,
+		Height:       t.Block.Height,
+		Transactions: append([]*Transaction{cb}, t.Block.Transactions[1:]...),
+	}
+	b.Hash = b.CalcHash()
+	return b, nil
+}
@@ -0,0 +1,61 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiningJobSolution(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	prev := bc.getLastBlock().Transactions[0]
+	var pool []*Transaction
+	extraNonce := []byte{0, 0, 0, 1, 0, 0, 0, 2}
+	for _, n := range []int{0, 1, 4} {
+		for len(pool) < n {
+			out := 1
+			if prev.IsCoinbase() {
+				out = 0
+			}
+			prev = spendOutput(w, prev, out, address, 1, 1)
+			pool = append(pool, prev)
+		}
+		tmpl, err := bc.NewBlockTemplate(address, pool)
+		require.NoError(t, err)
+		require.Len(t, tmpl.Block.Transactions, n+1)
+		job := tmpl.Job()
+		header, err := job.Header(extraNonce, job.Timestamp+1, 7)
+		require.NoError(t, err)
+		b, err := tmpl.Solution(extraNonce, job.Timestamp+1, 7)
+		require.NoError(t, err)
+		assert.Equal(t, b.hashTransactions(), b.MerkleRoot, "%d transactions", n+1)
+		assert.Equal(t, header.CalcHash(), b.Hash)
+		assert.True(t, bytes.HasSuffix(b.Transactions[0].Inputs[0].ScriptSig, extraNonce))
+		assert.Equal(t, tmpl.Block.Transactions[1:], b.Transactions[1:])
+		_, err = job.Header(extraNonce[1:], job.Timestamp, 0)
+		assert.Error(t, err)
+	}
+}
+
+func TestMiningJobSolutionIsValidBlock(t *testing.T) {
+	bc, w := newTestChain(t)
+	tmpl, err := bc.NewBlockTemplate(string(w.Address()), nil)
+	require.NoError(t, err)
+	job := tmpl.Job()
+	extraNonce := make([]byte, ExtraNonceSize)
+	var nonce uint32
+	for ; ; nonce++ {
+		header, err := job.Header(extraNonce, job.Timestamp, nonce)
+		require.NoError(t, err)
+		if header.IsValidBlockHeader() {
+			break
+		}
+	}
+	b, err := tmpl.Solution(extraNonce, job.Timestamp, nonce)
+	require.NoError(t, err)
+	require.NoError(t, bc.AddBlock(b))
+	assert.Equal(t, b.Hash, bc.getLastHash())
+}
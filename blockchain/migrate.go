@@ -0,0 +1,538 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+
+	"github.com/dgraph-io/badger"
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/mkohlhaas/gobc/wire"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// dbVersionEntry is the key in the database for the version of the database layout.
+// Databases without this entry were written with encoding/gob.
+var dbVersionEntry = []byte("dbversion")
+
+// Migrated blocks whose transaction IDs and signatures were calculated from an older encoding.
+var legacyPrefix = []byte("legacy-")
+
+// dbVersion is the current version of the database layout.
+//   - 0: blocks and undo data encoded with encoding/gob
+//   - 1: blocks and undo data encoded with the binary encoding
+//   - 2: block headers stored separately from the block bodies
+//   - 3: UTXO entries and undo data with height and coinbase flag
+//   - 4: transaction inputs with sequence number
+//   - 5: locking and unlocking scripts instead of public key hashes, signatures and public keys
+//   - 6: transactions with lock time
+//   - 7: migrated blocks with transactions of an older encoding marked as legacy blocks
+const dbVersion = 7
+
+// legacyHeaderVersion is the header version of blocks migrated from databases before version 2.
+// Their hashes were calculated differently and are kept as they are.
+const legacyHeaderVersion = 0
+
+// Types as they were encoded with encoding/gob. Gob matches fields by name.
+type (
+	legacyTxInput struct {
+		ID        []byte
+		Out       int
+		Signature []byte
+		PubKey    []byte
+	}
+	legacyTxOutput struct {
+		Value      int
+		PubKeyHash []byte
+	}
+	legacyTransaction struct {
+		ID      []byte
+		Inputs  []legacyTxInput
+		Outputs []legacyTxOutput
+	}
+	legacyBlock struct {
+		Timestamp    int64
+		Hash         []byte
+		Transactions []*legacyTransaction
+		PrevHash     []byte
+		Bits         uint32
+		Nonce        uint32
+		Height       uint64
+	}
+	legacySpentOutput struct {
+		TxID   []byte
+		Index  int
+		Output legacyTxOutput
+	}
+	legacyBlockUndo struct {
+		Spent []legacySpentOutput
+	}
+)
+
+func (out legacyTxOutput) convert() TxOutput {
+	return legacyOutput(out.Value, out.PubKeyHash)
+}
+
+func (tx *legacyTransaction) convert() *Transaction {
+	newTx := &Transaction{ID: tx.ID}
+	for _, in := range tx.Inputs {
+		newTx.Inputs = append(newTx.Inputs, legacyInput(in.ID, in.Out, in.Signature, in.PubKey, MaxTxInSequenceNum))
+	}
+	for _, out := range tx.Outputs {
+		newTx.Outputs = append(newTx.Outputs, out.convert())
+	}
+	return newTx
+}
+
+func (b *legacyBlock) convert() *Block {
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:   legacyHeaderVersion,
+			PrevHash:  b.PrevHash,
+			Timestamp: b.Timestamp,
+			Bits:      b.Bits,
+			Nonce:     b.Nonce,
+		},
+		Hash:   b.Hash,
+		Height: b.Height,
+	}
+	// Blocks from before difficulty retargeting were mined with the lowest difficulty.
+	if block.Bits == 0 {
+		block.Bits = MainNetParams.PowLimitBits
+	}
+	for _, tx := range b.Transactions {
+		block.Transactions = append(block.Transactions, tx.convert())
+	}
+	block.MerkleRoot = block.hashTransactions()
+	return block
+}
+
+// Decodes a block as it was stored in databases of version 1.
+// Format: version, timestamp, hash, previous hash, bits, nonce, height, number of transactions, transactions.
+func decodeV1Block(data []byte) (*Block, error) {
+	r := wire.NewReader(data)
+	r.ReadVersion()
+	b := &Block{BlockHeader: BlockHeader{Version: legacyHeaderVersion}}
+	b.Timestamp = r.ReadInt64()
+	b.Hash = r.ReadVarBytes()
+	b.PrevHash = r.ReadVarBytes()
+	b.Bits = r.ReadUint32()
+	b.Nonce = r.ReadUint32()
+	b.Height = r.ReadUint64()
+	b.Transactions = decodeLegacyTransactions(r, legacyTxFormat{decodeV3TxInput, decodeV4TxOutput})
+	if err := r.Finish(); err != nil {
+		return nil, err
+	}
+	b.MerkleRoot = b.hashTransactions()
+	return b, nil
+}
+
+// Converts a transaction input from before version 5 to an input with an unlocking script.
+// The coinbase data was stored in the public key.
+func legacyInput(id []byte, out int, sig, pubKey []byte, sequence uint32) TxInput {
+	in := TxInput{ID: id, Out: out, Sequence: sequence}
+	if out == noIndex {
+		in.ScriptSig = pubKey
+	} else {
+		in.ScriptSig = script.SignatureScript(sig, pubKey)
+	}
+	return in
+}
+
+// Converts a transaction output from before version 5 to an output locked with a pay-to-public-key-hash script.
+// Outputs without a public key hash, i.e. null outputs and outputs converted by an interrupted migration, are kept.
+func legacyOutput(value int, pubKeyHash []byte) TxOutput {
+	if len(pubKeyHash) != ripemd160.Size {
+		return TxOutput{Value: value, ScriptPubKey: pubKeyHash}
+	}
+	return TxOutput{Value: value, ScriptPubKey: script.PayToPubKeyHash(pubKeyHash)}
+}
+
+// Reads a transaction input as it was encoded before version 4. Such inputs are final.
+// Format: transaction ID, output index, signature, public key.
+func decodeV3TxInput(r *wire.Reader) TxInput {
+	return legacyInput(r.ReadVarBytes(), int(int32(r.ReadUint32())), r.ReadVarBytes(), r.ReadVarBytes(), MaxTxInSequenceNum)
+}
+
+// Reads a transaction input as it was encoded in version 4.
+// Format: transaction ID, output index, signature, public key, sequence number.
+func decodeV4TxInput(r *wire.Reader) TxInput {
+	return legacyInput(r.ReadVarBytes(), int(int32(r.ReadUint32())), r.ReadVarBytes(), r.ReadVarBytes(), r.ReadUint32())
+}
+
+// Reads a transaction output as it was encoded before version 5.
+// Format: value, public key hash.
+func decodeV4TxOutput(r *wire.Reader) TxOutput {
+	return legacyOutput(int(r.ReadInt64()), r.ReadVarBytes())
+}
+
+// Decoders of the inputs and outputs of transactions encoded before version 6.
+type legacyTxFormat struct {
+	decodeInput  func(*wire.Reader) TxInput
+	decodeOutput func(*wire.Reader) TxOutput
+}
+
+// Reads a transaction without lock time whose inputs are read by `decodeInput` and whose outputs are read by `decodeOutput`.
+func decodeLegacyTransaction(r *wire.Reader, decodeInput func(*wire.Reader) TxInput,
+	decodeOutput func(*wire.Reader) TxOutput) *Transaction {
+	tx := &Transaction{ID: r.ReadVarBytes()}
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		tx.Inputs = append(tx.Inputs, decodeInput(r))
+	}
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		tx.Outputs = append(tx.Outputs, decodeOutput(r))
+	}
+	return tx
+}
+
+// Reads the transactions of a block encoded before version 6 in `format`.
+func decodeLegacyTransactions(r *wire.Reader, format legacyTxFormat) []*Transaction {
+	var txs []*Transaction
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		txs = append(txs, decodeLegacyTransaction(r, format.decodeInput, format.decodeOutput))
+	}
+	return txs
+}
+
+// Decodes a block body stored in a database of version 2 to 5.
+// Bodies may have been converted to a later version already by an interrupted migration.
+// Returns nil if the body is already up to date.
+func migrateBody(val []byte, version int) ([]*Transaction, error) {
+	var formats []legacyTxFormat
+	if version <= 3 {
+		formats = append(formats, legacyTxFormat{decodeV3TxInput, decodeV4TxOutput})
+	}
+	if version <= 4 {
+		formats = append(formats, legacyTxFormat{decodeV4TxInput, decodeV4TxOutput})
+	}
+	formats = append(formats, legacyTxFormat{decodeTxInput, decodeTxOutput})
+	for _, format := range formats {
+		r := wire.NewReader(val)
+		r.ReadVersion()
+		txs := decodeLegacyTransactions(r, format)
+		if r.Finish() == nil {
+			return txs, nil
+		}
+	}
+	_, err := deserializeBody(val)
+	return nil, err
+}
+
+// Decodes a block stored in a database of version 0 or 1.
+func migrateBlock(val []byte) (*Block, error) {
+	if b, err := decodeV1Block(val); err == nil {
+		return b, nil
+	}
+	var block legacyBlock
+	if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&block); err != nil {
+		return nil, err
+	}
+	return block.convert(), nil
+}
+
+// Decodes undo data as it was stored in databases of version 1 and 2.
+// Format: version, number of spent outputs, spent outputs (transaction ID, index, output).
+func decodeV2Undo(data []byte) (*blockUndo, error) {
+	var undo blockUndo
+	r := wire.NewReader(data)
+	r.ReadVersion()
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		undo.Spent = append(undo.Spent, spentOutput{
+			TxID:   r.ReadVarBytes(),
+			Index:  int(r.ReadUint32()),
+			Output: decodeTxOutput(r),
+		})
+	}
+	if err := r.Finish(); err != nil {
+		return nil, err
+	}
+	return &undo, nil
+}
+
+// Decodes undo data stored in a database before version 5.
+// Height and coinbase flag of the spent outputs are set again by completeUndo.
+// Returns nil if the undo data is already up to date.
+func migrateUndo(val []byte, version int) (*blockUndo, error) {
+	undo, err := deserializeUndo(val)
+	if err == nil && version >= 5 {
+		return nil, nil
+	}
+	if err != nil {
+		undo, err = decodeV2Undo(val)
+	}
+	if err != nil {
+		var legacy legacyBlockUndo
+		if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&legacy); err != nil {
+			return nil, err
+		}
+		undo = &blockUndo{}
+		for _, so := range legacy.Spent {
+			undo.Spent = append(undo.Spent, spentOutput{TxID: so.TxID, Index: so.Index, Output: so.Output.convert()})
+		}
+	}
+	for i := range undo.Spent {
+		out := &undo.Spent[i].Output
+		*out = legacyOutput(out.Value, out.ScriptPubKey)
+	}
+	return undo, nil
+}
+
+// Sets height and coinbase flag of the outputs spent in `undo`.
+// Looks up the spent transactions in the transaction index.
+func (bc *BlockChain) completeUndo(undo *blockUndo) error {
+	for i := range undo.Spent {
+		so := &undo.Spent[i]
+		tx, blockHash, err := bc.GetTransaction(so.TxID)
+		if err != nil {
+			return err
+		}
+		_, height, err := bc.GetBlockHeader(blockHash)
+		if err != nil {
+			return err
+		}
+		so.Height = height
+		so.Coinbase = tx.IsCoinbase()
+	}
+	return nil
+}
+
+// Returns the version of the database layout.
+func (bc *BlockChain) dbVersion() (int, error) {
+	version := 0
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(dbVersionEntry)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 1 {
+				return fmt.Errorf("malformed database version %x", val)
+			}
+			version = int(val[0])
+			return nil
+		})
+	})
+	return version, err
+}
+
+// Migrates an older database to the current layout.
+// Undo data and block bodies are re-encoded, blocks are split into header and body.
+// Hashes and transaction IDs are kept as they are, so the migrated blocks stay linked.
+// Blocks whose transaction IDs do not match the current encoding are marked as legacy blocks.
+// The UTXO set and the indexes are rebuilt from the migrated blocks.
+// Proof of work of the migrated blocks is not validated again.
+// The migration can be interrupted and restarted.
+func migrateDB(bc *BlockChain) error {
+	version, err := bc.dbVersion()
+	if err != nil {
+		return err
+	}
+	if version == dbVersion {
+		return nil
+	}
+	if version > dbVersion {
+		return fmt.Errorf("unsupported database version %d", version)
+	}
+	log.Printf("Migrating database from version %d to %d.\n", version, dbVersion)
+	undos := make(map[string]*blockUndo)
+	bodies := make(map[string][]*Transaction)
+	var blocks []*Block
+	err = bc.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			switch {
+			case bytes.HasPrefix(key, undoPrefix):
+				val, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				undo, err := migrateUndo(val, version)
+				if err != nil {
+					return fmt.Errorf("migrating undo data %x: %w", key, err)
+				}
+				if undo != nil {
+					undos[string(key)] = undo
+				}
+			case len(key) == 32: // block hash
+				val, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				if _, err := getBlockHeader(txn, key); err == nil {
+					// Header and body are stored separately already.
+					txs, err := migrateBody(val, version)
+					if err != nil {
+						return fmt.Errorf("migrating block body %x: %w", key, err)
+					}
+					if txs != nil {
+						bodies[string(key)] = txs
+					}
+					continue
+				}
+				block, err := migrateBlock(val)
+				if err != nil {
+					return fmt.Errorf("migrating block %x: %w", key, err)
+				}
+				block.Hash = key
+				blocks = append(blocks, block)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			return storeBlock(txn, block)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for key, txs := range bodies {
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte(key), (&Block{Transactions: txs}).serializeBody())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// Old databases have neither transaction nor height index and their UTXO entries
+	// neither keep the positions of the outputs nor the height of the transactions.
+	UTXOSet{bc}.Reindex()
+	bc.ReindexTransactions()
+	bc.ReindexHeights()
+	// Undo data is only kept for blocks of the main chain, so the spent transactions are in the index.
+	for key, undo := range undos {
+		if err := bc.completeUndo(undo); err != nil {
+			return fmt.Errorf("migrating undo data %x: %w", key, err)
+		}
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte(key), undo.Serialize())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	legacy, err := bc.markLegacyBlocks()
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated %d blocks, %d block bodies and %d undo entries; %d legacy blocks.\n", len(blocks), len(bodies), len(undos), legacy)
+	return bc.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(dbVersionEntry, []byte{dbVersion})
+	})
+}
+
+// Marks all stored blocks with a transaction whose ID does not match its encoding as legacy blocks.
+// Their signatures were made for the encoding of their time as well. Returns the number of legacy blocks.
+func (bc *BlockChain) markLegacyBlocks() (int, error) {
+	var legacy []Hash
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if len(key) != 32 { // block hash
+				continue
+			}
+			err := it.Item().Value(func(val []byte) error {
+				txs, err := deserializeBody(val)
+				if err != nil {
+					return fmt.Errorf("block body %x: %w", key, err)
+				}
+				for _, tx := range txs {
+					if !bytes.Equal(tx.ID, tx.calcTransactionID()) {
+						legacy = append(legacy, key)
+						break
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, hash := range legacy {
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			return txn.Set(prefixedKey(legacyPrefix, hash), []byte{})
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(legacy), nil
+}
+
+// Returns true if block `hash` is a legacy block, see markLegacyBlocks.
+// The scripts of its transactions are not verified again when it is connected.
+func isLegacyBlock(txn *badger.Txn, hash Hash) (bool, error) {
+	_, err := txn.Get(prefixedKey(legacyPrefix, hash))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Types of wallet files as they were encoded with encoding/gob. The curve and the public point of the
+// private key are left out; the curve is always P-256 and the point follows from D.
+type (
+	legacyPrivateKey struct {
+		D *big.Int
+	}
+	legacyWallet struct {
+		PrivateKey legacyPrivateKey
+		PublicKey  []byte
+	}
+	legacyWallets struct {
+		Wallets map[string]*legacyWallet
+	}
+)
+
+// Decodes a wallet file written with encoding/gob.
+func decodeGobWallets(data []byte) (map[string]*Wallet, error) {
+	var legacy legacyWallets
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&legacy); err != nil {
+		return nil, err
+	}
+	wallets := make(map[string]*Wallet)
+	for address, w := range legacy.Wallets {
+		if w == nil || w.PrivateKey.D == nil {
+			return nil, fmt.Errorf("wallet %s without private key", address)
+		}
+		wallets[address] = &Wallet{newPrivateKey(w.PrivateKey.D.Bytes()), w.PublicKey}
+	}
+	return wallets, nil
+}
+
+// Rewrites the wallet file of `nodeId` written with encoding/gob with the binary encoding.
+// `data` is the old content; it is kept in a file with the suffix ".gob".
+func (ws *Wallets) migrateFile(nodeId string, data []byte) error {
+	wallets, err := decodeGobWallets(data)
+	if err != nil {
+		return err
+	}
+	walletFile := Params.walletPath(nodeId)
+	backup := walletFile + ".gob"
+	if err := os.WriteFile(backup, data, 0600); err != nil {
+		return err
+	}
+	ws.Wallets = wallets
+	ws.SaveFile(nodeId)
+	log.Printf("Migrated wallet file %s with %d wallets; the old file is kept as %s.\n", walletFile, len(wallets), backup)
+	return nil
+}
@@ -0,0 +1,128 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a random hash; hashes and transaction IDs of the GOB era were calculated differently.
+func legacyHash(t *testing.T) []byte {
+	hash := make([]byte, 32)
+	_, err := rand.Read(hash)
+	require.NoError(t, err)
+	return hash
+}
+
+// Returns `v` encoded with encoding/gob.
+func gobEncode(t *testing.T, v any) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(v))
+	return buf.Bytes()
+}
+
+// Creates a database as written with encoding/gob: genesis, a block spending the genesis output with a
+// signature of the old encoding and an empty block. Returns the migrated blockchain.
+func newLegacyChain(t *testing.T, w *Wallet) *BlockChain {
+	setCoinbaseMaturity(t, 0)
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	pubKeyHash := PublicKeyHash(w.PublicKey)
+	coinbase := func(height uint64, value int) *legacyTransaction {
+		return &legacyTransaction{
+			ID:      legacyHash(t),
+			Inputs:  []legacyTxInput{{Out: noIndex, PubKey: []byte{byte(height)}}},
+			Outputs: []legacyTxOutput{{value, pubKeyHash}},
+		}
+	}
+	genesis := coinbase(0, BlockSubsidy(0))
+	spend := &legacyTransaction{
+		ID:      legacyHash(t),
+		Inputs:  []legacyTxInput{{ID: genesis.ID, Out: 0, Signature: legacyHash(t), PubKey: w.PublicKey}},
+		Outputs: []legacyTxOutput{{BlockSubsidy(0), pubKeyHash}},
+	}
+	txs := [][]*legacyTransaction{{genesis}, {coinbase(1, BlockSubsidy(1)), spend}, {coinbase(2, BlockSubsidy(2))}}
+	timestamp := time.Now().Unix() - 3600
+	var prevHash []byte
+	err = db.Update(func(txn *badger.Txn) error {
+		for height, blockTxs := range txs {
+			b := legacyBlock{
+				Timestamp:    timestamp + int64(height),
+				Hash:         legacyHash(t),
+				Transactions: blockTxs,
+				PrevHash:     prevHash,
+				Bits:         Params.PowLimitBits,
+				Height:       uint64(height),
+			}
+			if err := txn.Set(b.Hash, gobEncode(t, &b)); err != nil {
+				return err
+			}
+			var undo legacyBlockUndo
+			if height == 1 {
+				undo.Spent = []legacySpentOutput{{TxID: genesis.ID, Index: 0, Output: genesis.Outputs[0]}}
+			}
+			if err := txn.Set(prefixedKey(undoPrefix, b.Hash), gobEncode(t, &undo)); err != nil {
+				return err
+			}
+			prevHash = b.Hash
+		}
+		return txn.Set(lastHashEntry, prevHash)
+	})
+	require.NoError(t, err)
+	bc := newBlockChain(db)
+	require.NoError(t, migrateDB(bc))
+	return bc
+}
+
+func TestReorganizeAcrossLegacyBlocks(t *testing.T) {
+	w := MakeWallet()
+	address := string(w.Address())
+	bc := newLegacyChain(t, w)
+	require.Equal(t, uint64(2), bc.BestHeight())
+	l2 := bc.getLastBlock()
+	l1, err := bc.GetBlock(l2.PrevHash)
+	require.NoError(t, err)
+	genesis, err := bc.GetBlock(l1.PrevHash)
+	require.NoError(t, err)
+	legacy := func(b *Block) bool {
+		var isLegacy bool
+		err := bc.Database.View(func(txn *badger.Txn) (err error) {
+			isLegacy, err = isLegacyBlock(txn, b.Hash)
+			return err
+		})
+		require.NoError(t, err)
+		return isLegacy
+	}
+	assert.True(t, legacy(genesis) && legacy(l1) && legacy(l2))
+	before := storedUTXOs(t, bc)
+
+	// A branch with more work disconnects the legacy blocks.
+	b1 := mineOn(t, genesis, CoinbaseTx(address, BlockSubsidy(1), "b1"))
+	b2 := mineOn(t, b1, CoinbaseTx(address, BlockSubsidy(2), "b2"))
+	b3 := mineOn(t, b2, CoinbaseTx(address, BlockSubsidy(3), "b3"))
+	for _, b := range []*Block{b1, b2, b3} {
+		require.NoError(t, bc.AddBlock(b))
+	}
+	assert.Equal(t, b3.Hash, bc.getLastHash())
+	assert.False(t, legacy(b3))
+
+	// Extending the legacy blocks connects them again; their signatures of the old encoding are not verified.
+	l3 := mineOn(t, l2, CoinbaseTx(address, BlockSubsidy(3), "l3"))
+	l4 := mineOn(t, l3, CoinbaseTx(address, BlockSubsidy(4), "l4"))
+	require.NoError(t, bc.AddBlock(l3))
+	require.NoError(t, bc.AddBlock(l4))
+	assert.Equal(t, l4.Hash, bc.getLastHash())
+	utxos := storedUTXOs(t, bc)
+	for outpoint, value := range before {
+		assert.Equal(t, value, utxos[outpoint])
+	}
+	UTXOSet{bc}.Reindex()
+	assert.Equal(t, utxos, storedUTXOs(t, bc))
+}
@@ -0,0 +1,167 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoSolution is returned when the miner gives up without finding a valid proof of work.
+var ErrNoSolution = errors.New("no proof of work found")
+
+// Miner solves the proof of work of blocks with several goroutines.
+// The nonce space is searched in rounds; in every round each goroutine checks its own slice of nonces.
+// The lowest valid nonce wins, so the mined block does not depend on the number of goroutines.
+// When the nonce space is exhausted the extra-nonce in the coinbase is incremented and the timestamp refreshed.
+type Miner struct {
+	Threads       int    // number of goroutines
+	MaxExtraNonce uint64 // how often the nonce space may be exhausted before giving up
+	nonceSpace    uint64 // number of nonces per extra-nonce; only tests shrink it
+	batchSize     uint64 // nonces checked by a goroutine per round
+}
+
+// NewMiner creates a miner using `threads` goroutines (at least one).
+func NewMiner(threads int) *Miner {
+	if threads < 1 {
+		threads = 1
+	}
+	return &Miner{
+		Threads:       threads,
+		MaxExtraNonce: 1 << 16,
+		nonceSpace:    1 << 32,
+		batchSize:     1 << 14,
+	}
+}
+
+// DefaultMiner solves the proof of work of the blocks we create. It uses all CPUs.
+var DefaultMiner = NewMiner(runtime.NumCPU())
+
+// MiningStats describes the work done solving the proof of work of a block.
+type MiningStats struct {
+	Hashes     uint64
+	Duration   time.Duration
+	ExtraNonce uint64 // number of times the nonce space was exhausted
+}
+
+// Hashrate returns the number of hashes per second.
+func (s MiningStats) Hashrate() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Hashes) / s.Duration.Seconds()
+}
+
+// Solve runs proof of work on block `b`. Updates nonce and hash in the block; may also update
+// timestamp, coinbase and Merkle root. Returns ErrNoSolution if the extra-nonces are exhausted
+// and the error of `ctx` if it is cancelled.
+func (m *Miner) Solve(ctx context.Context, b *Block) (MiningStats, error) {
+	start := time.Now()
+	stats := MiningStats{}
+	target := CompactToBig(b.Bits)
+	for {
+		nonce, hashes, found := m.searchNonces(ctx, b.BlockHeader, target)
+		stats.Hashes += hashes
+		if err := ctx.Err(); err != nil {
+			stats.Duration = time.Since(start)
+			return stats, err
+		}
+		if found {
+			b.Nonce = nonce
+			b.Hash = b.CalcHash()
+			stats.Duration = time.Since(start)
+			return stats, nil
+		}
+		if stats.ExtraNonce >= m.MaxExtraNonce || len(b.Transactions) == 0 || b.Transactions[0].isNotCoinbase() {
+			stats.Duration = time.Since(start)
+			return stats, ErrNoSolution
+		}
+		stats.ExtraNonce++
+		b.rollExtraNonce(stats.ExtraNonce)
+	}
+}
+
+// Searches the whole nonce space of `header` for the lowest nonce giving a hash below `target`.
+// Returns the nonce, the number of hashes calculated and if a nonce was found.
+// Stops after the current round if `ctx` is cancelled.
+func (m *Miner) searchNonces(ctx context.Context, header BlockHeader, target *big.Int) (uint32, uint64, bool) {
+	threads := uint64(m.Threads)
+	var hashes uint64
+	for base := uint64(0); base < m.nonceSpace && ctx.Err() == nil; base += threads * m.batchSize {
+		// Lowest goroutine which found a nonce in this round; higher goroutines stop early.
+		winner := int64(threads)
+		nonces := make([]uint32, threads)
+		var wg sync.WaitGroup
+		for i := uint64(0); i < threads; i++ {
+			from := base + i*m.batchSize
+			to := from + m.batchSize
+			if to > m.nonceSpace {
+				to = m.nonceSpace
+			}
+			wg.Add(1)
+			go func(i, from, to uint64) {
+				defer wg.Done()
+				data := header.Serialize()
+				nonce := data[headerSize-4:]
+				var intHash big.Int
+				n := from
+				defer func() { atomic.AddUint64(&hashes, n-from) }()
+				for ; n < to; n++ {
+					if atomic.LoadInt64(&winner) < int64(i) {
+						return // a lower nonce was found already
+					}
+					binary.LittleEndian.PutUint32(nonce, uint32(n))
+					intHash.SetBytes(doubleHash256(data))
+					if intHash.Cmp(target) == -1 {
+						nonces[i] = uint32(n)
+						n++ // count the last hash
+						for w := atomic.LoadInt64(&winner); int64(i) < w; w = atomic.LoadInt64(&winner) {
+							if atomic.CompareAndSwapInt64(&winner, w, int64(i)) {
+								break
+							}
+						}
+						return
+					}
+				}
+			}(i, from, to)
+		}
+		wg.Wait()
+		if winner < int64(threads) {
+			return nonces[winner], hashes, true
+		}
+	}
+	return 0, hashes, false
+}
+
+// Puts `extraNonce` at the end of the coinbase data and refreshes the timestamp.
+// The coinbase ID and the Merkle root change, so the nonce space can be searched again.
+// The coinbase is replaced by a copy; the transactions of the caller, e.g. of a block template, stay as they are.
+func (b *Block) rollExtraNonce(extraNonce uint64) {
+	cb := *b.Transactions[0]
+	cb.Inputs = append([]TxInput{}, cb.Inputs...)
+	b.Transactions = append([]*Transaction{&cb}, b.Transactions[1:]...)
+	data := cb.Inputs[0].ScriptSig
+	if extraNonce > 1 {
+		data = data[:len(data)-8] // remove previous extra-nonce
+	}
+	var en [8]byte
+	binary.LittleEndian.PutUint64(en[:], extraNonce)
+	cb.Inputs[0].ScriptSig = append(append([]byte{}, data...), en[:]...)
+	cb.ID = cb.calcTransactionID()
+	b.MerkleRoot = b.hashTransactions()
+	if now := time.Now().Unix(); now > b.Timestamp {
+		b.Timestamp = now
+	}
+}
+
+// Runs proof of work on block `b` with the default miner and logs the hashrate.
+func (b *Block) runProof(ctx context.Context) error {
+	stats, err := DefaultMiner.Solve(ctx, b)
+	log.Printf("Mining: %d hashes in %s (%.0f hashes/s, extra-nonce %d)\n", stats.Hashes, stats.Duration, stats.Hashrate(), stats.ExtraNonce)
+	return err
+}
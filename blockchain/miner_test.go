@@ -0,0 +1,84 @@
+package blockchain
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns an unsolved block on top of the genesis block of `bc`.
+func newCandidate(bc *BlockChain, address string) *Block {
+	last := bc.getLastBlock()
+	b := &Block{
+		BlockHeader:  BlockHeader{Version: blockVersion, PrevHash: last.Hash, Timestamp: last.Timestamp + 1, Bits: last.Bits},
+		Height:       1,
+		Transactions: []*Transaction{CoinbaseTx(address, BlockSubsidy(1), "candidate")},
+	}
+	b.MerkleRoot = b.hashTransactions()
+	return b
+}
+
+func TestSolutionDoesNotDependOnThreads(t *testing.T) {
+	bc, w := newTestChain(t)
+	var hashes []Hash
+	for _, threads := range []int{1, 3, 8} {
+		b := newCandidate(bc, string(w.Address()))
+		stats, err := NewMiner(threads).Solve(context.Background(), b)
+		require.NoError(t, err)
+		assert.True(t, b.IsValidBlockHeader())
+		assert.Equal(t, b.CalcHash(), b.Hash)
+		assert.NotZero(t, stats.Hashes)
+		hashes = append(hashes, b.Hash)
+	}
+	assert.Equal(t, hashes[0], hashes[1])
+	assert.Equal(t, hashes[0], hashes[2])
+}
+
+func TestExtraNonceRollover(t *testing.T) {
+	bc, w := newTestChain(t)
+	b := newCandidate(bc, string(w.Address()))
+	txs := b.Transactions
+	cb := txs[0]
+	cbID := cb.ID
+	m := NewMiner(2)
+	m.nonceSpace, m.batchSize = 16, 4
+
+	stats, err := m.Solve(context.Background(), b)
+	require.NoError(t, err)
+	assert.NotZero(t, stats.ExtraNonce)
+	assert.Less(t, b.Nonce, uint32(16))
+	assert.NotEqual(t, cbID, b.Transactions[0].ID)
+	// The caller's coinbase is not changed.
+	assert.Same(t, cb, txs[0])
+	assert.Equal(t, cbID, cb.ID)
+	assert.Equal(t, cbID, Hash(cb.calcTransactionID()))
+	assert.Equal(t, b.hashTransactions(), b.MerkleRoot)
+	require.NoError(t, bc.AddBlock(b))
+}
+
+func TestNoSolution(t *testing.T) {
+	bc, w := newTestChain(t)
+	b := newCandidate(bc, string(w.Address()))
+	b.Bits = BigToCompact(big.NewInt(1)) // no hash is below 1
+	m := NewMiner(2)
+	m.nonceSpace, m.batchSize, m.MaxExtraNonce = 16, 4, 3
+
+	stats, err := m.Solve(context.Background(), b)
+	assert.ErrorIs(t, err, ErrNoSolution)
+	assert.Equal(t, uint64(3), stats.ExtraNonce)
+	assert.Equal(t, uint64(4*16), stats.Hashes)
+}
+
+func TestSolveIsCancelled(t *testing.T) {
+	bc, w := newTestChain(t)
+	b := newCandidate(bc, string(w.Address()))
+	b.Bits = BigToCompact(big.NewInt(1))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := NewMiner(2).Solve(ctx, b)
+	assert.ErrorIs(t, err, context.Canceled)
+}
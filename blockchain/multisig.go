@@ -0,0 +1,191 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/mkohlhaas/gobc/bcerror"
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/mkohlhaas/gobc/wire"
+)
+
+// RedeemScripts are the redeem scripts of the script addresses of a node, e.g. its multisig addresses.
+// Outputs paying to a script address can only be spent by revealing its redeem script.
+type RedeemScripts struct {
+	// map: script address → redeem script
+	Scripts map[string]script.Script
+}
+
+// OpenRedeemScripts loads the redeem scripts of `nodeID`.
+// Returns no scripts if the file does not exist yet.
+func OpenRedeemScripts(nodeID string) (*RedeemScripts, error) {
+	rs := &RedeemScripts{Scripts: make(map[string]script.Script)}
+	file := Params.redeemScriptPath(nodeID)
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	bcerror.Handle(err)
+	r := wire.NewReader(data)
+	r.ReadVersion()
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		rs.Add(r.ReadVarBytes())
+	}
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("reading redeem scripts %s: %w", file, err)
+	}
+	return rs, nil
+}
+
+// Add adds `redeemScript` and returns its address.
+func (rs *RedeemScripts) Add(redeemScript script.Script) string {
+	address := string(ScriptToAddress(redeemScript))
+	rs.Scripts[address] = redeemScript
+	return address
+}
+
+// Get returns the redeem script of `address` or nil if it is unknown.
+func (rs *RedeemScripts) Get(address string) script.Script {
+	return rs.Scripts[address]
+}
+
+// SaveFile saves the redeem scripts of `nodeID`.
+// Format: version, number of scripts, scripts sorted by address.
+func (rs *RedeemScripts) SaveFile(nodeID string) {
+	var addresses []string
+	for address := range rs.Scripts {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	w := wire.NewWriter()
+	w.WriteVersion()
+	w.WriteVarInt(uint64(len(addresses)))
+	for _, address := range addresses {
+		w.WriteVarBytes(rs.Scripts[address])
+	}
+	err := os.MkdirAll(Params.DataDir, 0755)
+	bcerror.Handle(err)
+	err = os.WriteFile(Params.redeemScriptPath(nodeID), w.Bytes(), 0644)
+	bcerror.Handle(err)
+}
+
+// NewMultiSigScript returns the redeem script of an address needing signatures of `m` of `pubKeys`.
+// A redeem script must fit into a single stack element; this limits the number of keys to 7.
+func NewMultiSigScript(m int, pubKeys [][]byte) (script.Script, error) {
+	for _, pubKey := range pubKeys {
+		if len(pubKey) != 64 {
+			return nil, fmt.Errorf("invalid public key %x", pubKey)
+		}
+	}
+	redeemScript, err := script.MultiSigScript(m, pubKeys)
+	if err != nil {
+		return nil, err
+	}
+	if len(redeemScript) > script.MaxScriptElementSize {
+		return nil, fmt.Errorf("redeem script for %d public keys exceeds %d bytes", len(pubKeys), script.MaxScriptElementSize)
+	}
+	return redeemScript, nil
+}
+
+// NewMultiSigTransaction returns an unsigned transaction spending outputs of the multisig address of `redeemScript`.
+// `amount` goes to `to`, the change back to the multisig address and `fee` is left to the miner.
+// The unlocking script of every input is OP_0 <redeemScript>; the signers add their signatures with SignMultiSig.
+func NewMultiSigTransaction(redeemScript script.Script, to string, amount, fee int, UTXO *UTXOSet) (*Transaction, error) {
+	from := string(ScriptToAddress(redeemScript))
+	acc, validOutputs := UTXO.FindSpendableOutputs(LockingScript(from), amount+fee)
+	if acc < amount+fee {
+		return nil, fmt.Errorf("not enough funds: %s can spend %d", from, acc)
+	}
+	unlocking := script.NewBuilder().AddOp(script.OP_0).AddData(redeemScript).Script()
+	tx := &Transaction{}
+	for txid, outs := range validOutputs {
+		txID, err := hex.DecodeString(txid)
+		bcerror.Handle(err)
+		for _, out := range outs {
+			tx.Inputs = append(tx.Inputs, TxInput{ID: txID, Out: out, ScriptSig: unlocking, Sequence: MaxTxInSequenceNum})
+		}
+	}
+	tx.Outputs = append(tx.Outputs, *newTXOutput(amount, to))
+	if acc > amount+fee {
+		tx.Outputs = append(tx.Outputs, *newTXOutput(acc-amount-fee, from))
+	}
+	tx.ID = tx.calcTransactionID()
+	return tx, nil
+}
+
+// SignMultiSig adds the signature of `w` to all inputs of `tx` spending outputs of the multisig address of
+// `redeemScript`. Signatures added before are kept, so the signers can sign one after the other.
+// The spent outputs are looked up in the transaction index.
+// Returns the number of signatures still missing.
+func (bc *BlockChain) SignMultiSig(tx *Transaction, w *Wallet, redeemScript script.Script) (int, error) {
+	prevTXs := make(map[string]Transaction)
+	for _, in := range tx.Inputs {
+		prevTX, err := bc.findTransaction(in.ID)
+		if err != nil {
+			return 0, err
+		}
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+	return tx.signMultiSig(w, redeemScript, prevTXs)
+}
+
+// Adds the signature of `w` to the inputs of `tx` spending outputs locked to the hash of `redeemScript`.
+// Their unlocking scripts are OP_0 <signatures> <redeemScript> with the signatures in the order of the public keys.
+// `prevTXs` maps the IDs of the spent transactions to the transactions.
+func (tx *Transaction) signMultiSig(w *Wallet, redeemScript script.Script, prevTXs map[string]Transaction) (int, error) {
+	m, pubKeys := redeemScript.MultiSigKeys()
+	if m == 0 {
+		return 0, fmt.Errorf("redeem script %s is not a multisig script", redeemScript)
+	}
+	own := -1
+	for i, pubKey := range pubKeys {
+		if bytes.Equal(pubKey, w.PublicKey) {
+			own = i
+		}
+	}
+	if own < 0 {
+		return 0, fmt.Errorf("wallet %s is not a signer of %s", w.Address(), ScriptToAddress(redeemScript))
+	}
+	locking := script.PayToScriptHash(redeemScript.Hash160())
+	missing, signed := 0, false
+	for inID, in := range tx.Inputs {
+		prevTX, ok := prevTXs[hex.EncodeToString(in.ID)]
+		if !ok || !bytes.Equal(prevTX.Outputs[in.Out].ScriptPubKey, locking) {
+			continue
+		}
+		// Assign the signatures made so far to their public keys.
+		sigs := make([][]byte, len(pubKeys))
+		if data := in.ScriptSig.PushedData(); len(data) > 2 {
+			checker := txSigChecker{tx, inID, prevTX.Outputs[in.Out].Value}
+			for _, sig := range data[1 : len(data)-1] {
+				for i, pubKey := range pubKeys {
+					if sigs[i] == nil && checker.CheckSig(sig, pubKey, redeemScript) {
+						sigs[i] = sig
+						break
+					}
+				}
+			}
+		}
+		sigs[own] = tx.signInput(w.PrivateKey, inID, redeemScript, prevTX.Outputs[in.Out].Value, SigHashAll)
+		b := script.NewBuilder().AddOp(script.OP_0)
+		count := 0
+		for _, sig := range sigs {
+			if sig != nil && count < m {
+				b.AddData(sig)
+				count++
+			}
+		}
+		tx.Inputs[inID].ScriptSig = b.AddData(redeemScript).Script()
+		if m-count > missing {
+			missing = m - count
+		}
+		signed = true
+	}
+	if !signed {
+		return 0, fmt.Errorf("transaction %x does not spend outputs of %s", tx.ID, ScriptToAddress(redeemScript))
+	}
+	return missing, nil
+}
@@ -0,0 +1,82 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiSigTransaction(t *testing.T) {
+	bc, w := newTestChain(t)
+	signers := []*Wallet{MakeWallet(), MakeWallet(), MakeWallet()}
+	redeemScript, err := NewMultiSigScript(2, [][]byte{signers[0].PublicKey, signers[1].PublicKey, signers[2].PublicKey})
+	require.NoError(t, err)
+	address := string(ScriptToAddress(redeemScript))
+	require.True(t, Validate(address))
+
+	utxo := &UTXOSet{bc}
+	funding := newTestTransaction(t, w, address, 10, 1, utxo)
+	_, err = bc.MineBlock([]*Transaction{CoinbaseTx(string(w.Address()), BlockSubsidy(1)+1), funding})
+	require.NoError(t, err)
+	assert.Equal(t, 10, utxo.FindUnspentTransactions(LockingScript(address))[0].Value)
+
+	to := string(MakeWallet().Address())
+	tx, err := NewMultiSigTransaction(redeemScript, to, 6, 1, utxo)
+	require.NoError(t, err)
+	_, err = bc.SignMultiSig(tx, w, redeemScript)
+	assert.Error(t, err, "not a signer")
+
+	// The signers sign one after the other on a serialized copy.
+	missing, err := bc.SignMultiSig(tx, signers[2], redeemScript)
+	require.NoError(t, err)
+	assert.Equal(t, 1, missing)
+	_, err = bc.CheckTransaction(tx, nil)
+	assertRuleError(t, err, ErrBadSignature)
+	partial, err := DeserializeTransaction(tx.Serialize())
+	require.NoError(t, err)
+	missing, err = bc.SignMultiSig(&partial, signers[0], redeemScript)
+	require.NoError(t, err)
+	assert.Equal(t, 0, missing)
+	assert.Equal(t, tx.ID, partial.ID)
+
+	fee, err := bc.CheckTransaction(&partial, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, fee)
+	assert.Equal(t, LockingScript(address), partial.Outputs[1].ScriptPubKey)
+	assert.Equal(t, 3, partial.Outputs[1].Value)
+}
+
+func TestNewMultiSigScriptLimits(t *testing.T) {
+	var pubKeys [][]byte
+	for i := 0; i < 8; i++ {
+		pubKeys = append(pubKeys, MakeWallet().PublicKey)
+	}
+	_, err := NewMultiSigScript(2, pubKeys[:7])
+	assert.NoError(t, err)
+	_, err = NewMultiSigScript(2, pubKeys)
+	assert.Error(t, err, "redeem script too big")
+	_, err = NewMultiSigScript(3, pubKeys[:2])
+	assert.Error(t, err)
+	_, err = NewMultiSigScript(1, [][]byte{{1, 2, 3}})
+	assert.Error(t, err)
+}
+
+func TestRedeemScriptsFile(t *testing.T) {
+	params := *Params
+	params.DataDir = t.TempDir()
+	old := Params
+	Params = &params
+	t.Cleanup(func() { Params = old })
+
+	rs, err := OpenRedeemScripts("test")
+	require.NoError(t, err)
+	redeemScript, err := NewMultiSigScript(1, [][]byte{MakeWallet().PublicKey})
+	require.NoError(t, err)
+	address := rs.Add(redeemScript)
+	rs.SaveFile("test")
+
+	rs, err = OpenRedeemScripts("test")
+	require.NoError(t, err)
+	assert.Equal(t, redeemScript, rs.Get(address))
+}
@@ -0,0 +1,28 @@
+package blockchain
+
+// ChainUpdate describes a change of the main chain.
+// A new block on top of the last block is connected without disconnecting blocks;
+// a reorganization disconnects blocks first.
+type ChainUpdate struct {
+	Disconnected []*Block // blocks removed from the main chain, from the old last block downwards
+	Connected    []*Block // blocks added to the main chain, upwards to the new last block
+}
+
+// Subscribe registers `callback` for changes of the main chain.
+// Callbacks are called after the database was updated, in the goroutine which added the block.
+// Blocks are added one at a time, so callbacks see the updates in order; they must not add blocks.
+func (bc *BlockChain) Subscribe(callback func(ChainUpdate)) {
+	bc.subscribersMu.Lock()
+	defer bc.subscribersMu.Unlock()
+	bc.subscribers = append(bc.subscribers, callback)
+}
+
+// Tells all subscribers about `update`.
+func (bc *BlockChain) notify(update ChainUpdate) {
+	bc.subscribersMu.Lock()
+	subscribers := append([]func(ChainUpdate){}, bc.subscribers...)
+	bc.subscribersMu.Unlock()
+	for _, callback := range subscribers {
+		callback(update)
+	}
+}
@@ -0,0 +1,191 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultMaxOrphanSize is the default limit of the total size of the orphan blocks in bytes.
+	DefaultMaxOrphanSize = 10 * MaxBlockSize
+	// DefaultOrphanExpiry is the default time after which orphan blocks are removed.
+	DefaultOrphanExpiry = time.Hour
+)
+
+// An orphan block is a block whose previous block we do not know (yet).
+type orphanBlock struct {
+	block *Block
+	size  int
+	added time.Time
+	seq   uint64 // order of insertion
+}
+
+// ProcessBlock adds `block` to the blockchain like AddBlock. If the previous block is unknown,
+// `block` is kept in the orphan pool and `isOrphan` is true; MissingAncestor tells which block to request.
+// After a block was added, the orphans building on it are added as well, and the orphans building on them, etc.
+func (bc *BlockChain) ProcessBlock(block *Block) (isOrphan bool, err error) {
+	bc.orphanMu.Lock()
+	bc.expireOrphans()
+	_, known := bc.orphans[hex.EncodeToString(block.Hash)]
+	bc.orphanMu.Unlock()
+	if known {
+		return true, ruleError(ErrDuplicateBlock, "block %x already in the orphan pool", block.Hash)
+	}
+	err = bc.AddBlock(block)
+	var ruleErr RuleError
+	if !errors.As(err, &ruleErr) || ruleErr.Code != ErrOrphanBlock {
+		if err == nil {
+			bc.connectOrphans(block.Hash)
+		}
+		return false, err
+	}
+	// AddBlock checked the proof of work against the block's own target already.
+	if err := bc.checkOrphanTarget(block); err != nil {
+		return false, err
+	}
+	if err := bc.addOrphan(block); err != nil {
+		return false, err
+	}
+	// The previous block might have been added while we were not looking.
+	if _, err := bc.getBlockHeader(block.PrevHash); err == nil {
+		bc.connectOrphans(block.PrevHash)
+	}
+	return true, nil
+}
+
+// Rejects orphans claiming less work than the blocks at their height can have.
+// The target of the main chain changes at most by RetargetAdjustmentFactor per retarget,
+// so far from the last block the target of a valid block is bounded as well.
+// Otherwise anybody could fill the orphan pool with blocks mined at the PoW limit.
+func (bc *BlockChain) checkOrphanTarget(block *Block) error {
+	last := bc.getLastHeader()
+	easiest := CompactToBig(last.Bits)
+	if !Params.NoRetargeting {
+		from, to := last.Height/Params.RetargetInterval, block.Height/Params.RetargetInterval
+		if from > to {
+			from, to = to, from
+		}
+		factor := big.NewInt(Params.RetargetAdjustmentFactor)
+		for i := from; i < to && easiest.Cmp(Params.PowLimit) < 0; i++ {
+			easiest.Mul(easiest, factor)
+		}
+	}
+	if CompactToBig(block.Bits).Cmp(easiest) > 0 {
+		return ruleError(ErrBadDifficulty, "orphan block %x: target %08x too easy for height %d", block.Hash, block.Bits, block.Height)
+	}
+	return nil
+}
+
+// Adds `block` to the orphan pool. The oldest orphans are evicted if the orphan pool gets too big.
+func (bc *BlockChain) addOrphan(block *Block) error {
+	size := block.Size()
+	bc.orphanMu.Lock()
+	defer bc.orphanMu.Unlock()
+	if size > bc.MaxOrphanSize {
+		return fmt.Errorf("orphan block %x too big: %d bytes", block.Hash, size)
+	}
+	for bc.orphanSize+size > bc.MaxOrphanSize {
+		bc.removeOrphan(bc.sortedOrphans()[0])
+	}
+	bc.orphanSeq++
+	o := &orphanBlock{block: block, size: size, added: bc.now(), seq: bc.orphanSeq}
+	prev := hex.EncodeToString(block.PrevHash)
+	bc.orphans[hex.EncodeToString(block.Hash)] = o
+	bc.orphansByPrev[prev] = append(bc.orphansByPrev[prev], o)
+	bc.orphanSize += size
+	return nil
+}
+
+// Removes orphan `o`. Must be called with the lock held.
+func (bc *BlockChain) removeOrphan(o *orphanBlock) {
+	delete(bc.orphans, hex.EncodeToString(o.block.Hash))
+	prev := hex.EncodeToString(o.block.PrevHash)
+	siblings := bc.orphansByPrev[prev][:0]
+	for _, sibling := range bc.orphansByPrev[prev] {
+		if sibling != o {
+			siblings = append(siblings, sibling)
+		}
+	}
+	if len(siblings) == 0 {
+		delete(bc.orphansByPrev, prev)
+	} else {
+		bc.orphansByPrev[prev] = siblings
+	}
+	bc.orphanSize -= o.size
+}
+
+// Adds the orphans building on block `hash`, then the orphans building on them, etc.
+// Orphans which turn out to be invalid are dropped.
+func (bc *BlockChain) connectOrphans(hash Hash) {
+	queue := []Hash{hash}
+	for len(queue) > 0 {
+		prev := hex.EncodeToString(queue[0])
+		queue = queue[1:]
+		bc.orphanMu.Lock()
+		children := append([]*orphanBlock{}, bc.orphansByPrev[prev]...)
+		for _, o := range children {
+			bc.removeOrphan(o)
+		}
+		bc.orphanMu.Unlock()
+		for _, o := range children {
+			if err := bc.AddBlock(o.block); err != nil {
+				fmt.Printf("Rejected orphan block %x: %s\n", o.block.Hash, err)
+				continue
+			}
+			queue = append(queue, o.block.Hash)
+		}
+	}
+}
+
+// Removes the orphans older than OrphanExpiry. Must be called with the lock held.
+func (bc *BlockChain) expireOrphans() {
+	deadline := bc.now().Add(-bc.OrphanExpiry)
+	for _, o := range bc.orphans {
+		if o.added.Before(deadline) {
+			bc.removeOrphan(o)
+		}
+	}
+}
+
+// Returns the orphans, the oldest first. Must be called with the lock held.
+func (bc *BlockChain) sortedOrphans() []*orphanBlock {
+	orphans := make([]*orphanBlock, 0, len(bc.orphans))
+	for _, o := range bc.orphans {
+		orphans = append(orphans, o)
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].seq < orphans[j].seq })
+	return orphans
+}
+
+// MissingAncestor returns the hash of the unknown block orphan `hash` builds on, directly or through other orphans.
+// Returns `hash` itself if it is not an orphan.
+func (bc *BlockChain) MissingAncestor(hash Hash) Hash {
+	bc.orphanMu.Lock()
+	defer bc.orphanMu.Unlock()
+	for {
+		o, ok := bc.orphans[hex.EncodeToString(hash)]
+		if !ok {
+			return hash
+		}
+		hash = o.block.PrevHash
+	}
+}
+
+// IsOrphan returns true if block `hash` is in the orphan pool.
+func (bc *BlockChain) IsOrphan(hash Hash) bool {
+	bc.orphanMu.Lock()
+	defer bc.orphanMu.Unlock()
+	_, ok := bc.orphans[hex.EncodeToString(hash)]
+	return ok
+}
+
+// OrphanCount returns the number of blocks in the orphan pool.
+func (bc *BlockChain) OrphanCount() int {
+	bc.orphanMu.Lock()
+	defer bc.orphanMu.Unlock()
+	return len(bc.orphans)
+}
@@ -0,0 +1,98 @@
+package blockchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessBlockConnectsOrphans(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	genesis := bc.getLastBlock()
+	a1 := mineOn(t, genesis, CoinbaseTx(address, BlockSubsidy(1)))
+	a2 := mineOn(t, a1, CoinbaseTx(address, BlockSubsidy(2)))
+	a3 := mineOn(t, a2, CoinbaseTx(address, BlockSubsidy(3)))
+	b3 := mineOn(t, a2, CoinbaseTx(address, BlockSubsidy(3)))
+
+	// The blocks arrive in reverse order.
+	for _, b := range []*Block{a3, b3, a2} {
+		isOrphan, err := bc.ProcessBlock(b)
+		require.NoError(t, err)
+		assert.True(t, isOrphan)
+	}
+	assert.Equal(t, a1.Hash, bc.MissingAncestor(a3.Hash))
+	assert.Equal(t, 3, bc.OrphanCount())
+	isOrphan, err := bc.ProcessBlock(a3)
+	assert.True(t, isOrphan)
+	assertRuleError(t, err, ErrDuplicateBlock)
+	assert.Equal(t, genesis.Hash, bc.BestHash())
+
+	isOrphan, err = bc.ProcessBlock(a1)
+	require.NoError(t, err)
+	assert.False(t, isOrphan)
+	assert.Equal(t, 0, bc.OrphanCount())
+	assert.Equal(t, uint64(3), bc.BestHeight())
+	for _, b := range []*Block{a1, a2, a3, b3} {
+		_, err := bc.getBlockHeader(b.Hash)
+		assert.NoError(t, err)
+	}
+}
+
+func TestOrphanPoolLimits(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	last := bc.getLastBlock()
+	now := time.Now()
+	bc.now = func() time.Time { return now }
+	orphan := func(height uint64) *Block {
+		return mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(height))}, doubleHash256([]byte("unknown")), height, last.Bits)
+	}
+	o1, o2, o3 := orphan(5), orphan(6), orphan(7)
+	bc.MaxOrphanSize = o1.Size() + o2.Size()
+
+	// Size: the oldest orphan is evicted.
+	for _, b := range []*Block{o1, o2, o3} {
+		_, err := bc.ProcessBlock(b)
+		require.NoError(t, err)
+	}
+	assert.False(t, bc.IsOrphan(o1.Hash))
+	assert.True(t, bc.IsOrphan(o2.Hash))
+	assert.True(t, bc.IsOrphan(o3.Hash))
+
+	// Age: expired orphans are removed.
+	now = now.Add(bc.OrphanExpiry + time.Second)
+	o4 := orphan(8)
+	_, err := bc.ProcessBlock(o4)
+	require.NoError(t, err)
+	assert.Equal(t, 1, bc.OrphanCount())
+	assert.True(t, bc.IsOrphan(o4.Hash))
+}
+
+func TestOrphanTargetMustBeReachable(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	last := bc.getLastBlock()
+	// A network whose PoW limit is 16 times easier than the target of the genesis block.
+	params := *Params
+	params.PowLimit = powLimit(8)
+	old := Params
+	Params = &params
+	t.Cleanup(func() { Params = old })
+	easy := BigToCompact(powLimit(8))
+	unknown := doubleHash256([]byte("unknown"))
+
+	// The target can only get 4 times easier per retarget interval.
+	b := mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(1))}, unknown, 1, easy)
+	_, err := bc.ProcessBlock(b)
+	assertRuleError(t, err, ErrBadDifficulty)
+	assert.Equal(t, 0, bc.OrphanCount())
+
+	b = mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(25))}, unknown, 25, easy)
+	isOrphan, err := bc.ProcessBlock(b)
+	require.NoError(t, err)
+	assert.True(t, isOrphan)
+	assert.Equal(t, last.Hash, bc.BestHash())
+}
@@ -0,0 +1,150 @@
+package blockchain
+
+import (
+	"fmt"
+	"math/big"
+	"path/filepath"
+)
+
+// ChainParams defines a network: its genesis block, consensus rules, addresses and where its data lives.
+// Nodes of different networks cannot talk to each other and do not share databases or wallets.
+type ChainParams struct {
+	Name string
+
+	// Network
+	Magic       [4]byte  // start of every network message; differs from Bitcoin's, so we never talk to Bitcoin nodes
+	DefaultPort string   // port of the seed node
+	SeedNodes   []string // nodes to connect to on start up
+
+	// Version prefixes of addresses
+	PubKeyHashAddrID byte
+	ScriptHashAddrID byte
+
+	// Genesis block; the genesis reward goes to the address given when creating the blockchain.
+	GenesisData      string // data of the genesis coinbase
+	GenesisTimestamp int64
+
+	// Difficulty
+	PowLimit                 *big.Int // highest (easiest) target allowed
+	PowLimitBits             uint32   // PowLimit in compact form; target of the genesis block
+	RetargetInterval         uint64   // number of blocks after which the target is adjusted
+	TargetSpacing            int64    // desired time between two blocks in seconds
+	RetargetAdjustmentFactor int64    // limits a single adjustment of the target in either direction
+	NoRetargeting            bool     // keep the target of the genesis block forever
+	MineBlocksOnDemand       bool     // blocks can be generated with Generate()
+
+	// Coins
+	Subsidy          SubsidySchedule
+	CoinbaseMaturity uint64 // confirmations needed before coinbase outputs can be spent
+
+	// Directory of the databases and wallet files.
+	DataDir string
+}
+
+// Returns 2^(256-`zeros`).
+func powLimit(zeros uint) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), 256-zeros)
+}
+
+// MainNetParams are the parameters of the main network.
+var MainNetParams = ChainParams{
+	Name:                     "mainnet",
+	Magic:                    [4]byte{0x9c, 0x0b, 0xc5, 0xe1},
+	DefaultPort:              "3000",
+	SeedNodes:                []string{"localhost:3000"},
+	PubKeyHashAddrID:         0x00,
+	ScriptHashAddrID:         0x05,
+	GenesisData:              "The Times 03/Jan/2009: Chancellor on brink of second bailout for banks.",
+	GenesisTimestamp:         1231006505,
+	PowLimit:                 powLimit(12),
+	PowLimitBits:             BigToCompact(powLimit(12)),
+	RetargetInterval:         10,
+	TargetSpacing:            10,
+	RetargetAdjustmentFactor: 4,
+	Subsidy:                  SubsidySchedule{InitialSubsidy: 20, HalvingInterval: 210, MaxSupply: 8400},
+	CoinbaseMaturity:         10,
+	DataDir:                  "./tmp",
+}
+
+// TestNetParams are the parameters of the test network.
+// Same rules as the main network but different genesis block, ports and addresses.
+var TestNetParams = ChainParams{
+	Name:                     "testnet",
+	Magic:                    [4]byte{0x9c, 0x0b, 0xc5, 0x7e},
+	DefaultPort:              "13000",
+	SeedNodes:                []string{"localhost:13000"},
+	PubKeyHashAddrID:         0x6f,
+	ScriptHashAddrID:         0xc4,
+	GenesisData:              "gobc testnet genesis",
+	GenesisTimestamp:         1296688602,
+	PowLimit:                 powLimit(12),
+	PowLimitBits:             BigToCompact(powLimit(12)),
+	RetargetInterval:         10,
+	TargetSpacing:            10,
+	RetargetAdjustmentFactor: 4,
+	Subsidy:                  SubsidySchedule{InitialSubsidy: 20, HalvingInterval: 210, MaxSupply: 8400},
+	CoinbaseMaturity:         10,
+	DataDir:                  "./tmp/testnet",
+}
+
+// RegTestParams are the parameters of the regression test network.
+// Blocks are mined almost instantly and the difficulty never changes.
+var RegTestParams = ChainParams{
+	Name:                     "regtest",
+	Magic:                    [4]byte{0x9c, 0x0b, 0xc5, 0xa9},
+	DefaultPort:              "23000",
+	SeedNodes:                []string{"localhost:23000"},
+	PubKeyHashAddrID:         0x6f,
+	ScriptHashAddrID:         0xc4,
+	GenesisData:              "gobc regtest genesis",
+	GenesisTimestamp:         1296688602,
+	PowLimit:                 powLimit(1),
+	PowLimitBits:             BigToCompact(powLimit(1)),
+	RetargetInterval:         10,
+	TargetSpacing:            10,
+	RetargetAdjustmentFactor: 4,
+	NoRetargeting:            true,
+	MineBlocksOnDemand:       true,
+	Subsidy:                  SubsidySchedule{InitialSubsidy: 20, HalvingInterval: 150, MaxSupply: 6000},
+	CoinbaseMaturity:         10,
+	DataDir:                  "./tmp/regtest",
+}
+
+// Params are the parameters of the network we are on.
+var Params = &MainNetParams
+
+// SelectParams makes the network `name` ("mainnet", "testnet" or "regtest") the active network.
+func SelectParams(name string) error {
+	for _, params := range []*ChainParams{&MainNetParams, &TestNetParams, &RegTestParams} {
+		if params.Name == name {
+			Params = params
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown network %q", name)
+}
+
+// Returns the path of the database of node `nodeID`.
+func (p *ChainParams) dbPath(nodeID string) string {
+	return filepath.Join(p.DataDir, "blocks_"+nodeID)
+}
+
+// Returns the path of the wallet file of node `nodeID`.
+func (p *ChainParams) walletPath(nodeID string) string {
+	return filepath.Join(p.DataDir, "wallets_"+nodeID+".data")
+}
+
+// Returns the path of the file with the transactions sent by the wallets of node `nodeID`.
+func (p *ChainParams) walletTxPath(nodeID string) string {
+	return filepath.Join(p.DataDir, "wallettxs_"+nodeID+".data")
+}
+
+// Returns the path of the file with the redeem scripts of the script addresses of node `nodeID`.
+func (p *ChainParams) redeemScriptPath(nodeID string) string {
+	return filepath.Join(p.DataDir, "scripts_"+nodeID+".data")
+}
+
+// Returns the desired time for `RetargetInterval` blocks in seconds.
+func (p *ChainParams) targetTimespan() int64 {
+	return int64(p.RetargetInterval) * p.TargetSpacing
+}
@@ -0,0 +1,77 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Makes network `name` the active network for the duration of the test.
+func selectParams(t *testing.T, name string) {
+	old := Params
+	require.NoError(t, SelectParams(name))
+	t.Cleanup(func() { Params = old })
+}
+
+func TestSelectParams(t *testing.T) {
+	selectParams(t, "regtest")
+	assert.Equal(t, &RegTestParams, Params)
+	assert.Error(t, SelectParams("simnet"))
+	assert.Equal(t, &RegTestParams, Params)
+}
+
+func TestMagicIsUnique(t *testing.T) {
+	bitcoin := [][4]byte{
+		{0xf9, 0xbe, 0xb4, 0xd9}, // mainnet
+		{0x0b, 0x11, 0x09, 0x07}, // testnet3
+		{0xfa, 0xbf, 0xb5, 0xda}, // regtest
+	}
+	seen := make(map[[4]byte]bool)
+	for _, params := range []*ChainParams{&MainNetParams, &TestNetParams, &RegTestParams} {
+		assert.False(t, seen[params.Magic], params.Name)
+		assert.NotContains(t, bitcoin, params.Magic, params.Name)
+		seen[params.Magic] = true
+	}
+}
+
+func TestAddressesBelongToNetwork(t *testing.T) {
+	w := MakeWallet()
+	mainAddress := string(w.Address())
+	assert.True(t, Validate(mainAddress))
+
+	selectParams(t, "regtest")
+	regtestAddress := string(w.Address())
+	assert.NotEqual(t, mainAddress, regtestAddress)
+	assert.True(t, Validate(regtestAddress))
+	assert.False(t, Validate(mainAddress))
+	assert.Equal(t, PKHFrom([]byte(mainAddress)), PKHFrom([]byte(regtestAddress)))
+}
+
+func TestGenesisDependsOnNetwork(t *testing.T) {
+	address := string(MakeWallet().Address())
+	mainGenesis, err := genesis(CoinbaseTx(address, BlockSubsidy(0), Params.GenesisData))
+	require.NoError(t, err)
+	again, err := genesis(CoinbaseTx(address, BlockSubsidy(0), Params.GenesisData))
+	require.NoError(t, err)
+	assert.Equal(t, mainGenesis.Hash, again.Hash)
+
+	selectParams(t, "regtest")
+	regtestGenesis, err := genesis(CoinbaseTx(address, BlockSubsidy(0), Params.GenesisData))
+	require.NoError(t, err)
+	assert.NotEqual(t, mainGenesis.Hash, regtestGenesis.Hash)
+	assert.Equal(t, RegTestParams.PowLimitBits, regtestGenesis.Bits)
+	assert.Equal(t, RegTestParams.GenesisTimestamp, regtestGenesis.Timestamp)
+}
+
+func TestRegtestKeepsDifficulty(t *testing.T) {
+	selectParams(t, "regtest")
+	bc, w := newTestChain(t)
+	prev := bc.getLastBlock()
+	for i := uint64(1); i < 2*Params.RetargetInterval; i++ {
+		block, err := bc.MineBlock([]*Transaction{CoinbaseTx(string(w.Address()), BlockSubsidy(i))})
+		require.NoError(t, err)
+		assert.Equal(t, prev.Bits, block.Bits)
+		prev = block
+	}
+}
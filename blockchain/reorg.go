@@ -0,0 +1,374 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+	"github.com/mkohlhaas/gobc/bcerror"
+	"github.com/mkohlhaas/gobc/wire"
+)
+
+var (
+	// Cumulative proof of work of the chain ending in a block.
+	workPrefix = []byte("work-")
+	// Undo data of a block of the main chain.
+	undoPrefix = []byte("undo-")
+	// Blocks which failed validation while being connected, and their descendants.
+	invalidPrefix = []byte("invalid-")
+	// Last block of the main chain which could not be restored after a failed reorganization.
+	pendingTipEntry = []byte("pendingtip")
+)
+
+// spentOutput is the undo information for a transaction output spent by a block.
+type spentOutput struct {
+	TxID     Hash     // transaction ID of the spent output
+	Index    int      // index of the spent output in its transaction
+	Height   uint64   // height of the block containing the transaction
+	Coinbase bool     // true if the transaction is a coinbase
+	Output   TxOutput // the spent output itself
+}
+
+// blockUndo contains everything to disconnect a block from the UTXO set.
+type blockUndo struct {
+	Spent []spentOutput // in the order the outputs were spent in the block
+}
+
+// Serialize undo data for storing in DB.
+// Format: version, number of spent outputs, spent outputs (transaction ID, index, height, coinbase flag, output).
+func (u *blockUndo) Serialize() []byte {
+	w := wire.NewWriter()
+	w.WriteVersion()
+	w.WriteVarInt(uint64(len(u.Spent)))
+	for _, so := range u.Spent {
+		w.WriteVarBytes(so.TxID)
+		w.WriteUint32(uint32(so.Index))
+		w.WriteUint64(so.Height)
+		w.WriteBool(so.Coinbase)
+		so.Output.encode(w)
+	}
+	return w.Bytes()
+}
+
+// Deserialize undo data for retrieving from DB.
+func deserializeUndo(data []byte) (*blockUndo, error) {
+	var undo blockUndo
+	r := wire.NewReader(data)
+	r.ReadVersion()
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		undo.Spent = append(undo.Spent, spentOutput{
+			TxID:     r.ReadVarBytes(),
+			Index:    int(r.ReadUint32()),
+			Height:   r.ReadUint64(),
+			Coinbase: r.ReadBool(),
+			Output:   decodeTxOutput(r),
+		})
+	}
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("deserializing undo data: %w", err)
+	}
+	return &undo, nil
+}
+
+// Returns the database key of `hash` with `prefix`.
+func prefixedKey(prefix []byte, hash Hash) []byte {
+	return append(append([]byte{}, prefix...), hash...)
+}
+
+// Returns the cumulative proof of work of the chain ending in block `hash`.
+// Falls back to summing up the work of all blocks if it has not been stored.
+func (bc *BlockChain) chainWork(hash Hash) *big.Int {
+	work := new(big.Int)
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(prefixedKey(workPrefix, hash))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			work.SetBytes(val)
+			return nil
+		})
+	})
+	if err == nil {
+		return work
+	}
+	block, err := bc.getBlockHeader(hash)
+	bcerror.Handle(err)
+	if block.isGenesisBlock() {
+		return block.work()
+	}
+	return work.Add(bc.chainWork(block.PrevHash), block.work())
+}
+
+// Returns true if block `hash` failed validation.
+func (bc *BlockChain) isInvalid(hash Hash) bool {
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(prefixedKey(invalidPrefix, hash))
+		return err
+	})
+	return err == nil
+}
+
+// Remembers that blocks `hashes` failed validation or descend from a block which did.
+func (bc *BlockChain) markInvalid(hashes ...Hash) {
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		for _, hash := range hashes {
+			if err := txn.Set(prefixedKey(invalidPrefix, hash), []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	bcerror.Handle(err)
+}
+
+// Validates the transactions of `b` against the UTXO set, updates the UTXO set, the
+// transaction index and the height index and stores the undo data.
+func connectBlock(txn *badger.Txn, b *Block) error {
+	view := newUTXOView(txn)
+	if err := view.connectTransactions(b); err != nil {
+		return err
+	}
+	if err := view.commit(); err != nil {
+		return err
+	}
+	if err := indexTransactions(txn, b); err != nil {
+		return err
+	}
+	if err := indexHeight(txn, b); err != nil {
+		return err
+	}
+	undo := blockUndo{view.spent}
+	return txn.Set(prefixedKey(undoPrefix, b.Hash), undo.Serialize())
+}
+
+// Reverts the changes of `b` to the UTXO set with the help of the block's undo data
+// and removes the block from the transaction index and the height index.
+func disconnectBlock(txn *badger.Txn, b *Block) error {
+	item, err := txn.Get(prefixedKey(undoPrefix, b.Hash))
+	if err != nil {
+		return fmt.Errorf("no undo data for block %x: %w", b.Hash, err)
+	}
+	var undo *blockUndo
+	err = item.Value(func(val []byte) error {
+		undo, err = deserializeUndo(val)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	view := newUTXOView(txn)
+	// Walk backwards through the block; the undo data is in the order of spending.
+	next := len(undo.Spent)
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		tx := b.Transactions[i]
+		view.removeOutputs(tx)
+		if tx.IsCoinbase() {
+			continue
+		}
+		next -= len(tx.Inputs)
+		for _, so := range undo.Spent[next : next+len(tx.Inputs)] {
+			view.restoreOutput(so)
+		}
+	}
+	if err := view.commit(); err != nil {
+		return err
+	}
+	if err := unindexTransactions(txn, b); err != nil {
+		return err
+	}
+	if err := unindexHeight(txn, b); err != nil {
+		return err
+	}
+	return txn.Delete(prefixedKey(undoPrefix, b.Hash))
+}
+
+// Returns the blocks to disconnect (from the last block downwards) and the blocks to connect
+// (upwards to `newTip`) for making `newTip` the last block of the main chain.
+// Walks the headers only; the bodies are read for the returned blocks.
+func (bc *BlockChain) findFork(newTip *Block) (detach, attach []*Block) {
+	oldBlock := bc.getLastHeader()
+	newBlock := newTip
+	parent := func(b *Block) *Block {
+		prev, err := bc.getBlockHeader(b.PrevHash)
+		bcerror.Handle(err)
+		return prev
+	}
+	for newBlock.Height > oldBlock.Height {
+		attach = append([]*Block{newBlock}, attach...)
+		newBlock = parent(newBlock)
+	}
+	for oldBlock.Height > newBlock.Height {
+		detach = append(detach, oldBlock)
+		oldBlock = parent(oldBlock)
+	}
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		attach = append([]*Block{newBlock}, attach...)
+		detach = append(detach, oldBlock)
+		newBlock = parent(newBlock)
+		oldBlock = parent(oldBlock)
+	}
+	withBody := func(blocks []*Block) {
+		for i, b := range blocks {
+			if b.Transactions == nil {
+				block, err := bc.GetBlock(b.Hash)
+				bcerror.Handle(err)
+				blocks[i] = block
+			}
+		}
+	}
+	withBody(detach)
+	withBody(attach)
+	return detach, attach
+}
+
+// Makes `newTip` the last block of the main chain.
+// Disconnects the blocks of the current main chain down to the common ancestor and
+// connects the blocks of the new branch, all in one database transaction. Only if a deep
+// reorganization exceeds the size limit of transactions, it is committed in parts.
+// If a block of the new branch is invalid, it and its descendants are marked invalid and the
+// old main chain stays the main chain. If a part was committed already, the old main chain is
+// connected again; if that fails as well, it is remembered and AddBlock retries it.
+// The caller holds chainMu.
+func (bc *BlockChain) reorganize(newTip *Block) error {
+	oldTip := bc.getLastHeader()
+	detach, attach := bc.findFork(newTip)
+	for i, b := range attach {
+		if bc.isInvalid(b.Hash) {
+			bc.markInvalid(blockHashes(attach[i+1:])...)
+			return ruleError(ErrInvalidAncestor, "block %x is invalid", b.Hash)
+		}
+	}
+	if len(detach) > 0 {
+		fmt.Printf("Reorganizing: disconnecting %d and connecting %d blocks.\n", len(detach), len(attach))
+	}
+	done, err := bc.switchChain(detach, attach)
+	if err == nil {
+		bc.notify(ChainUpdate{Disconnected: detach, Connected: attach})
+		return nil
+	}
+	var ruleErr RuleError
+	if done >= len(detach) && errors.As(err, &ruleErr) {
+		bc.markInvalid(blockHashes(attach[done-len(detach):])...)
+	}
+	if bytes.Equal(bc.getLastHash(), oldTip.Hash) {
+		return err
+	}
+	// The old main chain was valid and has more work than the valid part of the new branch.
+	if _, rollbackErr := bc.switchChain(bc.findFork(oldTip)); rollbackErr != nil {
+		bc.setPendingTip(oldTip.Hash)
+		return fmt.Errorf("%w; restoring main chain %x: %v", err, oldTip.Hash, rollbackErr)
+	}
+	return err
+}
+
+// Finishes restoring the main chain after a failed reorganization, see reorganize.
+// The caller holds chainMu.
+func (bc *BlockChain) restorePendingTip() error {
+	var tip Hash
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(pendingTipEntry)
+		if err != nil {
+			return err
+		}
+		tip, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	bcerror.Handle(err)
+	if !bytes.Equal(tip, bc.getLastHash()) {
+		header, err := bc.getBlockHeader(tip)
+		bcerror.Handle(err)
+		if _, err := bc.switchChain(bc.findFork(header)); err != nil {
+			return fmt.Errorf("restoring main chain %x: %w", tip, err)
+		}
+	}
+	fmt.Printf("Restored main chain %x.\n", tip)
+	bc.setPendingTip(nil)
+	return nil
+}
+
+// Remembers `tip` as the last block of the main chain to be restored; nil forgets it.
+func (bc *BlockChain) setPendingTip(tip Hash) {
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		if tip == nil {
+			return txn.Delete(pendingTipEntry)
+		}
+		return txn.Set(pendingTipEntry, tip)
+	})
+	bcerror.Handle(err)
+}
+
+// Disconnects the last blocks `detach` (from the last block downwards) and connects `attach`.
+// Returns the number of blocks which were switched before an error.
+func (bc *BlockChain) switchChain(detach, attach []*Block) (int, error) {
+	steps := make([]func(txn *badger.Txn) error, 0, len(detach)+len(attach))
+	for _, b := range detach {
+		steps = append(steps, disconnectTip(b))
+	}
+	for _, b := range attach {
+		steps = append(steps, connectTip(b))
+	}
+	done := 0
+	for done < len(steps) {
+		n, err := bc.commitSteps(steps[done:])
+		if err != nil {
+			return done + n, err
+		}
+		done += n
+	}
+	return done, nil
+}
+
+// Runs as many of `steps` as fit into one database transaction and commits them.
+// Returns the number of committed steps, or the number of successful steps and the error of the failing one.
+// Nothing is committed if a step fails.
+func (bc *BlockChain) commitSteps(steps []func(txn *badger.Txn) error) (int, error) {
+	txn := bc.Database.NewTransaction(true)
+	defer txn.Discard()
+	for i, step := range steps {
+		err := step(txn)
+		if errors.Is(err, badger.ErrTxnTooBig) && i > 0 {
+			// The transaction contains part of the failed step; commit the steps before it from scratch.
+			txn.Discard()
+			return bc.commitSteps(steps[:i])
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(steps), txn.Commit()
+}
+
+// Returns a step connecting `b` on top of the last block and making it the last block.
+func connectTip(b *Block) func(txn *badger.Txn) error {
+	return func(txn *badger.Txn) error {
+		if err := connectBlock(txn, b); err != nil {
+			return err
+		}
+		return txn.Set(lastHashEntry, b.Hash)
+	}
+}
+
+// Returns a step disconnecting the last block `b` and making its previous block the last block.
+func disconnectTip(b *Block) func(txn *badger.Txn) error {
+	return func(txn *badger.Txn) error {
+		if err := disconnectBlock(txn, b); err != nil {
+			return err
+		}
+		return txn.Set(lastHashEntry, b.PrevHash)
+	}
+}
+
+// Returns the hashes of `blocks`.
+func blockHashes(blocks []*Block) []Hash {
+	hashes := make([]Hash, len(blocks))
+	for i, b := range blocks {
+		hashes[i] = b.Hash
+	}
+	return hashes
+}
@@ -0,0 +1,266 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns all unspent outputs stored in the UTXO set as a map: "transaction ID:index" -> value.
+func storedUTXOs(t *testing.T, bc *BlockChain) map[string]int {
+	snapshot := make(map[string]int)
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+			txID := bytes.TrimPrefix(it.Item().Key(), utxoPrefix)
+			err := it.Item().Value(func(val []byte) error {
+				for i, out := range deserializeOutputs(val).Outputs {
+					if !out.isNull() {
+						snapshot[fmt.Sprintf("%x:%d", txID, i)] = out.Value
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return snapshot
+}
+
+// Mines a block on top of `prev` without touching the blockchain.
+// The block is stamped after `prev`, so it is after the median time past of a chain of mined blocks.
+func mineOn(t *testing.T, prev *Block, txs ...*Transaction) *Block {
+	b, err := createBlockAt(nextBlockTime(prev.Timestamp), txs, prev.Hash, prev.Height+1, prev.Bits)
+	require.NoError(t, err)
+	return b
+}
+
+func TestReorganizeToChainWithMoreWork(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	genesis := bc.getLastBlock()
+	initial := storedUTXOs(t, bc)
+
+	// Main chain: genesis - a1 (spends the genesis output).
+	tx := newTestTransaction(t, w, string(MakeWallet().Address()), 5, 0, &UTXOSet{bc})
+	a1, err := bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)), tx})
+	require.NoError(t, err)
+	afterA1 := storedUTXOs(t, bc)
+
+	// Side chain with the same work does not replace the main chain.
+	b1 := mineOn(t, genesis, CoinbaseTx(address, BlockSubsidy(1)))
+	require.NoError(t, bc.AddBlock(b1))
+	assert.Equal(t, a1.Hash, bc.getLastHash())
+
+	// Side chain with more work does.
+	b2 := mineOn(t, b1, CoinbaseTx(address, BlockSubsidy(1)))
+	require.NoError(t, bc.AddBlock(b2))
+	assert.Equal(t, b2.Hash, bc.getLastHash())
+	utxos := storedUTXOs(t, bc)
+	for outpoint, value := range initial {
+		assert.Equal(t, value, utxos[outpoint], "genesis output must be unspent again")
+	}
+	assert.Len(t, utxos, 3)
+
+	// UTXO set after the reorganization is the same as a freshly indexed one.
+	UTXOSet{bc}.Reindex()
+	assert.Equal(t, utxos, storedUTXOs(t, bc))
+
+	// Back to the first chain; the transaction is connected again.
+	a2 := mineOn(t, a1, CoinbaseTx(address, BlockSubsidy(1)))
+	require.NoError(t, bc.AddBlock(a2))
+	assert.Equal(t, b2.Hash, bc.getLastHash())
+	a3 := mineOn(t, a2, CoinbaseTx(address, BlockSubsidy(1)))
+	require.NoError(t, bc.AddBlock(a3))
+	assert.Equal(t, a3.Hash, bc.getLastHash())
+	utxos = storedUTXOs(t, bc)
+	for outpoint, value := range afterA1 {
+		assert.Equal(t, value, utxos[outpoint])
+	}
+	UTXOSet{bc}.Reindex()
+	assert.Equal(t, utxos, storedUTXOs(t, bc))
+}
+
+func TestReorganizeRejectsInvalidBranch(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	genesis := bc.getLastBlock()
+	a1, err := bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1))})
+	require.NoError(t, err)
+
+	// Side chain whose first block pays too much.
+	cb := CoinbaseTx(address, BlockSubsidy(1)+1)
+	b1 := mineOn(t, genesis, cb)
+	require.NoError(t, bc.AddBlock(b1))
+	b2 := mineOn(t, b1, CoinbaseTx(address, BlockSubsidy(1)))
+	assertRuleError(t, bc.AddBlock(b2), ErrBadCoinbaseValue)
+	assert.Equal(t, a1.Hash, bc.getLastHash())
+
+	// Descendants of invalid blocks are rejected right away.
+	b3 := mineOn(t, b2, CoinbaseTx(address, BlockSubsidy(1)))
+	assert.True(t, bc.isInvalid(b1.Hash))
+	assertRuleError(t, bc.AddBlock(b3), ErrInvalidAncestor)
+}
+
+func TestReorganizeRestoresMainChain(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	genesis := bc.getLastBlock()
+	tx := newTestTransaction(t, w, string(MakeWallet().Address()), 5, 0, &UTXOSet{bc})
+	_, err := bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)), tx})
+	require.NoError(t, err)
+	a2, err := bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(2))})
+	require.NoError(t, err)
+	before := storedUTXOs(t, bc)
+
+	// The second block of the side chain pays too much; the reorganization fails there.
+	b1 := mineOn(t, genesis, CoinbaseTx(address, BlockSubsidy(1), "b1"))
+	b2 := mineOn(t, b1, CoinbaseTx(address, BlockSubsidy(2)+1, "b2"))
+	b3 := mineOn(t, b2, CoinbaseTx(address, BlockSubsidy(3), "b3"))
+	require.NoError(t, bc.AddBlock(b1))
+	require.NoError(t, bc.AddBlock(b2))
+	assertRuleError(t, bc.AddBlock(b3), ErrBadCoinbaseValue)
+	assert.Equal(t, a2.Hash, bc.getLastHash())
+	assert.Equal(t, before, storedUTXOs(t, bc))
+	assert.False(t, bc.isInvalid(b1.Hash))
+	assert.True(t, bc.isInvalid(b2.Hash))
+	assert.True(t, bc.isInvalid(b3.Hash), "descendants are invalid as well")
+
+	// Blocks on top of the invalid branch are rejected right away.
+	b4 := mineOn(t, b3, CoinbaseTx(address, BlockSubsidy(4), "b4"))
+	assertRuleError(t, bc.AddBlock(b4), ErrInvalidAncestor)
+	assert.Equal(t, a2.Hash, bc.getLastHash())
+}
+
+func TestConcurrentAddBlock(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	genesis := bc.getLastBlock()
+	branch := func(n int, data string) []*Block {
+		blocks := []*Block{genesis}
+		for i := 1; i <= n; i++ {
+			blocks = append(blocks, mineOn(t, blocks[i-1], CoinbaseTx(address, BlockSubsidy(uint64(i)), fmt.Sprintf("%s%d", data, i))))
+		}
+		return blocks[1:]
+	}
+	a, b := branch(3, "a"), branch(4, "b")
+
+	// Every update continues from the last block of the previous one.
+	tip := genesis.Hash
+	bc.Subscribe(func(update ChainUpdate) {
+		if len(update.Disconnected) > 0 {
+			assert.Equal(t, tip, update.Disconnected[0].Hash)
+		} else {
+			assert.Equal(t, tip, update.Connected[0].PrevHash)
+		}
+		tip = update.Connected[len(update.Connected)-1].Hash
+	})
+	var wg sync.WaitGroup
+	for _, blocks := range [][]*Block{a, b} {
+		wg.Add(1)
+		go func(blocks []*Block) {
+			defer wg.Done()
+			for _, block := range blocks {
+				assert.NoError(t, bc.AddBlock(block))
+			}
+		}(blocks)
+	}
+	wg.Wait()
+	assert.Equal(t, b[3].Hash, bc.getLastHash())
+	assert.Equal(t, b[3].Hash, tip)
+	utxos := storedUTXOs(t, bc)
+	UTXOSet{bc}.Reindex()
+	assert.Equal(t, utxos, storedUTXOs(t, bc))
+}
+
+func TestCommitStepsSplitsBigTransactions(t *testing.T) {
+	bc, _ := newTestChain(t)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("step-%d", i)) }
+	tooBig := true
+	steps := make([]func(txn *badger.Txn) error, 4)
+	for i := range steps {
+		i := i
+		steps[i] = func(txn *badger.Txn) error {
+			if err := txn.Set(key(i), []byte{}); err != nil {
+				return err
+			}
+			if i == 2 && tooBig {
+				tooBig = false
+				return badger.ErrTxnTooBig
+			}
+			return nil
+		}
+	}
+	exists := func(i int) bool {
+		return bc.Database.View(func(txn *badger.Txn) error {
+			_, err := txn.Get(key(i))
+			return err
+		}) == nil
+	}
+
+	// The steps before the one exceeding the limit are committed, the others are not.
+	n, err := bc.commitSteps(steps)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.True(t, exists(0) && exists(1))
+	assert.False(t, exists(2))
+	n, err = bc.commitSteps(steps[n:])
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.True(t, exists(2) && exists(3))
+
+	// Nothing is committed if a step fails.
+	failing := errors.New("failing step")
+	n, err = bc.commitSteps([]func(txn *badger.Txn) error{
+		func(txn *badger.Txn) error { return txn.Set(key(4), []byte{}) },
+		func(txn *badger.Txn) error { return failing },
+	})
+	assert.ErrorIs(t, err, failing)
+	assert.Equal(t, 1, n)
+	assert.False(t, exists(4))
+}
+
+func TestAddBlockRestoresPendingTip(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	genesis := bc.getLastBlock()
+	tx := newTestTransaction(t, w, string(MakeWallet().Address()), 5, 0, &UTXOSet{bc})
+	_, err := bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)), tx})
+	require.NoError(t, err)
+	a2, err := bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(2))})
+	require.NoError(t, err)
+	before := storedUTXOs(t, bc)
+
+	// A reorganization committed in parts failed and the old main chain could not be restored:
+	// the last block is on the side chain.
+	b1 := mineOn(t, genesis, CoinbaseTx(address, BlockSubsidy(1), "b1"))
+	require.NoError(t, bc.AddBlock(b1))
+	_, err = bc.switchChain(bc.findFork(b1))
+	require.NoError(t, err)
+	bc.setPendingTip(a2.Hash)
+	require.Equal(t, b1.Hash, bc.getLastHash())
+
+	// The next block restores the main chain first.
+	a3 := mineOn(t, a2, CoinbaseTx(address, BlockSubsidy(3), "a3"))
+	require.NoError(t, bc.AddBlock(a3))
+	assert.Equal(t, a3.Hash, bc.getLastHash())
+	utxos := storedUTXOs(t, bc)
+	for outpoint, value := range before {
+		assert.Equal(t, value, utxos[outpoint])
+	}
+	UTXOSet{bc}.Reindex()
+	assert.Equal(t, utxos, storedUTXOs(t, bc))
+	require.NoError(t, bc.restorePendingTip(), "the main chain is restored only once")
+	assert.Equal(t, a3.Hash, bc.getLastHash())
+}
@@ -0,0 +1,128 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+
+	"github.com/mkohlhaas/gobc/bcerror"
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/mkohlhaas/gobc/wire"
+)
+
+// SigHashType selects the parts of a transaction a signature commits to.
+// It is appended to the signature as a single byte.
+type SigHashType byte
+
+// Signature hash types like in Bitcoin. SigHashAnyOneCanPay is combined with one of the others.
+const (
+	SigHashAll          SigHashType = 0x01 // all inputs and outputs
+	SigHashNone         SigHashType = 0x02 // all inputs, no outputs: anybody may choose the outputs
+	SigHashSingle       SigHashType = 0x03 // all inputs and the output with the index of the signed input
+	SigHashAnyOneCanPay SigHashType = 0x80 // only the signed input: others may add inputs
+)
+
+// Size of a signature: r and s of 32 bytes each and the hash type.
+const sigSize = 65
+
+// Returns true if `t` is a defined hash type. Signatures with other hash types are invalid.
+func (t SigHashType) isValid() bool {
+	base := t &^ SigHashAnyOneCanPay
+	return base >= SigHashAll && base <= SigHashSingle
+}
+
+// Returns the hash signed for input `index` with hash type `hashType`, where `subScript` is the script checking
+// the signature and `value` the value of the spent output. The layout follows BIP 143 with the binary encoding
+// of package wire; the hash is the Double SHA256 hash of:
+//
+//   - hash of the outpoints (ID, output index) of all inputs, zero with SigHashAnyOneCanPay
+//   - hash of the sequence numbers of all inputs, zero unless SigHashAll without SigHashAnyOneCanPay
+//   - outpoint of the input, `subScript`, `value` (8 bytes) and sequence number of the input
+//   - hash of all outputs with SigHashAll, of the output `index` with SigHashSingle, zero otherwise
+//   - lock time and hash type (4 bytes each)
+//
+// Unlocking scripts are not signed; they cannot change the transaction ID either.
+func (tx *Transaction) signatureHash(index int, subScript script.Script, value int, hashType SigHashType) []byte {
+	zero := make([]byte, 32)
+	base := hashType &^ SigHashAnyOneCanPay
+	anyOneCanPay := hashType&SigHashAnyOneCanPay != 0
+
+	hashPrevouts, hashSequence, hashOutputs := zero, zero, zero
+	if !anyOneCanPay {
+		w := wire.NewWriter()
+		for _, in := range tx.Inputs {
+			w.WriteVarBytes(in.ID)
+			w.WriteUint32(uint32(in.Out))
+		}
+		hashPrevouts = doubleHash256(w.Bytes())
+	}
+	if !anyOneCanPay && base == SigHashAll {
+		w := wire.NewWriter()
+		for _, in := range tx.Inputs {
+			w.WriteUint32(in.Sequence)
+		}
+		hashSequence = doubleHash256(w.Bytes())
+	}
+	if base == SigHashAll {
+		w := wire.NewWriter()
+		for i := range tx.Outputs {
+			tx.Outputs[i].encode(w)
+		}
+		hashOutputs = doubleHash256(w.Bytes())
+	} else if base == SigHashSingle && index < len(tx.Outputs) {
+		w := wire.NewWriter()
+		tx.Outputs[index].encode(w)
+		hashOutputs = doubleHash256(w.Bytes())
+	}
+
+	in := tx.Inputs[index]
+	w := wire.NewWriter()
+	w.WriteFixedBytes(hashPrevouts, 32)
+	w.WriteFixedBytes(hashSequence, 32)
+	w.WriteVarBytes(in.ID)
+	w.WriteUint32(uint32(in.Out))
+	w.WriteVarBytes(subScript)
+	w.WriteInt64(int64(value))
+	w.WriteUint32(in.Sequence)
+	w.WriteFixedBytes(hashOutputs, 32)
+	w.WriteUint32(tx.LockTime)
+	w.WriteUint32(uint32(hashType))
+	return doubleHash256(w.Bytes())
+}
+
+// Returns the signature of input `index` by `privKey` where `subScript` is the script checking the signature
+// and `value` the value of the spent output.
+// Format: r||s (32 bytes each) with s in the lower half of the curve order, and the hash type.
+func (tx *Transaction) signInput(privKey ecdsa.PrivateKey, index int, subScript script.Script, value int, hashType SigHashType) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, tx.signatureHash(index, subScript, value, hashType))
+	bcerror.Handle(err)
+	// (r, N-s) is valid as well; only the low one is accepted, so nobody can change a signature.
+	if n := privKey.Curve.Params().N; s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		s.Sub(n, s)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return append(sig, byte(hashType))
+}
+
+// Returns true if `sig` is a valid signature of the hash of input `index` with the hash type of the signature.
+func (tx *Transaction) checkSig(index int, sig, pubKey []byte, subScript script.Script, value int) bool {
+	if len(sig) != sigSize || len(pubKey) != 64 {
+		return false
+	}
+	hashType := SigHashType(sig[64])
+	if !hashType.isValid() {
+		return false
+	}
+	curve := elliptic.P256()
+	x, y := new(big.Int).SetBytes(pubKey[:32]), new(big.Int).SetBytes(pubKey[32:])
+	if !curve.IsOnCurve(x, y) {
+		return false
+	}
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:64])
+	if s.Cmp(new(big.Int).Rsh(curve.Params().N, 1)) > 0 {
+		return false
+	}
+	rawPubKey := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	return ecdsa.Verify(&rawPubKey, tx.signatureHash(index, subScript, value, hashType), r, s)
+}
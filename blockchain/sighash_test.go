@@ -0,0 +1,130 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignatureHashGoldenVector(t *testing.T) {
+	dh := func(parts ...string) string {
+		data, err := hex.DecodeString(strings.Join(parts, ""))
+		require.NoError(t, err)
+		return hex.EncodeToString(doubleHash256(data))
+	}
+	zero := strings.Repeat("00", 32)
+	outpoint := "03010203" + "01000000"
+	outputs := []string{"0500000000000000" + "0171", "ffffffffffffffff" + "00"}
+	tx := goldenTransaction()
+
+	preimage := dh(outpoint) + dh("fdffffff") + // outpoints, sequence numbers
+		outpoint + "0171" + "0700000000000000" + "fdffffff" + // input with script and value
+		dh(outputs...) + "04030201" + "01000000" // outputs, lock time, hash type
+	assert.Equal(t, dh(preimage), hex.EncodeToString(tx.signatureHash(0, script.Script{0x71}, 7, SigHashAll)))
+
+	preimage = zero + zero + outpoint + "0171" + "0700000000000000" + "fdffffff" + dh(outputs[0]) + "04030201" + "83000000"
+	assert.Equal(t, dh(preimage), hex.EncodeToString(tx.signatureHash(0, script.Script{0x71}, 7, SigHashSingle|SigHashAnyOneCanPay)))
+}
+
+// Returns a transaction spending outputs 0 and 1 of `prev` to two outputs. Input 0 is signed with `hashType`.
+func newSigHashTestTx(w *Wallet, prev *Transaction, hashType SigHashType) *Transaction {
+	to := string(MakeWallet().Address())
+	tx := &Transaction{
+		Inputs:  []TxInput{{ID: prev.ID, Out: 0, Sequence: MaxRBFSequence}, {ID: prev.ID, Out: 1, Sequence: MaxRBFSequence}},
+		Outputs: []TxOutput{*newTXOutput(8, to), *newTXOutput(9, to)},
+	}
+	tx.ID = tx.calcTransactionID()
+	tx.SignInput(w.PrivateKey, 0, prev.Outputs[0], hashType)
+	return tx
+}
+
+// Returns true if input 0 of `tx` validly spends output 0 of `prev`.
+func input0Valid(tx, prev *Transaction) bool {
+	out := prev.Outputs[0]
+	return script.Verify(tx.Inputs[0].ScriptSig, out.ScriptPubKey, txSigChecker{tx, 0, out.Value}) == nil
+}
+
+func TestSigHashTypes(t *testing.T) {
+	w := MakeWallet()
+	address := string(w.Address())
+	prev := &Transaction{
+		Inputs:  []TxInput{{Out: noIndex}},
+		Outputs: []TxOutput{*newTXOutput(10, address), *newTXOutput(10, address), *newTXOutput(10, address)},
+	}
+	prev.ID = prev.calcTransactionID()
+	extraInput := TxInput{ID: prev.ID, Out: 2, Sequence: MaxRBFSequence}
+	extraOutput := *newTXOutput(1, address)
+
+	tests := []struct {
+		name     string
+		hashType SigHashType
+		change   func(tx *Transaction)
+		valid    bool
+	}{
+		{"all", SigHashAll, func(tx *Transaction) {}, true},
+		{"all: output", SigHashAll, func(tx *Transaction) { tx.Outputs[1].Value++ }, false},
+		{"all: sequence", SigHashAll, func(tx *Transaction) { tx.Inputs[1].Sequence-- }, false},
+		{"all: lock time", SigHashAll, func(tx *Transaction) { tx.LockTime = 1 }, false},
+		{"all: input", SigHashAll, func(tx *Transaction) { tx.Inputs = append(tx.Inputs, extraInput) }, false},
+		{"none: outputs", SigHashNone, func(tx *Transaction) { tx.Outputs = []TxOutput{extraOutput} }, true},
+		{"none: sequence", SigHashNone, func(tx *Transaction) { tx.Inputs[1].Sequence-- }, true},
+		{"none: input", SigHashNone, func(tx *Transaction) { tx.Inputs[1].Out = 2 }, false},
+		{"single: other output", SigHashSingle, func(tx *Transaction) { tx.Outputs[1].Value++ }, true},
+		{"single: own output", SigHashSingle, func(tx *Transaction) { tx.Outputs[0].Value++ }, false},
+		{"anyonecanpay: inputs", SigHashAll | SigHashAnyOneCanPay, func(tx *Transaction) { tx.Inputs[1] = extraInput }, true},
+		{"anyonecanpay: output", SigHashAll | SigHashAnyOneCanPay, func(tx *Transaction) { tx.Outputs[1].Value++ }, false},
+		{"single|anyonecanpay", SigHashSingle | SigHashAnyOneCanPay, func(tx *Transaction) {
+			tx.Inputs = append(tx.Inputs, extraInput)
+			tx.Outputs = append(tx.Outputs, extraOutput)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := newSigHashTestTx(w, prev, tt.hashType)
+			tt.change(tx)
+			assert.Equal(t, tt.valid, input0Valid(tx, prev))
+		})
+	}
+}
+
+func TestSignatureMalleability(t *testing.T) {
+	w := MakeWallet()
+	prev := &Transaction{
+		Inputs:  []TxInput{{Out: noIndex}},
+		Outputs: []TxOutput{*newTXOutput(10, string(w.Address())), *newTXOutput(10, string(w.Address()))},
+	}
+	prev.ID = prev.calcTransactionID()
+	tx := newSigHashTestTx(w, prev, SigHashAll)
+	require.True(t, input0Valid(tx, prev))
+	data := tx.Inputs[0].ScriptSig.PushedData()
+	sig, pubKey := data[0], data[1]
+	require.Len(t, sig, sigSize)
+
+	withSig := func(sig []byte) *Transaction {
+		changed := *tx
+		changed.Inputs = append([]TxInput{}, tx.Inputs...)
+		changed.Inputs[0].ScriptSig = script.SignatureScript(sig, pubKey)
+		return &changed
+	}
+	// The same signature with s replaced by N-s.
+	n := w.PrivateKey.Curve.Params().N
+	highS := new(big.Int).Sub(n, new(big.Int).SetBytes(sig[32:64]))
+	malleated := append(append(append([]byte{}, sig[:32]...), highS.FillBytes(make([]byte, 32))...), sig[64])
+	assert.False(t, input0Valid(withSig(malleated), prev), "high s")
+	assert.False(t, input0Valid(withSig(sig[:64]), prev), "no hash type")
+	for _, hashType := range []byte{0x00, 0x04, 0x80} {
+		changed := append(append([]byte{}, sig[:64]...), hashType)
+		assert.False(t, input0Valid(withSig(changed), prev), "hash type %x", hashType)
+	}
+
+	// The signature commits to the value of the spent output.
+	lower := *prev
+	lower.Outputs = append([]TxOutput{}, prev.Outputs...)
+	lower.Outputs[0].Value = 9
+	assert.False(t, input0Valid(tx, &lower))
+}
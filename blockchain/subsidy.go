@@ -0,0 +1,53 @@
+package blockchain
+
+// SubsidySchedule defines how many new coins the coinbase transaction of a block may mint.
+// The subsidy starts at `InitialSubsidy` and is halved every `HalvingInterval` blocks
+// until it is zero. No more than `MaxSupply` coins are minted altogether.
+type SubsidySchedule struct {
+	InitialSubsidy  int
+	HalvingInterval uint64
+	MaxSupply       int
+}
+
+// Returns the subsidy of a block at `height` without the cap of the max supply.
+func (s SubsidySchedule) halvedSubsidy(height uint64) int {
+	halvings := height / s.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return s.InitialSubsidy >> halvings
+}
+
+// Supply returns the number of coins minted by the blocks below `height`.
+func (s SubsidySchedule) Supply(height uint64) int {
+	supply := 0
+	for start := uint64(0); start < height; start += s.HalvingInterval {
+		subsidy := s.halvedSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+		blocks := s.HalvingInterval
+		if height-start < blocks {
+			blocks = height - start
+		}
+		supply += subsidy * int(blocks)
+		if supply >= s.MaxSupply {
+			return s.MaxSupply
+		}
+	}
+	return supply
+}
+
+// BlockSubsidy returns the number of new coins the block at `height` may mint.
+func (s SubsidySchedule) BlockSubsidy(height uint64) int {
+	subsidy := s.halvedSubsidy(height)
+	if left := s.MaxSupply - s.Supply(height); subsidy > left {
+		return left
+	}
+	return subsidy
+}
+
+// BlockSubsidy returns the number of new coins the block at `height` of the active network may mint.
+func BlockSubsidy(height uint64) int {
+	return Params.Subsidy.BlockSubsidy(height)
+}
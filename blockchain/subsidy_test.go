@@ -0,0 +1,73 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubsidySchedule(t *testing.T) {
+	s := SubsidySchedule{InitialSubsidy: 50, HalvingInterval: 10, MaxSupply: 1000}
+	assert.Equal(t, 50, s.BlockSubsidy(0))
+	assert.Equal(t, 50, s.BlockSubsidy(9))
+	assert.Equal(t, 25, s.BlockSubsidy(10))
+	assert.Equal(t, 12, s.BlockSubsidy(20))
+	assert.Equal(t, 500+250+120, s.Supply(30))
+	assert.Equal(t, 0, s.BlockSubsidy(10*64))
+
+	// The max supply caps the subsidy.
+	s.MaxSupply = 520
+	assert.Equal(t, 20, s.BlockSubsidy(10))
+	assert.Equal(t, 520, s.Supply(12))
+	assert.Equal(t, 0, s.BlockSubsidy(12))
+}
+
+func TestCoinbaseCollectsFees(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	tx := newTestTransaction(t, w, string(MakeWallet().Address()), 5, 3, &UTXOSet{bc})
+	fee, err := bc.CalcFee(tx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, fee)
+
+	last := bc.getLastBlock()
+	b := mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(1)+fee+1), tx}, last.Hash, 1, last.Bits)
+	assertRuleError(t, bc.AddBlock(b), ErrBadCoinbaseValue)
+	_, err = bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)+fee), tx})
+	require.NoError(t, err)
+	balance := 0
+	for _, out := range (UTXOSet{bc}).FindUnspentTransactions(script.PayToPubKeyHash(PublicKeyHash(w.PublicKey))) {
+		balance += out.Value
+	}
+	assert.Equal(t, BlockSubsidy(0)-5-fee+BlockSubsidy(1)+fee, balance)
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	utxo := &UTXOSet{bc}
+	tx := newTestTransaction(t, w, string(MakeWallet().Address()), 5, 0, utxo)
+	setCoinbaseMaturity(t, 2)
+
+	// The genesis coinbase has one confirmation in block 1.
+	acc, _ := utxo.FindSpendableOutputs(script.PayToPubKeyHash(PublicKeyHash(w.PublicKey)), 5)
+	assert.Equal(t, 0, acc)
+	_, err := bc.CheckTransaction(tx, nil)
+	assertRuleError(t, err, ErrImmatureSpend)
+	last := bc.getLastBlock()
+	b := mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(1)), tx}, last.Hash, 1, last.Bits)
+	assertRuleError(t, bc.AddBlock(b), ErrImmatureSpend)
+
+	// In block 2 the genesis coinbase has matured.
+	_, err = bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1))})
+	require.NoError(t, err)
+	acc, _ = utxo.FindSpendableOutputs(script.PayToPubKeyHash(PublicKeyHash(w.PublicKey)), 5)
+	assert.Equal(t, BlockSubsidy(0), acc)
+	fee, err := bc.CheckTransaction(tx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, fee)
+	_, err = bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(2)), tx})
+	require.NoError(t, err)
+}
@@ -0,0 +1,403 @@
+package blockchain
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	// MaxBlockSize is the maximum size of a serialized block in bytes.
+	MaxBlockSize = 1000000
+	// WitnessScaleFactor is the weight of a byte. Our transactions have no witness data,
+	// so every byte weighs the same.
+	WitnessScaleFactor = 4
+	// MaxBlockWeight is the maximum weight of a block.
+	MaxBlockWeight = MaxBlockSize * WitnessScaleFactor
+)
+
+// Limits of the block templates we create. Miners may choose to create smaller blocks.
+var (
+	BlockMaxSize   = MaxBlockSize
+	BlockMaxWeight = MaxBlockWeight
+)
+
+// Size returns the size of the serialized transaction in bytes.
+func (tx *Transaction) Size() int {
+	return len(tx.Serialize())
+}
+
+// Weight returns the weight of the transaction.
+func (tx *Transaction) Weight() int {
+	return tx.Size() * WitnessScaleFactor
+}
+
+// Size returns the size of the serialized block in bytes.
+func (b *Block) Size() int {
+	return len(b.Serialize())
+}
+
+// Weight returns the weight of the block.
+func (b *Block) Weight() int {
+	return b.Size() * WitnessScaleFactor
+}
+
+// BlockTemplate is a block without proof of work.
+// The coinbase is the first transaction and pays the block subsidy plus all fees.
+type BlockTemplate struct {
+	Block   *Block
+	Fees    []int   // fee of every transaction; the coinbase has none
+	Depends [][]int // indexes of the transactions in the block every transaction spends outputs of
+}
+
+// TotalFees returns the fees of all transactions of the template.
+func (t *BlockTemplate) TotalFees() int {
+	total := 0
+	for _, fee := range t.Fees {
+		total += fee
+	}
+	return total
+}
+
+// A transaction of the memory pool competing for a place in the block template.
+// Its package consists of the transaction and its ancestors which are not in the block yet.
+type templateEntry struct {
+	tx        *Transaction
+	id        string
+	fee       int
+	size      int
+	parents   []*templateEntry        // unconfirmed transactions this transaction spends outputs of
+	children  []*templateEntry        // unconfirmed transactions spending outputs of this transaction
+	ancestors map[*templateEntry]bool // ancestors which are not in the block yet
+	pkgFee    int                     // fee of the package
+	pkgSize   int                     // size of the package
+	order     int                     // parents have a lower order than their children
+	index     int                     // position in the templateQueue; -1 if not queued
+}
+
+// Returns the package of the entry. Ancestors come first.
+func (e *templateEntry) pkg() []*templateEntry {
+	pkg := make([]*templateEntry, 0, len(e.ancestors)+1)
+	for a := range e.ancestors {
+		pkg = append(pkg, a)
+	}
+	sort.Slice(pkg, func(i, j int) bool { return pkg[i].order < pkg[j].order })
+	return append(pkg, e)
+}
+
+// Adds the descendants of the entry to `descendants`.
+func (e *templateEntry) collectDescendants(descendants map[*templateEntry]bool) {
+	for _, c := range e.children {
+		if !descendants[c] {
+			descendants[c] = true
+			c.collectDescendants(descendants)
+		}
+	}
+}
+
+// templateQueue is a heap of template entries; the package with the highest fee rate comes first.
+// Ties are broken by the transaction ID.
+type templateQueue []*templateEntry
+
+func (q templateQueue) Len() int { return len(q) }
+
+func (q templateQueue) Less(i, j int) bool {
+	a, b := q[i], q[j]
+	return higherFeeRate(a.pkgFee, a.pkgSize, b.pkgFee, b.pkgSize) ||
+		(!higherFeeRate(b.pkgFee, b.pkgSize, a.pkgFee, a.pkgSize) && a.id < b.id)
+}
+
+func (q templateQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *templateQueue) Push(x any) {
+	e := x.(*templateEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *templateQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
+
+// Removes `e` and all its descendants from the queue.
+func (q *templateQueue) remove(e *templateEntry) {
+	if e.index < 0 {
+		return
+	}
+	heap.Remove(q, e.index)
+	for _, c := range e.children {
+		q.remove(c)
+	}
+}
+
+// Takes `e`, which was added to the block, out of the queue and out of the packages of its descendants.
+func (q *templateQueue) included(e *templateEntry) {
+	if e.index >= 0 {
+		heap.Remove(q, e.index)
+	}
+	descendants := make(map[*templateEntry]bool)
+	e.collectDescendants(descendants)
+	for d := range descendants {
+		if d.index < 0 {
+			continue
+		}
+		delete(d.ancestors, e)
+		d.pkgFee -= e.fee
+		d.pkgSize -= e.size
+		heap.Fix(q, d.index)
+	}
+}
+
+// Returns true if a package with `fee1` and `size1` pays a higher fee rate than a package with `fee2` and `size2`.
+func higherFeeRate(fee1, size1, fee2, size2 int) bool {
+	return fee1*size2 > fee2*size1
+}
+
+// NewBlockTemplate assembles a block on top of the last block with transactions from `pool`.
+// Transactions are selected by the fee rate of their package, i.e. the transaction together with
+// its ancestors in `pool` which are not in the block yet. Parents always precede their children.
+// Invalid and conflicting transactions are left out. The block respects BlockMaxSize and BlockMaxWeight.
+// The coinbase pays the block subsidy and the fees to `address`.
+func (bc *BlockChain) NewBlockTemplate(address string, pool []*Transaction) (*BlockTemplate, error) {
+	if !Validate(address) {
+		return nil, fmt.Errorf("invalid address %s", address)
+	}
+	last := bc.getLastHeader()
+	height := last.Height + 1
+	data := randomString() // coinbase data
+	var t *BlockTemplate
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		medianTime, err := medianTimePast(txn, last.Hash)
+		if err != nil {
+			return err
+		}
+		view := newUTXOView(txn)
+		queue := newTemplateQueue(view, pool)
+		// The coinbase value is not known yet; reserve the space of the coinbase.
+		coinbase := CoinbaseTx(address, 0, data)
+		b := newBlock(nextBlockTime(medianTime), []*Transaction{coinbase}, last.Hash, height, bc.calcNextRequiredBits(last))
+		size := b.Size() + 16 // room for a larger transaction count and an extra-nonce
+		t = &BlockTemplate{Block: b, Fees: []int{0}, Depends: [][]int{nil}}
+		index := map[string]int{} // position of the transactions in the block
+		for queue.Len() > 0 {
+			// The package with the highest fee rate.
+			best := (*queue)[0]
+			if size+best.pkgSize > BlockMaxSize || (size+best.pkgSize)*WitnessScaleFactor > BlockMaxWeight {
+				queue.remove(best) // does not fit; a smaller package might
+				continue
+			}
+			for _, e := range best.pkg() {
+				fee, err := view.checkTransactionInputs(e.tx, height, medianTime, true)
+				if err != nil {
+					// Neither this transaction nor its descendants can be included.
+					queue.remove(e)
+					break
+				}
+				view.spendInputs(e.tx)
+				view.addOutputs(e.tx, height)
+				var depends []int
+				for _, p := range e.parents {
+					depends = append(depends, index[p.id])
+				}
+				sort.Ints(depends)
+				index[e.id] = len(b.Transactions)
+				queue.included(e)
+				b.Transactions = append(b.Transactions, e.tx)
+				t.Fees = append(t.Fees, fee)
+				t.Depends = append(t.Depends, depends)
+				size += e.size
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Block.Transactions[0] = CoinbaseTx(address, BlockSubsidy(height)+t.TotalFees(), data)
+	t.Block.MerkleRoot = t.Block.hashTransactions()
+	return t, nil
+}
+
+// Returns the transactions of `pool` which might go into a block.
+// Coinbases, malformed transactions and transactions spending unknown outputs are left out.
+func newTemplateQueue(view *utxoView, pool []*Transaction) *templateQueue {
+	entries := make(map[string]*templateEntry)
+	for _, tx := range pool {
+		if checkTransactionSanity(tx) != nil || tx.IsCoinbase() {
+			continue
+		}
+		entries[hex.EncodeToString(tx.ID)] = &templateEntry{tx: tx, id: hex.EncodeToString(tx.ID), size: tx.Size()}
+	}
+	for id, e := range entries {
+		var valuesIn []int
+		missing := false
+		for _, in := range e.tx.Inputs {
+			if parent, ok := entries[hex.EncodeToString(in.ID)]; ok {
+				if in.Out < 0 || in.Out >= len(parent.tx.Outputs) {
+					missing = true
+					break
+				}
+				e.parents = appendParent(e.parents, parent)
+				valuesIn = append(valuesIn, parent.tx.Outputs[in.Out].Value)
+				continue
+			}
+			out := view.output(in)
+			if out == nil {
+				missing = true
+				break
+			}
+			valuesIn = append(valuesIn, out.Value)
+		}
+		fee, err := calcTransactionFee(e.tx, valuesIn)
+		if missing || err != nil {
+			delete(entries, id)
+			continue
+		}
+		e.fee = fee
+	}
+	// Packages in the order of the IDs, so the template does not depend on the order of `pool`.
+	ids := make([]string, 0, len(entries))
+	for id := range entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	queue := make(templateQueue, 0, len(ids))
+	dropped := make(map[*templateEntry]bool)
+	var addPackage func(e *templateEntry) bool
+	addPackage = func(e *templateEntry) bool {
+		if e.ancestors != nil || dropped[e] {
+			return !dropped[e]
+		}
+		for _, p := range e.parents {
+			// Transactions whose parents were dropped cannot be included either.
+			if _, ok := entries[p.id]; !ok || !addPackage(p) {
+				dropped[e] = true
+				return false
+			}
+		}
+		e.ancestors = make(map[*templateEntry]bool)
+		for _, p := range e.parents {
+			p.children = append(p.children, e)
+			for a := range p.ancestors {
+				e.ancestors[a] = true
+			}
+			e.ancestors[p] = true
+		}
+		e.pkgFee, e.pkgSize = e.fee, e.size
+		for a := range e.ancestors {
+			e.pkgFee += a.fee
+			e.pkgSize += a.size
+		}
+		e.order, e.index = len(queue), len(queue)
+		queue = append(queue, e)
+		return true
+	}
+	for _, id := range ids {
+		addPackage(entries[id])
+	}
+	heap.Init(&queue)
+	return &queue
+}
+
+// Appends `parent` to `parents` if it is not there yet.
+func appendParent(parents []*templateEntry, parent *templateEntry) []*templateEntry {
+	for _, p := range parents {
+		if p == parent {
+			return parents
+		}
+	}
+	return append(parents, parent)
+}
+
+// ------------------------------------------------------------------- //
+// ------------------ getblocktemplate ------------------------------- //
+// ------------------------------------------------------------------- //
+
+// TemplateTransaction is a transaction of a GetBlockTemplateResult.
+type TemplateTransaction struct {
+	Data    string `json:"data"`    // serialized transaction, hex encoded
+	TxID    string `json:"txid"`    // hex encoded
+	Depends []int  `json:"depends"` // 1-based indexes of the transactions this one depends on
+	Fee     int    `json:"fee"`
+	Size    int    `json:"size"`
+	Weight  int    `json:"weight"`
+}
+
+// GetBlockTemplateResult describes a block template for external miners,
+// modelled after Bitcoin's getblocktemplate (BIP 22).
+// The miner may use the coinbase as is or create its own paying `CoinbaseValue`.
+type GetBlockTemplateResult struct {
+	Version           uint32                `json:"version"`
+	PreviousBlockHash string                `json:"previousblockhash"`
+	Height            uint64                `json:"height"`
+	CurTime           int64                 `json:"curtime"`
+	Bits              string                `json:"bits"`
+	Target            string                `json:"target"`
+	CoinbaseTxn       TemplateTransaction   `json:"coinbasetxn"`
+	CoinbaseValue     int                   `json:"coinbasevalue"`
+	Transactions      []TemplateTransaction `json:"transactions"` // without coinbase
+	SizeLimit         int                   `json:"sizelimit"`
+	WeightLimit       int                   `json:"weightlimit"`
+}
+
+// Result returns the template in the format of getblocktemplate.
+func (t *BlockTemplate) Result() GetBlockTemplateResult {
+	b := t.Block
+	r := GetBlockTemplateResult{
+		Version:           b.Version,
+		PreviousBlockHash: hex.EncodeToString(b.PrevHash),
+		Height:            b.Height,
+		CurTime:           b.Timestamp,
+		Bits:              fmt.Sprintf("%08x", b.Bits),
+		Target:            fmt.Sprintf("%064x", CompactToBig(b.Bits)),
+		CoinbaseValue:     b.Transactions[0].Outputs[0].Value,
+		SizeLimit:         BlockMaxSize,
+		WeightLimit:       BlockMaxWeight,
+		Transactions:      []TemplateTransaction{},
+	}
+	for i, tx := range b.Transactions {
+		tt := TemplateTransaction{
+			Data:    hex.EncodeToString(tx.Serialize()),
+			TxID:    hex.EncodeToString(tx.ID),
+			Depends: append([]int{}, t.Depends[i]...),
+			Fee:     t.Fees[i],
+			Size:    tx.Size(),
+			Weight:  tx.Weight(),
+		}
+		if i == 0 {
+			r.CoinbaseTxn = tt
+			continue
+		}
+		r.Transactions = append(r.Transactions, tt)
+	}
+	return r
+}
+
+// MineBlockTemplate runs proof of work on a copy of the block of `t` and adds it to the blockchain.
+// Gives up when `ctx` is cancelled. The template is not changed.
+func (bc *BlockChain) MineBlockTemplate(ctx context.Context, t *BlockTemplate) (*Block, error) {
+	block := *t.Block
+	b := &block
+	if !bytes.Equal(b.PrevHash, bc.getLastHash()) {
+		return nil, fmt.Errorf("block template is not on top of the last block")
+	}
+	if err := b.runProof(ctx); err != nil {
+		return nil, err
+	}
+	if err := bc.AddBlock(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
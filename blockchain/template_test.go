@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a transaction of `w` spending output `out` of `prev`: `amount` goes to `to`, the change back to `w`.
+// `prev` does not have to be in the blockchain.
+func spendOutput(w *Wallet, prev *Transaction, out int, to string, amount, fee int) *Transaction {
+	tx := &Transaction{
+		Inputs: []TxInput{{ID: prev.ID, Out: out}},
+		Outputs: []TxOutput{
+			*newTXOutput(amount, to),
+			*newTXOutput(prev.Outputs[out].Value-amount-fee, string(w.Address())),
+		},
+	}
+	tx.ID = tx.calcTransactionID()
+	tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prev.ID): *prev})
+	return tx
+}
+
+// Mines a block with only a coinbase paying to `w` and returns the coinbase.
+func mineCoinbase(t *testing.T, bc *BlockChain, w *Wallet) *Transaction {
+	cb := CoinbaseTx(string(w.Address()), BlockSubsidy(bc.BestHeight()+1))
+	_, err := bc.MineBlock([]*Transaction{cb})
+	require.NoError(t, err)
+	return cb
+}
+
+// Sets the size limit of block templates for the duration of the test.
+func setBlockMaxSize(t *testing.T, size int) {
+	old := BlockMaxSize
+	BlockMaxSize = size
+	t.Cleanup(func() { BlockMaxSize = old })
+}
+
+func TestBlockTemplateSelectsByFeeRate(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	cb0 := bc.getLastBlock().Transactions[0]
+	cb1 := mineCoinbase(t, bc, w)
+	cb2 := mineCoinbase(t, bc, w)
+
+	low := spendOutput(w, cb0, 0, address, 5, 1)
+	parent := spendOutput(w, cb1, 0, address, 15, 0)
+	child := spendOutput(w, parent, 0, address, 2, 12) // pays for its parent
+	high := spendOutput(w, cb2, 0, address, 5, 5)
+
+	tmpl, err := bc.NewBlockTemplate(address, []*Transaction{low, child, high, parent})
+	require.NoError(t, err)
+	txs := tmpl.Block.Transactions
+	require.Len(t, txs, 5)
+	assert.True(t, txs[0].IsCoinbase())
+	assert.Equal(t, []Hash{parent.ID, child.ID, high.ID, low.ID}, []Hash{txs[1].ID, txs[2].ID, txs[3].ID, txs[4].ID})
+	assert.Equal(t, []int{0, 0, 12, 5, 1}, tmpl.Fees)
+	assert.Equal(t, []int{1}, tmpl.Depends[2])
+	assert.Equal(t, BlockSubsidy(3)+18, txs[0].Outputs[0].Value)
+
+	result := tmpl.Result()
+	assert.Len(t, result.Transactions, 4)
+	assert.Equal(t, []int{1}, result.Transactions[1].Depends)
+	assert.Equal(t, hex.EncodeToString(txs[0].ID), result.CoinbaseTxn.TxID)
+	assert.Equal(t, uint64(3), result.Height)
+
+	block, err := bc.MineBlockTemplate(context.Background(), tmpl)
+	require.NoError(t, err)
+	assert.Equal(t, block.Hash, bc.getLastHash())
+}
+
+func TestBlockTemplateLeavesOutInvalidTransactions(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	cb0 := bc.getLastBlock().Transactions[0]
+
+	cheap := spendOutput(w, cb0, 0, address, 5, 1)
+	expensive := spendOutput(w, cb0, 0, address, 5, 3) // conflicts with `cheap`
+	orphan := spendOutput(w, CoinbaseTx(address, 10), 0, address, 5, 1)
+	orphanChild := spendOutput(w, orphan, 0, address, 2, 1)
+
+	tmpl, err := bc.NewBlockTemplate(address, []*Transaction{cheap, expensive, orphan, orphanChild})
+	require.NoError(t, err)
+	require.Len(t, tmpl.Block.Transactions, 2)
+	assert.Equal(t, expensive.ID, tmpl.Block.Transactions[1].ID)
+}
+
+func TestBlockTemplateRespectsSizeLimit(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	cb0 := bc.getLastBlock().Transactions[0]
+	cb1 := mineCoinbase(t, bc, w)
+
+	low := spendOutput(w, cb0, 0, address, 5, 1)
+	high := spendOutput(w, cb1, 0, address, 5, 2)
+	empty, err := bc.NewBlockTemplate(address, nil)
+	require.NoError(t, err)
+	setBlockMaxSize(t, empty.Block.Size()+16+high.Size()+low.Size()/2)
+
+	tmpl, err := bc.NewBlockTemplate(address, []*Transaction{low, high})
+	require.NoError(t, err)
+	require.Len(t, tmpl.Block.Transactions, 2)
+	assert.Equal(t, high.ID, tmpl.Block.Transactions[1].ID)
+	assert.LessOrEqual(t, tmpl.Block.Size(), BlockMaxSize)
+	assert.Equal(t, BlockMaxSize, tmpl.Result().SizeLimit)
+	assert.Equal(t, BlockMaxWeight, tmpl.Result().WeightLimit)
+}
+
+func BenchmarkNewBlockTemplate(b *testing.B) {
+	bc, w := newTestChain(b)
+	address := string(w.Address())
+
+	// Unspent outputs for the pool, written to the UTXO set directly: the supply is too small to fund them.
+	funding := &Transaction{Inputs: []TxInput{{ID: make([]byte, 32), Out: 0}}}
+	for i := 0; i < 3000; i++ {
+		funding.Outputs = append(funding.Outputs, *newTXOutput(100, address))
+	}
+	funding.ID = funding.calcTransactionID()
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		view := newUTXOView(txn)
+		view.addOutputs(funding, 0)
+		return view.commit()
+	})
+	require.NoError(b, err)
+
+	// Transactions with different fee rates; every third one has a child and a grandchild.
+	var pool []*Transaction
+	for i := range funding.Outputs {
+		tx := spendOutput(w, funding, i, address, 10, 1+i%50)
+		pool = append(pool, tx)
+		for j := 0; j < 2 && i%3 == 0; j++ {
+			tx = spendOutput(w, tx, 1, address, 10, 1+(i+j)%70)
+			pool = append(pool, tx)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := bc.NewBlockTemplate(address, pool)
+		require.NoError(b, err)
+	}
+}
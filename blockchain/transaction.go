@@ -1,70 +1,97 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
-	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
-	"math/big"
 	"strings"
 
 	"github.com/mkohlhaas/gobc/bcerror"
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/mkohlhaas/gobc/wire"
 )
 
-const (
-	noIndex = -1
-)
+const noIndex = -1
 
 // Transaction contains transaction inputs and outputs.
 type Transaction struct {
-	ID      Hash
-	Inputs  []TxInput
-	Outputs []TxOutput
+	ID       Hash
+	Inputs   []TxInput
+	Outputs  []TxOutput
+	LockTime uint32 // the transaction can only be included above this block height or Unix time; see LockTimeThreshold
 }
 
-// Updates Transaction ID.
+// Returns Transaction ID.
+// The ID is the Double SHA256 hash of the transaction without its ID and unlocking scripts,
+// so signing a transaction does not change its ID. The coinbase data is part of the ID.
 func (tx *Transaction) calcTransactionID() []byte {
-	oldTX_ID := tx.ID
-	tx.ID = make([]byte, 0) // reset transaction ID before calculating the Double SHA256 hash!
-	dh := doubleHash256(tx.Serialize())
-	tx.ID = oldTX_ID
-	return dh
+	txCopy := Transaction{Inputs: make([]TxInput, len(tx.Inputs)), Outputs: tx.Outputs, LockTime: tx.LockTime}
+	for i, in := range tx.Inputs {
+		txCopy.Inputs[i] = TxInput{ID: in.ID, Out: in.Out, Sequence: in.Sequence}
+	}
+	if tx.IsCoinbase() {
+		txCopy.Inputs[0].ScriptSig = tx.Inputs[0].ScriptSig
+	}
+	return doubleHash256(txCopy.Serialize())
 }
 
 // Serialize transaction.
 func (tx *Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
-	bcerror.Handle(err)
-	return encoded.Bytes()
+	w := wire.NewWriter()
+	w.WriteVersion()
+	tx.encode(w)
+	return w.Bytes()
 }
 
 // DeserializeTransaction deserializes transaction.
-func DeserializeTransaction(data []byte) Transaction {
-	var transaction Transaction
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
-	bcerror.Handle(err)
-	return transaction
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	r := wire.NewReader(data)
+	r.ReadVersion()
+	tx := decodeTransaction(r)
+	if err := r.Finish(); err != nil {
+		return Transaction{}, fmt.Errorf("deserializing transaction: %w", err)
+	}
+	return *tx, nil
+}
+
+// Writes transaction without version byte.
+// Format: ID, number of inputs, inputs, number of outputs, outputs, lock time (4 bytes).
+func (tx *Transaction) encode(w *wire.Writer) {
+	w.WriteVarBytes(tx.ID)
+	w.WriteVarInt(uint64(len(tx.Inputs)))
+	for i := range tx.Inputs {
+		tx.Inputs[i].encode(w)
+	}
+	w.WriteVarInt(uint64(len(tx.Outputs)))
+	for i := range tx.Outputs {
+		tx.Outputs[i].encode(w)
+	}
+	w.WriteUint32(tx.LockTime)
+}
+
+// Reads transaction written by encode().
+func decodeTransaction(r *wire.Reader) *Transaction {
+	tx := decodeLegacyTransaction(r, decodeTxInput, decodeTxOutput)
+	tx.LockTime = r.ReadUint32()
+	return tx
 }
 
 // CoinbaseTx is the first transcaction in a block.
-// Mining rewards and fees go to `to`.
+// Mining rewards and fees (`value`) go to `to`.
+// `value` must not exceed the block subsidy plus the fees of the block's transactions.
 // `data` can be any string. Typically used for vanity blocks.
 // `data` is defined as a variadic argument to make it optional.
-func CoinbaseTx(to string, data ...string) *Transaction {
+func CoinbaseTx(to string, value int, data ...string) *Transaction {
 	if len(data) == 0 {
-		data[0] = randomString()
+		data = append(data, randomString())
 	}
 	txin := TxInput{
-		Out:    noIndex,
-		PubKey: []byte(data[0])}
-	txout := newTXOutput(20, to)
+		Out:       noIndex,
+		ScriptSig: []byte(data[0]),
+		Sequence:  MaxTxInSequenceNum}
+	txout := newTXOutput(value, to)
 	tx := &Transaction{
 		Inputs:  []TxInput{txin},
 		Outputs: []TxOutput{*txout}}
@@ -81,15 +108,15 @@ func randomString() string {
 }
 
 // NewTransaction returns a transaction which uses all spendable outputs.
+// `fee` is left to the miner: the inputs exceed the outputs by `fee`.
 // Left over/change will be transferred to payer.
-func NewTransaction(w *Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+func NewTransaction(w *Wallet, to string, amount, fee int, UTXO *UTXOSet) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
-	pubKeyHash := PublicKeyHash(w.PublicKey)
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs := UTXO.FindSpendableOutputs(script.PayToPubKeyHash(PublicKeyHash(w.PublicKey)), amount+fee)
 	fmt.Printf("Spendable output: %d\n", acc)
-	if acc < amount {
-		log.Panic("Error: not enough funds")
+	if acc < amount+fee {
+		return nil, fmt.Errorf("not enough funds: %d spendable, %d needed", acc, amount+fee)
 	}
 	// Spendable outputs become inputs.
 	for txid, outs := range validOutputs {
@@ -99,39 +126,122 @@ func NewTransaction(w *Wallet, to string, amount int, UTXO *UTXOSet) *Transactio
 			input := TxInput{
 				ID:  txID,
 				Out: out,
-				// TODO: Signature is left empty.
-				PubKey: w.PublicKey}
+				// Wallet transactions can be replaced; see BumpFee.
+				Sequence: MaxRBFSequence}
 			inputs = append(inputs, input)
 		}
 	}
 	from := fmt.Sprintf("%s", w.Address())
 	outputs = append(outputs, *newTXOutput(amount, to))
-	if acc > amount {
+	if acc > amount+fee {
 		// Create separate output to oneself (`from`) for change/odd money.
-		outputs = append(outputs, *newTXOutput(acc-amount, from))
+		outputs = append(outputs, *newTXOutput(acc-amount-fee, from))
 	}
 	tx := &Transaction{
 		Inputs:  inputs,
 		Outputs: outputs}
 	tx.ID = tx.calcTransactionID()
-	UTXO.Blockchain.signTransaction(tx, w.PrivateKey)
+	if err := UTXO.Blockchain.signTransaction(tx, w.PrivateKey); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// NewSignedTransaction returns a transaction of wallet `w` spending the outputs referenced by `inputs`.
+// `prevTXs` maps the IDs of the spent transactions to the transactions. The inputs are signed by `w`.
+func NewSignedTransaction(w *Wallet, inputs []TxInput, outputs []TxOutput, prevTXs map[string]Transaction) *Transaction {
+	tx := &Transaction{Outputs: outputs}
+	for _, in := range inputs {
+		tx.Inputs = append(tx.Inputs, TxInput{ID: in.ID, Out: in.Out, Sequence: in.Sequence})
+	}
+	tx.ID = tx.calcTransactionID()
+	tx.Sign(w.PrivateKey, prevTXs)
 	return tx
 }
 
-// Returns true if transaction is a coinbase transaction.
-func (tx *Transaction) isCoinbase() bool {
+// BumpFee returns a replacement for the unconfirmed transaction `tx` of wallet `w` which pays `fee` instead
+// of its current fee. The additional fee is taken from the change output paying back to `w`.
+// The spent outputs are looked up in the transaction index.
+func (bc *BlockChain) BumpFee(w *Wallet, tx *Transaction, fee int) (*Transaction, error) {
+	if !tx.SignalsReplacement() {
+		return nil, fmt.Errorf("transaction %x does not signal replaceability", tx.ID)
+	}
+	oldFee, err := bc.CalcFee(tx)
+	if err != nil {
+		return nil, err
+	}
+	if fee <= oldFee {
+		return nil, fmt.Errorf("transaction %x: new fee %d does not exceed the current fee %d", tx.ID, fee, oldFee)
+	}
+	outputs := append([]TxOutput{}, tx.Outputs...)
+	change := -1
+	for i := range outputs {
+		if outputs[i].IsLockedWith(PublicKeyHash(w.PublicKey)) {
+			change = i
+		}
+	}
+	if change < 0 || outputs[change].Value <= fee-oldFee {
+		return nil, fmt.Errorf("transaction %x: no change output to pay %d more", tx.ID, fee-oldFee)
+	}
+	outputs[change].Value -= fee - oldFee
+	prevTXs := make(map[string]Transaction)
+	for _, in := range tx.Inputs {
+		prevTX, err := bc.findTransaction(in.ID)
+		if err != nil {
+			return nil, err
+		}
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+	return NewSignedTransaction(w, tx.Inputs, outputs, prevTXs), nil
+}
+
+// IsCoinbase returns true if transaction is a coinbase transaction.
+func (tx *Transaction) IsCoinbase() bool {
 	return tx.Inputs[0].Out == noIndex
 }
 
+// SignalsReplacement returns true if the transaction may be replaced in the memory pool,
+// i.e. if the sequence number of an input does not exceed MaxRBFSequence.
+func (tx *Transaction) SignalsReplacement() bool {
+	for _, in := range tx.Inputs {
+		if in.Sequence <= MaxRBFSequence {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the transaction can be included in the block at `height` whose previous block has
+// the median time past `medianTime`. Transactions whose inputs are all final ignore the lock time.
+func (tx *Transaction) isFinal(height uint64, medianTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	limit := int64(height)
+	if tx.LockTime >= LockTimeThreshold {
+		limit = medianTime
+	}
+	if int64(tx.LockTime) < limit {
+		return true
+	}
+	for _, in := range tx.Inputs {
+		if in.Sequence != MaxTxInSequenceNum {
+			return false
+		}
+	}
+	return true
+}
+
 // Returns true if transaction is NOT a coinbase transaction.
 func (tx *Transaction) isNotCoinbase() bool {
-	return !tx.isCoinbase()
+	return !tx.IsCoinbase()
 }
 
 // Sign transaction.
-// `prevTXs` is a map: Transaction ID -> transaction.
+// Every input gets the unlocking script <signature> <public key> for its pay-to-public-key-hash output,
+// signed with SigHashAll. `prevTXs` is a map: Transaction ID -> transaction.
 func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
-	if tx.isCoinbase() {
+	if tx.IsCoinbase() {
 		return // nothing to do for the coinbase transaction
 	}
 	for _, in := range tx.Inputs {
@@ -139,75 +249,80 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 			log.Panic("ERROR: Previous transaction is not correct")
 		}
 	}
-	txCleansed := tx.cleanTransaction()
-	for inID, in := range txCleansed.Inputs {
+	for inID, in := range tx.Inputs {
 		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		// has already been removed in cleanTransaction()
-		// txCleansed.Inputs[inId].Signature = nil
-		txCleansed.Inputs[inID].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-		dataToSign := fmt.Sprintf("%x\n", txCleansed)
-		// Signing uses the entire cleaned transaction!
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
-		bcerror.Handle(err)
-		signature := append(r.Bytes(), s.Bytes()...)
-		tx.Inputs[inID].Signature = signature
-		txCleansed.Inputs[inID].PubKey = nil
+		tx.SignInput(privKey, inID, prevTX.Outputs[in.Out], SigHashAll)
 	}
 }
 
-// Verifies transaction.
-func (tx *Transaction) verify(prevTXs map[string]Transaction) bool {
-	if tx.isCoinbase() {
-		return true // nothing to verify for coinbase transaction
+// SignInput sets the unlocking script <signature> <public key> of input `index` spending the
+// pay-to-public-key-hash output `prevOut`. `hashType` selects what the signature commits to, e.g.
+// SigHashSingle|SigHashAnyOneCanPay lets others add inputs and outputs after the signed ones.
+func (tx *Transaction) SignInput(privKey ecdsa.PrivateKey, index int, prevOut TxOutput, hashType SigHashType) {
+	pubKey := append(privKey.PublicKey.X.FillBytes(make([]byte, 32)), privKey.PublicKey.Y.FillBytes(make([]byte, 32))...)
+	signature := tx.signInput(privKey, index, prevOut.ScriptPubKey, prevOut.Value, hashType)
+	tx.Inputs[index].ScriptSig = script.SignatureScript(signature, pubKey)
+}
+
+// Verifies transaction: the unlocking script of every input must satisfy the locking script of the spent output.
+func (tx *Transaction) verify(prevTXs map[string]Transaction) error {
+	if tx.IsCoinbase() {
+		return nil // nothing to verify for coinbase transaction
 	}
 	for _, in := range tx.Inputs {
 		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
 			log.Panic("Previous transaction not correct")
 		}
 	}
-	txCleansed := tx.cleanTransaction()
-	curve := elliptic.P256()
 	for inID, in := range tx.Inputs {
 		prevTx := prevTXs[hex.EncodeToString(in.ID)]
-		// has already been removed in cleanTransaction()
-		// txCleansed.Inputs[inId].Signature = nil
-		txCleansed.Inputs[inID].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-		// Verify ecdsa signature.
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
-		dataToVerify := fmt.Sprintf("%x\n", txCleansed)
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if !ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) {
-			return false
+		checker := txSigChecker{tx, inID, prevTx.Outputs[in.Out].Value}
+		if err := script.Verify(in.ScriptSig, prevTx.Outputs[in.Out].ScriptPubKey, checker); err != nil {
+			return fmt.Errorf("input %d: %w", inID, err)
 		}
-		txCleansed.Inputs[inID].PubKey = nil
 	}
-	return true
+	return nil
 }
 
-// Remove Signature and PubKey from transaction inputs.
-func (tx *Transaction) cleanTransaction() Transaction {
-	var inputs []TxInput
-	var outputs []TxOutput
-	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{
-			ID:  in.ID,
-			Out: in.Out})
+// Checks the signatures of input `index` of `tx` spending an output of `value`.
+// Signatures are r||s and the hash type, public keys X||Y on P-256, all halves 32 bytes.
+type txSigChecker struct {
+	tx    *Transaction
+	index int
+	value int
+}
+
+// CheckSig implements script.SigChecker.
+func (c txSigChecker) CheckSig(sig, pubKey []byte, subScript script.Script) bool {
+	return c.tx.checkSig(c.index, sig, pubKey, subScript, c.value)
+}
+
+// CheckLockTime implements script.SigChecker.
+// The lock time of the transaction must be of the same kind as `lockTime` and not below it.
+// The input must not be final, otherwise the lock time of the transaction would be ignored.
+func (c txSigChecker) CheckLockTime(lockTime int64) bool {
+	txLockTime := int64(c.tx.LockTime)
+	if (lockTime < int64(LockTimeThreshold)) != (txLockTime < int64(LockTimeThreshold)) {
+		return false
+	}
+	return lockTime <= txLockTime && c.tx.Inputs[c.index].Sequence != MaxTxInSequenceNum
+}
+
+// CheckSequence implements script.SigChecker.
+// Relative lock times with SequenceLockTimeDisabled always pass. Otherwise the input's relative lock time
+// must be enabled, of the same kind as `sequence` and not below it; the block validation enforces it.
+func (c txSigChecker) CheckSequence(sequence int64) bool {
+	if sequence&int64(SequenceLockTimeDisabled) != 0 {
+		return true
 	}
-	// Copy transaction outputs
-	for _, out := range tx.Outputs {
-		// outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
-		outputs = append(outputs, out) // TODO: Does this work ?
+	txSequence := c.tx.Inputs[c.index].Sequence
+	if txSequence&SequenceLockTimeDisabled != 0 {
+		return false
 	}
-	return Transaction{tx.ID, inputs, outputs}
+	if uint32(sequence)&SequenceLockTimeIsSeconds != txSequence&SequenceLockTimeIsSeconds {
+		return false
+	}
+	return uint32(sequence)&SequenceLockTimeMask <= txSequence&SequenceLockTimeMask
 }
 
 func (tx *Transaction) String() string {
@@ -217,13 +332,20 @@ func (tx *Transaction) String() string {
 		fmt.Fprintf(&b, "     Input %d:\n", i)
 		fmt.Fprintf(&b, "       TXID:      %x\n", input.ID)
 		fmt.Fprintf(&b, "       Out:       %d\n", input.Out)
-		fmt.Fprintf(&b, "       Signature: %x\n", input.Signature)
-		fmt.Fprintf(&b, "       PubKey:    %x\n", input.PubKey)
+		if tx.IsCoinbase() {
+			fmt.Fprintf(&b, "       Data:      %x\n", []byte(input.ScriptSig))
+		} else {
+			fmt.Fprintf(&b, "       ScriptSig: %s\n", input.ScriptSig)
+		}
+		fmt.Fprintf(&b, "       Sequence:  %08x\n", input.Sequence)
 	}
 	for i, output := range tx.Outputs {
 		fmt.Fprintf(&b, "     Output %d:\n", i)
 		fmt.Fprintf(&b, "       Value:  %d\n", output.Value)
-		fmt.Fprintf(&b, "       Script: %x\n", output.PubKeyHash)
+		fmt.Fprintf(&b, "       Script: %s\n", output.ScriptPubKey)
+	}
+	if tx.LockTime != 0 {
+		fmt.Fprintf(&b, "     LockTime: %d\n", tx.LockTime)
 	}
 	return b.String()
 }
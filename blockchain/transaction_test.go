@@ -0,0 +1,152 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/mkohlhaas/gobc/script"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a transaction of `w` paying `amount` to `to`, see NewTransaction.
+func newTestTransaction(t *testing.T, w *Wallet, to string, amount, fee int, utxo *UTXOSet) *Transaction {
+	tx, err := NewTransaction(w, to, amount, fee, utxo)
+	require.NoError(t, err)
+	return tx
+}
+
+func TestNewTransactionErrors(t *testing.T) {
+	bc, w := newTestChain(t)
+	to := string(MakeWallet().Address())
+	_, err := NewTransaction(w, to, BlockSubsidy(0), 1, &UTXOSet{bc})
+	assert.ErrorContains(t, err, "not enough funds")
+
+	// The spent transaction is not in the transaction index.
+	tx := &Transaction{Inputs: []TxInput{{ID: make([]byte, 32), Out: 0}}, Outputs: []TxOutput{*newTXOutput(1, to)}}
+	tx.ID = tx.calcTransactionID()
+	assert.Error(t, bc.signTransaction(tx, w.PrivateKey))
+}
+
+func TestBumpFee(t *testing.T) {
+	bc, w := newTestChain(t)
+	to := string(MakeWallet().Address())
+	tx := newTestTransaction(t, w, to, 5, 1, &UTXOSet{bc})
+	require.True(t, tx.SignalsReplacement())
+
+	_, err := bc.BumpFee(w, tx, 1)
+	assert.Error(t, err)
+	replacement, err := bc.BumpFee(w, tx, 4)
+	require.NoError(t, err)
+	assert.NotEqual(t, tx.ID, replacement.ID)
+	assert.Equal(t, tx.Inputs[0].ID, replacement.Inputs[0].ID)
+	assert.Equal(t, tx.Outputs[0], replacement.Outputs[0])
+	assert.Equal(t, tx.Outputs[1].Value-3, replacement.Outputs[1].Value)
+	fee, err := bc.CheckTransaction(replacement, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4, fee)
+
+	// All change goes to the fee: nothing left to take from.
+	_, err = bc.BumpFee(w, tx, 1+tx.Outputs[1].Value)
+	assert.Error(t, err)
+
+	final := *tx
+	final.Inputs = []TxInput{tx.Inputs[0]}
+	final.Inputs[0].Sequence = MaxTxInSequenceNum
+	assert.False(t, final.SignalsReplacement())
+	_, err = bc.BumpFee(w, &final, 4)
+	assert.Error(t, err)
+}
+
+func TestSpendCustomScript(t *testing.T) {
+	bc, w := newTestChain(t)
+	cb := bc.getLastBlock().Transactions[0]
+	// Anybody knowing the preimage of `hash` can spend the output.
+	preimage := []byte("secret")
+	hash := sha256.Sum256(preimage)
+	puzzle := script.NewBuilder().AddOp(script.OP_SHA256).AddData(hash[:]).AddOp(script.OP_EQUAL).Script()
+	locked := NewSignedTransaction(w, []TxInput{{ID: cb.ID, Out: 0, Sequence: MaxTxInSequenceNum}},
+		[]TxOutput{{Value: cb.Outputs[0].Value - 1, ScriptPubKey: puzzle}},
+		map[string]Transaction{hex.EncodeToString(cb.ID): *cb})
+	pending := func(id Hash) *Transaction {
+		if bytes.Equal(id, locked.ID) {
+			return locked
+		}
+		return nil
+	}
+	spend := func(data []byte) *Transaction {
+		tx := &Transaction{
+			Inputs:  []TxInput{{ID: locked.ID, Out: 0, ScriptSig: script.NewBuilder().AddData(data).Script(), Sequence: MaxTxInSequenceNum}},
+			Outputs: []TxOutput{*newTXOutput(locked.Outputs[0].Value-1, string(MakeWallet().Address()))},
+		}
+		tx.ID = tx.calcTransactionID()
+		return tx
+	}
+
+	_, err := bc.CheckTransaction(spend([]byte("guess")), pending)
+	assertRuleError(t, err, ErrBadSignature)
+	fee, err := bc.CheckTransaction(spend(preimage), pending)
+	require.NoError(t, err)
+	assert.Equal(t, 1, fee)
+}
+
+func TestSpendTimeLockedOutputs(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	cb := bc.getLastBlock().Transactions[0]
+	p2pkh := script.PayToPubKeyHash(PublicKeyHash(w.PublicKey))
+	// Spendable above height 2 and 2 blocks after confirmation.
+	cltv := append(script.NewBuilder().AddInt64(2).AddOp(script.OP_CHECKLOCKTIMEVERIFY).AddOp(script.OP_DROP).Script(), p2pkh...)
+	csv := append(script.NewBuilder().AddInt64(2).AddOp(script.OP_CHECKSEQUENCEVERIFY).AddOp(script.OP_DROP).Script(), p2pkh...)
+	funding := NewSignedTransaction(w, []TxInput{{ID: cb.ID, Out: 0, Sequence: MaxTxInSequenceNum}},
+		[]TxOutput{{Value: 5, ScriptPubKey: cltv}, {Value: 5, ScriptPubKey: csv}},
+		map[string]Transaction{hex.EncodeToString(cb.ID): *cb})
+	fee := cb.Outputs[0].Value - 10
+	_, err := bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)+fee), funding})
+	require.NoError(t, err)
+
+	_, err = bc.CheckTransaction(spendLocked(w, funding, 0, MaxRBFSequence, 2), nil)
+	assertRuleError(t, err, ErrUnfinalizedTx)
+	_, err = bc.CheckTransaction(spendLocked(w, funding, 0, MaxRBFSequence, 1), nil)
+	assertRuleError(t, err, ErrBadSignature)
+	_, err = bc.CheckTransaction(spendLocked(w, funding, 0, MaxTxInSequenceNum, 2), nil)
+	assertRuleError(t, err, ErrBadSignature)
+
+	_, err = bc.CheckTransaction(spendLocked(w, funding, 1, 2, 0), nil)
+	assertRuleError(t, err, ErrSequenceLockNotMet)
+	_, err = bc.CheckTransaction(spendLocked(w, funding, 1, 1, 0), nil)
+	assertRuleError(t, err, ErrBadSignature)
+	_, err = bc.CheckTransaction(spendLocked(w, funding, 1, MaxRBFSequence, 0), nil)
+	assertRuleError(t, err, ErrBadSignature)
+
+	mineCoinbase(t, bc, w)
+	_, err = bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(3)+2),
+		spendLocked(w, funding, 0, MaxRBFSequence, 2), spendLocked(w, funding, 1, 2, 0)})
+	require.NoError(t, err)
+}
+
+func TestWalletTransactionsFile(t *testing.T) {
+	params := *Params
+	params.DataDir = t.TempDir()
+	old := Params
+	Params = &params
+	t.Cleanup(func() { Params = old })
+
+	wt, err := OpenWalletTransactions("test")
+	require.NoError(t, err)
+	assert.Empty(t, wt.Transactions)
+	address := string(MakeWallet().Address())
+	tx1, tx2 := CoinbaseTx(address, 1), CoinbaseTx(address, 2)
+	wt.Add(tx1)
+	wt.Add(tx2)
+	wt.Remove(tx1.ID)
+	wt.SaveFile("test")
+
+	wt, err = OpenWalletTransactions("test")
+	require.NoError(t, err)
+	assert.Nil(t, wt.Get(tx1.ID))
+	assert.Equal(t, tx2, wt.Get(tx2.ID))
+}
@@ -2,43 +2,94 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
 
 	"github.com/mkohlhaas/gobc/bcerror"
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/mkohlhaas/gobc/wire"
 )
 
-// Script stack (input on top of output):
-// Signature   Script (from input)
-// PubkeyHash  Script (from output)
+// Sequence numbers of transaction inputs.
+// Like in Bitcoin (BIP 125) a transaction with an input below MaxRBFSequence can be replaced
+// in the memory pool by a transaction paying a higher fee.
+const (
+	MaxTxInSequenceNum uint32 = 0xffffffff // final input; also used for coinbase inputs
+	MaxRBFSequence     uint32 = 0xfffffffd // highest sequence number signaling replaceability
+)
+
+// Lock times. Like in Bitcoin a transaction with a lock time can only be included in a block above
+// the lock time unless all its inputs are final (BIP 113). Lock times below LockTimeThreshold are block
+// heights, others Unix times compared with the median time past of the previous block.
+// The sequence number of an input can lock the input relative to the block containing the spent
+// output (BIP 68): unless SequenceLockTimeDisabled is set, the spending block must be at least
+// `sequence & SequenceLockTimeMask` blocks or, with SequenceLockTimeIsSeconds, that many times
+// 512 seconds of median time past later.
+const (
+	LockTimeThreshold           uint32 = 500000000
+	SequenceLockTimeDisabled    uint32 = 1 << 31
+	SequenceLockTimeIsSeconds   uint32 = 1 << 22
+	SequenceLockTimeMask        uint32 = 0x0000ffff
+	SequenceLockTimeGranularity        = 9 // relative lock times in seconds are counted in units of 2^9 seconds
+)
 
 // TxInput is the transaction input.
 type TxInput struct {
-	ID        []byte // transaction ID of the TxOutput this TxInput comes from
-	Out       int    // index of the TxOutput in the transaction where this TxInput comes from
-	Signature []byte // = Signature Script in real Bitcoin
-	PubKey    []byte
+	ID        []byte        // transaction ID of the TxOutput this TxInput comes from
+	Out       int           // index of the TxOutput in the transaction where this TxInput comes from
+	ScriptSig script.Script // unlocking script; arbitrary data for the coinbase input
+	Sequence  uint32        // see MaxRBFSequence and SequenceLockTimeDisabled
 }
 
 // TxOutput is the transaction output.
 type TxOutput struct {
-	Value      int
-	PubKeyHash Hash // = Pubkey Script in real Bitcoin
+	Value        int
+	ScriptPubKey script.Script // locking script; see script.PayToPubKeyHash
 }
 
 // TxOutputs is a list of transaction outputs.
+// In the UTXO set outputs keep their position in the transaction; spent outputs are null.
 type TxOutputs struct {
-	Outputs []TxOutput
+	Height   uint64 // height of the block containing the transaction
+	Coinbase bool   // outputs of a coinbase transaction must mature before they can be spent
+	Outputs  []TxOutput
+}
+
+// Marks a transaction output in the UTXO set as spent.
+func (out *TxOutput) setNull() {
+	out.Value = -1
+	out.ScriptPubKey = nil
 }
 
-// Sets PubKeyHash in transaction output.
+// Returns true if transaction output in the UTXO set has already been spent.
+func (out *TxOutput) isNull() bool {
+	return out.Value == -1
+}
+
+// Returns true if all outputs have been spent.
+func (outs *TxOutputs) isFullySpent() bool {
+	for i := range outs.Outputs {
+		if !outs.Outputs[i].isNull() {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the outputs can be spent in the block at `height`.
+// Outputs of a coinbase transaction can be spent after `CoinbaseMaturity` confirmations.
+// A reorganization can make coinbase transactions disappear; their coins must not have moved on by then.
+func (outs *TxOutputs) isMature(height uint64) bool {
+	return !outs.Coinbase || height >= outs.Height+Params.CoinbaseMaturity
+}
+
+// Locks transaction output to `address`; see LockingScript.
 func (out *TxOutput) lock(address []byte) {
-	pubKeyHash := PKHFrom(address)
-	out.PubKeyHash = pubKeyHash
+	out.ScriptPubKey = LockingScript(string(address))
 }
 
-// IsLockedWith returns true if transaction output is locked with pubKeyHash.
+// IsLockedWith returns true if transaction output is locked with a pay-to-public-key-hash script to pubKeyHash.
 func (out *TxOutput) IsLockedWith(pubKeyHash Hash) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	h := out.ScriptPubKey.PubKeyHash()
+	return h != nil && bytes.Equal(h, pubKeyHash)
 }
 
 // Creates new transaction output.
@@ -49,20 +100,64 @@ func newTXOutput(value int, address string) *TxOutput {
 	return txo
 }
 
+// Writes transaction input.
+// Format: transaction ID, output index (4 bytes, -1 = 0xffffffff), unlocking script, sequence number (4 bytes).
+func (in *TxInput) encode(w *wire.Writer) {
+	w.WriteVarBytes(in.ID)
+	w.WriteUint32(uint32(in.Out))
+	w.WriteVarBytes(in.ScriptSig)
+	w.WriteUint32(in.Sequence)
+}
+
+// Reads transaction input written by encode().
+func decodeTxInput(r *wire.Reader) TxInput {
+	return TxInput{
+		ID:        r.ReadVarBytes(),
+		Out:       int(int32(r.ReadUint32())),
+		ScriptSig: r.ReadVarBytes(),
+		Sequence:  r.ReadUint32(),
+	}
+}
+
+// Writes transaction output.
+// Format: value (8 bytes), locking script.
+func (out *TxOutput) encode(w *wire.Writer) {
+	w.WriteInt64(int64(out.Value))
+	w.WriteVarBytes(out.ScriptPubKey)
+}
+
+// Reads transaction output written by encode().
+func decodeTxOutput(r *wire.Reader) TxOutput {
+	return TxOutput{
+		Value:        int(r.ReadInt64()),
+		ScriptPubKey: r.ReadVarBytes(),
+	}
+}
+
 // Serialize transaction outputs for storing in DB.
+// Format: version, height, coinbase flag, number of outputs, outputs.
 func (outs *TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(*outs)
-	bcerror.Handle(err)
-	return buffer.Bytes()
+	w := wire.NewWriter()
+	w.WriteVersion()
+	w.WriteUint64(outs.Height)
+	w.WriteBool(outs.Coinbase)
+	w.WriteVarInt(uint64(len(outs.Outputs)))
+	for i := range outs.Outputs {
+		outs.Outputs[i].encode(w)
+	}
+	return w.Bytes()
 }
 
 // Deserialize transaction outputs for retrieving from DB.
 func deserializeOutputs(data []byte) TxOutputs {
 	var outputs TxOutputs
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	err := decode.Decode(&outputs)
-	bcerror.Handle(err)
+	r := wire.NewReader(data)
+	r.ReadVersion()
+	outputs.Height = r.ReadUint64()
+	outputs.Coinbase = r.ReadBool()
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		outputs.Outputs = append(outputs.Outputs, decodeTxOutput(r))
+	}
+	bcerror.Handle(r.Finish())
 	return outputs
 }
@@ -0,0 +1,80 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+	"github.com/mkohlhaas/gobc/bcerror"
+)
+
+// Transaction index for all transactions of the main chain.
+// key:   prefix + transaction ID
+// value: block hash + position of the transaction in the block (4 bytes, big endian)
+var txIndexPrefix = []byte("txidx-")
+
+// Adds all transactions of block `b` to the transaction index.
+func indexTransactions(txn *badger.Txn, b *Block) error {
+	for pos, tx := range b.Transactions {
+		location := make([]byte, len(b.Hash)+4)
+		copy(location, b.Hash)
+		binary.BigEndian.PutUint32(location[len(b.Hash):], uint32(pos))
+		if err := txn.Set(prefixedKey(txIndexPrefix, tx.ID), location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes all transactions of block `b` from the transaction index.
+func unindexTransactions(txn *badger.Txn, b *Block) error {
+	for _, tx := range b.Transactions {
+		if err := txn.Delete(prefixedKey(txIndexPrefix, tx.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTransaction returns a transaction of the main chain and the hash of the block containing it.
+func (bc *BlockChain) GetTransaction(ID Hash) (*Transaction, Hash, error) {
+	var location []byte
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(prefixedKey(txIndexPrefix, ID))
+		if err != nil {
+			return err
+		}
+		location, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("transaction %x not found", ID)
+	}
+	blockHash := Hash(location[:len(location)-4])
+	pos := binary.BigEndian.Uint32(location[len(location)-4:])
+	block, err := bc.GetBlock(blockHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if int(pos) >= len(block.Transactions) {
+		return nil, nil, fmt.Errorf("transaction index corrupt for transaction %x", ID)
+	}
+	return block.Transactions[pos], blockHash, nil
+}
+
+// ReindexTransactions rebuilds the transaction index from the main chain.
+// Returns the number of indexed transactions.
+func (bc *BlockChain) ReindexTransactions() int {
+	bc.deleteByPrefix(txIndexPrefix)
+	count := 0
+	iter := bc.CreateBCIterator()
+	for iter.HasNext() {
+		block := iter.GetNext()
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			return indexTransactions(txn, block)
+		})
+		bcerror.Handle(err)
+		count += len(block.Transactions)
+	}
+	return count
+}
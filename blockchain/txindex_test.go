@@ -0,0 +1,38 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionIndex(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	genesis := bc.getLastBlock()
+
+	tx := newTestTransaction(t, w, string(MakeWallet().Address()), 5, 0, &UTXOSet{bc})
+	a1, err := bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)), tx})
+	require.NoError(t, err)
+	found, blockHash, err := bc.GetTransaction(tx.ID)
+	require.NoError(t, err)
+	assert.Equal(t, tx.ID, found.ID)
+	assert.Equal(t, a1.Hash, blockHash)
+
+	// Disconnected transactions are removed from the index.
+	b1 := mineOn(t, genesis, CoinbaseTx(address, BlockSubsidy(1)))
+	require.NoError(t, bc.AddBlock(b1))
+	require.NoError(t, bc.AddBlock(mineOn(t, b1, CoinbaseTx(address, BlockSubsidy(1)))))
+	_, _, err = bc.GetTransaction(tx.ID)
+	assert.Error(t, err)
+	_, blockHash, err = bc.GetTransaction(b1.Transactions[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, b1.Hash, blockHash)
+
+	// Rebuilding the index yields the same result.
+	assert.Equal(t, 3, bc.ReindexTransactions())
+	_, blockHash, err = bc.GetTransaction(b1.Transactions[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, b1.Hash, blockHash)
+}
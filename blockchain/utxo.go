@@ -9,6 +9,7 @@ import (
 	"github.com/dgraph-io/badger"
 
 	"github.com/mkohlhaas/gobc/bcerror"
+	"github.com/mkohlhaas/gobc/script"
 )
 
 var (
@@ -24,9 +25,12 @@ type UTXOSet struct {
 }
 
 // FindSpendableOutputs returns accumulated amount and a map: Transaction ID -> List of Indexes in Transaction.
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash Hash, amount int) (int, map[string][]int) {
+// Only outputs locked with `lockingScript` are collected, until they reach `amount`.
+// Outputs of coinbase transactions which have not yet matured are skipped.
+func (u UTXOSet) FindSpendableOutputs(lockingScript script.Script, amount int) (int, map[string][]int) {
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
+	nextHeight := u.Blockchain.BestHeight() + 1
 	db := u.Blockchain.Database
 	err := db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
@@ -44,8 +48,11 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash Hash, amount int) (int, map[str
 			k = bytes.TrimPrefix(k, utxoPrefix)
 			txID := hex.EncodeToString(k)
 			outs := deserializeOutputs(v)
+			if !outs.isMature(nextHeight) {
+				continue
+			}
 			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWith(pubKeyHash) && accumulated < amount {
+				if !out.isNull() && bytes.Equal(out.ScriptPubKey, lockingScript) && accumulated < amount {
 					accumulated += out.Value
 					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
 				}
@@ -57,8 +64,8 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash Hash, amount int) (int, map[str
 	return accumulated, unspentOuts
 }
 
-// FindUnspentTransactions returnds all unused transactions.
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash Hash) []TxOutput {
+// FindUnspentTransactions returnds all unused transaction outputs locked with `lockingScript`.
+func (u UTXOSet) FindUnspentTransactions(lockingScript script.Script) []TxOutput {
 	var UTXOs []TxOutput
 	db := u.Blockchain.Database
 	err := db.View(func(txn *badger.Txn) error {
@@ -75,7 +82,7 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash Hash) []TxOutput {
 			bcerror.Handle(err)
 			outs := deserializeOutputs(v)
 			for _, out := range outs.Outputs {
-				if out.IsLockedWith(pubKeyHash) {
+				if !out.isNull() && bytes.Equal(out.ScriptPubKey, lockingScript) {
 					UTXOs = append(UTXOs, out)
 				}
 			}
@@ -106,15 +113,15 @@ func (u UTXOSet) CountTransactions() int {
 // Reindex rebuilds the index of unspent transaction outputs.
 func (u UTXOSet) Reindex() {
 	db := u.Blockchain.Database
-	u.deleteByPrefix(utxoPrefix)
+	u.Blockchain.deleteByPrefix(utxoPrefix)
 	log.Printf("Before UTXO\n")
 	UTXO := u.Blockchain.findUTXO()
 	log.Printf("UTXO %v\n", UTXO)
 	err := db.Update(func(txn *badger.Txn) error {
 		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID)
+			id, err := hex.DecodeString(txID)
 			bcerror.Handle(err)
-			key = append(utxoPrefix, key...)
+			key := utxoKey(id)
 			fmt.Printf("Reindex, key: %v\n", key)
 			err = txn.Set(key, outs.Serialize())
 			bcerror.Handle(err)
@@ -124,96 +131,128 @@ func (u UTXOSet) Reindex() {
 	bcerror.Handle(err)
 }
 
-// Update ... (TODO)
-func (u *UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Database
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.isCoinbase() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					bcerror.Handle(err)
-					var v []byte
-					err = item.Value(func(val []byte) error {
-						v = append([]byte{}, val...)
-						return nil
-					})
-					bcerror.Handle(err)
-					outs := deserializeOutputs(v)
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
-					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
-					}
-				}
-			}
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
-			}
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
-			}
-		}
+// HasUnspentOutputs returns true if transaction `txID` has unspent outputs in the UTXO set.
+func (bc *BlockChain) HasUnspentOutputs(txID Hash) bool {
+	found := false
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		outs := newUTXOView(txn).entry(txID)
+		found = outs != nil && !outs.isFullySpent()
 		return nil
 	})
 	bcerror.Handle(err)
+	return found
 }
 
-// Deletes all entries in the database with `prefix`.
-func (u *UTXOSet) deleteByPrefix(prefix []byte) {
-	// local function to delete keys.
-	deleteKeys := func(keysForDelete [][]byte) error {
-		fmt.Printf("DeleteByPrefix, key: %v\n", keysForDelete)
-		err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
-			for _, key := range keysForDelete {
-				fmt.Printf("DeleteByPrefix, key: %v\n", key)
-				if err := txn.Delete(key); err != nil {
-					return err
-				}
-			}
-			return nil
-		})
-		return err
+// Returns the database key of the UTXO entry for transaction `txID`.
+func utxoKey(txID Hash) []byte {
+	return append(append([]byte{}, utxoPrefix...), txID...)
+}
+
+// utxoView is an in-memory view on the UTXO set.
+// Entries are loaded lazily from the database and written back with commit().
+// Used for validating and connecting blocks.
+type utxoView struct {
+	txn      *badger.Txn
+	entries  map[string]*TxOutputs // map: transaction ID -> outputs (nil if there is no entry)
+	modified map[string]bool       // transaction IDs of entries which must be written back
+	spent    []spentOutput         // outputs spent by spendInputs() in that order; the undo data of a block
+}
+
+// Creates a new UTXO view on top of a database transaction.
+func newUTXOView(txn *badger.Txn) *utxoView {
+	return &utxoView{
+		txn:      txn,
+		entries:  make(map[string]*TxOutputs),
+		modified: make(map[string]bool),
 	}
+}
 
-	collectSize := 100_000
-	u.Blockchain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		keysForDelete := make([][]byte, 0, collectSize)
-		keysCollected := 0
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keysCollected++
-			if keysCollected == collectSize {
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
-				}
-				keysForDelete = make([][]byte, 0, collectSize)
-				keysCollected = 0
-			}
-		}
-		if keysCollected > 0 {
-			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
-			}
-		}
+// Returns UTXO entry of transaction `txID` or nil if it does not exist.
+func (v *utxoView) entry(txID Hash) *TxOutputs {
+	id := hex.EncodeToString(txID)
+	if outs, ok := v.entries[id]; ok {
+		return outs
+	}
+	item, err := v.txn.Get(utxoKey(txID))
+	if err == badger.ErrKeyNotFound {
+		v.entries[id] = nil
+		return nil
+	}
+	bcerror.Handle(err)
+	var outs TxOutputs
+	err = item.Value(func(val []byte) error {
+		outs = deserializeOutputs(val)
 		return nil
 	})
+	bcerror.Handle(err)
+	v.entries[id] = &outs
+	return &outs
+}
+
+// Returns the unspent output referenced by `in` or nil if it is missing or already spent.
+func (v *utxoView) output(in TxInput) *TxOutput {
+	outs := v.entry(in.ID)
+	if outs == nil || in.Out < 0 || in.Out >= len(outs.Outputs) || outs.Outputs[in.Out].isNull() {
+		return nil
+	}
+	return &outs.Outputs[in.Out]
+}
+
+// Marks the outputs referenced by the inputs of `tx` as spent.
+// The spent outputs are recorded for undoing.
+func (v *utxoView) spendInputs(tx *Transaction) {
+	for _, in := range tx.Inputs {
+		outs := v.entry(in.ID)
+		out := &outs.Outputs[in.Out]
+		v.spent = append(v.spent, spentOutput{in.ID, in.Out, outs.Height, outs.Coinbase, *out})
+		out.setNull()
+		v.modified[hex.EncodeToString(in.ID)] = true
+	}
+}
+
+// Makes a spent output unspent again.
+func (v *utxoView) restoreOutput(so spentOutput) {
+	outs := v.entry(so.TxID)
+	if outs == nil {
+		outs = &TxOutputs{Height: so.Height, Coinbase: so.Coinbase}
+		v.entries[hex.EncodeToString(so.TxID)] = outs
+	}
+	for len(outs.Outputs) <= so.Index {
+		outs.Outputs = append(outs.Outputs, TxOutput{Value: -1})
+	}
+	outs.Outputs[so.Index] = so.Output
+	v.modified[hex.EncodeToString(so.TxID)] = true
+}
+
+// Removes all outputs of `tx` from the view.
+func (v *utxoView) removeOutputs(tx *Transaction) {
+	id := hex.EncodeToString(tx.ID)
+	v.entries[id] = &TxOutputs{}
+	v.modified[id] = true
+}
+
+// Adds the outputs of `tx` included in the block at `height` to the view.
+func (v *utxoView) addOutputs(tx *Transaction, height uint64) {
+	id := hex.EncodeToString(tx.ID)
+	v.entries[id] = &TxOutputs{Height: height, Coinbase: tx.IsCoinbase(), Outputs: append([]TxOutput{}, tx.Outputs...)}
+	v.modified[id] = true
+}
+
+// Writes all modified entries back to the database.
+// Fully spent entries are removed.
+func (v *utxoView) commit() error {
+	for id := range v.modified {
+		txID, err := hex.DecodeString(id)
+		bcerror.Handle(err)
+		outs := v.entries[id]
+		if outs.isFullySpent() {
+			err = v.txn.Delete(utxoKey(txID))
+		} else {
+			err = v.txn.Set(utxoKey(txID), outs.Serialize())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,423 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// maxTimeOffset is how far a block's timestamp may lie in the future.
+const maxTimeOffset = 2 * time.Hour
+
+// medianTimeBlocks is the number of blocks whose median timestamp is the median time past of the last one.
+const medianTimeBlocks = 11
+
+// ErrorCode identifies the consensus rule a block or transaction violates.
+type ErrorCode int
+
+const (
+	ErrDuplicateBlock ErrorCode = iota
+	ErrOrphanBlock
+	ErrInvalidAncestor
+	ErrBadProofOfWork
+	ErrBadBlockHash
+	ErrBadMerkleRoot
+	ErrBadHeight
+	ErrBadDifficulty
+	ErrTimeTooNew
+	ErrNoTransactions
+	ErrBlockTooBig
+	ErrFirstTxNotCoinbase
+	ErrMultipleCoinbases
+	ErrBadCoinbase
+	ErrBadCoinbaseValue
+	ErrDuplicateTx
+	ErrBadTxID
+	ErrNoTxInputs
+	ErrNoTxOutputs
+	ErrBadTxOutValue
+	ErrDuplicateTxInput
+	ErrMissingTxOut
+	ErrDoubleSpend
+	ErrImmatureSpend
+	ErrSpendTooHigh
+	ErrBadSignature
+	ErrUnfinalizedTx
+	ErrSequenceLockNotMet
+	ErrBadTxInValue
+	ErrTimeTooOld
+)
+
+var errorCodeStrings = map[ErrorCode]string{
+	ErrDuplicateBlock:     "ErrDuplicateBlock",
+	ErrOrphanBlock:        "ErrOrphanBlock",
+	ErrInvalidAncestor:    "ErrInvalidAncestor",
+	ErrBadProofOfWork:     "ErrBadProofOfWork",
+	ErrBadBlockHash:       "ErrBadBlockHash",
+	ErrBadMerkleRoot:      "ErrBadMerkleRoot",
+	ErrBadHeight:          "ErrBadHeight",
+	ErrBadDifficulty:      "ErrBadDifficulty",
+	ErrTimeTooNew:         "ErrTimeTooNew",
+	ErrNoTransactions:     "ErrNoTransactions",
+	ErrBlockTooBig:        "ErrBlockTooBig",
+	ErrFirstTxNotCoinbase: "ErrFirstTxNotCoinbase",
+	ErrMultipleCoinbases:  "ErrMultipleCoinbases",
+	ErrBadCoinbase:        "ErrBadCoinbase",
+	ErrBadCoinbaseValue:   "ErrBadCoinbaseValue",
+	ErrDuplicateTx:        "ErrDuplicateTx",
+	ErrBadTxID:            "ErrBadTxID",
+	ErrNoTxInputs:         "ErrNoTxInputs",
+	ErrNoTxOutputs:        "ErrNoTxOutputs",
+	ErrBadTxOutValue:      "ErrBadTxOutValue",
+	ErrDuplicateTxInput:   "ErrDuplicateTxInput",
+	ErrMissingTxOut:       "ErrMissingTxOut",
+	ErrDoubleSpend:        "ErrDoubleSpend",
+	ErrImmatureSpend:      "ErrImmatureSpend",
+	ErrSpendTooHigh:       "ErrSpendTooHigh",
+	ErrBadSignature:       "ErrBadSignature",
+	ErrUnfinalizedTx:      "ErrUnfinalizedTx",
+	ErrSequenceLockNotMet: "ErrSequenceLockNotMet",
+	ErrBadTxInValue:       "ErrBadTxInValue",
+	ErrTimeTooOld:         "ErrTimeTooOld",
+}
+
+// Stringer for error codes.
+func (c ErrorCode) String() string {
+	if s, ok := errorCodeStrings[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ErrorCode (%d)", int(c))
+}
+
+// RuleError is returned when a block or transaction violates a consensus rule.
+type RuleError struct {
+	Code        ErrorCode // reason for rejection
+	Description string    // human readable description
+}
+
+func (e RuleError) Error() string {
+	return e.Description
+}
+
+// Creates a RuleError.
+func ruleError(code ErrorCode, format string, args ...any) RuleError {
+	return RuleError{code, fmt.Sprintf(format, args...)}
+}
+
+// Performs all checks of a block header which do not depend on the block's position in the blockchain.
+// `hash` is the claimed hash of the block.
+func checkHeaderSanity(h *BlockHeader, hash Hash) error {
+	if !bytes.Equal(hash, h.CalcHash()) {
+		return ruleError(ErrBadBlockHash, "block %x: hash does not match header", hash)
+	}
+	if !h.IsValidBlockHeader() {
+		return ruleError(ErrBadProofOfWork, "block %x: hash is not below target", hash)
+	}
+	if time.Unix(h.Timestamp, 0).After(time.Now().Add(maxTimeOffset)) {
+		return ruleError(ErrTimeTooNew, "block %x: timestamp too far in the future", hash)
+	}
+	return nil
+}
+
+// Performs all checks which do not depend on the block's position in the blockchain.
+func checkBlockSanity(b *Block) error {
+	if err := checkHeaderSanity(&b.BlockHeader, b.Hash); err != nil {
+		return err
+	}
+	if len(b.Transactions) == 0 {
+		return ruleError(ErrNoTransactions, "block %x: no transactions", b.Hash)
+	}
+	if size := b.Size(); size > MaxBlockSize || b.Weight() > MaxBlockWeight {
+		return ruleError(ErrBlockTooBig, "block %x: size %d exceeds limit", b.Hash, size)
+	}
+	// The header commits to the transactions by the Merkle root.
+	if !bytes.Equal(b.MerkleRoot, b.hashTransactions()) {
+		return ruleError(ErrBadMerkleRoot, "block %x: Merkle root does not match transactions", b.Hash)
+	}
+	txIDs := make(map[string]bool)
+	for i, tx := range b.Transactions {
+		if err := checkTransactionSanity(tx); err != nil {
+			return err
+		}
+		switch {
+		case i == 0 && tx.isNotCoinbase():
+			return ruleError(ErrFirstTxNotCoinbase, "block %x: first transaction is not a coinbase", b.Hash)
+		case i > 0 && tx.IsCoinbase():
+			return ruleError(ErrMultipleCoinbases, "block %x: more than one coinbase", b.Hash)
+		}
+		txID := hex.EncodeToString(tx.ID)
+		if txIDs[txID] {
+			return ruleError(ErrDuplicateTx, "block %x: duplicate transaction %s", b.Hash, txID)
+		}
+		txIDs[txID] = true
+	}
+	return nil
+}
+
+// Performs all checks of a transaction which do not need the UTXO set.
+func checkTransactionSanity(tx *Transaction) error {
+	if len(tx.Inputs) == 0 {
+		return ruleError(ErrNoTxInputs, "transaction %x: no inputs", tx.ID)
+	}
+	if len(tx.Outputs) == 0 {
+		return ruleError(ErrNoTxOutputs, "transaction %x: no outputs", tx.ID)
+	}
+	if !bytes.Equal(tx.ID, tx.calcTransactionID()) {
+		return ruleError(ErrBadTxID, "transaction %x: ID does not match content", tx.ID)
+	}
+	valueOut := 0
+	for _, out := range tx.Outputs {
+		if !isMoneyRange(out.Value) {
+			return ruleError(ErrBadTxOutValue, "transaction %x: output value %d out of range", tx.ID, out.Value)
+		}
+		valueOut += out.Value
+		if !isMoneyRange(valueOut) {
+			return ruleError(ErrBadTxOutValue, "transaction %x: total output value %d out of range", tx.ID, valueOut)
+		}
+	}
+	if tx.IsCoinbase() {
+		if len(tx.Inputs) != 1 || len(tx.Inputs[0].ID) != 0 {
+			return ruleError(ErrBadCoinbase, "transaction %x: malformed coinbase", tx.ID)
+		}
+		return nil
+	}
+	spent := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out)
+		if spent[outpoint] {
+			return ruleError(ErrDuplicateTxInput, "transaction %x: output %s spent twice", tx.ID, outpoint)
+		}
+		spent[outpoint] = true
+	}
+	return nil
+}
+
+// Returns true if `value` is a valid amount: not negative and not above the maximum supply.
+// Values and sums in this range cannot overflow when they are added.
+func isMoneyRange(value int) bool {
+	return value >= 0 && value <= Params.Subsidy.MaxSupply
+}
+
+// Returns the fee of `tx` (inputs - outputs) where `valuesIn` are the values of the spent outputs.
+// Both the inputs and the outputs must sum up to amounts in the money range.
+func calcTransactionFee(tx *Transaction, valuesIn []int) (int, error) {
+	valueIn := 0
+	for _, value := range valuesIn {
+		if !isMoneyRange(value) {
+			return 0, ruleError(ErrBadTxInValue, "transaction %x: input value %d out of range", tx.ID, value)
+		}
+		valueIn += value
+		if !isMoneyRange(valueIn) {
+			return 0, ruleError(ErrBadTxInValue, "transaction %x: total input value %d out of range", tx.ID, valueIn)
+		}
+	}
+	valueOut := 0
+	for _, out := range tx.Outputs {
+		if !isMoneyRange(out.Value) {
+			return 0, ruleError(ErrBadTxOutValue, "transaction %x: output value %d out of range", tx.ID, out.Value)
+		}
+		valueOut += out.Value
+		if !isMoneyRange(valueOut) {
+			return 0, ruleError(ErrBadTxOutValue, "transaction %x: total output value %d out of range", tx.ID, valueOut)
+		}
+	}
+	if valueIn < valueOut {
+		return 0, ruleError(ErrSpendTooHigh, "transaction %x: outputs (%d) exceed inputs (%d)", tx.ID, valueOut, valueIn)
+	}
+	return valueIn - valueOut, nil
+}
+
+// Returns the median time past of block `hash`: the median timestamp of the block and its 10 ancestors.
+// Unlike the timestamps of single blocks it increases with the height, so lock times are compared with it.
+func medianTimePast(txn *badger.Txn, hash Hash) (int64, error) {
+	var timestamps []int64
+	for len(timestamps) < medianTimeBlocks {
+		b, err := getBlockHeader(txn, hash)
+		if err != nil {
+			return 0, err
+		}
+		timestamps = append(timestamps, b.Timestamp)
+		if b.isGenesisBlock() {
+			break
+		}
+		hash = b.PrevHash
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+// Returns the timestamp of a new block whose previous block has the median time past `medianTime`:
+// the current time, but at least one second after the median time past.
+func nextBlockTime(medianTime int64) int64 {
+	if now := time.Now().Unix(); now > medianTime {
+		return now
+	}
+	return medianTime + 1
+}
+
+// Returns an error unless `tx` is final in the block at `height` whose previous block has the median time past `medianTime`.
+func checkLockTime(tx *Transaction, height uint64, medianTime int64) error {
+	if !tx.isFinal(height, medianTime) {
+		return ruleError(ErrUnfinalizedTx, "transaction %x: lock time %d not reached at height %d, median time %d",
+			tx.ID, tx.LockTime, height, medianTime)
+	}
+	return nil
+}
+
+// Returns an error unless the relative lock time of input `in` has expired in the block at `height` whose previous
+// block has the median time past `medianTime`. The spent output was created in the block at `prevHeight`.
+// Relative lock times in seconds count from the median time past of the block before that block.
+func (v *utxoView) checkSequenceLock(tx *Transaction, in TxInput, prevHeight, height uint64, medianTime int64) error {
+	if in.Sequence&SequenceLockTimeDisabled != 0 {
+		return nil
+	}
+	locked := uint64(in.Sequence & SequenceLockTimeMask)
+	if in.Sequence&SequenceLockTimeIsSeconds == 0 {
+		if height < prevHeight+locked {
+			return ruleError(ErrSequenceLockNotMet, "transaction %x: output %x:%d from height %d locked for %d blocks at height %d",
+				tx.ID, in.ID, in.Out, prevHeight, locked, height)
+		}
+		return nil
+	}
+	if prevHeight > 0 {
+		prevHeight--
+	}
+	hash, err := hashByHeight(v.txn, prevHeight)
+	if err != nil {
+		return err
+	}
+	start, err := medianTimePast(v.txn, hash)
+	if err != nil {
+		return err
+	}
+	if seconds := int64(locked) << SequenceLockTimeGranularity; medianTime < start+seconds {
+		return ruleError(ErrSequenceLockNotMet, "transaction %x: output %x:%d locked for %d seconds after median time %d at median time %d",
+			tx.ID, in.ID, in.Out, seconds, start, medianTime)
+	}
+	return nil
+}
+
+// Validates the inputs of a non-coinbase transaction against the view.
+// `height` is the height of the block which spends the inputs and `medianTime` the median time past
+// of its previous block; the lock time and the relative lock times of the inputs must have expired.
+// The unlocking scripts are verified if `verifyScripts` is set.
+// Returns the transaction fee (inputs - outputs).
+func (v *utxoView) checkTransactionInputs(tx *Transaction, height uint64, medianTime int64, verifyScripts bool) (int, error) {
+	if err := checkLockTime(tx, height, medianTime); err != nil {
+		return 0, err
+	}
+	prevTXs := make(map[string]Transaction)
+	var valuesIn []int
+	for _, in := range tx.Inputs {
+		out := v.output(in)
+		if out == nil {
+			if v.entry(in.ID) != nil {
+				return 0, ruleError(ErrDoubleSpend, "transaction %x: output %x:%d already spent", tx.ID, in.ID, in.Out)
+			}
+			return 0, ruleError(ErrMissingTxOut, "transaction %x: output %x:%d does not exist", tx.ID, in.ID, in.Out)
+		}
+		if outs := v.entry(in.ID); !outs.isMature(height) {
+			return 0, ruleError(ErrImmatureSpend, "transaction %x: coinbase %x from height %d spent at height %d, needs %d confirmations",
+				tx.ID, in.ID, outs.Height, height, Params.CoinbaseMaturity)
+		}
+		if err := v.checkSequenceLock(tx, in, v.entry(in.ID).Height, height, medianTime); err != nil {
+			return 0, err
+		}
+		valuesIn = append(valuesIn, out.Value)
+		prevTXs[hex.EncodeToString(in.ID)] = Transaction{ID: in.ID, Outputs: v.entry(in.ID).Outputs}
+	}
+	fee, err := calcTransactionFee(tx, valuesIn)
+	if err != nil {
+		return 0, err
+	}
+	if !verifyScripts {
+		return fee, nil
+	}
+	if err := tx.verify(prevTXs); err != nil {
+		return 0, ruleError(ErrBadSignature, "transaction %x: %s", tx.ID, err)
+	}
+	return fee, nil
+}
+
+// Validates all transactions of `b` against the view and applies them to the view.
+// The coinbase may claim at most the block subsidy plus all transaction fees.
+// Signatures of migrated legacy blocks are not verified; they were made for an older encoding.
+func (v *utxoView) connectTransactions(b *Block) error {
+	medianTime, err := medianTimePast(v.txn, b.PrevHash)
+	if err != nil {
+		return err
+	}
+	legacy, err := isLegacyBlock(v.txn, b.Hash)
+	if err != nil {
+		return err
+	}
+	fees := 0
+	for _, tx := range b.Transactions {
+		if outs := v.entry(tx.ID); outs != nil && !outs.isFullySpent() {
+			return ruleError(ErrDuplicateTx, "block %x: transaction %x overwrites unspent outputs", b.Hash, tx.ID)
+		}
+		if tx.IsCoinbase() {
+			if err := checkLockTime(tx, b.Height, medianTime); err != nil {
+				return err
+			}
+		} else {
+			fee, err := v.checkTransactionInputs(tx, b.Height, medianTime, !legacy)
+			if err != nil {
+				return err
+			}
+			fees += fee
+			v.spendInputs(tx)
+		}
+		v.addOutputs(tx, b.Height)
+	}
+	claimed := 0
+	for _, out := range b.Transactions[0].Outputs {
+		claimed += out.Value
+	}
+	if allowed := BlockSubsidy(b.Height) + fees; claimed > allowed {
+		return ruleError(ErrBadCoinbaseValue, "block %x: coinbase pays %d, allowed are %d", b.Hash, claimed, allowed)
+	}
+	return nil
+}
+
+// CheckTransaction validates a transaction which is not yet in a block, e.g. for the memory pool.
+// The transaction is checked against the UTXO set as if it was included in the next block;
+// its lock time and the relative lock times of its inputs must have expired by then.
+// Outputs of unconfirmed transactions are spendable if `pending` returns the transaction (nil if unknown).
+// `pending` may be nil. Whether other unconfirmed transactions spend the same outputs is not checked.
+// Returns the transaction fee.
+func (bc *BlockChain) CheckTransaction(tx *Transaction, pending func(id Hash) *Transaction) (int, error) {
+	if err := checkTransactionSanity(tx); err != nil {
+		return 0, err
+	}
+	if tx.IsCoinbase() {
+		return 0, ruleError(ErrBadCoinbase, "transaction %x: coinbase outside of a block", tx.ID)
+	}
+	last := bc.getLastHeader()
+	nextHeight := last.Height + 1
+	var fee int
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		medianTime, err := medianTimePast(txn, last.Hash)
+		if err != nil {
+			return err
+		}
+		view := newUTXOView(txn)
+		if pending != nil {
+			for _, in := range tx.Inputs {
+				if view.entry(in.ID) != nil {
+					continue
+				}
+				if parent := pending(in.ID); parent != nil {
+					view.addOutputs(parent, nextHeight)
+				}
+			}
+		}
+		fee, err = view.checkTransactionInputs(tx, nextHeight, medianTime, true)
+		return err
+	})
+	return fee, err
+}
@@ -0,0 +1,291 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Creates a blockchain in a temporary directory. The genesis reward goes to the returned wallet.
+// Coinbase outputs can be spent at once unless the test sets another coinbase maturity.
+func newTestChain(t testing.TB) (*BlockChain, *Wallet) {
+	w := MakeWallet()
+	return newTestChainFor(t, string(w.Address())), w
+}
+
+// Creates a blockchain in a temporary directory. The genesis reward goes to `address`.
+func newTestChainFor(t testing.TB, address string) *BlockChain {
+	setCoinbaseMaturity(t, 0)
+	opts := badger.DefaultOptions(t.TempDir()).WithLogger(nil)
+	db, err := badger.Open(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	bc := newBlockChain(db)
+	require.NoError(t, bc.writeGenesis(address))
+	UTXOSet{bc}.Reindex()
+	return bc
+}
+
+// Creates a block without adding it to a blockchain.
+func mustCreateBlock(t *testing.T, txs []*Transaction, prevHash Hash, height uint64, bits uint32) *Block {
+	b, err := createBlock(txs, prevHash, height, bits)
+	require.NoError(t, err)
+	return b
+}
+
+// Sets the coinbase maturity for the duration of the test.
+func setCoinbaseMaturity(t testing.TB, maturity uint64) {
+	old := Params.CoinbaseMaturity
+	Params.CoinbaseMaturity = maturity
+	t.Cleanup(func() { Params.CoinbaseMaturity = old })
+}
+
+// Asserts that `err` is a RuleError with `code`.
+func assertRuleError(t *testing.T, err error, code ErrorCode) {
+	var ruleErr RuleError
+	if assert.True(t, errors.As(err, &ruleErr), "expected RuleError, got %v", err) {
+		assert.Equal(t, code, ruleErr.Code, ruleErr.Description)
+	}
+}
+
+func TestAddBlockAcceptsValidBlock(t *testing.T) {
+	bc, w := newTestChain(t)
+	tx := newTestTransaction(t, w, string(MakeWallet().Address()), 5, 0, &UTXOSet{bc})
+	block, err := bc.MineBlock([]*Transaction{CoinbaseTx(string(w.Address()), BlockSubsidy(1)), tx})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), bc.BestHeight())
+	assert.Equal(t, block.Hash, bc.getLastHash())
+	assertRuleError(t, bc.AddBlock(block), ErrDuplicateBlock)
+}
+
+func TestAddBlockRejectsInvalidBlocks(t *testing.T) {
+	bc, w := newTestChain(t)
+	last := bc.getLastBlock()
+	address := string(w.Address())
+
+	// Proof of work was never run.
+	b := &Block{BlockHeader: BlockHeader{Version: blockVersion, PrevHash: last.Hash, Timestamp: last.Timestamp, Bits: last.Bits}, Height: 1}
+	b.Transactions = []*Transaction{CoinbaseTx(address, BlockSubsidy(1))}
+	b.MerkleRoot = b.hashTransactions()
+	for b.IsValidBlockHeader() {
+		b.Nonce++
+	}
+	b.Hash = b.CalcHash()
+	assertRuleError(t, bc.AddBlock(b), ErrBadProofOfWork)
+
+	// Hash does not belong to the header.
+	b = mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(1))}, last.Hash, 1, last.Bits)
+	b.Hash = doubleHash256(b.Hash)
+	assertRuleError(t, bc.AddBlock(b), ErrBadBlockHash)
+
+	// Transactions do not match the Merkle root.
+	b = mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(1))}, last.Hash, 1, last.Bits)
+	b.Transactions = []*Transaction{CoinbaseTx(address, BlockSubsidy(1))}
+	assertRuleError(t, bc.AddBlock(b), ErrBadMerkleRoot)
+
+	// Wrong height.
+	b = mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(1))}, last.Hash, 5, last.Bits)
+	assertRuleError(t, bc.AddBlock(b), ErrBadHeight)
+
+	// Wrong target.
+	b = mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(1))}, last.Hash, 1, BigToCompact(new(big.Int).Rsh(Params.PowLimit, 1)))
+	assertRuleError(t, bc.AddBlock(b), ErrBadDifficulty)
+
+	// Unknown parent.
+	b = mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(1))}, doubleHash256([]byte("unknown")), 1, last.Bits)
+	assertRuleError(t, bc.AddBlock(b), ErrOrphanBlock)
+
+	// Block too big.
+	b = mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(1), strings.Repeat("x", MaxBlockSize))}, last.Hash, 1, last.Bits)
+	assertRuleError(t, bc.AddBlock(b), ErrBlockTooBig)
+
+	// Coinbase is not the first transaction.
+	tx := newTestTransaction(t, w, address, 5, 0, &UTXOSet{bc})
+	b = mustCreateBlock(t, []*Transaction{tx, CoinbaseTx(address, BlockSubsidy(1))}, last.Hash, 1, last.Bits)
+	assertRuleError(t, bc.AddBlock(b), ErrFirstTxNotCoinbase)
+
+	// Coinbase pays too much.
+	cb := CoinbaseTx(address, BlockSubsidy(1)+1)
+	b = mustCreateBlock(t, []*Transaction{cb}, last.Hash, 1, last.Bits)
+	assertRuleError(t, bc.AddBlock(b), ErrBadCoinbaseValue)
+
+	// Tampered transaction.
+	tampered := *tx
+	tampered.Outputs = append([]TxOutput{}, tx.Outputs...)
+	tampered.Outputs[0].ScriptPubKey = script.PayToPubKeyHash(PublicKeyHash(MakeWallet().PublicKey))
+	tampered.ID = tampered.calcTransactionID()
+	b = mustCreateBlock(t, []*Transaction{CoinbaseTx(address, BlockSubsidy(1)), &tampered}, last.Hash, 1, last.Bits)
+	assertRuleError(t, bc.AddBlock(b), ErrBadSignature)
+
+	assert.Equal(t, uint64(0), bc.BestHeight())
+}
+
+func TestAddBlockRejectsDoubleSpend(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	tx1 := newTestTransaction(t, w, string(MakeWallet().Address()), 5, 0, &UTXOSet{bc})
+	tx2 := newTestTransaction(t, w, string(MakeWallet().Address()), 6, 0, &UTXOSet{bc})
+
+	// Both transactions in the same block.
+	_, err := bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)), tx1, tx2})
+	assertRuleError(t, err, ErrDoubleSpend)
+
+	// Second transaction in a later block.
+	// The spent output's entry has been removed from the UTXO set.
+	_, err = bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)), tx1})
+	require.NoError(t, err)
+	_, err = bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)), tx2})
+	assertRuleError(t, err, ErrMissingTxOut)
+}
+
+func TestRejectsOverflowingValues(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	cb := bc.getLastBlock().Transactions[0]
+	withOutputs := func(values ...int) *Transaction {
+		tx := &Transaction{Inputs: []TxInput{{ID: cb.ID, Out: 0, Sequence: MaxTxInSequenceNum}}}
+		for _, value := range values {
+			tx.Outputs = append(tx.Outputs, *newTXOutput(value, address))
+		}
+		tx.ID = tx.calcTransactionID()
+		tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(cb.ID): *cb})
+		return tx
+	}
+
+	// The outputs wrap around to 8 if summed without checks, leaving a fee of 12.
+	overflow := withOutputs(math.MaxInt64, math.MaxInt64, 10)
+	_, err := bc.CheckTransaction(overflow, nil)
+	assertRuleError(t, err, ErrBadTxOutValue)
+	_, err = bc.CalcFee(overflow)
+	assertRuleError(t, err, ErrBadTxOutValue)
+	_, err = bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)+12), overflow})
+	assertRuleError(t, err, ErrBadTxOutValue)
+	tmpl, err := bc.NewBlockTemplate(address, []*Transaction{overflow})
+	require.NoError(t, err)
+	assert.Len(t, tmpl.Block.Transactions, 1)
+	assert.Equal(t, 0, tmpl.TotalFees())
+
+	// Each output is valid but not their sum.
+	max := Params.Subsidy.MaxSupply
+	_, err = bc.CheckTransaction(withOutputs(max, 1), nil)
+	assertRuleError(t, err, ErrBadTxOutValue)
+	_, err = calcTransactionFee(withOutputs(1), []int{max, max})
+	assertRuleError(t, err, ErrBadTxInValue)
+
+	fee, err := bc.CheckTransaction(withOutputs(cb.Outputs[0].Value-3, 1), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fee)
+	assert.Equal(t, uint64(0), bc.BestHeight())
+}
+
+// Mines a block with `timestamp` on top of the last block and adds it to the blockchain.
+func mineAt(t *testing.T, bc *BlockChain, timestamp int64, txs ...*Transaction) error {
+	last := bc.getLastHeader()
+	b, err := createBlockAt(timestamp, txs, last.Hash, last.Height+1, bc.calcNextRequiredBits(last))
+	require.NoError(t, err)
+	return bc.AddBlock(b)
+}
+
+// Returns a transaction of `w` spending output `out` of `prev` with `sequence` and `lockTime`.
+func spendLocked(w *Wallet, prev *Transaction, out int, sequence, lockTime uint32) *Transaction {
+	tx := &Transaction{
+		Inputs:   []TxInput{{ID: prev.ID, Out: out, Sequence: sequence}},
+		Outputs:  []TxOutput{*newTXOutput(prev.Outputs[out].Value-1, string(w.Address()))},
+		LockTime: lockTime,
+	}
+	tx.ID = tx.calcTransactionID()
+	tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prev.ID): *prev})
+	return tx
+}
+
+func TestLockTime(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	cb := bc.getLastBlock().Transactions[0]
+
+	// Lock time as block height: the transaction can go into blocks above height 1.
+	locked := spendLocked(w, cb, 0, MaxRBFSequence, 1)
+	_, err := bc.CheckTransaction(locked, nil)
+	assertRuleError(t, err, ErrUnfinalizedTx)
+	_, err = bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)+1), locked})
+	assertRuleError(t, err, ErrUnfinalizedTx)
+	// Final inputs disable the lock time.
+	_, err = bc.CheckTransaction(spendLocked(w, cb, 0, MaxTxInSequenceNum, 1), nil)
+	assert.NoError(t, err)
+
+	mineCoinbase(t, bc, w)
+	_, err = bc.CheckTransaction(locked, nil)
+	assert.NoError(t, err)
+
+	// Lock time as Unix time: compared with the median time past of the previous block.
+	lockTime := time.Now().Unix() + 3600
+	locked = spendLocked(w, cb, 0, MaxRBFSequence, uint32(lockTime))
+	assert.Less(t, bc.MedianTimePast(), lockTime)
+	_, err = bc.CheckTransaction(locked, nil)
+	assertRuleError(t, err, ErrUnfinalizedTx)
+	err = mineAt(t, bc, lockTime+1, CoinbaseTx(address, BlockSubsidy(2)+1), locked)
+	assertRuleError(t, err, ErrUnfinalizedTx)
+	require.NoError(t, mineAt(t, bc, lockTime+1, CoinbaseTx(address, BlockSubsidy(2))))
+	require.NoError(t, mineAt(t, bc, lockTime+1, CoinbaseTx(address, BlockSubsidy(3))))
+	assert.Equal(t, lockTime+1, bc.MedianTimePast())
+	require.NoError(t, mineAt(t, bc, lockTime+2, CoinbaseTx(address, BlockSubsidy(4)+1), locked))
+}
+
+func TestSequenceLocks(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+	genesis := bc.getLastBlock()
+	cb := genesis.Transactions[0]
+
+	// Relative lock time in blocks: the output of height 0 can be spent at height 2.
+	locked := spendLocked(w, cb, 0, 2, 0)
+	_, err := bc.CheckTransaction(locked, nil)
+	assertRuleError(t, err, ErrSequenceLockNotMet)
+	_, err = bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(1)+1), locked})
+	assertRuleError(t, err, ErrSequenceLockNotMet)
+	_, err = bc.CheckTransaction(spendLocked(w, cb, 0, SequenceLockTimeDisabled|2, 0), nil)
+	assert.NoError(t, err)
+	require.NoError(t, mineAt(t, bc, genesis.Timestamp+100, CoinbaseTx(address, BlockSubsidy(1))))
+	_, err = bc.CheckTransaction(locked, nil)
+	assert.NoError(t, err)
+
+	// Relative lock time in seconds counts from the median time past of the block before the output's block.
+	locked = spendLocked(w, cb, 0, SequenceLockTimeIsSeconds|1, 0)
+	require.NoError(t, mineAt(t, bc, genesis.Timestamp+1000, CoinbaseTx(address, BlockSubsidy(2))))
+	assert.Equal(t, genesis.Timestamp+100, bc.MedianTimePast())
+	_, err = bc.CheckTransaction(locked, nil)
+	assertRuleError(t, err, ErrSequenceLockNotMet)
+	require.NoError(t, mineAt(t, bc, genesis.Timestamp+1000, CoinbaseTx(address, BlockSubsidy(3))))
+	assert.Equal(t, genesis.Timestamp+1000, bc.MedianTimePast())
+	require.NoError(t, mineAt(t, bc, genesis.Timestamp+1001, CoinbaseTx(address, BlockSubsidy(4)+1), locked))
+}
+
+func TestRejectsTimestampNotAfterMedianTimePast(t *testing.T) {
+	bc, w := newTestChain(t)
+	address := string(w.Address())
+
+	// Blocks from the future raise the median time past above the current time.
+	future := time.Now().Unix() + 3600
+	for bc.MedianTimePast() < future {
+		require.NoError(t, mineAt(t, bc, future, CoinbaseTx(address, BlockSubsidy(bc.BestHeight()+1))))
+	}
+	assertRuleError(t, mineAt(t, bc, future, CoinbaseTx(address, BlockSubsidy(bc.BestHeight()+1))), ErrTimeTooOld)
+	assertRuleError(t, mineAt(t, bc, time.Now().Unix(), CoinbaseTx(address, BlockSubsidy(bc.BestHeight()+1))), ErrTimeTooOld)
+
+	// New blocks are stamped after the median time past.
+	tmpl, err := bc.NewBlockTemplate(address, nil)
+	require.NoError(t, err)
+	assert.Equal(t, future+1, tmpl.Block.Timestamp)
+	b, err := bc.MineBlock([]*Transaction{CoinbaseTx(address, BlockSubsidy(bc.BestHeight()+1))})
+	require.NoError(t, err)
+	assert.Equal(t, future+1, b.Timestamp)
+}
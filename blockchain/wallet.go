@@ -6,8 +6,10 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"math/big"
 
 	"github.com/mkohlhaas/gobc/bcerror"
+	"github.com/mkohlhaas/gobc/script"
 	"golang.org/x/crypto/ripemd160"
 )
 
@@ -17,12 +19,30 @@ type Wallet struct {
 	PublicKey  []byte
 }
 
+// PKToAddress returns the address of `pubKey` on the active network.
 func PKToAddress(pubKey []byte) []byte {
-	pubHash := PublicKeyHash(pubKey)
-	versionedHash := append([]byte{0}, pubHash...)
+	return encodeAddress(Params.PubKeyHashAddrID, PublicKeyHash(pubKey))
+}
+
+// ScriptToAddress returns the pay-to-script-hash address of `redeemScript` on the active network.
+func ScriptToAddress(redeemScript script.Script) []byte {
+	return encodeAddress(Params.ScriptHashAddrID, redeemScript.Hash160())
+}
+
+// Returns the address of `hash`: version, hash and checksum in Base58.
+func encodeAddress(version byte, hash []byte) []byte {
+	versionedHash := append([]byte{version}, hash...)
 	checksum := Checksum(versionedHash)
-	hash := append(versionedHash, checksum...)
-	return Base58Encode(hash)
+	return Base58Encode(append(versionedHash, checksum...))
+}
+
+// LockingScript returns the script locking outputs to `address`: pay-to-public-key-hash for wallet addresses,
+// pay-to-script-hash for script addresses. `address` must be valid.
+func LockingScript(address string) script.Script {
+	if Base58Decode([]byte(address))[0] == Params.ScriptHashAddrID {
+		return script.PayToScriptHash(PKHFrom([]byte(address)))
+	}
+	return script.PayToPubKeyHash(PKHFrom([]byte(address)))
 }
 
 // https://raw.githubusercontent.com/kallerosenbaum/grokkingbitcoin/master/images/ch03/03-13.svg
@@ -38,10 +58,20 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	curve := elliptic.P256()
 	sKey, err := ecdsa.GenerateKey(curve, rand.Reader)
 	bcerror.Handle(err)
-	pKey := append(sKey.PublicKey.X.Bytes(), sKey.PublicKey.Y.Bytes()...)
+	// Both coordinates have a fixed size of 32 bytes.
+	pKey := append(sKey.PublicKey.X.FillBytes(make([]byte, 32)), sKey.PublicKey.Y.FillBytes(make([]byte, 32))...)
 	return *sKey, pKey
 }
 
+// Restores a private key from its secret scalar `d`.
+func newPrivateKey(d []byte) ecdsa.PrivateKey {
+	curve := elliptic.P256()
+	sKey := ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	sKey.PublicKey.Curve = curve
+	sKey.PublicKey.X, sKey.PublicKey.Y = curve.ScalarBaseMult(d)
+	return sKey
+}
+
 // Create a new wallet.
 func MakeWallet() *Wallet {
 	private, public := newKeyPair()
@@ -73,11 +103,15 @@ func Checksum(payload []byte) []byte {
 }
 
 // https://raw.githubusercontent.com/kallerosenbaum/grokkingbitcoin/master/images/ch03/03-15.svg
-// Checks checksum of address.
+// Checks checksum of address and that it belongs to the active network.
+// Both wallet (public key hash) and script hash addresses are valid.
 func Validate(address string) bool {
 	pubKeyHash := Base58Decode([]byte(address))
 	actualChecksum := pubKeyHash[len(pubKeyHash)-4:]
 	version := pubKeyHash[0]
+	if version != Params.PubKeyHashAddrID && version != Params.ScriptHashAddrID {
+		return false
+	}
 	pubKeyHash = PKHFrom([]byte(address))
 	calculatedChecksum := Checksum(append([]byte{version}, pubKeyHash...))
 	return bytes.Compare(actualChecksum, calculatedChecksum) == 0
@@ -1,17 +1,14 @@
 package blockchain
 
 import (
-	"bytes"
-	"crypto/elliptic"
-	"encoding/gob"
 	"fmt"
 	"os"
+	"sort"
 
 	"github.com/mkohlhaas/gobc/bcerror"
+	"github.com/mkohlhaas/gobc/wire"
 )
 
-const walletFile = "./tmp/wallets_%s.data"
-
 type Wallets struct {
 	// map: Bitcoin Address → Wallet
 	Wallets map[string]*Wallet
@@ -50,33 +47,51 @@ func (ws Wallets) GetWallet(address string) Wallet {
 }
 
 // Saves wallets into a file.
+// Format: version, number of wallets, wallets (address, private key, public key) sorted by address.
 func (ws *Wallets) SaveFile(nodeId string) {
-	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile, nodeId)
-	// NOTE: Works only with Go version 1.18.x!
-	gob.Register(elliptic.P256())
-	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
+	walletFile := Params.walletPath(nodeId)
+	addresses := ws.GetAllAddresses()
+	sort.Strings(addresses)
+	w := wire.NewWriter()
+	w.WriteVersion()
+	w.WriteVarInt(uint64(len(addresses)))
+	for _, address := range addresses {
+		wallet := ws.Wallets[address]
+		w.WriteString(address)
+		w.WriteVarBytes(wallet.PrivateKey.D.FillBytes(make([]byte, 32)))
+		w.WriteVarBytes(wallet.PublicKey)
+	}
+	err := os.MkdirAll(Params.DataDir, 0755)
 	bcerror.Handle(err)
-	err = os.WriteFile(walletFile, content.Bytes(), 0644)
+	err = os.WriteFile(walletFile, w.Bytes(), 0644)
 	bcerror.Handle(err)
 }
 
-// Loads wallet file for `nodeId`.
-// Returns an error If file does not exist.
+// Loads wallet file for `nodeId`. Files written with encoding/gob by older versions are migrated.
+// Returns an error If file does not exist or cannot be decoded.
 func (ws *Wallets) LoadFile(nodeId string) error {
-	walletFile := fmt.Sprintf(walletFile, nodeId)
+	walletFile := Params.walletPath(nodeId)
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
-	var wallets Wallets
 	fileContent, err := os.ReadFile(walletFile)
 	bcerror.Handle(err)
-	// NOTE: Works only with Go version 1.18.x!
-	gob.Register(elliptic.P256())
-	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&wallets)
-	bcerror.Handle(err)
-	ws.Wallets = wallets.Wallets
+	wallets := make(map[string]*Wallet)
+	r := wire.NewReader(fileContent)
+	r.ReadVersion()
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		address := r.ReadString()
+		privateKey := r.ReadVarBytes()
+		publicKey := r.ReadVarBytes()
+		wallets[address] = &Wallet{newPrivateKey(privateKey), publicKey}
+	}
+	if err := r.Finish(); err != nil {
+		// Files written by older versions were encoded with encoding/gob.
+		if migrateErr := ws.migrateFile(nodeId, fileContent); migrateErr == nil {
+			return nil
+		}
+		return fmt.Errorf("reading wallet file %s: %w", walletFile, err)
+	}
+	ws.Wallets = wallets
 	return nil
 }
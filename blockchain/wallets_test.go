@@ -0,0 +1,52 @@
+package blockchain
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Sets an empty data directory for the duration of the test.
+func useTempDataDir(t *testing.T) {
+	params := *Params
+	params.DataDir = t.TempDir()
+	old := Params
+	Params = &params
+	t.Cleanup(func() { Params = old })
+}
+
+func TestMigrateGobWalletFile(t *testing.T) {
+	useTempDataDir(t) // the wallets of the old file have main network addresses
+	data, err := os.ReadFile(filepath.Join("..", "tmp", "wallets_3000.data"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(Params.walletPath("3000"), data, 0644))
+
+	wallets, err := OpenWallets("3000")
+	require.NoError(t, err)
+	require.NotEmpty(t, wallets.Wallets)
+	for address, w := range wallets.Wallets {
+		assert.Equal(t, address, string(w.Address()))
+		assert.True(t, bytes.Equal(w.PublicKey, append(w.PrivateKey.X.FillBytes(make([]byte, 32)), w.PrivateKey.Y.FillBytes(make([]byte, 32))...)))
+	}
+	backup, err := os.ReadFile(Params.walletPath("3000") + ".gob")
+	require.NoError(t, err)
+	assert.Equal(t, data, backup)
+
+	// The file was rewritten with the binary encoding.
+	reopened, err := OpenWallets("3000")
+	require.NoError(t, err)
+	assert.Equal(t, wallets.Wallets, reopened.Wallets)
+}
+
+func TestOpenWalletsRejectsGarbage(t *testing.T) {
+	useTempDataDir(t)
+	require.NoError(t, os.WriteFile(Params.walletPath("1"), []byte("garbage"), 0644))
+	_, err := OpenWallets("1")
+	assert.Error(t, err)
+	_, err = OpenWallets("2")
+	assert.True(t, os.IsNotExist(err))
+}
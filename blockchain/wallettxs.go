@@ -0,0 +1,75 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/mkohlhaas/gobc/bcerror"
+	"github.com/mkohlhaas/gobc/wire"
+)
+
+// WalletTransactions are the transactions sent by the wallets of a node.
+// They are kept so that unconfirmed transactions can be replaced later; see BumpFee.
+type WalletTransactions struct {
+	// map: transaction ID (hex) → transaction
+	Transactions map[string]*Transaction
+}
+
+// OpenWalletTransactions loads the wallet transactions of `nodeID`.
+// Returns no transactions if the file does not exist yet.
+func OpenWalletTransactions(nodeID string) (*WalletTransactions, error) {
+	wt := &WalletTransactions{Transactions: make(map[string]*Transaction)}
+	file := Params.walletTxPath(nodeID)
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return wt, nil
+	}
+	bcerror.Handle(err)
+	r := wire.NewReader(data)
+	r.ReadVersion()
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		tx := decodeTransaction(r)
+		wt.Transactions[hex.EncodeToString(tx.ID)] = tx
+	}
+	if err := r.Finish(); err != nil {
+		return nil, fmt.Errorf("reading wallet transactions %s (files written by older versions are not supported): %w", file, err)
+	}
+	return wt, nil
+}
+
+// Add adds transaction `tx`.
+func (wt *WalletTransactions) Add(tx *Transaction) {
+	wt.Transactions[hex.EncodeToString(tx.ID)] = tx
+}
+
+// Get returns transaction `id` or nil if the wallets did not send it.
+func (wt *WalletTransactions) Get(id Hash) *Transaction {
+	return wt.Transactions[hex.EncodeToString(id)]
+}
+
+// Remove removes transaction `id`.
+func (wt *WalletTransactions) Remove(id Hash) {
+	delete(wt.Transactions, hex.EncodeToString(id))
+}
+
+// SaveFile saves the wallet transactions of `nodeID`.
+// Format: version, number of transactions, transactions sorted by ID.
+func (wt *WalletTransactions) SaveFile(nodeID string) {
+	var ids []string
+	for id := range wt.Transactions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	w := wire.NewWriter()
+	w.WriteVersion()
+	w.WriteVarInt(uint64(len(ids)))
+	for _, id := range ids {
+		wt.Transactions[id].encode(w)
+	}
+	err := os.MkdirAll(Params.DataDir, 0755)
+	bcerror.Handle(err)
+	err = os.WriteFile(Params.walletTxPath(nodeID), w.Bytes(), 0644)
+	bcerror.Handle(err)
+}
@@ -1,46 +1,107 @@
 package cli
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mkohlhaas/gobc/blockchain"
 	"github.com/mkohlhaas/gobc/network"
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/mkohlhaas/gobc/stratum"
 )
 
 type CommandLine struct{}
 
 func (cli *CommandLine) printUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-network mainnet|testnet|regtest] COMMAND")
 	fmt.Println(" getbalance -address ADDRESS - get the balance for an address")
 	fmt.Println(" createblockchain -address ADDRESS creates a blockchain and sends genesis reward to address")
 	fmt.Println(" printchain - Prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT -mine - Send amount of coins. Then -mine flag is set, mine off of this node")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT [-fee FEE] -mine - Send amount of coins and pay a fee (default 1) to the miner. Then -mine flag is set, mine off of this node")
+	fmt.Println(" bumpfee -txid TXID [-fee FEE] - Replace an unconfirmed transaction sent by our wallets by one paying FEE (default: one more than before)")
 	fmt.Println(" createwallet - Creates a new Wallet")
+	fmt.Println(" getpubkey -address ADDRESS - Prints the public key of a wallet, e.g. for createmultisig on another node")
+	fmt.Println(" createmultisig -m M -keys KEY,KEY,... - Creates an address needing M signatures of the keys (public keys in hex or addresses of our wallets)")
+	fmt.Println(" spendmultisig -from ADDRESS -to TO -amount AMOUNT [-fee FEE] -file FILE - Writes a transaction from a multisig address to FILE, signed by our wallets")
+	fmt.Println(" signtx -file FILE - Adds the signatures of our wallets to the multisig transaction in FILE")
+	fmt.Println(" sendtx -file FILE - Sends the completely signed transaction in FILE")
+	fmt.Println(" initiate -from FROM -to TO -amount AMOUNT [-fee FEE] [-locktime DURATION | -lockblocks N] -mine - Pays to a new hash time-locked contract for TO refundable after DURATION (default 48h) or N blocks (regtest only) and prints its secret")
+	fmt.Println(" participate -from FROM -to TO -amount AMOUNT -secrethash HASH [-fee FEE] [-locktime DURATION | -lockblocks N] -mine - Pays to a contract for the secret of the initiator refundable after DURATION (default 24h) or N blocks (regtest only)")
+	fmt.Println(" auditcontract -contract CONTRACT -txid TXID - Prints the contract paid by transaction TXID")
+	fmt.Println(" redeem -contract CONTRACT -txid TXID -secret SECRET [-fee FEE] -mine - Spends the contract with its secret")
+	fmt.Println(" refund -contract CONTRACT -txid TXID [-fee FEE] -mine - Spends the contract after its lock time; a time has passed once the median time past of the last blocks is after it")
+	fmt.Println(" extractsecret -txid TXID -secrethash HASH - Prints the secret revealed by the redeem transaction TXID")
 	fmt.Println(" listaddresses - Lists the addresses in our wallet file")
 	fmt.Println(" reindexutxo - Rebuilds the UTXO set")
-	fmt.Println(" startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println(" reindextx - Rebuilds the transaction and height indexes")
+	fmt.Println(" getblock -height HEIGHT - Prints the block at HEIGHT of the main chain")
+	fmt.Println(" getblocktemplate -address ADDRESS - Prints a block template paying to ADDRESS from the running node with ID specified in NODE_ID env. var. for external miners")
+	fmt.Println(" generate -blocks N -address ADDRESS - Mines N blocks paying to ADDRESS at once (regtest only)")
+	fmt.Println(" startnode -miner ADDRESS [-threads N] [-stratum HOST:PORT] - Start a node with ID specified in NODE_ID env. var. -miner enables mining on N cores (default all); with -stratum external workers mine instead")
+	fmt.Println(" worker -connect HOST:PORT [-name NAME] [-threads N] - Mine for the job server of a node on N cores (default all)")
 }
-func (cli *CommandLine) validateArgs() {
-	if len(os.Args) < 2 {
+func (cli *CommandLine) validateArgs(args []string) {
+	if len(args) < 1 {
 		cli.printUsage()
 		runtime.Goexit()
 	}
 }
-func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
+func (cli *CommandLine) StartNode(nodeID, minerAddress, stratumAddress string) {
 	fmt.Printf("Starting Node %s\n", nodeID)
 	if len(minerAddress) > 0 {
 		if blockchain.Validate(minerAddress) {
 			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
+			if len(stratumAddress) > 0 {
+				fmt.Printf("Job server for external workers listening on %s\n", stratumAddress)
+			} else {
+				fmt.Printf("Mining with %d threads\n", blockchain.DefaultMiner.Threads)
+			}
 		} else {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	network.StartServer(nodeID, minerAddress)
+	network.StartServer(nodeID, minerAddress, stratumAddress)
+}
+func (cli *CommandLine) worker(address, name string, threads int) {
+	w, err := stratum.Dial(address, name, threads)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer w.Close()
+	fmt.Printf("Worker %s mining for %s with %d threads\n", name, address, w.Threads)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				printWorkerStats(w.Stats())
+			}
+		}
+	}()
+	if err := w.Run(ctx); err != nil {
+		fmt.Println(err)
+	}
+	printWorkerStats(w.Stats())
+}
+func printWorkerStats(s stratum.WorkerStats) {
+	fmt.Printf("Shares: %d accepted, %d rejected (%d stale), blocks: %d, %.0f hashes/s\n",
+		s.AcceptedShares, s.RejectedShares, s.StaleShares, s.Blocks, s.Hashrate())
 }
 func (cli *CommandLine) reindexUTXO(nodeID string) {
 	chain := blockchain.OpenBlockChain(nodeID)
@@ -51,19 +112,192 @@ func (cli *CommandLine) reindexUTXO(nodeID string) {
 	count := UTXOSet.CountTransactions()
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
+func (cli *CommandLine) reindexTransactions(nodeID string) {
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	count := chain.ReindexTransactions()
+	chain.ReindexHeights()
+	fmt.Printf("Done! There are %d transactions in the transaction index.\n", count)
+}
+func (cli *CommandLine) getBlock(height uint64, nodeID string) {
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	block, err := chain.GetBlockByHeight(height)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Hash: %x\n", block.Hash)
+	fmt.Println(block)
+}
+func (cli *CommandLine) getBlockTemplate(address, nodeID string) {
+	if !blockchain.Validate(address) {
+		log.Panic("Address is not Valid")
+	}
+	result, err := network.GetBlockTemplate("localhost:"+nodeID, address)
+	if err != nil {
+		log.Panic(err)
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(string(data))
+}
 func (cli *CommandLine) listAddresses(nodeID string) {
-	wallets, _ := blockchain.OpenWallets(nodeID)
+	wallets, err := blockchain.OpenWallets(nodeID)
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
+	}
 	addresses := wallets.GetAllAddresses()
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
 }
 func (cli *CommandLine) createWallet(nodeID string) {
-	wallets, _ := blockchain.OpenWallets(nodeID)
+	// Only a missing file is created; a file which cannot be read must not be overwritten.
+	wallets, err := blockchain.OpenWallets(nodeID)
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
+	}
 	address := wallets.AddWallet()
 	wallets.SaveFile(nodeID)
 	fmt.Printf("New address is: %s\n", address)
 }
+func (cli *CommandLine) getPubKey(address, nodeID string) {
+	wallets, err := blockchain.OpenWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	if _, ok := wallets.Wallets[address]; !ok {
+		log.Panicf("Wallet %s not found", address)
+	}
+	fmt.Printf("%x\n", wallets.GetWallet(address).PublicKey)
+}
+func (cli *CommandLine) createMultiSig(m int, keys []string, nodeID string) {
+	wallets, err := blockchain.OpenWallets(nodeID)
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
+	}
+	var pubKeys [][]byte
+	for _, key := range keys {
+		if wallet, ok := wallets.Wallets[key]; ok {
+			pubKeys = append(pubKeys, wallet.PublicKey)
+			continue
+		}
+		pubKey, err := hex.DecodeString(key)
+		if err != nil {
+			log.Panicf("%s is neither a public key nor the address of one of our wallets", key)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+	redeemScript, err := blockchain.NewMultiSigScript(m, pubKeys)
+	if err != nil {
+		log.Panic(err)
+	}
+	scripts, err := blockchain.OpenRedeemScripts(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	address := scripts.Add(redeemScript)
+	scripts.SaveFile(nodeID)
+	fmt.Printf("Multisig address (%d of %d): %s\n", m, len(pubKeys), address)
+	fmt.Printf("Redeem script: %x\n", []byte(redeemScript))
+}
+func (cli *CommandLine) spendMultiSig(from, to string, amount, fee int, file, nodeID string) {
+	if !blockchain.Validate(to) {
+		log.Panic("Address is not Valid")
+	}
+	scripts, err := blockchain.OpenRedeemScripts(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	redeemScript := scripts.Get(from)
+	if redeemScript == nil {
+		log.Panicf("Multisig address %s not found; create it with createmultisig first", from)
+	}
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	tx, err := blockchain.NewMultiSigTransaction(redeemScript, to, amount, fee, &blockchain.UTXOSet{Blockchain: chain})
+	if err != nil {
+		log.Panic(err)
+	}
+	cli.signMultiSig(chain, tx, nodeID)
+	writeTxFile(file, tx)
+}
+func (cli *CommandLine) signTx(file, nodeID string) {
+	tx := readTxFile(file)
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	cli.signMultiSig(chain, tx, nodeID)
+	writeTxFile(file, tx)
+}
+
+// Adds the signatures of all our wallets which are signers of the multisig inputs of `tx`.
+// The redeem scripts are the last elements of the unlocking scripts.
+func (cli *CommandLine) signMultiSig(chain *blockchain.BlockChain, tx *blockchain.Transaction, nodeID string) {
+	wallets, err := blockchain.OpenWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	signed := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		data := in.ScriptSig.PushedData()
+		if len(data) < 2 || signed[string(data[len(data)-1])] {
+			continue
+		}
+		redeemScript := script.Script(data[len(data)-1])
+		signed[string(redeemScript)] = true
+		_, pubKeys := redeemScript.MultiSigKeys()
+		for _, pubKey := range pubKeys {
+			address := string(blockchain.PKToAddress(pubKey))
+			if _, ok := wallets.Wallets[address]; !ok {
+				continue
+			}
+			wallet := wallets.GetWallet(address)
+			missing, err := chain.SignMultiSig(tx, &wallet, redeemScript)
+			if err != nil {
+				log.Panic(err)
+			}
+			fmt.Printf("Signed with %s, %d signatures missing\n", address, missing)
+		}
+	}
+}
+func (cli *CommandLine) sendTx(file, nodeID string) {
+	tx := readTxFile(file)
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	if _, err := chain.CheckTransaction(tx, nil); err != nil {
+		log.Panic(err)
+	}
+	network.SendTx(blockchain.Params.SeedNodes[0], tx)
+	fmt.Printf("Success! Transaction %x\n", tx.ID)
+}
+
+// Writes transaction `tx` to `file` in hex.
+func writeTxFile(file string, tx *blockchain.Transaction) {
+	err := os.WriteFile(file, []byte(hex.EncodeToString(tx.Serialize())+"\n"), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Transaction %x written to %s\n", tx.ID, file)
+}
+
+// Reads a transaction written by writeTxFile.
+func readTxFile(file string) *blockchain.Transaction {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		log.Panic(err)
+	}
+	tx, err := blockchain.DeserializeTransaction(raw)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &tx
+}
 func (cli *CommandLine) printChain(nodeID string) {
 	bc := blockchain.OpenBlockChain(nodeID)
 	defer bc.Database.Close()
@@ -72,15 +306,22 @@ func (cli *CommandLine) printChain(nodeID string) {
 		block := iter.GetNext()
 		fmt.Printf("Hash: %x\n", block.Hash)
 		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
-		block.RunProof()
 		fmt.Printf("PoW: %s\n", strconv.FormatBool(block.IsValidBlockHeader()))
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
 		fmt.Println()
-		if len(block.PrevHash) == 0 {
-			break
-		}
+	}
+}
+func (cli *CommandLine) generate(n int, address, nodeID string) {
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	blocks, err := chain.Generate(n, address)
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, block := range blocks {
+		fmt.Printf("%x\n", block.Hash)
 	}
 }
 func (cli *CommandLine) createBlockChain(address, nodeID string) {
@@ -101,14 +342,13 @@ func (cli *CommandLine) getBalance(address, nodeID string) {
 	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 	balance := 0
-	pubKeyHash := blockchain.PKHFrom([]byte(address))
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	UTXOs := UTXOSet.FindUnspentTransactions(blockchain.LockingScript(address))
 	for _, out := range UTXOs {
 		balance += out.Value
 	}
 	fmt.Printf("Balance of %s: %d\n", address, balance)
 }
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CommandLine) send(from, to string, amount, fee int, nodeID string, mineNow bool) {
 	if !blockchain.Validate(to) {
 		log.Panic("Address is not Valid")
 	}
@@ -123,20 +363,90 @@ func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow
 		log.Panic(err)
 	}
 	wallet := wallets.GetWallet(from)
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
+	tx, err := blockchain.NewTransaction(&wallet, to, amount, fee, &UTXOSet)
+	if err != nil {
+		log.Panic(err)
+	}
 	if mineNow {
-		cbTx := blockchain.CoinbaseTx(from)
+		cbTx := blockchain.CoinbaseTx(from, blockchain.BlockSubsidy(chain.BestHeight()+1)+fee)
 		txs := []*blockchain.Transaction{cbTx, tx}
-		block := chain.MineBlock(txs)
-		UTXOSet.Update(block)
+		if _, err := chain.MineBlock(txs); err != nil {
+			log.Panic(err)
+		}
 	} else {
-		network.SendTx(network.KnownNodes[0], tx)
+		network.SendTx(blockchain.Params.SeedNodes[0], tx)
 		fmt.Println("send tx")
+		// Remember the transaction for bumpfee.
+		walletTxs, err := blockchain.OpenWalletTransactions(nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		walletTxs.Add(tx)
+		walletTxs.SaveFile(nodeID)
 	}
-	fmt.Println("Success!")
+	fmt.Printf("Success! Transaction %x\n", tx.ID)
+}
+func (cli *CommandLine) bumpFee(txID string, fee int, nodeID string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	walletTxs, err := blockchain.OpenWalletTransactions(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx := walletTxs.Get(id)
+	if tx == nil {
+		log.Panicf("Transaction %s was not sent by our wallets", txID)
+	}
+	if _, _, err := chain.GetTransaction(id); err == nil {
+		log.Panicf("Transaction %s is already confirmed", txID)
+	}
+	wallets, err := blockchain.OpenWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	// The unlocking scripts of the wallet's inputs are <signature> <public key>.
+	data := tx.Inputs[0].ScriptSig.PushedData()
+	if len(data) != 2 {
+		log.Panicf("Transaction %s does not spend a wallet output", txID)
+	}
+	address := string(blockchain.PKToAddress(data[1]))
+	if _, ok := wallets.Wallets[address]; !ok {
+		log.Panicf("Wallet %s not found", address)
+	}
+	wallet := wallets.GetWallet(address)
+	if fee == 0 {
+		oldFee, err := chain.CalcFee(tx)
+		if err != nil {
+			log.Panic(err)
+		}
+		fee = oldFee + 1
+	}
+	replacement, err := chain.BumpFee(&wallet, tx, fee)
+	if err != nil {
+		log.Panic(err)
+	}
+	network.SendTx(blockchain.Params.SeedNodes[0], replacement)
+	walletTxs.Remove(tx.ID)
+	walletTxs.Add(replacement)
+	walletTxs.SaveFile(nodeID)
+	fmt.Printf("Replaced transaction %x by %x paying a fee of %d\n", tx.ID, replacement.ID, fee)
 }
 func (cli *CommandLine) Run() {
-	cli.validateArgs()
+	// The network is selected before the command, e.g. `-network regtest printchain`.
+	networkCmd := flag.NewFlagSet("network", flag.ExitOnError)
+	networkName := networkCmd.String("network", blockchain.MainNetParams.Name, "Network to use: mainnet, testnet or regtest")
+	if err := networkCmd.Parse(os.Args[1:]); err != nil {
+		log.Panic(err)
+	}
+	args := networkCmd.Args()
+	cli.validateArgs(args)
+	if err := blockchain.SelectParams(*networkName); err != nil {
+		log.Panic(err)
+	}
 	nodeID := os.Getenv("NODE_ID")
 	if nodeID == "" {
 		fmt.Printf("Please set NODE_ID environment variable!")
@@ -145,56 +455,208 @@ func (cli *CommandLine) Run() {
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindextx", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	getBlockTemplateCmd := flag.NewFlagSet("getblocktemplate", flag.ExitOnError)
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	workerCmd := flag.NewFlagSet("worker", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	createMultiSigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	spendMultiSigCmd := flag.NewFlagSet("spendmultisig", flag.ExitOnError)
+	signTxCmd := flag.NewFlagSet("signtx", flag.ExitOnError)
+	sendTxCmd := flag.NewFlagSet("sendtx", flag.ExitOnError)
+	initiateCmd := flag.NewFlagSet("initiate", flag.ExitOnError)
+	participateCmd := flag.NewFlagSet("participate", flag.ExitOnError)
+	auditContractCmd := flag.NewFlagSet("auditcontract", flag.ExitOnError)
+	redeemCmd := flag.NewFlagSet("redeem", flag.ExitOnError)
+	refundCmd := flag.NewFlagSet("refund", flag.ExitOnError)
+	extractSecretCmd := flag.NewFlagSet("extractsecret", flag.ExitOnError)
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 1, "Fee for the miner")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	bumpFeeTxID := bumpFeeCmd.String("txid", "", "ID of the transaction to replace")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "New fee of the transaction (default: one more than before)")
+	getBlockHeight := getBlockCmd.Int64("height", -1, "Height of the block in the main chain")
+	getBlockTemplateAddress := getBlockTemplateCmd.String("address", "", "The address to send the block reward to")
+	generateBlocks := generateCmd.Int("blocks", 0, "Number of blocks to mine")
+	generateAddress := generateCmd.String("address", "", "The address to send the block rewards to")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
-	switch os.Args[1] {
+	startNodeThreads := startNodeCmd.Int("threads", runtime.NumCPU(), "Number of goroutines used for mining")
+	startNodeStratum := startNodeCmd.String("stratum", "", "Hand out mining jobs to external workers on HOST:PORT")
+	workerConnect := workerCmd.String("connect", "", "Address HOST:PORT of the job server")
+	workerName := workerCmd.String("name", "worker-"+nodeID, "Name of the worker")
+	workerThreads := workerCmd.Int("threads", runtime.NumCPU(), "Number of goroutines used for mining")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "Address of the wallet")
+	createMultiSigM := createMultiSigCmd.Int("m", 0, "Number of signatures needed")
+	createMultiSigKeys := createMultiSigCmd.String("keys", "", "Comma separated public keys (hex) or addresses of our wallets")
+	spendMultiSigFrom := spendMultiSigCmd.String("from", "", "Source multisig address")
+	spendMultiSigTo := spendMultiSigCmd.String("to", "", "Destination address")
+	spendMultiSigAmount := spendMultiSigCmd.Int("amount", 0, "Amount to send")
+	spendMultiSigFee := spendMultiSigCmd.Int("fee", 1, "Fee for the miner")
+	spendMultiSigFile := spendMultiSigCmd.String("file", "", "File to write the transaction to")
+	signTxFile := signTxCmd.String("file", "", "File with the transaction")
+	sendTxFile := sendTxCmd.String("file", "", "File with the transaction")
+	initiateFrom := initiateCmd.String("from", "", "Source wallet address, gets the refund")
+	initiateTo := initiateCmd.String("to", "", "Wallet address of the participant")
+	initiateAmount := initiateCmd.Int("amount", 0, "Amount to pay to the contract")
+	initiateFee := initiateCmd.Int("fee", 1, "Fee for the miner")
+	initiateLockTime := initiateCmd.Duration("locktime", 48*time.Hour, "Time until the contract can be refunded")
+	initiateLockBlocks := initiateCmd.Int("lockblocks", 0, "Number of blocks until the contract can be refunded, instead of -locktime (regtest only)")
+	initiateMine := initiateCmd.Bool("mine", false, "Mine immediately on the same node")
+	participateFrom := participateCmd.String("from", "", "Source wallet address, gets the refund")
+	participateTo := participateCmd.String("to", "", "Wallet address of the initiator")
+	participateAmount := participateCmd.Int("amount", 0, "Amount to pay to the contract")
+	participateFee := participateCmd.Int("fee", 1, "Fee for the miner")
+	participateSecretHash := participateCmd.String("secrethash", "", "Secret hash of the initiator's contract")
+	participateLockTime := participateCmd.Duration("locktime", 24*time.Hour, "Time until the contract can be refunded")
+	participateLockBlocks := participateCmd.Int("lockblocks", 0, "Number of blocks until the contract can be refunded, instead of -locktime (regtest only)")
+	participateMine := participateCmd.Bool("mine", false, "Mine immediately on the same node")
+	auditContractContract := auditContractCmd.String("contract", "", "Contract script in hex")
+	auditContractTxID := auditContractCmd.String("txid", "", "ID of the transaction paying to the contract")
+	redeemContract := redeemCmd.String("contract", "", "Contract script in hex")
+	redeemTxID := redeemCmd.String("txid", "", "ID of the transaction paying to the contract")
+	redeemSecret := redeemCmd.String("secret", "", "Secret of the contract in hex")
+	redeemFee := redeemCmd.Int("fee", 1, "Fee for the miner")
+	redeemMine := redeemCmd.Bool("mine", false, "Mine immediately on the same node")
+	refundContract := refundCmd.String("contract", "", "Contract script in hex")
+	refundTxID := refundCmd.String("txid", "", "ID of the transaction paying to the contract")
+	refundFee := refundCmd.Int("fee", 1, "Fee for the miner")
+	refundMine := refundCmd.Bool("mine", false, "Mine immediately on the same node")
+	extractSecretTxID := extractSecretCmd.String("txid", "", "ID of the transaction redeeming the contract")
+	extractSecretSecretHash := extractSecretCmd.String("secrethash", "", "Secret hash of the contract")
+	switch args[0] {
 	case "reindexutxo":
-		err := reindexUTXOCmd.Parse(os.Args[2:])
+		err := reindexUTXOCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "reindextx":
+		err := reindexTxCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getblock":
+		err := getBlockCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
+		err := getBalanceCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
+		err := createBlockchainCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getblocktemplate":
+		err := getBlockTemplateCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "generate":
+		err := generateCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "startnode":
-		err := startNodeCmd.Parse(os.Args[2:])
+		err := startNodeCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "worker":
+		err := workerCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "listaddresses":
-		err := listAddressesCmd.Parse(os.Args[2:])
+		err := listAddressesCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
+		err := createWalletCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
+		err := printChainCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
+		err := sendCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "bumpfee":
+		err := bumpFeeCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpubkey":
+		err := getPubKeyCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultiSigCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "spendmultisig":
+		err := spendMultiSigCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signtx":
+		err := signTxCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "sendtx":
+		err := sendTxCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "initiate":
+		err := initiateCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "participate":
+		err := participateCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "auditcontract":
+		err := auditContractCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "redeem":
+		err := redeemCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "refund":
+		err := refundCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "extractsecret":
+		err := extractSecretCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
@@ -228,12 +690,120 @@ func (cli *CommandLine) Run() {
 	if reindexUTXOCmd.Parsed() {
 		cli.reindexUTXO(nodeID)
 	}
+	if reindexTxCmd.Parsed() {
+		cli.reindexTransactions(nodeID)
+	}
+	if getBlockCmd.Parsed() {
+		if *getBlockHeight < 0 {
+			getBlockCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getBlock(uint64(*getBlockHeight), nodeID)
+	}
+	if getBlockTemplateCmd.Parsed() {
+		if *getBlockTemplateAddress == "" {
+			getBlockTemplateCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getBlockTemplate(*getBlockTemplateAddress, nodeID)
+	}
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, nodeID, *sendMine)
+	}
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxID == "" || *bumpFeeFee < 0 {
+			bumpFeeCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.bumpFee(*bumpFeeTxID, *bumpFeeFee, nodeID)
+	}
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getPubKey(*getPubKeyAddress, nodeID)
+	}
+	if createMultiSigCmd.Parsed() {
+		if *createMultiSigM <= 0 || *createMultiSigKeys == "" {
+			createMultiSigCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.createMultiSig(*createMultiSigM, strings.Split(*createMultiSigKeys, ","), nodeID)
+	}
+	if spendMultiSigCmd.Parsed() {
+		if *spendMultiSigFrom == "" || *spendMultiSigTo == "" || *spendMultiSigAmount <= 0 || *spendMultiSigFee < 0 || *spendMultiSigFile == "" {
+			spendMultiSigCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.spendMultiSig(*spendMultiSigFrom, *spendMultiSigTo, *spendMultiSigAmount, *spendMultiSigFee, *spendMultiSigFile, nodeID)
+	}
+	if signTxCmd.Parsed() {
+		if *signTxFile == "" {
+			signTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.signTx(*signTxFile, nodeID)
+	}
+	if sendTxCmd.Parsed() {
+		if *sendTxFile == "" {
+			sendTxCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.sendTx(*sendTxFile, nodeID)
+	}
+	if initiateCmd.Parsed() {
+		if *initiateFrom == "" || *initiateTo == "" || *initiateAmount <= 0 || *initiateFee < 0 || *initiateLockTime <= 0 || *initiateLockBlocks < 0 {
+			initiateCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.initiate(*initiateFrom, *initiateTo, *initiateAmount, *initiateFee, *initiateLockTime, *initiateLockBlocks, nodeID, *initiateMine)
+	}
+	if participateCmd.Parsed() {
+		if *participateFrom == "" || *participateTo == "" || *participateAmount <= 0 || *participateFee < 0 || *participateSecretHash == "" || *participateLockTime <= 0 || *participateLockBlocks < 0 {
+			participateCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.participate(*participateFrom, *participateTo, *participateAmount, *participateFee, *participateSecretHash, *participateLockTime, *participateLockBlocks, nodeID, *participateMine)
+	}
+	if auditContractCmd.Parsed() {
+		if *auditContractContract == "" || *auditContractTxID == "" {
+			auditContractCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.auditContract(*auditContractContract, *auditContractTxID, nodeID)
+	}
+	if redeemCmd.Parsed() {
+		if *redeemContract == "" || *redeemTxID == "" || *redeemSecret == "" || *redeemFee < 0 {
+			redeemCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.redeem(*redeemContract, *redeemTxID, *redeemSecret, *redeemFee, nodeID, *redeemMine)
+	}
+	if refundCmd.Parsed() {
+		if *refundContract == "" || *refundTxID == "" || *refundFee < 0 {
+			refundCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.refund(*refundContract, *refundTxID, *refundFee, nodeID, *refundMine)
+	}
+	if extractSecretCmd.Parsed() {
+		if *extractSecretTxID == "" || *extractSecretSecretHash == "" {
+			extractSecretCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.extractSecret(*extractSecretTxID, *extractSecretSecretHash, nodeID)
+	}
+	if generateCmd.Parsed() {
+		if *generateBlocks <= 0 || *generateAddress == "" {
+			generateCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.generate(*generateBlocks, *generateAddress, nodeID)
 	}
 	if startNodeCmd.Parsed() {
 		nodeID := os.Getenv("NODE_ID")
@@ -241,6 +811,18 @@ func (cli *CommandLine) Run() {
 			startNodeCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.StartNode(nodeID, *startNodeMiner)
+		if *startNodeStratum != "" && *startNodeMiner == "" {
+			startNodeCmd.Usage()
+			runtime.Goexit()
+		}
+		blockchain.DefaultMiner = blockchain.NewMiner(*startNodeThreads)
+		cli.StartNode(nodeID, *startNodeMiner, *startNodeStratum)
+	}
+	if workerCmd.Parsed() {
+		if *workerConnect == "" {
+			workerCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.worker(*workerConnect, *workerName, *workerThreads)
 	}
 }
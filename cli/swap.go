@@ -0,0 +1,168 @@
+package cli
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+	"github.com/mkohlhaas/gobc/network"
+	"github.com/mkohlhaas/gobc/script"
+)
+
+// Atomic swaps with hash time-locked contracts between two blockchains, like Decred's atomicswap tool:
+//
+//  1. The initiator creates a secret and pays to a contract on chain A (initiate).
+//  2. The participant audits it and pays to a contract with the same secret hash on chain B (participate).
+//  3. The initiator redeems on chain B and reveals the secret (redeem).
+//  4. The participant extracts the secret (extractsecret) and redeems on chain A (redeem).
+//
+// If the swap is abandoned both get their coins back after the lock times (refund).
+// The participant's lock time is shorter, so the initiator cannot wait for it and then refund on chain A.
+//
+// Lock times in seconds expire when the median time past of the last blocks passes them, so refunds need
+// new blocks mined after the lock time. On regtest, where blocks are only mined on demand, contracts can
+// be locked for a number of blocks instead (-lockblocks) and unlocked with generate.
+
+func (cli *CommandLine) initiate(from, to string, amount, fee int, lockTime time.Duration, lockBlocks int, nodeID string, mineNow bool) {
+	secret, secretHash := blockchain.NewSecret()
+	fmt.Printf("Secret:      %x\n", secret)
+	fmt.Printf("Secret hash: %x\n", secretHash)
+	cli.fundContract(from, to, amount, fee, secretHash, lockTime, lockBlocks, nodeID, mineNow)
+}
+func (cli *CommandLine) participate(from, to string, amount, fee int, secretHash string, lockTime time.Duration, lockBlocks int, nodeID string, mineNow bool) {
+	cli.fundContract(from, to, amount, fee, decodeHex("secret hash", secretHash), lockTime, lockBlocks, nodeID, mineNow)
+}
+
+// Pays `amount` from wallet `from` to a new contract for `to` and prints the contract.
+// The contract is locked for `lockBlocks` blocks if set, otherwise for `lockTime`.
+func (cli *CommandLine) fundContract(from, to string, amount, fee int, secretHash []byte, lockTime time.Duration, lockBlocks int, nodeID string, mineNow bool) {
+	wallets, err := blockchain.OpenWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	if _, ok := wallets.Wallets[from]; !ok {
+		log.Panicf("Wallet %s not found", from)
+	}
+	wallet := wallets.GetWallet(from)
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	expiry := uint32(time.Now().Add(lockTime).Unix())
+	if lockBlocks > 0 {
+		if !blockchain.Params.MineBlocksOnDemand {
+			log.Panicf("Lock times in blocks are not supported on %s", blockchain.Params.Name)
+		}
+		expiry = uint32(chain.BestHeight()) + uint32(lockBlocks)
+	}
+	contract, err := blockchain.NewContract(&wallet, to, secretHash, expiry)
+	if err != nil {
+		log.Panic(err)
+	}
+	address := string(blockchain.ScriptToAddress(contract))
+	tx, err := blockchain.NewTransaction(&wallet, address, amount, fee, &blockchain.UTXOSet{Blockchain: chain})
+	if err != nil {
+		log.Panic(err)
+	}
+	sendOrMine(chain, tx, fee, from, mineNow)
+	fmt.Printf("Contract address:     %s\n", address)
+	fmt.Printf("Contract:             %x\n", []byte(contract))
+	fmt.Printf("Contract transaction: %x\n", tx.ID)
+	fmt.Printf("Lock time:            %s\n", blockchain.FormatLockTime(int64(expiry)))
+}
+func (cli *CommandLine) auditContract(contractHex, txID, nodeID string) {
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	c := findContract(chain, contractHex, txID)
+	fmt.Printf("Contract address:  %s\n", blockchain.ScriptToAddress(c.Script))
+	fmt.Printf("Contract value:    %d\n", c.Value)
+	fmt.Printf("Recipient address: %s\n", c.RecipientAddress())
+	fmt.Printf("Refund address:    %s\n", c.RefundAddress())
+	fmt.Printf("Secret hash:       %x\n", c.SecretHash)
+	fmt.Printf("Lock time:         %s\n", c.LockTimeString())
+	fmt.Printf("Median time past:  %s\n", time.Unix(chain.MedianTimePast(), 0).UTC().Format(time.RFC3339))
+	fmt.Printf("Spent:             %t\n", c.Spent)
+}
+func (cli *CommandLine) redeem(contractHex, txID, secret string, fee int, nodeID string, mineNow bool) {
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	c := findContract(chain, contractHex, txID)
+	wallet := contractWallet(c.RecipientAddress(), nodeID)
+	tx, err := blockchain.RedeemContract(wallet, c, decodeHex("secret", secret), fee)
+	if err != nil {
+		log.Panic(err)
+	}
+	sendOrMine(chain, tx, fee, c.RecipientAddress(), mineNow)
+	fmt.Printf("Redeemed contract, transaction %x\n", tx.ID)
+}
+func (cli *CommandLine) refund(contractHex, txID string, fee int, nodeID string, mineNow bool) {
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	c := findContract(chain, contractHex, txID)
+	wallet := contractWallet(c.RefundAddress(), nodeID)
+	tx, err := chain.RefundContract(wallet, c, fee)
+	if err != nil {
+		log.Panic(err)
+	}
+	sendOrMine(chain, tx, fee, c.RefundAddress(), mineNow)
+	fmt.Printf("Refunded contract, transaction %x\n", tx.ID)
+}
+func (cli *CommandLine) extractSecret(txID, secretHash, nodeID string) {
+	chain := blockchain.OpenBlockChain(nodeID)
+	defer chain.Database.Close()
+	tx, _, err := chain.GetTransaction(decodeHex("transaction ID", txID))
+	if err != nil {
+		log.Panic(err)
+	}
+	secret, err := blockchain.ExtractSecret(tx, decodeHex("secret hash", secretHash))
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Secret: %x\n", secret)
+}
+
+// Returns the contract `contractHex` paid by transaction `txID`.
+func findContract(chain *blockchain.BlockChain, contractHex, txID string) *blockchain.Contract {
+	c, err := chain.FindContract(script.Script(decodeHex("contract", contractHex)), decodeHex("transaction ID", txID))
+	if err != nil {
+		log.Panic(err)
+	}
+	return c
+}
+
+// Returns our wallet of `address`.
+func contractWallet(address, nodeID string) *blockchain.Wallet {
+	wallets, err := blockchain.OpenWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	if _, ok := wallets.Wallets[address]; !ok {
+		log.Panicf("Wallet %s of the contract not found", address)
+	}
+	wallet := wallets.GetWallet(address)
+	return &wallet
+}
+
+// Mines `tx` in a block paying the reward and `fee` to `address` if `mineNow` is set, otherwise sends it to the seed node.
+func sendOrMine(chain *blockchain.BlockChain, tx *blockchain.Transaction, fee int, address string, mineNow bool) {
+	if mineNow {
+		cbTx := blockchain.CoinbaseTx(address, blockchain.BlockSubsidy(chain.BestHeight()+1)+fee)
+		if _, err := chain.MineBlock([]*blockchain.Transaction{cbTx, tx}); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+	if _, err := chain.CheckTransaction(tx, nil); err != nil {
+		log.Panic(err)
+	}
+	network.SendTx(blockchain.Params.SeedNodes[0], tx)
+}
+
+// Decodes the hex argument `name`.
+func decodeHex(name, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		log.Panicf("Invalid %s %s: %v", name, s, err)
+	}
+	return data
+}
@@ -0,0 +1,376 @@
+// Package mempool keeps the valid transactions which are not in a block yet.
+//
+// Transactions are validated against the UTXO set and the transactions already in the pool,
+// i.e. a transaction may spend outputs of unconfirmed transactions. Transactions spending an
+// output another transaction of the pool spends already are rejected, unless they replace
+// that transaction by paying a higher fee (replace-by-fee, see checkReplacement).
+// The pool follows the main chain: transactions of connected blocks and transactions conflicting
+// with them are removed; transactions of disconnected blocks return to the pool.
+// Transactions spending outputs of unknown transactions wait in a small orphan pool for their parents.
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+)
+
+const (
+	// DefaultMaxSize is the default size limit of the pool: the serialized transactions of 300 full blocks.
+	DefaultMaxSize = 300 * blockchain.MaxBlockSize
+	// DefaultExpiry is the default time after which transactions are removed from the pool.
+	DefaultExpiry = 14 * 24 * time.Hour
+)
+
+// Reasons for rejecting a transaction besides the consensus rules (see blockchain.RuleError).
+var (
+	ErrAlreadyInPool = errors.New("transaction already in memory pool")
+	ErrConflict      = errors.New("transaction conflicts with memory pool")
+	ErrPoolFull      = errors.New("memory pool full")
+)
+
+// TxDesc describes a transaction of the pool.
+type TxDesc struct {
+	Tx    *blockchain.Transaction
+	Fee   int
+	Size  int       // size of the serialized transaction in bytes
+	Added time.Time // when the transaction entered the pool
+	seq   uint64    // order of insertion; parents are always inserted before their children
+
+	// Aggregates of the transaction and its ancestors in the pool (see packages.go).
+	AncestorCount, AncestorSize, AncestorFees int
+	// Aggregates of the transaction and its descendants in the pool.
+	DescendantCount, DescendantSize, DescendantFees int
+}
+
+// Returns true if the descendant package of `d` pays a lower fee rate than the one of `other`.
+// Ties are broken by transaction ID.
+func (d *TxDesc) lowerDescendantFeeRate(other *TxDesc) bool {
+	if d.DescendantFees*other.DescendantSize != other.DescendantFees*d.DescendantSize {
+		return d.DescendantFees*other.DescendantSize < other.DescendantFees*d.DescendantSize
+	}
+	return hex.EncodeToString(d.Tx.ID) < hex.EncodeToString(other.Tx.ID)
+}
+
+// TxPool is the memory pool. It is safe for concurrent use.
+type TxPool struct {
+	chain         *blockchain.BlockChain
+	MaxSize       int           // limit of the total size of the transactions in bytes
+	Expiry        time.Duration // transactions older than this are removed
+	MaxOrphanSize int           // limit of the total size of the orphans in bytes
+	OrphanExpiry  time.Duration // orphans older than this are removed
+
+	// Package limits; see DefaultMaxAncestors.
+	MaxAncestors, MaxAncestorSize, MaxDescendants, MaxDescendantSize int
+
+	mu              sync.Mutex
+	txs             map[string]*TxDesc // by transaction ID
+	spends          map[string]*TxDesc // outpoint (see outpoint()) -> transaction of the pool spending it
+	size            int                // total size of the transactions
+	seq             uint64             // sequence number of the last inserted transaction or orphan
+	orphans         map[string]*orphan // by transaction ID
+	orphansByParent map[string]map[*orphan]bool
+	orphanSize      int              // total size of the orphans
+	now             func() time.Time // only tests change the clock
+}
+
+// New creates an empty memory pool for `chain` and subscribes it to the changes of the main chain.
+func New(chain *blockchain.BlockChain) *TxPool {
+	p := &TxPool{
+		chain:             chain,
+		MaxSize:           DefaultMaxSize,
+		Expiry:            DefaultExpiry,
+		MaxOrphanSize:     DefaultMaxOrphanSize,
+		OrphanExpiry:      DefaultOrphanExpiry,
+		MaxAncestors:      DefaultMaxAncestors,
+		MaxAncestorSize:   DefaultMaxAncestorSize,
+		MaxDescendants:    DefaultMaxDescendants,
+		MaxDescendantSize: DefaultMaxDescendantSize,
+		txs:               make(map[string]*TxDesc),
+		spends:            make(map[string]*TxDesc),
+		orphans:           make(map[string]*orphan),
+		orphansByParent:   make(map[string]map[*orphan]bool),
+		now:               time.Now,
+	}
+	chain.Subscribe(p.chainUpdated)
+	return p
+}
+
+// Returns the key of output `index` of transaction `txID`.
+func outpoint(txID blockchain.Hash, index int) string {
+	return fmt.Sprintf("%x:%d", txID, index)
+}
+
+// AddTransaction validates `tx` and adds it to the pool. Orphans are rejected; see ProcessTransaction.
+// Conflicting transactions which signal replaceability are evicted with their descendants if `tx` pays more.
+// Transactions exceeding the package limits are rejected with ErrPackageLimit.
+// If the pool exceeds its size limit, the transactions whose descendant packages pay the lowest fee rate
+// are evicted together with their descendants, so a child paying for its parent protects the parent.
+// If `tx` itself would be evicted it is rejected with ErrPoolFull and the pool is left as it was.
+func (p *TxPool) AddTransaction(tx *blockchain.Transaction) (*TxDesc, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+	return p.add(tx, p.now())
+}
+
+// Adds `tx` which entered the pool at `added`. Must be called with the lock held.
+func (p *TxPool) add(tx *blockchain.Transaction, added time.Time) (*TxDesc, error) {
+	id := hex.EncodeToString(tx.ID)
+	if _, ok := p.txs[id]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyInPool, id)
+	}
+	conflicts := p.conflicts(tx)
+	for _, c := range conflicts {
+		if !c.Tx.SignalsReplacement() {
+			return nil, fmt.Errorf("%w: %s spends outputs %x spends already", ErrConflict, id, c.Tx.ID)
+		}
+	}
+	fee, err := p.chain.CheckTransaction(tx, p.pending)
+	if err != nil {
+		return nil, err
+	}
+	size := tx.Size()
+	ancestors := p.ancestors(tx)
+	if err := p.checkPackageLimits(tx, size, ancestors); err != nil {
+		return nil, err
+	}
+	// Replaced and evicted transactions, in case `tx` is evicted itself.
+	var removed []*TxDesc
+	if len(conflicts) > 0 {
+		evicted, err := p.checkReplacement(tx, fee, conflicts)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range evicted {
+			p.remove(d)
+		}
+		removed = evicted
+	}
+	p.seq++
+	d := &TxDesc{Tx: tx, Fee: fee, Size: size, Added: added, seq: p.seq}
+	p.insert(d, ancestors)
+	for p.size > p.MaxSize {
+		victim := p.lowestDescendantFeeRate()
+		removed = append(removed, p.removeWithDescendants(victim)...)
+		if _, ok := p.txs[id]; !ok {
+			p.restore(removed, d)
+			return nil, fmt.Errorf("%w: fee rate of %s too low", ErrPoolFull, id)
+		}
+	}
+	return d, nil
+}
+
+// Returns the transaction `id` of the pool or nil. Must be called with the lock held.
+func (p *TxPool) pending(id blockchain.Hash) *blockchain.Transaction {
+	if d, ok := p.txs[hex.EncodeToString(id)]; ok {
+		return d.Tx
+	}
+	return nil
+}
+
+// Returns the transaction whose descendant package pays the lowest fee rate. The pool must not be empty.
+func (p *TxPool) lowestDescendantFeeRate() *TxDesc {
+	var lowest *TxDesc
+	for _, d := range p.txs {
+		if lowest == nil || d.lowerDescendantFeeRate(lowest) {
+			lowest = d
+		}
+	}
+	return lowest
+}
+
+// Inserts `d` with its `ancestors` in the pool into the indexes.
+func (p *TxPool) insert(d *TxDesc, ancestors map[*TxDesc]bool) {
+	p.addToPackages(d, ancestors)
+	p.txs[hex.EncodeToString(d.Tx.ID)] = d
+	for _, in := range d.Tx.Inputs {
+		p.spends[outpoint(in.ID, in.Out)] = d
+	}
+	p.size += d.Size
+}
+
+// Removes `d` but not its descendants.
+func (p *TxPool) remove(d *TxDesc) {
+	p.removeFromPackages(d)
+	delete(p.txs, hex.EncodeToString(d.Tx.ID))
+	for _, in := range d.Tx.Inputs {
+		delete(p.spends, outpoint(in.ID, in.Out))
+	}
+	p.size -= d.Size
+}
+
+// Removes `d` and all transactions spending its outputs, directly or indirectly. Returns the removed transactions.
+func (p *TxPool) removeWithDescendants(d *TxDesc) []*TxDesc {
+	p.remove(d)
+	removed := []*TxDesc{d}
+	for i := range d.Tx.Outputs {
+		if child, ok := p.spends[outpoint(d.Tx.ID, i)]; ok {
+			removed = append(removed, p.removeWithDescendants(child)...)
+		}
+	}
+	return removed
+}
+
+// Inserts the removed transactions `descs` except `skip` again; parents are inserted before their children.
+func (p *TxPool) restore(descs []*TxDesc, skip *TxDesc) {
+	pending := make(map[string]*TxDesc)
+	for _, d := range descs {
+		if d != skip {
+			pending[hex.EncodeToString(d.Tx.ID)] = d
+		}
+	}
+	var insert func(d *TxDesc)
+	insert = func(d *TxDesc) {
+		id := hex.EncodeToString(d.Tx.ID)
+		if _, ok := pending[id]; !ok {
+			return
+		}
+		delete(pending, id)
+		for _, in := range d.Tx.Inputs {
+			if parent, ok := pending[hex.EncodeToString(in.ID)]; ok {
+				insert(parent)
+			}
+		}
+		p.insert(d, p.ancestors(d.Tx))
+	}
+	for _, d := range descs {
+		insert(d)
+	}
+}
+
+// Removes the transactions older than Expiry with their descendants.
+func (p *TxPool) expire() {
+	deadline := p.now().Add(-p.Expiry)
+	for _, d := range p.sorted() {
+		if _, ok := p.txs[hex.EncodeToString(d.Tx.ID)]; ok && d.Added.Before(deadline) {
+			p.removeWithDescendants(d)
+		}
+	}
+}
+
+// Returns all transactions in the order they were inserted.
+func (p *TxPool) sorted() []*TxDesc {
+	descs := make([]*TxDesc, 0, len(p.txs))
+	for _, d := range p.txs {
+		descs = append(descs, d)
+	}
+	sort.Slice(descs, func(i, j int) bool { return descs[i].seq < descs[j].seq })
+	return descs
+}
+
+// Follows the main chain.
+func (p *TxPool) chainUpdated(update blockchain.ChainUpdate) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(update.Disconnected) > 0 {
+		p.reorganize(update.Disconnected)
+	} else {
+		for _, b := range update.Connected {
+			p.blockConnected(b)
+		}
+	}
+	p.expire()
+	p.expireOrphans()
+	// Orphans may spend outputs of the connected blocks.
+	for _, b := range update.Connected {
+		for _, tx := range b.Transactions {
+			p.promoteOrphans(tx)
+		}
+	}
+}
+
+// Removes the transactions of `b` and the transactions conflicting with them.
+// Transactions spending outputs of `b` stay in the pool.
+func (p *TxPool) blockConnected(b *blockchain.Block) {
+	for _, tx := range b.Transactions {
+		if d, ok := p.txs[hex.EncodeToString(tx.ID)]; ok {
+			p.remove(d)
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if conflict, ok := p.spends[outpoint(in.ID, in.Out)]; ok {
+				p.removeWithDescendants(conflict)
+			}
+		}
+	}
+}
+
+// Validates the pool again after a reorganization. The transactions of the `disconnected` blocks
+// come first, the oldest block first, then the transactions of the pool.
+// Transactions which are invalid on the new main chain, e.g. because a connected block contains
+// them or conflicts with them, are dropped.
+func (p *TxPool) reorganize(disconnected []*blockchain.Block) {
+	old := p.sorted()
+	p.txs = make(map[string]*TxDesc)
+	p.spends = make(map[string]*TxDesc)
+	p.size = 0
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, tx := range disconnected[i].Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+			p.add(tx, p.now())
+		}
+	}
+	for _, d := range old {
+		p.add(d.Tx, d.Added)
+	}
+}
+
+// Has returns true if transaction `id` is in the pool.
+func (p *TxPool) Has(id blockchain.Hash) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.txs[hex.EncodeToString(id)]
+	return ok
+}
+
+// Transaction returns transaction `id` of the pool or nil if it is not in the pool.
+func (p *TxPool) Transaction(id blockchain.Hash) *blockchain.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending(id)
+}
+
+// Transactions returns all transactions of the pool. Parents precede their children.
+func (p *TxPool) Transactions() []*blockchain.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var txs []*blockchain.Transaction
+	for _, d := range p.sorted() {
+		txs = append(txs, d.Tx)
+	}
+	return txs
+}
+
+// Desc returns a copy of the description of transaction `id`; false if it is not in the pool.
+func (p *TxPool) Desc(id blockchain.Hash) (TxDesc, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if d, ok := p.txs[hex.EncodeToString(id)]; ok {
+		return *d, true
+	}
+	return TxDesc{}, false
+}
+
+// Count returns the number of transactions in the pool.
+func (p *TxPool) Count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.txs)
+}
+
+// Size returns the total size of the transactions in the pool in bytes.
+func (p *TxPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
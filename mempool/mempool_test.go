@@ -0,0 +1,208 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Selects a regtest network without coinbase maturity with its data in a temporary directory.
+func selectTestParams(t *testing.T) {
+	params := blockchain.RegTestParams
+	params.DataDir = t.TempDir()
+	params.CoinbaseMaturity = 0
+	old := blockchain.Params
+	blockchain.Params = &params
+	t.Cleanup(func() { blockchain.Params = old })
+}
+
+// Creates a blockchain whose rewards go to `w`.
+func newTestChain(t *testing.T, nodeID string, w *blockchain.Wallet) *blockchain.BlockChain {
+	chain := blockchain.CreateBlockChain(string(w.Address()), nodeID)
+	t.Cleanup(func() { chain.Database.Close() })
+	blockchain.UTXOSet{Blockchain: chain}.Reindex()
+	return chain
+}
+
+// Creates a pool on a blockchain with `n` generated blocks. Returns the coinbases of the generated blocks.
+func newTestPool(t *testing.T, n int) (*TxPool, *blockchain.BlockChain, *blockchain.Wallet, []*blockchain.Transaction) {
+	selectTestParams(t)
+	w := blockchain.MakeWallet()
+	chain := newTestChain(t, "test", w)
+	blocks, err := chain.Generate(n, string(w.Address()))
+	require.NoError(t, err)
+	var coinbases []*blockchain.Transaction
+	for _, b := range blocks {
+		coinbases = append(coinbases, b.Transactions[0])
+	}
+	return New(chain), chain, w, coinbases
+}
+
+// Returns a final transaction of `w` spending output `out` of `prev` back to `w` and paying `fee`.
+func spend(w *blockchain.Wallet, prev *blockchain.Transaction, out, fee int) *blockchain.Transaction {
+	return spendWithSequence(w, prev, out, fee, blockchain.MaxTxInSequenceNum)
+}
+
+// Like spend() but with input sequence number `sequence`.
+func spendWithSequence(w *blockchain.Wallet, prev *blockchain.Transaction, out, fee int, sequence uint32) *blockchain.Transaction {
+	return blockchain.NewSignedTransaction(w,
+		[]blockchain.TxInput{{ID: prev.ID, Out: out, Sequence: sequence}},
+		[]blockchain.TxOutput{{Value: prev.Outputs[out].Value - fee, ScriptPubKey: script.PayToPubKeyHash(blockchain.PublicKeyHash(w.PublicKey))}},
+		map[string]blockchain.Transaction{hex.EncodeToString(prev.ID): *prev})
+}
+
+// Mines a block with `txs` on top of the last block.
+func mine(t *testing.T, chain *blockchain.BlockChain, w *blockchain.Wallet, txs ...*blockchain.Transaction) {
+	cb := blockchain.CoinbaseTx(string(w.Address()), blockchain.BlockSubsidy(chain.BestHeight()+1))
+	_, err := chain.MineBlock(append([]*blockchain.Transaction{cb}, txs...))
+	require.NoError(t, err)
+}
+
+func TestAddTransaction(t *testing.T) {
+	p, _, w, coinbases := newTestPool(t, 2)
+	parent := spend(w, coinbases[0], 0, 2)
+	child := spend(w, parent, 0, 1)
+	conflict := spend(w, coinbases[0], 0, 5)
+	orphan := spend(w, spend(w, coinbases[1], 0, 1), 0, 1)
+
+	d, err := p.AddTransaction(parent)
+	require.NoError(t, err)
+	assert.Equal(t, 2, d.Fee)
+	assert.Equal(t, parent.Size(), d.Size)
+	_, err = p.AddTransaction(child)
+	require.NoError(t, err)
+
+	_, err = p.AddTransaction(parent)
+	assert.ErrorIs(t, err, ErrAlreadyInPool)
+	_, err = p.AddTransaction(conflict)
+	assert.ErrorIs(t, err, ErrConflict)
+	_, err = p.AddTransaction(orphan)
+	var ruleErr blockchain.RuleError
+	require.True(t, errors.As(err, &ruleErr))
+	assert.Equal(t, blockchain.ErrMissingTxOut, ruleErr.Code)
+
+	assert.Equal(t, []*blockchain.Transaction{parent, child}, p.Transactions())
+	assert.Equal(t, 2, p.Count())
+	assert.Equal(t, parent.Size()+child.Size(), p.Size())
+	assert.True(t, p.Has(child.ID))
+	assert.Equal(t, child, p.Transaction(child.ID))
+	assert.Nil(t, p.Transaction(conflict.ID))
+}
+
+func TestBlockConnectedRemovesTransactions(t *testing.T) {
+	p, chain, w, coinbases := newTestPool(t, 2)
+	parent := spend(w, coinbases[0], 0, 1)
+	child := spend(w, parent, 0, 1)
+	other := spend(w, coinbases[1], 0, 1)
+	for _, tx := range []*blockchain.Transaction{parent, child, other} {
+		_, err := p.AddTransaction(tx)
+		require.NoError(t, err)
+	}
+
+	// The block confirms `parent` and double-spends the input of `other`.
+	mine(t, chain, w, parent, spend(w, coinbases[1], 0, 3))
+	assert.Equal(t, []*blockchain.Transaction{child}, p.Transactions())
+	assert.Equal(t, child.Size(), p.Size())
+}
+
+func TestReorganizationReturnsTransactions(t *testing.T) {
+	p, chain, w, coinbases := newTestPool(t, 2)
+	// A second blockchain with the same genesis block and the same generated blocks.
+	other := newTestChain(t, "other", w)
+	_, err := other.Generate(2, string(w.Address()))
+	require.NoError(t, err)
+	require.Equal(t, chain.BestHash(), other.BestHash())
+
+	parent := spend(w, coinbases[0], 0, 1)
+	child := spend(w, parent, 0, 1)
+	for _, tx := range []*blockchain.Transaction{parent, child} {
+		_, err := p.AddTransaction(tx)
+		require.NoError(t, err)
+	}
+	mine(t, chain, w, parent)
+	assert.Equal(t, []*blockchain.Transaction{child}, p.Transactions())
+
+	// The longer branch of the other blockchain replaces the block with `parent`.
+	blocks, err := other.Generate(2, string(w.Address()))
+	require.NoError(t, err)
+	for _, b := range blocks {
+		require.NoError(t, chain.AddBlock(b))
+	}
+	require.Equal(t, other.BestHash(), chain.BestHash())
+	assert.Equal(t, []*blockchain.Transaction{parent, child}, p.Transactions())
+}
+
+func TestRelativeLockTime(t *testing.T) {
+	p, chain, w, coinbases := newTestPool(t, 2)
+	other := newTestChain(t, "other", w)
+	_, err := other.Generate(2, string(w.Address()))
+	require.NoError(t, err)
+
+	// `locked` can be mined one block after `parent`.
+	parent := spend(w, coinbases[0], 0, 1)
+	locked := spendWithSequence(w, parent, 0, 1, 1)
+	_, err = p.AddTransaction(parent)
+	require.NoError(t, err)
+	_, err = p.AddTransaction(locked)
+	var ruleErr blockchain.RuleError
+	require.True(t, errors.As(err, &ruleErr))
+	assert.Equal(t, blockchain.ErrSequenceLockNotMet, ruleErr.Code)
+	mine(t, chain, w, parent)
+	_, err = p.AddTransaction(locked)
+	require.NoError(t, err)
+
+	// After a reorganization `parent` is unconfirmed again.
+	blocks, err := other.Generate(2, string(w.Address()))
+	require.NoError(t, err)
+	for _, b := range blocks {
+		require.NoError(t, chain.AddBlock(b))
+	}
+	assert.Equal(t, []*blockchain.Transaction{parent}, p.Transactions())
+}
+
+func TestEvictsLowestFeeRate(t *testing.T) {
+	p, _, w, coinbases := newTestPool(t, 4)
+	low := spend(w, coinbases[0], 0, 1)
+	lowChild := spend(w, low, 0, 2)
+	high := spend(w, coinbases[1], 0, 3)
+	p.MaxSize = low.Size() + lowChild.Size() + high.Size()
+	for _, tx := range []*blockchain.Transaction{low, lowChild, high} {
+		_, err := p.AddTransaction(tx)
+		require.NoError(t, err)
+	}
+
+	// `low` and its child pay the lowest fee rate and go together.
+	medium := spend(w, coinbases[2], 0, 2)
+	_, err := p.AddTransaction(medium)
+	require.NoError(t, err)
+	assert.Equal(t, []*blockchain.Transaction{high, medium}, p.Transactions())
+
+	p.MaxSize = p.Size()
+	_, err = p.AddTransaction(spend(w, coinbases[3], 0, 1))
+	assert.ErrorIs(t, err, ErrPoolFull)
+	assert.Equal(t, []*blockchain.Transaction{high, medium}, p.Transactions())
+}
+
+func TestExpiry(t *testing.T) {
+	p, _, w, coinbases := newTestPool(t, 2)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	old := spend(w, coinbases[0], 0, 1)
+	oldChild := spend(w, old, 0, 1)
+	for _, tx := range []*blockchain.Transaction{old, oldChild} {
+		_, err := p.AddTransaction(tx)
+		require.NoError(t, err)
+	}
+
+	now = now.Add(p.Expiry + time.Second)
+	fresh := spend(w, coinbases[1], 0, 1)
+	_, err := p.AddTransaction(fresh)
+	require.NoError(t, err)
+	assert.Equal(t, []*blockchain.Transaction{fresh}, p.Transactions())
+}
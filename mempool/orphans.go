@@ -0,0 +1,199 @@
+package mempool
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+)
+
+const (
+	// DefaultMaxOrphanSize is the default limit of the total size of the orphans in bytes.
+	DefaultMaxOrphanSize = 100 * 1000
+	// DefaultOrphanExpiry is the default time after which orphans are removed.
+	DefaultOrphanExpiry = 20 * time.Minute
+)
+
+// ErrOrphanTooBig is returned for orphans which would not fit into the orphan pool even if it was empty.
+var ErrOrphanTooBig = errors.New("orphan transaction too big")
+
+// An orphan is a transaction spending outputs of transactions we do not know (yet).
+// Orphans cannot be validated, so they are keyed by the hash of their serialization: the ID does not cover
+// the unlocking scripts, and a copy with invalid signatures must not keep out the genuine transaction.
+type orphan struct {
+	tx    *blockchain.Transaction
+	key   string
+	size  int
+	added time.Time
+	seq   uint64 // order of insertion
+}
+
+// ProcessTransaction adds `tx` to the pool. If `tx` spends outputs of unknown transactions it is
+// kept in the orphan pool; the IDs of the missing parents are returned, so they can be requested.
+// Returns the transactions which entered the pool: `tx` and the orphans which became valid because of `tx`.
+func (p *TxPool) ProcessTransaction(tx *blockchain.Transaction) (accepted []*blockchain.Transaction, missing []blockchain.Hash, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+	p.expireOrphans()
+	if _, ok := p.orphans[orphanKey(tx)]; ok {
+		return nil, nil, fmt.Errorf("%w: %x is an orphan", ErrAlreadyInPool, tx.ID)
+	}
+	if _, err := p.add(tx, p.now()); err != nil {
+		var ruleErr blockchain.RuleError
+		if !errors.As(err, &ruleErr) || ruleErr.Code != blockchain.ErrMissingTxOut {
+			return nil, nil, err
+		}
+		missing = p.missingParents(tx)
+		if len(missing) == 0 {
+			return nil, nil, err // a known transaction lacks the output
+		}
+		if err := p.addOrphan(tx); err != nil {
+			return nil, nil, err
+		}
+		return nil, missing, nil
+	}
+	return append([]*blockchain.Transaction{tx}, p.promoteOrphans(tx)...), nil, nil
+}
+
+// Returns the IDs of the transactions `tx` spends outputs of which are neither in the pool
+// nor have unspent outputs in the UTXO set.
+func (p *TxPool) missingParents(tx *blockchain.Transaction) []blockchain.Hash {
+	var missing []blockchain.Hash
+	seen := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		id := hex.EncodeToString(in.ID)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if _, ok := p.txs[id]; !ok && !p.chain.HasUnspentOutputs(in.ID) {
+			missing = append(missing, in.ID)
+		}
+	}
+	return missing
+}
+
+// Adds `tx` to the orphan pool. The oldest orphans are evicted if the orphan pool gets too big.
+func (p *TxPool) addOrphan(tx *blockchain.Transaction) error {
+	size := tx.Size()
+	if size > p.MaxOrphanSize {
+		return fmt.Errorf("%w: %x has %d bytes", ErrOrphanTooBig, tx.ID, size)
+	}
+	for p.orphanSize+size > p.MaxOrphanSize {
+		p.removeOrphan(p.sortedOrphans()[0])
+	}
+	p.seq++
+	o := &orphan{tx: tx, key: orphanKey(tx), size: size, added: p.now(), seq: p.seq}
+	p.orphans[o.key] = o
+	for _, in := range tx.Inputs {
+		parent := hex.EncodeToString(in.ID)
+		if p.orphansByParent[parent] == nil {
+			p.orphansByParent[parent] = make(map[*orphan]bool)
+		}
+		p.orphansByParent[parent][o] = true
+	}
+	p.orphanSize += size
+	return nil
+}
+
+// Returns the key of `tx` in the orphan pool.
+func orphanKey(tx *blockchain.Transaction) string {
+	hash := sha256.Sum256(tx.Serialize())
+	return hex.EncodeToString(hash[:])
+}
+
+// Removes orphan `o`.
+func (p *TxPool) removeOrphan(o *orphan) {
+	delete(p.orphans, o.key)
+	for _, in := range o.tx.Inputs {
+		parent := hex.EncodeToString(in.ID)
+		delete(p.orphansByParent[parent], o)
+		if len(p.orphansByParent[parent]) == 0 {
+			delete(p.orphansByParent, parent)
+		}
+	}
+	p.orphanSize -= o.size
+}
+
+// Moves the orphans spending outputs of `parent` into the pool, and the orphans spending their outputs, etc.
+// Orphans which are invalid for other reasons than missing parents are dropped.
+// Returns the transactions which entered the pool.
+func (p *TxPool) promoteOrphans(parent *blockchain.Transaction) []*blockchain.Transaction {
+	var promoted []*blockchain.Transaction
+	queue := []*blockchain.Transaction{parent}
+	for len(queue) > 0 {
+		id := hex.EncodeToString(queue[0].ID)
+		queue = queue[1:]
+		var children []*orphan
+		for o := range p.orphansByParent[id] {
+			children = append(children, o)
+		}
+		sortOrphans(children)
+		for _, o := range children {
+			if _, ok := p.orphans[o.key]; !ok {
+				continue // removed by an earlier child
+			}
+			_, err := p.add(o.tx, p.now())
+			var ruleErr blockchain.RuleError
+			if errors.As(err, &ruleErr) && ruleErr.Code == blockchain.ErrMissingTxOut {
+				continue // still misses another parent
+			}
+			p.removeOrphan(o)
+			if err == nil {
+				promoted = append(promoted, o.tx)
+				queue = append(queue, o.tx)
+			}
+		}
+	}
+	return promoted
+}
+
+// Removes the orphans older than OrphanExpiry.
+func (p *TxPool) expireOrphans() {
+	deadline := p.now().Add(-p.OrphanExpiry)
+	for _, o := range p.orphans {
+		if o.added.Before(deadline) {
+			p.removeOrphan(o)
+		}
+	}
+}
+
+// Returns the orphans, the oldest first.
+func (p *TxPool) sortedOrphans() []*orphan {
+	orphans := make([]*orphan, 0, len(p.orphans))
+	for _, o := range p.orphans {
+		orphans = append(orphans, o)
+	}
+	sortOrphans(orphans)
+	return orphans
+}
+
+// Sorts `orphans` by insertion, the oldest first.
+func sortOrphans(orphans []*orphan) {
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].seq < orphans[j].seq })
+}
+
+// IsOrphan returns true if a transaction with ID `id` is in the orphan pool.
+func (p *TxPool) IsOrphan(id blockchain.Hash) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, o := range p.orphans {
+		if bytes.Equal(o.tx.ID, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// OrphanCount returns the number of orphans.
+func (p *TxPool) OrphanCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.orphans)
+}
@@ -0,0 +1,100 @@
+package mempool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrphansArePromoted(t *testing.T) {
+	p, _, w, coinbases := newTestPool(t, 1)
+	parent := spend(w, coinbases[0], 0, 1)
+	child := spend(w, parent, 0, 1)
+	grandchild := spend(w, child, 0, 1)
+
+	accepted, missing, err := p.ProcessTransaction(grandchild)
+	require.NoError(t, err)
+	assert.Empty(t, accepted)
+	assert.Equal(t, []blockchain.Hash{child.ID}, missing)
+	_, missing, err = p.ProcessTransaction(child)
+	require.NoError(t, err)
+	assert.Equal(t, []blockchain.Hash{parent.ID}, missing)
+	assert.Equal(t, 2, p.OrphanCount())
+	assert.True(t, p.IsOrphan(child.ID))
+	_, _, err = p.ProcessTransaction(child)
+	assert.ErrorIs(t, err, ErrAlreadyInPool)
+
+	accepted, missing, err = p.ProcessTransaction(parent)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+	assert.Equal(t, []*blockchain.Transaction{parent, child, grandchild}, accepted)
+	assert.Equal(t, accepted, p.Transactions())
+	assert.Equal(t, 0, p.OrphanCount())
+}
+
+func TestOrphanPromotedByBlock(t *testing.T) {
+	p, chain, w, coinbases := newTestPool(t, 1)
+	parent := spend(w, coinbases[0], 0, 1)
+	child := spend(w, parent, 0, 1)
+	_, missing, err := p.ProcessTransaction(child)
+	require.NoError(t, err)
+	assert.Len(t, missing, 1)
+
+	mine(t, chain, w, parent)
+	assert.Equal(t, []*blockchain.Transaction{child}, p.Transactions())
+	assert.Equal(t, 0, p.OrphanCount())
+}
+
+func TestOrphanWithInvalidSignatures(t *testing.T) {
+	p, _, w, coinbases := newTestPool(t, 1)
+	parent := spend(w, coinbases[0], 0, 1)
+	child := spend(w, parent, 0, 1)
+	// A copy with the signature of another transaction has the same ID.
+	forged := *child
+	forged.Inputs = append([]blockchain.TxInput{}, child.Inputs...)
+	forged.Inputs[0].ScriptSig = spend(w, parent, 0, 2).Inputs[0].ScriptSig
+	require.Equal(t, child.ID, forged.ID)
+
+	_, _, err := p.ProcessTransaction(&forged)
+	require.NoError(t, err)
+	_, _, err = p.ProcessTransaction(child)
+	require.NoError(t, err, "the genuine transaction is kept as well")
+	assert.Equal(t, 2, p.OrphanCount())
+
+	accepted, _, err := p.ProcessTransaction(parent)
+	require.NoError(t, err)
+	assert.Equal(t, []*blockchain.Transaction{parent, child}, accepted)
+	assert.Equal(t, 0, p.OrphanCount())
+}
+
+func TestOrphanEviction(t *testing.T) {
+	p, _, w, coinbases := newTestPool(t, 4)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	var orphans []*blockchain.Transaction
+	for _, cb := range coinbases {
+		orphans = append(orphans, spend(w, spend(w, cb, 0, 1), 0, 1))
+	}
+	p.MaxOrphanSize = orphans[0].Size() * 2
+
+	for _, tx := range orphans[:3] {
+		_, _, err := p.ProcessTransaction(tx)
+		require.NoError(t, err)
+	}
+	assert.False(t, p.IsOrphan(orphans[0].ID), "the oldest orphan is evicted")
+	assert.True(t, p.IsOrphan(orphans[1].ID))
+	assert.True(t, p.IsOrphan(orphans[2].ID))
+
+	now = now.Add(p.OrphanExpiry + time.Second)
+	_, _, err := p.ProcessTransaction(orphans[3])
+	require.NoError(t, err)
+	assert.Equal(t, 1, p.OrphanCount())
+	assert.True(t, p.IsOrphan(orphans[3].ID))
+
+	p.MaxOrphanSize = orphans[0].Size() - 1
+	_, _, err = p.ProcessTransaction(orphans[0])
+	assert.ErrorIs(t, err, ErrOrphanTooBig)
+}
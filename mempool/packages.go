@@ -0,0 +1,92 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+)
+
+// Default package limits. A package is a transaction together with its unconfirmed ancestors
+// or descendants in the pool; the limits include the transaction itself.
+const (
+	DefaultMaxAncestors      = 25
+	DefaultMaxAncestorSize   = 101 * 1000
+	DefaultMaxDescendants    = 25
+	DefaultMaxDescendantSize = 101 * 1000
+)
+
+// ErrPackageLimit is returned for transactions which would exceed the package limits.
+var ErrPackageLimit = errors.New("transaction exceeds package limits")
+
+// Returns the transactions of the pool `tx` spends outputs of, directly or indirectly.
+func (p *TxPool) ancestors(tx *blockchain.Transaction) map[*TxDesc]bool {
+	ancestors := make(map[*TxDesc]bool)
+	queue := []*blockchain.Transaction{tx}
+	for len(queue) > 0 {
+		for _, in := range queue[0].Inputs {
+			if parent, ok := p.txs[hex.EncodeToString(in.ID)]; ok && !ancestors[parent] {
+				ancestors[parent] = true
+				queue = append(queue, parent.Tx)
+			}
+		}
+		queue = queue[1:]
+	}
+	return ancestors
+}
+
+// Checks that `tx` of `size` bytes with `ancestors` respects the package limits:
+// its ancestor package and the descendant packages of all its ancestors must not get too big.
+func (p *TxPool) checkPackageLimits(tx *blockchain.Transaction, size int, ancestors map[*TxDesc]bool) error {
+	if len(ancestors)+1 > p.MaxAncestors {
+		return fmt.Errorf("%w: %x would have %d unconfirmed ancestors, at most %d are allowed",
+			ErrPackageLimit, tx.ID, len(ancestors), p.MaxAncestors-1)
+	}
+	ancestorSize := size
+	for a := range ancestors {
+		ancestorSize += a.Size
+		if a.DescendantCount+1 > p.MaxDescendants {
+			return fmt.Errorf("%w: %x would have more than %d descendants", ErrPackageLimit, a.Tx.ID, p.MaxDescendants-1)
+		}
+		if a.DescendantSize+size > p.MaxDescendantSize {
+			return fmt.Errorf("%w: descendants of %x would exceed %d bytes", ErrPackageLimit, a.Tx.ID, p.MaxDescendantSize)
+		}
+	}
+	if ancestorSize > p.MaxAncestorSize {
+		return fmt.Errorf("%w: ancestors of %x would exceed %d bytes", ErrPackageLimit, tx.ID, p.MaxAncestorSize)
+	}
+	return nil
+}
+
+// Adds `d` to the package aggregates: the ancestor package of `d` and the descendant packages of its ancestors.
+// `d` has no descendants yet.
+func (p *TxPool) addToPackages(d *TxDesc, ancestors map[*TxDesc]bool) {
+	d.AncestorCount, d.AncestorSize, d.AncestorFees = 1, d.Size, d.Fee
+	d.DescendantCount, d.DescendantSize, d.DescendantFees = 1, d.Size, d.Fee
+	for a := range ancestors {
+		d.AncestorCount++
+		d.AncestorSize += a.Size
+		d.AncestorFees += a.Fee
+		a.DescendantCount++
+		a.DescendantSize += d.Size
+		a.DescendantFees += d.Fee
+	}
+}
+
+// Removes `d` from the descendant packages of its ancestors and the ancestor packages of its descendants.
+func (p *TxPool) removeFromPackages(d *TxDesc) {
+	for a := range p.ancestors(d.Tx) {
+		a.DescendantCount--
+		a.DescendantSize -= d.Size
+		a.DescendantFees -= d.Fee
+	}
+	descendants := make(map[*TxDesc]bool)
+	p.collectDescendants(d, descendants)
+	delete(descendants, d)
+	for c := range descendants {
+		c.AncestorCount--
+		c.AncestorSize -= d.Size
+		c.AncestorFees -= d.Fee
+	}
+}
@@ -0,0 +1,95 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageAggregates(t *testing.T) {
+	p, chain, w, coinbases := newTestPool(t, 1)
+	parent := spend(w, coinbases[0], 0, 1)
+	child := spend(w, parent, 0, 2)
+	grandchild := spend(w, child, 0, 3)
+	for _, tx := range []*blockchain.Transaction{parent, child, grandchild} {
+		_, err := p.AddTransaction(tx)
+		require.NoError(t, err)
+	}
+	size := parent.Size() // all three have the same size
+
+	d, _ := p.Desc(parent.ID)
+	assert.Equal(t, []int{1, size, 1}, []int{d.AncestorCount, d.AncestorSize, d.AncestorFees})
+	assert.Equal(t, []int{3, 3 * size, 6}, []int{d.DescendantCount, d.DescendantSize, d.DescendantFees})
+	d, _ = p.Desc(child.ID)
+	assert.Equal(t, []int{2, 2 * size, 3}, []int{d.AncestorCount, d.AncestorSize, d.AncestorFees})
+	assert.Equal(t, []int{2, 2 * size, 5}, []int{d.DescendantCount, d.DescendantSize, d.DescendantFees})
+
+	// Confirming the parent takes it out of the packages of its descendants.
+	mine(t, chain, w, parent)
+	_, ok := p.Desc(parent.ID)
+	assert.False(t, ok)
+	d, _ = p.Desc(grandchild.ID)
+	assert.Equal(t, []int{2, 2 * size, 5}, []int{d.AncestorCount, d.AncestorSize, d.AncestorFees})
+	assert.Equal(t, []int{1, size, 3}, []int{d.DescendantCount, d.DescendantSize, d.DescendantFees})
+}
+
+func TestPackageLimits(t *testing.T) {
+	p, _, w, coinbases := newTestPool(t, 1)
+	p.MaxAncestors = 2
+	p.MaxDescendants = 3
+	parent := blockchain.NewSignedTransaction(w,
+		[]blockchain.TxInput{{ID: coinbases[0].ID, Out: 0, Sequence: blockchain.MaxTxInSequenceNum}},
+		[]blockchain.TxOutput{
+			{Value: 5, ScriptPubKey: script.PayToPubKeyHash(blockchain.PublicKeyHash(w.PublicKey))},
+			{Value: 5, ScriptPubKey: script.PayToPubKeyHash(blockchain.PublicKeyHash(w.PublicKey))},
+			{Value: coinbases[0].Outputs[0].Value - 11, ScriptPubKey: script.PayToPubKeyHash(blockchain.PublicKeyHash(w.PublicKey))},
+		},
+		map[string]blockchain.Transaction{hex.EncodeToString(coinbases[0].ID): *coinbases[0]})
+	child1, child2, child3 := spend(w, parent, 0, 1), spend(w, parent, 1, 1), spend(w, parent, 2, 1)
+	for _, tx := range []*blockchain.Transaction{parent, child1, child2} {
+		_, err := p.AddTransaction(tx)
+		require.NoError(t, err)
+	}
+
+	_, err := p.AddTransaction(spend(w, child1, 0, 1))
+	assert.ErrorIs(t, err, ErrPackageLimit, "too many ancestors")
+	_, err = p.AddTransaction(child3)
+	assert.ErrorIs(t, err, ErrPackageLimit, "too many descendants of the parent")
+	p.MaxDescendants = 4
+	p.MaxDescendantSize = parent.Size() + child1.Size() + child2.Size()
+	_, err = p.AddTransaction(child3)
+	assert.ErrorIs(t, err, ErrPackageLimit, "descendants of the parent too big")
+	assert.Equal(t, 3, p.Count())
+}
+
+func TestChildPaysForParent(t *testing.T) {
+	p, chain, w, coinbases := newTestPool(t, 3)
+	parent := spend(w, coinbases[0], 0, 0)
+	child := spend(w, parent, 0, 10)
+	medium := spend(w, coinbases[1], 0, 3)
+	for _, tx := range []*blockchain.Transaction{parent, child, medium} {
+		_, err := p.AddTransaction(tx)
+		require.NoError(t, err)
+	}
+
+	// The child protects its parent from eviction: the cheapest package is the new transaction.
+	p.MaxSize = p.Size()
+	_, err := p.AddTransaction(spend(w, coinbases[2], 0, 2))
+	assert.ErrorIs(t, err, ErrPoolFull)
+	assert.Equal(t, []*blockchain.Transaction{parent, child, medium}, p.Transactions())
+
+	// The miner prefers parent and child over `medium` although the parent pays nothing.
+	address := string(w.Address())
+	empty, err := chain.NewBlockTemplate(address, nil)
+	require.NoError(t, err)
+	old := blockchain.BlockMaxSize
+	blockchain.BlockMaxSize = empty.Block.Size() + 16 + parent.Size() + child.Size() + medium.Size()/2
+	t.Cleanup(func() { blockchain.BlockMaxSize = old })
+	tmpl, err := chain.NewBlockTemplate(address, p.Transactions())
+	require.NoError(t, err)
+	assert.Equal(t, []*blockchain.Transaction{parent, child}, tmpl.Block.Transactions[1:])
+}
@@ -0,0 +1,92 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+)
+
+// MaxReplacementEvictions is the maximum number of transactions a replacement may evict:
+// the transactions it conflicts with and all their descendants.
+const MaxReplacementEvictions = 100
+
+// ErrReplacement is returned for transactions which may not replace the transactions they conflict with.
+var ErrReplacement = errors.New("replacement rejected")
+
+// Returns the transactions of the pool spending outputs `tx` spends as well.
+func (p *TxPool) conflicts(tx *blockchain.Transaction) []*TxDesc {
+	var conflicts []*TxDesc
+	seen := make(map[*TxDesc]bool)
+	for _, in := range tx.Inputs {
+		if d, ok := p.spends[outpoint(in.ID, in.Out)]; ok && !seen[d] {
+			seen[d] = true
+			conflicts = append(conflicts, d)
+		}
+	}
+	return conflicts
+}
+
+// Checks whether `tx` paying `fee` may replace the `conflicts` (opt-in replace-by-fee as in BIP 125):
+//   - every conflicting transaction signals replaceability,
+//   - at most MaxReplacementEvictions transactions are evicted,
+//   - `tx` does not spend outputs of the evicted transactions,
+//   - `tx` pays a higher fee rate than every conflicting transaction and
+//   - a higher fee than all evicted transactions together.
+//
+// Returns the transactions to evict, the oldest first.
+func (p *TxPool) checkReplacement(tx *blockchain.Transaction, fee int, conflicts []*TxDesc) ([]*TxDesc, error) {
+	id := hex.EncodeToString(tx.ID)
+	evicted := make(map[*TxDesc]bool)
+	for _, c := range conflicts {
+		if !c.Tx.SignalsReplacement() {
+			return nil, fmt.Errorf("%w: %s conflicts with %x which is not replaceable", ErrConflict, id, c.Tx.ID)
+		}
+		p.collectDescendants(c, evicted)
+	}
+	if len(evicted) > MaxReplacementEvictions {
+		return nil, fmt.Errorf("%w: %s would evict %d transactions, at most %d are allowed",
+			ErrReplacement, id, len(evicted), MaxReplacementEvictions)
+	}
+	evictedFees := 0
+	for d := range evicted {
+		evictedFees += d.Fee
+		for _, in := range tx.Inputs {
+			if hex.EncodeToString(in.ID) == hex.EncodeToString(d.Tx.ID) {
+				return nil, fmt.Errorf("%w: %s spends an output of %x which it replaces", ErrReplacement, id, d.Tx.ID)
+			}
+		}
+	}
+	size := tx.Size()
+	for _, c := range conflicts {
+		if fee*c.Size <= c.Fee*size {
+			return nil, fmt.Errorf("%w: fee rate of %s (%d/%d bytes) not higher than of %x (%d/%d bytes)",
+				ErrReplacement, id, fee, size, c.Tx.ID, c.Fee, c.Size)
+		}
+	}
+	if fee <= evictedFees {
+		return nil, fmt.Errorf("%w: fee of %s (%d) not higher than the fees of the %d replaced transactions (%d)",
+			ErrReplacement, id, fee, len(evicted), evictedFees)
+	}
+	descs := make([]*TxDesc, 0, len(evicted))
+	for d := range evicted {
+		descs = append(descs, d)
+	}
+	sort.Slice(descs, func(i, j int) bool { return descs[i].seq < descs[j].seq })
+	return descs, nil
+}
+
+// Adds `d` and all transactions spending its outputs, directly or indirectly, to `descendants`.
+func (p *TxPool) collectDescendants(d *TxDesc, descendants map[*TxDesc]bool) {
+	if descendants[d] {
+		return
+	}
+	descendants[d] = true
+	for i := range d.Tx.Outputs {
+		if child, ok := p.spends[outpoint(d.Tx.ID, i)]; ok {
+			p.collectDescendants(child, descendants)
+		}
+	}
+}
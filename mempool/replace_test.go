@@ -0,0 +1,96 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+	"github.com/mkohlhaas/gobc/script"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplaceByFee(t *testing.T) {
+	p, _, w, coinbases := newTestPool(t, 2)
+	original := spendWithSequence(w, coinbases[0], 0, 2, blockchain.MaxRBFSequence)
+	child := spendWithSequence(w, original, 0, 1, blockchain.MaxRBFSequence)
+	final := spend(w, coinbases[1], 0, 1)
+	for _, tx := range []*blockchain.Transaction{original, child, final} {
+		_, err := p.AddTransaction(tx)
+		require.NoError(t, err)
+	}
+
+	// Final transactions cannot be replaced.
+	_, err := p.AddTransaction(spendWithSequence(w, coinbases[1], 0, 5, blockchain.MaxRBFSequence))
+	assert.ErrorIs(t, err, ErrConflict)
+
+	// The replacement must pay more than `original` and `child` together.
+	_, err = p.AddTransaction(spendWithSequence(w, coinbases[0], 0, 3, blockchain.MaxRBFSequence))
+	assert.ErrorIs(t, err, ErrReplacement)
+
+	// It must not spend outputs of the transactions it replaces.
+	prevTXs := map[string]blockchain.Transaction{
+		hex.EncodeToString(coinbases[0].ID): *coinbases[0],
+		hex.EncodeToString(original.ID):     *original,
+	}
+	value := coinbases[0].Outputs[0].Value + original.Outputs[0].Value - 10
+	spendsOriginal := blockchain.NewSignedTransaction(w,
+		[]blockchain.TxInput{{ID: coinbases[0].ID, Out: 0}, {ID: original.ID, Out: 0}},
+		[]blockchain.TxOutput{{Value: value, ScriptPubKey: script.PayToPubKeyHash(blockchain.PublicKeyHash(w.PublicKey))}}, prevTXs)
+	_, err = p.AddTransaction(spendsOriginal)
+	assert.ErrorIs(t, err, ErrReplacement)
+
+	// It must pay a higher fee rate: 4 is more than 3 but spread over many more bytes.
+	var outputs []blockchain.TxOutput
+	for i := 0; i < 15; i++ {
+		outputs = append(outputs, blockchain.TxOutput{Value: 1, ScriptPubKey: script.PayToPubKeyHash(blockchain.PublicKeyHash(w.PublicKey))})
+	}
+	outputs[0].Value = coinbases[0].Outputs[0].Value - 4 - 14
+	large := blockchain.NewSignedTransaction(w, []blockchain.TxInput{{ID: coinbases[0].ID, Out: 0}}, outputs,
+		map[string]blockchain.Transaction{hex.EncodeToString(coinbases[0].ID): *coinbases[0]})
+	_, err = p.AddTransaction(large)
+	assert.ErrorIs(t, err, ErrReplacement)
+
+	replacement := spendWithSequence(w, coinbases[0], 0, 4, blockchain.MaxRBFSequence)
+	_, err = p.AddTransaction(replacement)
+	require.NoError(t, err)
+	assert.Equal(t, []*blockchain.Transaction{final, replacement}, p.Transactions())
+	assert.Equal(t, final.Size()+replacement.Size(), p.Size())
+}
+
+func TestReplacementEvictedFromFullPool(t *testing.T) {
+	p, _, w, coinbases := newTestPool(t, 2)
+	original := spendWithSequence(w, coinbases[0], 0, 2, blockchain.MaxRBFSequence)
+	child := spendWithSequence(w, original, 0, 1, blockchain.MaxRBFSequence)
+	high := spend(w, coinbases[1], 0, 20)
+	for _, tx := range []*blockchain.Transaction{original, child, high} {
+		_, err := p.AddTransaction(tx)
+		require.NoError(t, err)
+	}
+	before := p.Transactions()
+	p.MaxSize = p.Size()
+
+	// The replacement pays more than `original` and `child` but at the lowest fee rate of the pool
+	// after replacing them, and the pool is full.
+	var outputs []blockchain.TxOutput
+	for i := 0; i < 12; i++ {
+		outputs = append(outputs, blockchain.TxOutput{Value: 1, ScriptPubKey: script.PayToPubKeyHash(blockchain.PublicKeyHash(w.PublicKey))})
+	}
+	outputs[0].Value = coinbases[0].Outputs[0].Value - 6 - 11
+	replacement := blockchain.NewSignedTransaction(w, []blockchain.TxInput{{ID: coinbases[0].ID, Out: 0}}, outputs,
+		map[string]blockchain.Transaction{hex.EncodeToString(coinbases[0].ID): *coinbases[0]})
+	require.Greater(t, replacement.Size(), original.Size()+child.Size())
+	_, err := p.AddTransaction(replacement)
+	assert.ErrorIs(t, err, ErrPoolFull)
+
+	// Nothing is lost.
+	assert.Equal(t, before, p.Transactions())
+	assert.Equal(t, p.MaxSize, p.Size())
+	d, ok := p.Desc(original.ID)
+	require.True(t, ok)
+	assert.Equal(t, 2, d.DescendantCount)
+	assert.Equal(t, original.Size()+child.Size(), d.DescendantSize)
+	d, ok = p.Desc(child.ID)
+	require.True(t, ok)
+	assert.Equal(t, 2, d.AncestorCount)
+}
@@ -0,0 +1,198 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+	"github.com/mkohlhaas/gobc/stratum"
+)
+
+const (
+	minPoolSize       = 2  // number of valid transactions needed before we start mining
+	rebuildFeePercent = 10 // the memory pool must pay this much more in fees than the template to rebuild it
+)
+
+var (
+	miner     *miningWorker   // mines blocks in the background; nil if we are not a miner
+	jobServer *stratum.Server // hands out mining jobs to external workers; nil if there is none
+)
+
+// A miningWorker owns the block template and mines it until a block is found or the template is stale.
+// The template is stale when a new block becomes the tip or the memory pool pays
+// significantly more fees (see rebuildFeePercent).
+type miningWorker struct {
+	chain   *blockchain.BlockChain
+	address string
+	wake    chan struct{} // the tip or the memory pool changed
+	done    chan struct{} // closed when the worker stopped
+}
+
+// Creates a worker mining for `address`.
+func newMiningWorker(chain *blockchain.BlockChain, address string) *miningWorker {
+	return &miningWorker{
+		chain:   chain,
+		address: address,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// Tells the worker that the tip or the memory pool changed. Never blocks.
+func (m *miningWorker) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default: // the worker has not seen the last notification yet
+	}
+}
+
+// Mines until `ctx` is cancelled.
+func (m *miningWorker) run(ctx context.Context) {
+	defer close(m.done)
+	for {
+		tmpl, err := m.chain.NewBlockTemplate(m.address, txPool.Transactions())
+		if err != nil {
+			fmt.Printf("Creating block template: %s\n", err)
+			return
+		}
+		if len(tmpl.Block.Transactions)-1 < minPoolSize {
+			// Nothing to mine. Wait for transactions.
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.wake:
+				continue
+			}
+		}
+		if !m.mine(ctx, tmpl) {
+			return
+		}
+	}
+}
+
+// Mines a block from `tmpl`. Returns false if the worker has to stop.
+func (m *miningWorker) mine(ctx context.Context, tmpl *blockchain.BlockTemplate) bool {
+	mineCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		block *blockchain.Block
+		err   error
+	}
+	found := make(chan result, 1)
+	go func() {
+		// MineBlockTemplate validates the block and updates the UTXO set.
+		block, err := m.chain.MineBlockTemplate(mineCtx, tmpl)
+		found <- result{block, err}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			<-found
+			return false
+		case <-m.wake:
+			if m.isStale(tmpl) {
+				fmt.Println("Block template is stale; rebuilding")
+				cancel()
+				<-found
+				return true
+			}
+		case res := <-found:
+			if errors.Is(res.err, context.Canceled) {
+				return true
+			}
+			if res.err != nil {
+				// Mining the same template again would fail again. Wait for a change.
+				fmt.Printf("Mined block rejected: %s\n", res.err)
+				select {
+				case <-ctx.Done():
+					return false
+				case <-m.wake:
+					return true
+				}
+			}
+			fmt.Printf("New block mined: %s\n", res.block)
+			announceBlock(res.block)
+			return true
+		}
+	}
+}
+
+// Returns true if `tmpl` is not on top of the tip anymore or the memory pool pays
+// at least rebuildFeePercent more fees.
+func (m *miningWorker) isStale(tmpl *blockchain.BlockTemplate) bool {
+	if !bytes.Equal(tmpl.Block.PrevHash, m.chain.BestHash()) {
+		return true
+	}
+	fresh, err := m.chain.NewBlockTemplate(m.address, txPool.Transactions())
+	if err != nil {
+		return false
+	}
+	fees, freshFees := tmpl.TotalFees(), fresh.TotalFees()
+	return freshFees*100 >= fees*(100+rebuildFeePercent) && freshFees > fees
+}
+
+// Tells our peers about `block`.
+// The memory pool has already dropped the block's transactions when the block was connected.
+func announceBlock(block *blockchain.Block) {
+	for _, node := range KnownNodes {
+		if node != nodeAddress {
+			sendInv(node, "block", []blockchain.Hash{block.Hash})
+		}
+	}
+}
+
+// Starts the mining worker. Returns a function which stops the worker and waits for it.
+func startMining(chain *blockchain.BlockChain, address string) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	miner = newMiningWorker(chain, address)
+	go miner.run(ctx)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-miner.done
+		})
+	}
+}
+
+// Tells the mining worker and the job server that the tip or the memory pool changed.
+func notifyMiners() {
+	if miner != nil {
+		miner.notify()
+	}
+	if jobServer != nil {
+		if err := jobServer.Refresh(); err != nil {
+			fmt.Printf("Refreshing mining job: %s\n", err)
+		}
+	}
+}
+
+// Starts a job server for external workers on `addr`; blocks pay to `address`.
+// Returns a function which stops the job server.
+func startJobServer(chain *blockchain.BlockChain, address, addr string) (stop func(), err error) {
+	ln, err := net.Listen(protocol, addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	jobServer = stratum.NewServer(chain, address, txPool.Transactions)
+	jobServer.OnBlock = announceBlock
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := jobServer.Serve(ctx, ln); err != nil {
+			fmt.Printf("Job server: %s\n", err)
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}, nil
+}
@@ -5,8 +5,8 @@ package network
 
 import (
 	"bytes"
-	"encoding/gob"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,41 +14,84 @@ import (
 	"os"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/mkohlhaas/gobc/bcerror"
 	"github.com/mkohlhaas/gobc/blockchain"
+	"github.com/mkohlhaas/gobc/mempool"
+	"github.com/mkohlhaas/gobc/wire"
 	"github.com/vrecan/death/v3"
 )
 
 const (
-	protocol      = "tcp"
-	commandLength = 12
+	protocol        = "tcp"
+	magicLength     = 4
+	commandLength   = 12
+	templateTimeout = 30 * time.Second // for requesting a block template
 )
 
 var (
 	nodeAddress     string
 	mineAddress     string
-	KnownNodes      = []string{"localhost:3000"}              // TODO: replace slice with map (makes insertion and deletion easier); KnownNodes      = map[string]bool{"localhost:3000": true}
-	blocksInTransit = make([]blockchain.Hash, 0)              // track downloaded block hashes
-	memoryPool      = make(map[string]blockchain.Transaction) // map: transaction id -> transaction
+	KnownNodes      []string                     // seed nodes of the network and peers; TODO: replace slice with map (makes insertion and deletion easier); KnownNodes      = map[string]bool{"localhost:3000": true}
+	blocksInTransit = make([]blockchain.Hash, 0) // track downloaded block hashes
+	txPool          *mempool.TxPool              // transactions waiting for a block
 )
 
+// payload is implemented by all messages.
+// Messages are encoded with the binary encoding of package wire.
+type payload interface {
+	encode(w *wire.Writer)
+	decode(r *wire.Reader)
+}
+
 // For sending/receiving known nodes.
 type addr struct {
 	addrList []string // list of peers
 }
 
+func (p *addr) encode(w *wire.Writer) {
+	w.WriteVarInt(uint64(len(p.addrList)))
+	for _, a := range p.addrList {
+		w.WriteString(a)
+	}
+}
+
+func (p *addr) decode(r *wire.Reader) {
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		p.addrList = append(p.addrList, r.ReadString())
+	}
+}
+
 // For sending/receiving blocks.
 type block struct {
 	addrFrom string // sender
 	block    []byte // block
 }
 
+func (p *block) encode(w *wire.Writer) {
+	w.WriteString(p.addrFrom)
+	w.WriteVarBytes(p.block)
+}
+
+func (p *block) decode(r *wire.Reader) {
+	p.addrFrom = r.ReadString()
+	p.block = r.ReadVarBytes()
+}
+
 // For sending/receiving requesting a list of all block hashes.
 type getBlocks struct {
 	addrFrom string // sender
 }
 
+func (p *getBlocks) encode(w *wire.Writer) {
+	w.WriteString(p.addrFrom)
+}
+
+func (p *getBlocks) decode(r *wire.Reader) {
+	p.addrFrom = r.ReadString()
+}
+
 // For sending/receiving blocks and transactions.
 type getData struct {
 	addrFrom string // sender
@@ -56,6 +99,18 @@ type getData struct {
 	id       []byte // identifier
 }
 
+func (p *getData) encode(w *wire.Writer) {
+	w.WriteString(p.addrFrom)
+	w.WriteString(p.kind)
+	w.WriteVarBytes(p.id)
+}
+
+func (p *getData) decode(r *wire.Reader) {
+	p.addrFrom = r.ReadString()
+	p.kind = r.ReadString()
+	p.id = r.ReadVarBytes()
+}
+
 // For sending/receiving inventary. Can be either blocks or transactions.
 // Show me
 type inv struct {
@@ -64,18 +119,75 @@ type inv struct {
 	items    []blockchain.Hash // blocks or transactions
 }
 
+func (p *inv) encode(w *wire.Writer) {
+	w.WriteString(p.addrFrom)
+	w.WriteString(p.kind)
+	w.WriteVarInt(uint64(len(p.items)))
+	for _, item := range p.items {
+		w.WriteVarBytes(item)
+	}
+}
+
+func (p *inv) decode(r *wire.Reader) {
+	p.addrFrom = r.ReadString()
+	p.kind = r.ReadString()
+	for n, i := r.ReadCount(), 0; i < n && r.Err() == nil; i++ {
+		p.items = append(p.items, r.ReadVarBytes())
+	}
+}
+
 // For sending/receiving transactions.
 type tx struct {
 	addrFrom    string // sender
 	transaction []byte // one transaction only in our implementation
 }
 
+func (p *tx) encode(w *wire.Writer) {
+	w.WriteString(p.addrFrom)
+	w.WriteVarBytes(p.transaction)
+}
+
+func (p *tx) decode(r *wire.Reader) {
+	p.addrFrom = r.ReadString()
+	p.transaction = r.ReadVarBytes()
+}
+
 // For sending/receiving version and current blockchain height.
 type version struct {
 	bestHeight uint64 // current blockchain length
 	addrFrom   string // the sender
 }
 
+func (p *version) encode(w *wire.Writer) {
+	w.WriteUint64(p.bestHeight)
+	w.WriteString(p.addrFrom)
+}
+
+func (p *version) decode(r *wire.Reader) {
+	p.bestHeight = r.ReadUint64()
+	p.addrFrom = r.ReadString()
+}
+
+// For requesting a block template paying to `address`.
+// The node answers on the same connection with a blockTemplateReply.
+type getBlockTemplate struct {
+	address string // coinbase address
+}
+
+func (p *getBlockTemplate) encode(w *wire.Writer) {
+	w.WriteString(p.address)
+}
+
+func (p *getBlockTemplate) decode(r *wire.Reader) {
+	p.address = r.ReadString()
+}
+
+// Answer to getBlockTemplate in JSON like getblocktemplate of Bitcoin Core.
+type blockTemplateReply struct {
+	Result *blockchain.GetBlockTemplateResult `json:"result"`
+	Error  string                             `json:"error,omitempty"`
+}
+
 // ------------------------------------------------------------------- //
 // ------------------- Sending Requests ------------------------------ //
 // ------------------------------------------------------------------- //
@@ -89,6 +201,13 @@ func cmdToBytes(cmd string) []byte {
 	return bytes[:]
 }
 
+// Returns a message for the active network: magic bytes, command, payload.
+func newMessage(cmd string, payload []byte) []byte {
+	msg := append([]byte{}, blockchain.Params.Magic[:]...)
+	msg = append(msg, cmdToBytes(cmd)...)
+	return append(msg, payload...)
+}
+
 // Generic send used by every specific send function, e.g. SendAddr(), sendData(),...
 // Sends `data` to `addr`.
 // Removes `addr` from list of known nodes if it is unreachable..
@@ -112,12 +231,12 @@ func sendData(addr string, data []byte) {
 	bcerror.Handle(err)
 }
 
-func encode(data any) []byte {
-	var buff bytes.Buffer
-	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(data)
-	bcerror.Handle(err)
-	return buff.Bytes()
+// Returns the encoded payload prefixed with the version of the encoding.
+func encode(p payload) []byte {
+	w := wire.NewWriter()
+	w.WriteVersion()
+	p.encode(w)
+	return w.Bytes()
 }
 
 // Sends a getblock message to every known node.
@@ -131,8 +250,8 @@ func requestBlocks() {
 func sendAddr(address string) {
 	nodes := addr{KnownNodes}
 	nodes.addrList = append(nodes.addrList, nodeAddress)
-	payload := encode(nodes)
-	request := append(cmdToBytes("addr"), payload...)
+	payload := encode(&nodes)
+	request := newMessage("addr", payload)
 	sendData(address, request)
 }
 
@@ -140,50 +259,89 @@ func sendAddr(address string) {
 // Send our peer those hashes.
 func sendInv(address, kind string, items []blockchain.Hash) {
 	inventory := inv{nodeAddress, kind, items}
-	payload := encode(inventory)
-	request := append(cmdToBytes("inv"), payload...)
+	payload := encode(&inventory)
+	request := newMessage("inv", payload)
 	sendData(address, request)
 }
 
 // Request all block hashes from peer.
 func sendGetBlocks(address string) {
-	payload := encode(getBlocks{nodeAddress})
-	request := append(cmdToBytes("getblocks"), payload...)
+	payload := encode(&getBlocks{nodeAddress})
+	request := newMessage("getblocks", payload)
 	sendData(address, request)
 }
 
 // Send a request for a single block or a single transaction.
 // `id` is hash of the block or transaction.
 func sendGetData(address, kind string, id []byte) {
-	payload := encode(getData{nodeAddress, kind, id})
-	request := append(cmdToBytes("getdata"), payload...)
+	payload := encode(&getData{nodeAddress, kind, id})
+	request := newMessage("getdata", payload)
 	sendData(address, request)
 }
 
 // Sends the whole block to our peer.
 func sendBlock(addr string, b *blockchain.Block) {
 	data := block{nodeAddress, b.Serialize()}
-	payload := encode(data)
-	request := append(cmdToBytes("block"), payload...)
+	payload := encode(&data)
+	request := newMessage("block", payload)
 	sendData(addr, request)
 }
 
 // Sends transaction to peer.
 func SendTx(addr string, tnx *blockchain.Transaction) {
 	data := tx{nodeAddress, tnx.Serialize()}
-	payload := encode(data)
-	request := append(cmdToBytes("tx"), payload...)
+	payload := encode(&data)
+	request := newMessage("tx", payload)
 	sendData(addr, request)
 }
 
 // Send the peer our current state of the blockchain.
 func sendVersion(addr string, chain *blockchain.BlockChain) {
 	bestHeight := chain.BestHeight()
-	payload := encode(version{bestHeight, nodeAddress})
-	request := append(cmdToBytes("version"), payload...)
+	payload := encode(&version{bestHeight, nodeAddress})
+	request := newMessage("version", payload)
 	sendData(addr, request)
 }
 
+// Requests a block template paying to `address` from the node at `addr`.
+// External miners build their blocks from it.
+func GetBlockTemplate(addr, address string) (*blockchain.GetBlockTemplateResult, error) {
+	conn, err := net.DialTimeout(protocol, addr, templateTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(templateTimeout))
+	if err != nil {
+		return nil, err
+	}
+	request := newMessage("getblocktmpl", encode(&getBlockTemplate{address}))
+	if _, err = conn.Write(request); err != nil {
+		return nil, err
+	}
+	// The node reads the request up to EOF.
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		if err = tcp.CloseWrite(); err != nil {
+			return nil, err
+		}
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, err
+	}
+	var reply blockTemplateReply
+	if err = json.Unmarshal(data, &reply); err != nil {
+		return nil, fmt.Errorf("decoding block template from %s: %w", addr, err)
+	}
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	if reply.Result == nil {
+		return nil, fmt.Errorf("no block template from %s", addr)
+	}
+	return reply.Result, nil
+}
+
 // ------------------------------------------------------------------- //
 // ------------------ Receiving Requests ----------------------------- //
 // ------------------------------------------------------------------- //
@@ -195,6 +353,12 @@ func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
 	req, err := ioutil.ReadAll(conn)
 	defer conn.Close()
 	bcerror.Handle(err)
+	// Messages of other networks are dropped.
+	if len(req) < magicLength+commandLength || !bytes.Equal(req[:magicLength], blockchain.Params.Magic[:]) {
+		fmt.Printf("Dropping message from %s: not a %s message\n", conn.RemoteAddr(), blockchain.Params.Name)
+		return
+	}
+	req = req[magicLength:]
 	command := bytesToCmd(req[:commandLength])
 	fmt.Printf("Received %s command\n", command)
 	switch command {
@@ -212,6 +376,8 @@ func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
 		HandleGetData(req, chain)
 	case "version":
 		HandleVersion(req, chain)
+	case "getblocktmpl":
+		HandleGetBlockTemplate(req, chain, conn)
 	default:
 		fmt.Println("Unknown command")
 	}
@@ -228,21 +394,25 @@ func bytesToCmd(bytes []byte) string {
 	return fmt.Sprintf("%s", cmd)
 }
 
-// Returns decoded request.
+// Decodes request into `p`.
 // Used by all handler functions, e.g. HandleAddr, HandleVersion, etc...
-func decode(request []byte, payload any) any {
-	var buff bytes.Buffer
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(payload)
-	bcerror.Handle(err)
-	return payload
+func decode(request []byte, p payload) error {
+	r := wire.NewReader(request[commandLength:])
+	r.ReadVersion()
+	p.decode(r)
+	if err := r.Finish(); err != nil {
+		return fmt.Errorf("decoding request: %w", err)
+	}
+	return nil
 }
 
 // Adds addresses to list of known nodes.
 func HandleAddr(request []byte) {
 	var payload addr
-	decode(request, &payload)
+	if err := decode(request, &payload); err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Printf("HandleAddr: %+v.\n", payload)
 	KnownNodes = append(KnownNodes, payload.addrList...)
 	fmt.Printf("there are %d known nodes\n", len(KnownNodes))
@@ -252,26 +422,45 @@ func HandleAddr(request []byte) {
 // Adds a received block to the blockchain.
 func HandleBlock(request []byte, chain *blockchain.BlockChain) {
 	var payload block
-	decode(request, &payload)
+	if err := decode(request, &payload); err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Printf("HandleBlock: %+v.\n", payload)
-	block := blockchain.DeserializeBlock(payload.block)
+	block, err := blockchain.DeserializeBlock(payload.block)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Println("Received a new block:")
 	fmt.Printf("%s.\n", block)
-	chain.AddBlock(block)
+	// ProcessBlock validates the block and updates the UTXO set.
+	// Blocks arriving before their parents wait in the orphan pool; the missing ancestor is requested from the sender.
+	isOrphan, err := chain.ProcessBlock(block)
+	switch {
+	case err != nil:
+		fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+	case isOrphan:
+		missing := chain.MissingAncestor(block.Hash)
+		fmt.Printf("Block %x is an orphan; requesting block %x\n", block.Hash, missing)
+		sendGetData(payload.addrFrom, "block", missing)
+	default:
+		notifyMiners() // we might have a new tip
+	}
 	if len(blocksInTransit) > 0 {
 		blockHash := blocksInTransit[0]
 		sendGetData(payload.addrFrom, "block", blockHash)
 		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{Blockchain: chain}
-		UTXOSet.Reindex()
 	}
 }
 
 // Peer has a new block or transaction.
 func HandleInv(request []byte, chain *blockchain.BlockChain) {
 	var payload inv
-	decode(request, &payload)
+	if err := decode(request, &payload); err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Printf("HandleInv: %+v.\n", payload)
 	if payload.kind == "block" {
 		blocksInTransit = payload.items
@@ -290,7 +479,8 @@ func HandleInv(request []byte, chain *blockchain.BlockChain) {
 	// Request transaction from sender.
 	if payload.kind == "tx" {
 		txID := payload.items[0] // In our implementation there is only one transaction in the list. See sendInv() call in HandleTx().
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
+		// Orphans are requested again: the orphan with this ID may be a copy with invalid signatures.
+		if !txPool.Has(txID) {
 			sendGetData(payload.addrFrom, "tx", txID)
 		}
 	}
@@ -299,9 +489,12 @@ func HandleInv(request []byte, chain *blockchain.BlockChain) {
 // Sends all block hashes to sender.
 func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
 	var payload getBlocks
-	decode(request, &payload)
+	if err := decode(request, &payload); err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Printf("HandleGetBlocks: %+v.\n", payload)
-	blockHashes := chain.GetBlockHashes()
+	blockHashes := chain.GetBlockHashes(0, chain.BestHeight())
 	sendInv(payload.addrFrom, "block", blockHashes)
 }
 
@@ -309,7 +502,10 @@ func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
 // No check if we have block or transaction available.
 func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 	var payload getData
-	decode(request, &payload)
+	if err := decode(request, &payload); err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Printf("HandleGetData: %+v.\n", payload)
 	if payload.kind == "block" {
 		block, err := chain.GetBlock([]byte(payload.id))
@@ -319,35 +515,56 @@ func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 		}
 		sendBlock(payload.addrFrom, block)
 	}
-	// Transaction must be in the memory pool. (TODO: Strange!)
+	// Only transactions of the memory pool are sent.
 	if payload.kind == "tx" {
-		txID := hex.EncodeToString(payload.id)
-		tx := memoryPool[txID]
-		SendTx(payload.addrFrom, &tx)
+		tx := txPool.Transaction(payload.id)
+		if tx == nil {
+			fmt.Printf("Transaction %x not in memory pool\n", payload.id)
+			return
+		}
+		SendTx(payload.addrFrom, tx)
 	}
 }
 
-// Adds received transaction to the memory pool and starts mining
-// if we are a miner and memoryPool is big enough (> 2 entries).
+// Adds received transaction to the memory pool and tells the miner if we are one.
+// Orphans wait in the memory pool's orphan pool; their missing parents are requested from the sender.
 func HandleTx(request []byte, chain *blockchain.BlockChain) {
 	var payload tx
-	decode(request, &payload)
+	if err := decode(request, &payload); err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Printf("HandleTx: %+v.\n", payload)
 	txData := payload.transaction
-	tx := blockchain.DeserializeTransaction(txData)
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
-	// Central node sends transaction ID to all other nodes.
+	tx, err := blockchain.DeserializeTransaction(txData)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	accepted, missing, err := txPool.ProcessTransaction(&tx)
+	if err != nil {
+		fmt.Printf("Transaction %x rejected: %s\n", tx.ID, err)
+		return
+	}
+	if len(missing) > 0 {
+		fmt.Printf("Transaction %x is an orphan; requesting %d parents\n", tx.ID, len(missing))
+		for _, parent := range missing {
+			sendGetData(payload.addrFrom, "tx", parent)
+		}
+		return
+	}
+	// Central node sends transaction IDs to all other nodes; promoted orphans are sent as well.
 	if nodeAddress == KnownNodes[0] {
-		for _, node := range KnownNodes {
-			if node != nodeAddress && node != payload.addrFrom {
-				sendInv(node, "tx", []blockchain.Hash{tx.ID})
+		for _, t := range accepted {
+			for _, node := range KnownNodes {
+				if node != nodeAddress && node != payload.addrFrom {
+					sendInv(node, "tx", []blockchain.Hash{t.ID})
+				}
 			}
 		}
 	} else {
-		// Other nodes can mine transaction if memory pool is big enough.
-		if len(memoryPool) >= 2 && len(mineAddress) > 0 {
-			MineTx(chain)
-		}
+		// Other nodes mine the transactions of the memory pool.
+		notifyMiners()
 	}
 }
 
@@ -355,7 +572,10 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 // if we are behind or send our version if we are ahead.
 func HandleVersion(request []byte, chain *blockchain.BlockChain) {
 	var payload version
-	decode(request, &payload)
+	if err := decode(request, &payload); err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Printf("HandleVersion: %+v.\n", payload)
 	bestHeight := chain.BestHeight()
 	otherHeight := payload.bestHeight
@@ -373,6 +593,27 @@ func HandleVersion(request []byte, chain *blockchain.BlockChain) {
 	}
 }
 
+// Answers with a block template built from the memory pool.
+func HandleGetBlockTemplate(request []byte, chain *blockchain.BlockChain, conn net.Conn) {
+	var reply blockTemplateReply
+	var payload getBlockTemplate
+	if err := decode(request, &payload); err != nil {
+		reply.Error = err.Error()
+	} else if !blockchain.Validate(payload.address) {
+		reply.Error = fmt.Sprintf("invalid address %q", payload.address)
+	} else if tmpl, err := chain.NewBlockTemplate(payload.address, txPool.Transactions()); err != nil {
+		reply.Error = err.Error()
+	} else {
+		result := tmpl.Result()
+		reply.Result = &result
+	}
+	data, err := json.Marshal(reply)
+	bcerror.Handle(err)
+	if _, err = conn.Write(data); err != nil {
+		fmt.Printf("Sending block template to %s: %v\n", conn.RemoteAddr(), err)
+	}
+}
+
 func senderIsKnown(addr string) bool {
 	for _, node := range KnownNodes {
 		if node == addr {
@@ -386,61 +627,18 @@ func senderIsNotKnown(addr string) bool {
 	return !senderIsKnown(addr)
 }
 
-// ------------------------------------------------------------------- //
-// ----------------------- Mining ------------------------------------ //
-// ------------------------------------------------------------------- //
-
-// Mines a new block and sends it to all nodes.
-func MineTx(chain *blockchain.BlockChain) {
-	// Remove all invalid transactions from memory pool.
-	var txs []*blockchain.Transaction
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
-		}
-	}
-	if len(txs) == 0 {
-		fmt.Println("All Transactions are invalid")
-		return
-	}
-	cbTx := blockchain.CoinbaseTx(mineAddress)
-	txs = append(txs, cbTx)
-	// TODO: Make coinbase the first transaction in the block.
-	// txs = append([]*blockchain.Transaction{cbTx}, txs...)
-	newBlock := chain.MineBlock(txs)
-	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
-	UTXOSet.Reindex()
-	fmt.Printf("New block mined: %s\n", newBlock)
-	// Delete transactions from memoryPool.
-	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
-	}
-	// Tell our peers we have a new block.
-	for _, node := range KnownNodes {
-		if node != nodeAddress {
-			sendInv(node, "block", []blockchain.Hash{newBlock.Hash})
-		}
-	}
-	// Mine again in case we are not finished.
-	// Transactions come in via HandleTx() which calls MineTx(). Problematic.
-	if len(memoryPool) > 0 {
-		MineTx(chain)
-	}
-}
-
 // ------------------------------------------------------------------- //
 // ----------------------- Server ------------------------------------ //
 // ------------------------------------------------------------------- //
 
 // Starts server and waits for TCP connections.
-// `minerAddress` will get the mining reward.
-func StartServer(nodeID, minerAddress string) {
+// `minerAddress` will get the mining reward. If `stratumAddress` is set, external workers
+// mine on our behalf: a job server listens on `stratumAddress` instead of mining ourselves.
+func StartServer(nodeID, minerAddress, stratumAddress string) {
 	// set global variables
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 	mineAddress = minerAddress
+	KnownNodes = append([]string{}, blockchain.Params.SeedNodes...)
 	// start TCP listen
 	ln, err := net.Listen(protocol, nodeAddress)
 	bcerror.Handle(err)
@@ -448,7 +646,18 @@ func StartServer(nodeID, minerAddress string) {
 	// Open blockchain.
 	chain := blockchain.OpenBlockChain(nodeID)
 	defer chain.Database.Close()
-	go closeDB(chain)
+	// The memory pool follows the main chain.
+	txPool = mempool.New(chain)
+	// Mining runs in the background and is stopped before the database is closed.
+	stopMining := func() {}
+	if len(mineAddress) > 0 && len(stratumAddress) > 0 {
+		stopMining, err = startJobServer(chain, mineAddress, stratumAddress)
+		bcerror.Handle(err)
+	} else if len(mineAddress) > 0 {
+		stopMining = startMining(chain, mineAddress)
+	}
+	defer stopMining()
+	go closeDB(chain, stopMining)
 	// Non-central nodes send version package to central node.
 	if nodeAddress != KnownNodes[0] {
 		sendVersion(KnownNodes[0], chain)
@@ -462,11 +671,13 @@ func StartServer(nodeID, minerAddress string) {
 }
 
 // Runs in a goroutine and waits for Ctrl-C to shutt down the server.
-func closeDB(chain *blockchain.BlockChain) {
+// Stops mining with `stopMining` before closing the database.
+func closeDB(chain *blockchain.BlockChain, stopMining func()) {
 	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM)
 	d.WaitForDeathWithFunc(func() {
 		defer os.Exit(0)
 		defer runtime.Goexit()
+		stopMining()
 		chain.Database.Close()
 	})
 }
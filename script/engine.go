@@ -0,0 +1,531 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+// SigChecker checks the signatures of OP_CHECKSIG and OP_CHECKMULTISIG and the lock times of
+// OP_CHECKLOCKTIMEVERIFY and OP_CHECKSEQUENCEVERIFY. It knows the transaction input being validated.
+type SigChecker interface {
+	// CheckSig returns true if `sig` is a valid signature of the input by `pubKey`.
+	// `subScript` is the locking script being executed.
+	CheckSig(sig, pubKey []byte, subScript Script) bool
+	// CheckLockTime returns true if the lock time of the transaction is at least `lockTime` (BIP 65).
+	CheckLockTime(lockTime int64) bool
+	// CheckSequence returns true if the relative lock time of the input is at least `sequence` (BIP 112).
+	CheckSequence(sequence int64) bool
+}
+
+// Verify runs the unlocking script `scriptSig` and then the locking script `scriptPubKey` on the resulting stack.
+// Succeeds if the top of the stack is true afterwards. `scriptSig` must only push data.
+// For pay-to-script-hash outputs the last element pushed by `scriptSig` is the redeem script; it is run on the
+// other elements and must leave true on the stack as well.
+func Verify(scriptSig, scriptPubKey Script, checker SigChecker) error {
+	if !scriptSig.IsPushOnly() {
+		return scriptError(ErrNotPushOnly, "script: signature script does not only push data")
+	}
+	e := &engine{checker: checker}
+	if err := e.execute(scriptSig); err != nil {
+		return err
+	}
+	redeemStack := append([][]byte{}, e.stack...)
+	if err := e.execute(scriptPubKey); err != nil {
+		return err
+	}
+	if err := e.checkResult(); err != nil {
+		return err
+	}
+	if scriptPubKey.ScriptHash() == nil {
+		return nil
+	}
+	e.stack = redeemStack
+	redeemScript, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if err := e.execute(redeemScript); err != nil {
+		return err
+	}
+	return e.checkResult()
+}
+
+// Returns an error unless the top of the stack is true.
+func (e *engine) checkResult() error {
+	if len(e.stack) == 0 || !asBool(e.stack[len(e.stack)-1]) {
+		return scriptError(ErrEvalFalse, "script: false stack entry at end of script execution")
+	}
+	return nil
+}
+
+// Execution state.
+type engine struct {
+	checker  SigChecker
+	stack    [][]byte
+	altStack [][]byte
+	conds    []bool // one entry per enclosing OP_IF; true if the branch is executed
+	numOps   int
+	script   Script // script being executed
+}
+
+// Runs `script` on the current stack.
+func (e *engine) execute(script Script) error {
+	if len(script) > MaxScriptSize {
+		return scriptError(ErrScriptTooBig, "script: size %d exceeds %d bytes", len(script), MaxScriptSize)
+	}
+	instrs, err := script.parse()
+	if err != nil {
+		return err
+	}
+	e.script, e.numOps, e.conds, e.altStack = script, 0, nil, nil
+	for _, instr := range instrs {
+		if len(instr.data) > MaxScriptElementSize {
+			return scriptError(ErrElementTooBig, "script: push of %d bytes exceeds %d bytes", len(instr.data), MaxScriptElementSize)
+		}
+		if instr.op > OP_16 {
+			if err := e.countOps(1); err != nil {
+				return err
+			}
+		}
+		if !e.executing() && !isConditional(instr.op) {
+			continue
+		}
+		if err := e.step(instr); err != nil {
+			return err
+		}
+		if len(e.stack)+len(e.altStack) > MaxStackSize {
+			return scriptError(ErrStackOverflow, "script: stack exceeds %d elements", MaxStackSize)
+		}
+	}
+	if len(e.conds) != 0 {
+		return scriptError(ErrUnbalancedConditional, "script: OP_IF without OP_ENDIF")
+	}
+	return nil
+}
+
+// Returns true if the current branch is executed.
+func (e *engine) executing() bool {
+	for _, c := range e.conds {
+		if !c {
+			return false
+		}
+	}
+	return true
+}
+
+// Adds `n` operations to the operation count of the script.
+func (e *engine) countOps(n int) error {
+	e.numOps += n
+	if e.numOps > MaxOpsPerScript {
+		return scriptError(ErrTooManyOperations, "script: more than %d operations", MaxOpsPerScript)
+	}
+	return nil
+}
+
+// Executes a single instruction.
+func (e *engine) step(instr instruction) error {
+	op := instr.op
+	switch {
+	case op <= OP_PUSHDATA4:
+		e.push(instr.data)
+		return nil
+	case op == OP_1NEGATE || (op >= OP_1 && op <= OP_16):
+		e.pushNum(scriptNum(int64(op) - OP_1 + 1))
+		return nil
+	}
+	switch op {
+	case OP_NOP:
+	case OP_IF, OP_NOTIF:
+		cond := false
+		if e.executing() {
+			v, err := e.pop()
+			if err != nil {
+				return err
+			}
+			cond = asBool(v) == (op == OP_IF)
+		}
+		e.conds = append(e.conds, cond)
+	case OP_ELSE:
+		if len(e.conds) == 0 {
+			return scriptError(ErrUnbalancedConditional, "script: OP_ELSE without OP_IF")
+		}
+		e.conds[len(e.conds)-1] = !e.conds[len(e.conds)-1]
+	case OP_ENDIF:
+		if len(e.conds) == 0 {
+			return scriptError(ErrUnbalancedConditional, "script: OP_ENDIF without OP_IF")
+		}
+		e.conds = e.conds[:len(e.conds)-1]
+	case OP_VERIFY:
+		return e.verify(ErrVerify)
+	case OP_RETURN:
+		return scriptError(ErrEarlyReturn, "script: OP_RETURN executed")
+
+	case OP_TOALTSTACK:
+		v, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.altStack = append(e.altStack, v)
+	case OP_FROMALTSTACK:
+		if len(e.altStack) == 0 {
+			return scriptError(ErrInvalidStackOperation, "script: OP_FROMALTSTACK on empty alternate stack")
+		}
+		e.push(e.altStack[len(e.altStack)-1])
+		e.altStack = e.altStack[:len(e.altStack)-1]
+	case OP_2DROP:
+		if err := e.need(2); err != nil {
+			return err
+		}
+		e.stack = e.stack[:len(e.stack)-2]
+	case OP_2DUP:
+		if err := e.need(2); err != nil {
+			return err
+		}
+		e.push(e.peek(1))
+		e.push(e.peek(1))
+	case OP_IFDUP:
+		if err := e.need(1); err != nil {
+			return err
+		}
+		if asBool(e.peek(0)) {
+			e.push(e.peek(0))
+		}
+	case OP_DEPTH:
+		e.pushNum(scriptNum(len(e.stack)))
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+	case OP_DUP:
+		if err := e.need(1); err != nil {
+			return err
+		}
+		e.push(e.peek(0))
+	case OP_NIP:
+		if err := e.need(2); err != nil {
+			return err
+		}
+		e.stack = append(e.stack[:len(e.stack)-2], e.peek(0))
+	case OP_OVER:
+		if err := e.need(2); err != nil {
+			return err
+		}
+		e.push(e.peek(1))
+	case OP_ROT:
+		if err := e.need(3); err != nil {
+			return err
+		}
+		n := len(e.stack)
+		e.stack[n-3], e.stack[n-2], e.stack[n-1] = e.stack[n-2], e.stack[n-1], e.stack[n-3]
+	case OP_SWAP:
+		if err := e.need(2); err != nil {
+			return err
+		}
+		n := len(e.stack)
+		e.stack[n-2], e.stack[n-1] = e.stack[n-1], e.stack[n-2]
+	case OP_SIZE:
+		if err := e.need(1); err != nil {
+			return err
+		}
+		e.pushNum(scriptNum(len(e.peek(0))))
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		if err := e.need(2); err != nil {
+			return err
+		}
+		a, _ := e.pop()
+		b, _ := e.pop()
+		e.push(fromBool(bytes.Equal(a, b)))
+		if op == OP_EQUALVERIFY {
+			return e.verify(ErrEqualVerify)
+		}
+
+	case OP_1ADD, OP_1SUB, OP_NEGATE, OP_ABS, OP_NOT, OP_0NOTEQUAL:
+		return e.unaryOp(op)
+	case OP_ADD, OP_SUB, OP_BOOLAND, OP_BOOLOR, OP_NUMEQUAL, OP_NUMEQUALVERIFY, OP_NUMNOTEQUAL,
+		OP_LESSTHAN, OP_GREATERTHAN, OP_LESSTHANOREQUAL, OP_GREATERTHANOREQUAL, OP_MIN, OP_MAX:
+		return e.binaryOp(op)
+	case OP_WITHIN:
+		max, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		min, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		x, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		e.push(fromBool(min <= x && x < max))
+
+	case OP_SHA256:
+		v, err := e.pop()
+		if err != nil {
+			return err
+		}
+		h := sha256.Sum256(v)
+		e.push(h[:])
+	case OP_HASH160:
+		v, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(hash160(v))
+	case OP_HASH256:
+		v, err := e.pop()
+		if err != nil {
+			return err
+		}
+		h := sha256.Sum256(v)
+		h = sha256.Sum256(h[:])
+		e.push(h[:])
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		if err := e.need(2); err != nil {
+			return err
+		}
+		pubKey, _ := e.pop()
+		sig, _ := e.pop()
+		e.push(fromBool(e.checkSig(sig, pubKey)))
+		if op == OP_CHECKSIGVERIFY {
+			return e.verify(ErrCheckSigVerify)
+		}
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		if err := e.checkMultiSig(); err != nil {
+			return err
+		}
+		if op == OP_CHECKMULTISIGVERIFY {
+			return e.verify(ErrCheckMultiSigVerify)
+		}
+	case OP_CHECKLOCKTIMEVERIFY, OP_CHECKSEQUENCEVERIFY:
+		return e.checkLockTime(op)
+	default:
+		return scriptError(ErrBadOpcode, "script: invalid opcode 0x%02x", op)
+	}
+	return nil
+}
+
+// Executes an arithmetic opcode with one operand.
+func (e *engine) unaryOp(op byte) error {
+	n, err := e.popNum()
+	if err != nil {
+		return err
+	}
+	switch op {
+	case OP_1ADD:
+		n++
+	case OP_1SUB:
+		n--
+	case OP_NEGATE:
+		n = -n
+	case OP_ABS:
+		if n < 0 {
+			n = -n
+		}
+	case OP_NOT:
+		e.push(fromBool(n == 0))
+		return nil
+	case OP_0NOTEQUAL:
+		e.push(fromBool(n != 0))
+		return nil
+	}
+	e.pushNum(n)
+	return nil
+}
+
+// Executes an arithmetic opcode with two operands.
+func (e *engine) binaryOp(op byte) error {
+	b, err := e.popNum()
+	if err != nil {
+		return err
+	}
+	a, err := e.popNum()
+	if err != nil {
+		return err
+	}
+	switch op {
+	case OP_ADD:
+		e.pushNum(a + b)
+	case OP_SUB:
+		e.pushNum(a - b)
+	case OP_BOOLAND:
+		e.push(fromBool(a != 0 && b != 0))
+	case OP_BOOLOR:
+		e.push(fromBool(a != 0 || b != 0))
+	case OP_NUMEQUAL, OP_NUMEQUALVERIFY:
+		e.push(fromBool(a == b))
+		if op == OP_NUMEQUALVERIFY {
+			return e.verify(ErrNumEqualVerify)
+		}
+	case OP_NUMNOTEQUAL:
+		e.push(fromBool(a != b))
+	case OP_LESSTHAN:
+		e.push(fromBool(a < b))
+	case OP_GREATERTHAN:
+		e.push(fromBool(a > b))
+	case OP_LESSTHANOREQUAL:
+		e.push(fromBool(a <= b))
+	case OP_GREATERTHANOREQUAL:
+		e.push(fromBool(a >= b))
+	case OP_MIN:
+		if b < a {
+			a = b
+		}
+		e.pushNum(a)
+	case OP_MAX:
+		if b > a {
+			a = b
+		}
+		e.pushNum(a)
+	}
+	return nil
+}
+
+// Executes OP_CHECKMULTISIG.
+// Stack: <dummy> <sig 1> ... <sig m> <m> <pubkey 1> ... <pubkey n> <n>.
+// The signatures must be in the order of the public keys. Like in Bitcoin an additional element
+// is consumed; it must be empty.
+func (e *engine) checkMultiSig() error {
+	n, err := e.popNum()
+	if err != nil {
+		return err
+	}
+	if n < 0 || n > MaxPubKeysPerMultisig {
+		return scriptError(ErrPubKeyCount, "script: %d public keys, at most %d are allowed", n, MaxPubKeysPerMultisig)
+	}
+	if err := e.countOps(int(n)); err != nil {
+		return err
+	}
+	pubKeys, err := e.popN(int(n))
+	if err != nil {
+		return err
+	}
+	m, err := e.popNum()
+	if err != nil {
+		return err
+	}
+	if m < 0 || m > n {
+		return scriptError(ErrSigCount, "script: %d signatures for %d public keys", m, n)
+	}
+	sigs, err := e.popN(int(m))
+	if err != nil {
+		return err
+	}
+	dummy, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if len(dummy) != 0 {
+		return scriptError(ErrSigNullDummy, "script: OP_CHECKMULTISIG dummy element is not empty")
+	}
+	for len(sigs) > 0 && len(sigs) <= len(pubKeys) {
+		if e.checkSig(sigs[0], pubKeys[0]) {
+			sigs = sigs[1:]
+		}
+		pubKeys = pubKeys[1:]
+	}
+	e.push(fromBool(len(sigs) == 0))
+	return nil
+}
+
+// Executes OP_CHECKLOCKTIMEVERIFY and OP_CHECKSEQUENCEVERIFY.
+// Like in Bitcoin the lock time stays on the stack; scripts usually drop it with OP_DROP.
+func (e *engine) checkLockTime(op byte) error {
+	if err := e.need(1); err != nil {
+		return err
+	}
+	lockTime, err := makeScriptNum(e.peek(0), lockTimeNumSize)
+	if err != nil {
+		return err
+	}
+	if lockTime < 0 {
+		return scriptError(ErrNegativeLockTime, "script: %s: negative lock time %d", opcodeNames[op], lockTime)
+	}
+	var ok bool
+	switch {
+	case e.checker == nil:
+	case op == OP_CHECKLOCKTIMEVERIFY:
+		ok = e.checker.CheckLockTime(int64(lockTime))
+	default:
+		ok = e.checker.CheckSequence(int64(lockTime))
+	}
+	if !ok {
+		return scriptError(ErrUnsatisfiedLockTime, "script: %s: lock time %d not reached", opcodeNames[op], lockTime)
+	}
+	return nil
+}
+
+// Returns true if `sig` is a valid signature by `pubKey`.
+func (e *engine) checkSig(sig, pubKey []byte) bool {
+	return e.checker != nil && len(sig) > 0 && e.checker.CheckSig(sig, pubKey, e.script)
+}
+
+// Pops the top element; if it is false the script fails with `code`.
+func (e *engine) verify(code ErrorCode) error {
+	v, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if !asBool(v) {
+		return scriptError(code, "script: %v failed", code)
+	}
+	return nil
+}
+
+// Returns an error if the stack has fewer than `n` elements.
+func (e *engine) need(n int) error {
+	if len(e.stack) < n {
+		return scriptError(ErrInvalidStackOperation, "script: operation needs %d stack elements, there are %d", n, len(e.stack))
+	}
+	return nil
+}
+
+// Returns the element `i` positions below the top of the stack.
+func (e *engine) peek(i int) []byte {
+	return e.stack[len(e.stack)-1-i]
+}
+
+func (e *engine) push(v []byte) {
+	e.stack = append(e.stack, v)
+}
+
+func (e *engine) pushNum(n scriptNum) {
+	e.push(n.Bytes())
+}
+
+func (e *engine) pop() ([]byte, error) {
+	if err := e.need(1); err != nil {
+		return nil, err
+	}
+	v := e.peek(0)
+	e.stack = e.stack[:len(e.stack)-1]
+	return v, nil
+}
+
+// Pops the top `n` elements; they are returned in the order they were pushed.
+func (e *engine) popN(n int) ([][]byte, error) {
+	if err := e.need(n); err != nil {
+		return nil, err
+	}
+	elems := append([][]byte{}, e.stack[len(e.stack)-n:]...)
+	e.stack = e.stack[:len(e.stack)-n]
+	return elems, nil
+}
+
+func (e *engine) popNum() (scriptNum, error) {
+	v, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	return makeScriptNum(v, maxNumSize)
+}
+
+// Returns RIPEMD-160(SHA-256(`b`)).
+func hash160(b []byte) []byte {
+	h := sha256.Sum256(b)
+	hasher := ripemd160.New()
+	hasher.Write(h[:])
+	return hasher.Sum(nil)
+}
@@ -0,0 +1,220 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Accepts signature "sig-<pubkey>" for every public key and lock times up to `lockTime` and `sequence`.
+type testChecker struct {
+	lockTime, sequence int64
+}
+
+func (testChecker) CheckSig(sig, pubKey []byte, subScript Script) bool {
+	return bytes.Equal(sig, append([]byte("sig-"), pubKey...))
+}
+
+func (c testChecker) CheckLockTime(lockTime int64) bool {
+	return lockTime <= c.lockTime
+}
+
+func (c testChecker) CheckSequence(sequence int64) bool {
+	return sequence <= c.sequence
+}
+
+func sig(pubKey string) []byte {
+	return []byte("sig-" + pubKey)
+}
+
+// Asserts that err is an Error with `code`.
+func assertScriptError(t *testing.T, err error, code ErrorCode) {
+	t.Helper()
+	var scriptErr Error
+	if assert.True(t, errors.As(err, &scriptErr), "expected script error %v, got %v", code, err) {
+		assert.Equal(t, code, scriptErr.Code, scriptErr.Description)
+	}
+}
+
+func TestOpcodes(t *testing.T) {
+	ops := func(ops ...byte) Script { return Script(ops) }
+	tests := []struct {
+		name   string
+		script Script
+		err    *ErrorCode
+	}{
+		{"arithmetic", NewBuilder().AddInt64(2).AddInt64(3).AddOp(OP_ADD).AddInt64(5).AddOp(OP_NUMEQUAL).Script(), nil},
+		{"negative numbers", NewBuilder().AddInt64(-300).AddOp(OP_ABS).AddInt64(300).AddOp(OP_EQUAL).Script(), nil},
+		{"within", ops(OP_1, OP_1, OP_16, OP_WITHIN), nil},
+		{"min max", append(ops(OP_1, OP_16, OP_MIN, OP_1, OP_16, OP_MAX, OP_SUB), NewBuilder().AddInt64(-15).AddOp(OP_NUMEQUAL).Script()...), nil},
+		{"stack", ops(OP_1, OP_0, OP_SWAP, OP_DUP, OP_ROT, OP_2DROP, OP_DEPTH, OP_1, OP_EQUALVERIFY), nil},
+		{"alt stack", ops(OP_1, OP_TOALTSTACK, OP_0, OP_FROMALTSTACK, OP_NIP), nil},
+		{"if", ops(OP_1, OP_IF, OP_1, OP_ELSE, OP_0, OP_ENDIF), nil},
+		{"else", ops(OP_0, OP_IF, OP_0, OP_ELSE, OP_1, OP_ENDIF), nil},
+		{"nested if in skipped branch", ops(OP_0, OP_IF, OP_IF, OP_RETURN, OP_ENDIF, OP_ELSE, OP_1, OP_ENDIF), nil},
+		{"hash", NewBuilder().AddData([]byte("abc")).AddOp(OP_HASH160).AddData(hash160([]byte("abc"))).AddOp(OP_EQUAL).Script(), nil},
+		{"false", ops(OP_1, OP_NOT), codePtr(ErrEvalFalse)},
+		{"negative zero is false", NewBuilder().AddData([]byte{0x80}).Script(), codePtr(ErrEvalFalse)},
+		{"verify", ops(OP_0, OP_VERIFY, OP_1), codePtr(ErrVerify)},
+		{"return", ops(OP_1, OP_RETURN), codePtr(ErrEarlyReturn)},
+		{"empty stack", ops(OP_DROP), codePtr(ErrInvalidStackOperation)},
+		{"unbalanced if", ops(OP_1, OP_IF, OP_1), codePtr(ErrUnbalancedConditional)},
+		{"unbalanced endif", ops(OP_1, OP_ENDIF), codePtr(ErrUnbalancedConditional)},
+		{"invalid opcode", ops(OP_1, 0xba), codePtr(ErrBadOpcode)},
+		{"malformed push", ops(OP_PUSHDATA1, 5, 1), codePtr(ErrMalformedPush)},
+		{"number too big", NewBuilder().AddInt64(1 << 40).AddOp(OP_1ADD).Script(), codePtr(ErrNumberTooBig)},
+	}
+	for _, tt := range tests {
+		err := Verify(nil, tt.script, testChecker{})
+		if tt.err == nil {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assertScriptError(t, err, *tt.err)
+		}
+	}
+}
+
+func codePtr(code ErrorCode) *ErrorCode {
+	return &code
+}
+
+func TestPayToPubKeyHash(t *testing.T) {
+	pubKey := []byte("public key")
+	locking := PayToPubKeyHash(hash160(pubKey))
+	assert.Equal(t, hash160(pubKey), locking.PubKeyHash())
+	assert.Equal(t, "OP_DUP OP_HASH160 "+Script(hash160(pubKey)).hexString()+" OP_EQUALVERIFY OP_CHECKSIG", locking.String())
+
+	assert.NoError(t, Verify(SignatureScript(sig("public key"), pubKey), locking, testChecker{}))
+	err := Verify(SignatureScript(sig("other key"), []byte("other key")), locking, testChecker{})
+	assertScriptError(t, err, ErrEqualVerify)
+	err = Verify(SignatureScript(sig("other key"), pubKey), locking, testChecker{})
+	assertScriptError(t, err, ErrEvalFalse)
+	err = Verify(append(SignatureScript(sig("public key"), pubKey), OP_DUP), locking, testChecker{})
+	assertScriptError(t, err, ErrNotPushOnly)
+}
+
+func TestCheckMultiSig(t *testing.T) {
+	// 2-of-3
+	locking := NewBuilder().AddInt64(2).AddData([]byte("a")).AddData([]byte("b")).AddData([]byte("c")).
+		AddInt64(3).AddOp(OP_CHECKMULTISIG).Script()
+	unlock := func(sigs ...[]byte) Script {
+		b := NewBuilder().AddOp(OP_0)
+		for _, s := range sigs {
+			b.AddData(s)
+		}
+		return b.Script()
+	}
+	assert.NoError(t, Verify(unlock(sig("a"), sig("c")), locking, testChecker{}))
+	assert.NoError(t, Verify(unlock(sig("b"), sig("c")), locking, testChecker{}))
+	// Signatures must be in the order of the public keys.
+	assertScriptError(t, Verify(unlock(sig("c"), sig("a")), locking, testChecker{}), ErrEvalFalse)
+	assertScriptError(t, Verify(unlock(sig("a"), sig("a")), locking, testChecker{}), ErrEvalFalse)
+	assertScriptError(t, Verify(unlock(sig("a")), locking, testChecker{}), ErrInvalidStackOperation)
+	dummy := append(Script{OP_1}, unlock(sig("a"), sig("b"))[1:]...)
+	assertScriptError(t, Verify(dummy, locking, testChecker{}), ErrSigNullDummy)
+}
+
+func TestLimits(t *testing.T) {
+	require.NoError(t, Verify(nil, NewBuilder().AddData(make([]byte, MaxScriptElementSize)).AddOp(OP_SIZE).Script(), nil))
+	err := Verify(nil, NewBuilder().AddData(make([]byte, MaxScriptElementSize+1)).Script(), nil)
+	assertScriptError(t, err, ErrElementTooBig)
+
+	err = Verify(nil, append(Script{OP_1}, bytes.Repeat([]byte{OP_NOP}, MaxOpsPerScript+1)...), nil)
+	assertScriptError(t, err, ErrTooManyOperations)
+	// Opcodes in branches which are not executed count as well.
+	err = Verify(nil, append(append(Script{OP_1, OP_0, OP_IF}, bytes.Repeat([]byte{OP_NOP}, MaxOpsPerScript)...), OP_ENDIF), nil)
+	assertScriptError(t, err, ErrTooManyOperations)
+
+	err = Verify(nil, bytes.Repeat([]byte{OP_1}, MaxStackSize+1), nil)
+	assertScriptError(t, err, ErrStackOverflow)
+
+	err = Verify(nil, make(Script, MaxScriptSize+1), nil)
+	assertScriptError(t, err, ErrScriptTooBig)
+}
+
+func TestPayToScriptHash(t *testing.T) {
+	redeem, err := MultiSigScript(2, [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	require.NoError(t, err)
+	m, pubKeys := redeem.MultiSigKeys()
+	assert.Equal(t, 2, m)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, pubKeys)
+	m, _ = PayToPubKeyHash(hash160([]byte("a"))).MultiSigKeys()
+	assert.Zero(t, m)
+
+	locking := PayToScriptHash(redeem.Hash160())
+	assert.Equal(t, redeem.Hash160(), locking.ScriptHash())
+	assert.Nil(t, locking.PubKeyHash())
+	unlock := func(redeem Script, sigs ...[]byte) Script {
+		b := NewBuilder().AddOp(OP_0)
+		for _, s := range sigs {
+			b.AddData(s)
+		}
+		return b.AddData(redeem).Script()
+	}
+	assert.NoError(t, Verify(unlock(redeem, sig("a"), sig("b")), locking, testChecker{}))
+	// The redeem script is run: matching its hash is not enough.
+	assertScriptError(t, Verify(unlock(redeem, sig("a")), locking, testChecker{}), ErrInvalidStackOperation)
+	other, err := MultiSigScript(1, [][]byte{[]byte("a")})
+	require.NoError(t, err)
+	assertScriptError(t, Verify(unlock(other, sig("a")), locking, testChecker{}), ErrEvalFalse)
+}
+
+func TestCheckLockTime(t *testing.T) {
+	checker := testChecker{lockTime: 1000, sequence: 10}
+	lock := func(n int64, op byte) Script {
+		return NewBuilder().AddInt64(n).AddOp(op).AddOp(OP_DROP).AddOp(OP_1).Script()
+	}
+	assert.NoError(t, Verify(nil, lock(1000, OP_CHECKLOCKTIMEVERIFY), checker))
+	assertScriptError(t, Verify(nil, lock(1001, OP_CHECKLOCKTIMEVERIFY), checker), ErrUnsatisfiedLockTime)
+	assert.NoError(t, Verify(nil, lock(10, OP_CHECKSEQUENCEVERIFY), checker))
+	assertScriptError(t, Verify(nil, lock(11, OP_CHECKSEQUENCEVERIFY), checker), ErrUnsatisfiedLockTime)
+	assertScriptError(t, Verify(nil, lock(-1, OP_CHECKLOCKTIMEVERIFY), checker), ErrNegativeLockTime)
+	assertScriptError(t, Verify(nil, Script{OP_CHECKSEQUENCEVERIFY}, checker), ErrInvalidStackOperation)
+	assertScriptError(t, Verify(nil, lock(1, OP_CHECKLOCKTIMEVERIFY), nil), ErrUnsatisfiedLockTime)
+
+	// Lock times may take 5 bytes, other numbers only 4.
+	unixTime := int64(3000000000)
+	assert.NoError(t, Verify(nil, lock(unixTime, OP_CHECKLOCKTIMEVERIFY), testChecker{lockTime: unixTime}))
+	assertScriptError(t, Verify(nil, lock(1<<40, OP_CHECKLOCKTIMEVERIFY), checker), ErrNumberTooBig)
+	assert.Equal(t, "10 OP_CHECKSEQUENCEVERIFY OP_DROP 1", lock(10, OP_CHECKSEQUENCEVERIFY).String())
+}
+
+func TestHashTimeLock(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, SecretSize)
+	secretHash := sha256.Sum256(secret)
+	contract := &HashTimeLock{
+		SecretHash:   secretHash[:],
+		RecipientPKH: hash160([]byte("recipient")),
+		RefundPKH:    hash160([]byte("sender")),
+		LockTime:     1000,
+	}
+	s := contract.Script()
+	assert.Equal(t, contract, s.HashTimeLock())
+	for _, lockTime := range []int64{0, 16, 3000000000} {
+		c := *contract
+		c.LockTime = lockTime
+		assert.Equal(t, &c, c.Script().HashTimeLock())
+	}
+	assert.Nil(t, PayToPubKeyHash(contract.RefundPKH).HashTimeLock())
+	assert.Nil(t, append(s, OP_NOP).HashTimeLock())
+
+	locking := PayToScriptHash(s.Hash160())
+	redeem := func(pubKey string, secret []byte) Script {
+		return HashTimeLockRedeem(sig(pubKey), []byte(pubKey), secret, s)
+	}
+	assert.NoError(t, Verify(redeem("recipient", secret), locking, testChecker{}))
+	assertScriptError(t, Verify(redeem("sender", secret), locking, testChecker{}), ErrEqualVerify)
+	assertScriptError(t, Verify(redeem("recipient", make([]byte, SecretSize)), locking, testChecker{}), ErrEqualVerify)
+	assertScriptError(t, Verify(redeem("recipient", secret[1:]), locking, testChecker{}), ErrEqualVerify)
+
+	refund := func(pubKey string) Script {
+		return HashTimeLockRefund(sig(pubKey), []byte(pubKey), s)
+	}
+	assert.NoError(t, Verify(refund("sender"), locking, testChecker{lockTime: 1000}))
+	assertScriptError(t, Verify(refund("sender"), locking, testChecker{lockTime: 999}), ErrUnsatisfiedLockTime)
+	assertScriptError(t, Verify(refund("recipient"), locking, testChecker{lockTime: 1000}), ErrEqualVerify)
+}
@@ -0,0 +1,80 @@
+package script
+
+import "fmt"
+
+// ErrorCode identifies the reason a script failed.
+type ErrorCode int
+
+// Error codes.
+const (
+	ErrScriptTooBig ErrorCode = iota
+	ErrElementTooBig
+	ErrTooManyOperations
+	ErrStackOverflow
+	ErrMalformedPush
+	ErrBadOpcode
+	ErrInvalidStackOperation
+	ErrUnbalancedConditional
+	ErrEarlyReturn
+	ErrVerify
+	ErrEqualVerify
+	ErrNumEqualVerify
+	ErrCheckSigVerify
+	ErrCheckMultiSigVerify
+	ErrNumberTooBig
+	ErrPubKeyCount
+	ErrSigCount
+	ErrSigNullDummy
+	ErrNotPushOnly
+	ErrEvalFalse
+	ErrNegativeLockTime
+	ErrUnsatisfiedLockTime
+)
+
+var errorCodeStrings = map[ErrorCode]string{
+	ErrScriptTooBig:          "ErrScriptTooBig",
+	ErrElementTooBig:         "ErrElementTooBig",
+	ErrTooManyOperations:     "ErrTooManyOperations",
+	ErrStackOverflow:         "ErrStackOverflow",
+	ErrMalformedPush:         "ErrMalformedPush",
+	ErrBadOpcode:             "ErrBadOpcode",
+	ErrInvalidStackOperation: "ErrInvalidStackOperation",
+	ErrUnbalancedConditional: "ErrUnbalancedConditional",
+	ErrEarlyReturn:           "ErrEarlyReturn",
+	ErrVerify:                "ErrVerify",
+	ErrEqualVerify:           "ErrEqualVerify",
+	ErrNumEqualVerify:        "ErrNumEqualVerify",
+	ErrCheckSigVerify:        "ErrCheckSigVerify",
+	ErrCheckMultiSigVerify:   "ErrCheckMultiSigVerify",
+	ErrNumberTooBig:          "ErrNumberTooBig",
+	ErrPubKeyCount:           "ErrPubKeyCount",
+	ErrSigCount:              "ErrSigCount",
+	ErrSigNullDummy:          "ErrSigNullDummy",
+	ErrNotPushOnly:           "ErrNotPushOnly",
+	ErrEvalFalse:             "ErrEvalFalse",
+	ErrNegativeLockTime:      "ErrNegativeLockTime",
+	ErrUnsatisfiedLockTime:   "ErrUnsatisfiedLockTime",
+}
+
+// Stringer for error codes.
+func (c ErrorCode) String() string {
+	if s, ok := errorCodeStrings[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ErrorCode (%d)", int(c))
+}
+
+// Error is returned when a script fails.
+type Error struct {
+	Code        ErrorCode // reason for failure
+	Description string    // human readable description
+}
+
+func (e Error) Error() string {
+	return e.Description
+}
+
+// Creates an Error.
+func scriptError(code ErrorCode, format string, args ...any) Error {
+	return Error{code, fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,78 @@
+package script
+
+// Maximum size in bytes of a number operand of the arithmetic opcodes.
+// Results may overflow this size; they can be pushed but not used as operands again.
+const maxNumSize = 4
+
+// Maximum size in bytes of the lock time operand of OP_CHECKLOCKTIMEVERIFY and OP_CHECKSEQUENCEVERIFY.
+// Lock times are unsigned 32 bit numbers and need a fifth byte for the sign.
+const lockTimeNumSize = 5
+
+// A number on the stack.
+// Numbers are encoded little endian with the sign in the most significant bit; zero is the empty byte slice.
+type scriptNum int64
+
+// Decodes number `b` of at most `maxSize` bytes.
+func makeScriptNum(b []byte, maxSize int) (scriptNum, error) {
+	if len(b) > maxSize {
+		return 0, scriptError(ErrNumberTooBig, "number of %d bytes exceeds %d bytes", len(b), maxSize)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var n int64
+	for i, v := range b {
+		n |= int64(v) << (8 * i)
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		n &^= int64(0x80) << (8 * (len(b) - 1))
+		n = -n
+	}
+	return scriptNum(n), nil
+}
+
+// Bytes encodes the number minimally.
+func (n scriptNum) Bytes() []byte {
+	if n == 0 {
+		return nil
+	}
+	negative := n < 0
+	abs := int64(n)
+	if negative {
+		abs = -abs
+	}
+	var b []byte
+	for abs > 0 {
+		b = append(b, byte(abs))
+		abs >>= 8
+	}
+	// The sign needs its own byte if the most significant bit is taken.
+	if b[len(b)-1]&0x80 != 0 {
+		if negative {
+			b = append(b, 0x80)
+		} else {
+			b = append(b, 0x00)
+		}
+	} else if negative {
+		b[len(b)-1] |= 0x80
+	}
+	return b
+}
+
+// Returns the boolean value of stack element `b`: false is zero, including negative zero.
+func asBool(b []byte) bool {
+	for i, v := range b {
+		if v != 0 {
+			return i != len(b)-1 || v != 0x80
+		}
+	}
+	return false
+}
+
+// Returns the stack element for boolean `v`.
+func fromBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Package script implements a subset of Bitcoin's script language.
+//
+// Transaction outputs are locked with a script (ScriptPubKey) and inputs unlock them with another
+// script (ScriptSig). To spend an output the unlocking script is run first and the locking script
+// is run on the resulting stack; the spend is valid if the top of the stack is true afterwards.
+// The standard locking script is pay-to-public-key-hash (P2PKH):
+//
+//	ScriptPubKey: OP_DUP OP_HASH160 <public key hash> OP_EQUALVERIFY OP_CHECKSIG
+//	ScriptSig:    <signature> <public key>
+//
+// Pay-to-script-hash (P2SH) outputs commit to the hash of a redeem script, e.g. an M-of-N multisig
+// script. The unlocking script pushes the redeem script last and it is run on the stack left by
+// the unlocking script:
+//
+//	ScriptPubKey: OP_HASH160 <script hash> OP_EQUAL
+//	ScriptSig:    OP_0 <signature 1> ... <signature m> <redeem script>
+//
+// Signatures are checked by a SigChecker which knows the transaction being validated.
+package script
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Execution limits. Scripts exceeding them fail.
+const (
+	MaxScriptSize         = 10000 // bytes of a script
+	MaxScriptElementSize  = 520   // bytes of a single stack element
+	MaxStackSize          = 1000  // elements on the stack and the alternate stack together
+	MaxOpsPerScript       = 201   // opcodes above OP_16 per script, including the keys of OP_CHECKMULTISIG
+	MaxPubKeysPerMultisig = 20    // public keys of OP_CHECKMULTISIG
+)
+
+// Script is a sequence of opcodes and pushed data.
+type Script []byte
+
+// A parsed opcode with the data it pushes.
+type instruction struct {
+	op   byte
+	data []byte
+}
+
+// Splits script `s` into instructions.
+// On errors the instructions before the malformed one are returned as well.
+func (s Script) parse() ([]instruction, error) {
+	var instrs []instruction
+	for i := 0; i < len(s); {
+		op := s[i]
+		i++
+		var n int
+		switch {
+		case op >= OP_DATA_1 && op <= OP_DATA_75:
+			n = int(op)
+		case op == OP_PUSHDATA1 || op == OP_PUSHDATA2 || op == OP_PUSHDATA4:
+			size := map[byte]int{OP_PUSHDATA1: 1, OP_PUSHDATA2: 2, OP_PUSHDATA4: 4}[op]
+			if len(s)-i < size {
+				return instrs, scriptError(ErrMalformedPush, "script: length of push at %d exceeds script", i-1)
+			}
+			var length [4]byte
+			copy(length[:], s[i:i+size])
+			n = int(binary.LittleEndian.Uint32(length[:]))
+			i += size
+		}
+		if n < 0 || len(s)-i < n {
+			return instrs, scriptError(ErrMalformedPush, "script: data of push at %d exceeds script", i-1)
+		}
+		instr := instruction{op: op}
+		if n > 0 {
+			instr.data = s[i : i+n]
+		}
+		instrs = append(instrs, instr)
+		i += n
+	}
+	return instrs, nil
+}
+
+// IsPushOnly returns true if the script only pushes data (the opcodes up to OP_16).
+func (s Script) IsPushOnly() bool {
+	instrs, err := s.parse()
+	if err != nil {
+		return false
+	}
+	for _, instr := range instrs {
+		if instr.op > OP_16 {
+			return false
+		}
+	}
+	return true
+}
+
+// String disassembles the script: data as hex, opcodes by name.
+func (s Script) String() string {
+	instrs, err := s.parse()
+	var parts []string
+	for _, instr := range instrs {
+		switch {
+		case instr.op == OP_0:
+			parts = append(parts, "0")
+		case instr.op <= OP_PUSHDATA4:
+			parts = append(parts, hex.EncodeToString(instr.data))
+		case instr.op >= OP_1 && instr.op <= OP_16:
+			parts = append(parts, fmt.Sprint(instr.op-OP_1+1))
+		case opcodeNames[instr.op] != "":
+			parts = append(parts, opcodeNames[instr.op])
+		default:
+			parts = append(parts, fmt.Sprintf("OP_UNKNOWN%d", instr.op))
+		}
+	}
+	if err != nil {
+		parts = append(parts, "[error]")
+	}
+	return strings.Join(parts, " ")
+}
+
+// Builder creates scripts.
+// Data is pushed with the smallest possible push opcode.
+type Builder struct {
+	script Script
+}
+
+// NewBuilder creates a Builder for an empty script.
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// AddOp appends opcode `op`.
+func (b *Builder) AddOp(op byte) *Builder {
+	b.script = append(b.script, op)
+	return b
+}
+
+// AddData appends a push of `data`.
+func (b *Builder) AddData(data []byte) *Builder {
+	n := len(data)
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == 1 && data[0] >= 1 && data[0] <= 16:
+		return b.AddOp(OP_1 - 1 + data[0])
+	case n == 1 && data[0] == 0x81:
+		return b.AddOp(OP_1NEGATE)
+	case n <= OP_DATA_75:
+		b.script = append(b.script, byte(n))
+	case n <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(n))
+	case n <= 0xffff:
+		b.script = append(b.script, OP_PUSHDATA2, byte(n), byte(n>>8))
+	default:
+		b.script = append(b.script, OP_PUSHDATA4, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	b.script = append(b.script, data...)
+	return b
+}
+
+// AddInt64 appends a push of number `n`.
+func (b *Builder) AddInt64(n int64) *Builder {
+	return b.AddData(scriptNum(n).Bytes())
+}
+
+// Script returns the script built so far.
+func (b *Builder) Script() Script {
+	return append(Script{}, b.script...)
+}
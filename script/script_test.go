@@ -0,0 +1,46 @@
+package script
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the script bytes as hex.
+func (s Script) hexString() string {
+	return hex.EncodeToString(s)
+}
+
+func TestScriptNum(t *testing.T) {
+	tests := []struct {
+		n   int64
+		hex string
+	}{
+		{0, ""}, {1, "01"}, {-1, "81"}, {127, "7f"}, {128, "8000"}, {-128, "8080"}, {255, "ff00"}, {256, "0001"}, {-32768, "008080"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.hex, hex.EncodeToString(scriptNum(tt.n).Bytes()), tt.n)
+		n, err := makeScriptNum(scriptNum(tt.n).Bytes(), maxNumSize)
+		assert.NoError(t, err)
+		assert.Equal(t, scriptNum(tt.n), n)
+	}
+}
+
+func TestBuilderUsesSmallestPush(t *testing.T) {
+	assert.Equal(t, "00", NewBuilder().AddData(nil).Script().hexString())
+	assert.Equal(t, "60", NewBuilder().AddInt64(16).Script().hexString())
+	assert.Equal(t, "4f", NewBuilder().AddInt64(-1).Script().hexString())
+	assert.Equal(t, "0111", NewBuilder().AddInt64(17).Script().hexString())
+	assert.Equal(t, "4b", NewBuilder().AddData(make([]byte, 75)).Script().hexString()[:2])
+	assert.Equal(t, "4c4c", NewBuilder().AddData(make([]byte, 76)).Script().hexString()[:4])
+	assert.Equal(t, "4d0001", NewBuilder().AddData(make([]byte, 256)).Script().hexString()[:6])
+
+	s := NewBuilder().AddData(bytes.Repeat([]byte{7}, 300)).AddInt64(3).AddData([]byte{0xab}).Script()
+	assert.True(t, s.IsPushOnly())
+	assert.Equal(t, [][]byte{bytes.Repeat([]byte{7}, 300), {3}, {0xab}}, s.PushedData())
+	assert.False(t, append(s, OP_DUP).IsPushOnly())
+	assert.Nil(t, append(s, OP_DUP).PushedData())
+	assert.Equal(t, "3 ab OP_DUP [error]", append(s[len(s)-3:], OP_DUP, OP_DATA_1).String())
+}
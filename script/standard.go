@@ -0,0 +1,181 @@
+package script
+
+import "bytes"
+
+// Size of a public key hash (RIPEMD-160).
+const pubKeyHashSize = 20
+
+// PayToPubKeyHash returns the standard locking script paying to `pubKeyHash`:
+// OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG.
+func PayToPubKeyHash(pubKeyHash []byte) Script {
+	return NewBuilder().AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// PubKeyHash returns the public key hash of a pay-to-public-key-hash script or nil for other scripts.
+func (s Script) PubKeyHash() []byte {
+	if len(s) != pubKeyHashSize+5 || s[0] != OP_DUP || s[1] != OP_HASH160 || s[2] != pubKeyHashSize ||
+		s[pubKeyHashSize+3] != OP_EQUALVERIFY || s[pubKeyHashSize+4] != OP_CHECKSIG {
+		return nil
+	}
+	return s[3 : pubKeyHashSize+3]
+}
+
+// SignatureScript returns the unlocking script for a pay-to-public-key-hash output: <sig> <pubKey>.
+func SignatureScript(sig, pubKey []byte) Script {
+	return NewBuilder().AddData(sig).AddData(pubKey).Script()
+}
+
+// PushedData returns the data pushed by a push-only script, e.g. the signature and public key of
+// an unlocking script. Returns nil if the script is malformed or not push-only.
+func (s Script) PushedData() [][]byte {
+	instrs, err := s.parse()
+	if err != nil {
+		return nil
+	}
+	var data [][]byte
+	for _, instr := range instrs {
+		switch {
+		case instr.op > OP_16:
+			return nil
+		case instr.op == OP_1NEGATE || instr.op >= OP_1:
+			data = append(data, scriptNum(int64(instr.op)-OP_1+1).Bytes())
+		default:
+			data = append(data, append([]byte{}, instr.data...))
+		}
+	}
+	return data
+}
+
+// PayToScriptHash returns the locking script paying to the hash of a redeem script (BIP 16):
+// OP_HASH160 <scriptHash> OP_EQUAL. It is spent by pushing the data the redeem script needs and the redeem script.
+func PayToScriptHash(scriptHash []byte) Script {
+	return NewBuilder().AddOp(OP_HASH160).AddData(scriptHash).AddOp(OP_EQUAL).Script()
+}
+
+// ScriptHash returns the script hash of a pay-to-script-hash script or nil for other scripts.
+func (s Script) ScriptHash() []byte {
+	if len(s) != pubKeyHashSize+3 || s[0] != OP_HASH160 || s[1] != pubKeyHashSize || s[pubKeyHashSize+2] != OP_EQUAL {
+		return nil
+	}
+	return s[2 : pubKeyHashSize+2]
+}
+
+// Hash160 returns RIPEMD-160(SHA-256(`s`)), the hash a pay-to-script-hash script commits to.
+func (s Script) Hash160() []byte {
+	return hash160(s)
+}
+
+// MultiSigScript returns a script which needs signatures of `m` of `pubKeys`:
+// <m> <pubkey 1> ... <pubkey n> <n> OP_CHECKMULTISIG.
+func MultiSigScript(m int, pubKeys [][]byte) (Script, error) {
+	n := len(pubKeys)
+	if n < 1 || n > 16 {
+		return nil, scriptError(ErrPubKeyCount, "script: %d public keys, 1 to 16 are allowed", n)
+	}
+	if m < 1 || m > n {
+		return nil, scriptError(ErrSigCount, "script: %d signatures for %d public keys", m, n)
+	}
+	b := NewBuilder().AddInt64(int64(m))
+	for _, pubKey := range pubKeys {
+		b.AddData(pubKey)
+	}
+	return b.AddInt64(int64(n)).AddOp(OP_CHECKMULTISIG).Script(), nil
+}
+
+// MultiSigKeys returns the number of required signatures and the public keys of a script created by MultiSigScript.
+// Returns 0 and nil for other scripts.
+func (s Script) MultiSigKeys() (int, [][]byte) {
+	instrs, err := s.parse()
+	if err != nil || len(instrs) < 4 || instrs[len(instrs)-1].op != OP_CHECKMULTISIG {
+		return 0, nil
+	}
+	isSmallInt := func(op byte) bool { return op >= OP_1 && op <= OP_16 }
+	first, last := instrs[0].op, instrs[len(instrs)-2].op
+	if !isSmallInt(first) || !isSmallInt(last) {
+		return 0, nil
+	}
+	m, n := int(first-OP_1+1), int(last-OP_1+1)
+	keys := instrs[1 : len(instrs)-2]
+	if len(keys) != n || m > n {
+		return 0, nil
+	}
+	var pubKeys [][]byte
+	for _, instr := range keys {
+		if instr.op > OP_PUSHDATA4 || len(instr.data) == 0 {
+			return 0, nil
+		}
+		pubKeys = append(pubKeys, instr.data)
+	}
+	return m, pubKeys
+}
+
+// Size of the secrets of hash time-locked contracts. The contract checks it, so a secret revealed on one
+// blockchain is accepted by a contract with the same hash on another one.
+const SecretSize = 32
+
+// HashTimeLock is a hash time-locked contract (HTLC). The recipient can spend with the secret whose
+// SHA-256 hash is SecretHash; the sender gets a refund once the lock time has passed.
+type HashTimeLock struct {
+	SecretHash   []byte // SHA-256 hash of the secret
+	RecipientPKH []byte // public key hash of the recipient
+	RefundPKH    []byte // public key hash of the sender
+	LockTime     int64  // block height or Unix time before which there is no refund
+}
+
+// Script returns the contract script of `c`:
+//
+//	OP_IF
+//	    OP_SIZE <SecretSize> OP_EQUALVERIFY OP_SHA256 <secret hash> OP_EQUALVERIFY OP_DUP OP_HASH160 <recipient PKH>
+//	OP_ELSE
+//	    <lock time> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <refund PKH>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+func (c *HashTimeLock) Script() Script {
+	return NewBuilder().AddOp(OP_IF).
+		AddOp(OP_SIZE).AddInt64(SecretSize).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_SHA256).AddData(c.SecretHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(c.RecipientPKH).
+		AddOp(OP_ELSE).
+		AddInt64(c.LockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(c.RefundPKH).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// HashTimeLock returns the contract of a script created by HashTimeLock.Script or nil for other scripts.
+func (s Script) HashTimeLock() *HashTimeLock {
+	instrs, err := s.parse()
+	if err != nil || len(instrs) != 20 {
+		return nil
+	}
+	lockTime, err := makeScriptNum(instrs[11].data, lockTimeNumSize)
+	if instrs[11].op >= OP_1 && instrs[11].op <= OP_16 {
+		lockTime, err = scriptNum(instrs[11].op-OP_1+1), nil
+	}
+	if err != nil {
+		return nil
+	}
+	c := &HashTimeLock{
+		SecretHash:   instrs[5].data,
+		RecipientPKH: instrs[9].data,
+		RefundPKH:    instrs[16].data,
+		LockTime:     int64(lockTime),
+	}
+	if !bytes.Equal(c.Script(), s) {
+		return nil
+	}
+	return c
+}
+
+// HashTimeLockRedeem returns the unlocking script of the recipient of the pay-to-script-hash output
+// of `contract`: <sig> <pubKey> <secret> OP_TRUE <contract>.
+func HashTimeLockRedeem(sig, pubKey, secret []byte, contract Script) Script {
+	return NewBuilder().AddData(sig).AddData(pubKey).AddData(secret).AddOp(OP_TRUE).AddData(contract).Script()
+}
+
+// HashTimeLockRefund returns the unlocking script of the sender of the pay-to-script-hash output
+// of `contract`: <sig> <pubKey> OP_FALSE <contract>.
+func HashTimeLockRefund(sig, pubKey []byte, contract Script) Script {
+	return NewBuilder().AddData(sig).AddData(pubKey).AddOp(OP_FALSE).AddData(contract).Script()
+}
@@ -0,0 +1,251 @@
+package stratum
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+)
+
+// hashesPerCheck is the number of hashes a mining goroutine calculates before it looks for a new job.
+const hashesPerCheck = 1 << 12
+
+// Worker is an external miner connected to a job server.
+// It mines the jobs of the server and submits every share it finds.
+type Worker struct {
+	Threads int // number of mining goroutines
+
+	conn        net.Conn
+	scanner     *bufio.Scanner
+	extraNonce1 []byte
+	writeMu     sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*big.Int // share target of the submitted shares without response
+	stats   WorkerStats
+}
+
+// Dial connects to the job server at `addr` and subscribes as worker `name`.
+func Dial(addr, name string, threads int) (*Worker, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	w := &Worker{
+		Threads: threads,
+		conn:    conn,
+		scanner: bufio.NewScanner(conn),
+		pending: make(map[uint64]*big.Int),
+		stats:   WorkerStats{Name: name, Connected: time.Now()},
+	}
+	if err := w.subscribe(name); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Sends the subscription and waits for the extranonce1.
+func (w *Worker) subscribe(name string) error {
+	params, _ := json.Marshal(subscribeParams{Worker: name})
+	id, err := w.request(methodSubscribe, params, nil)
+	if err != nil {
+		return err
+	}
+	if !w.scanner.Scan() {
+		return fmt.Errorf("subscribing: connection closed: %v", w.scanner.Err())
+	}
+	var resp message
+	if err := json.Unmarshal(w.scanner.Bytes(), &resp); err != nil {
+		return fmt.Errorf("subscribing: %w", err)
+	}
+	if resp.ID == nil || *resp.ID != id {
+		return errors.New("subscribing: unexpected message")
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("subscribing: %s", resp.Error)
+	}
+	var result subscribeResult
+	if err := json.Unmarshal(resp.Result, &result); err != nil {
+		return fmt.Errorf("subscribing: %w", err)
+	}
+	extraNonce1, err := hex.DecodeString(result.ExtraNonce1)
+	if err != nil || len(extraNonce1) != blockchain.ExtraNonce1Size || result.ExtraNonce2Size != blockchain.ExtraNonce2Size {
+		return errors.New("subscribing: unsupported extra-nonce")
+	}
+	w.extraNonce1 = extraNonce1
+	return nil
+}
+
+// Stats returns the statistics of the worker as reported by the server's responses.
+func (w *Worker) Stats() WorkerStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
+
+// Close disconnects from the server.
+func (w *Worker) Close() error {
+	return w.conn.Close()
+}
+
+// Run mines the jobs of the server until `ctx` is cancelled or the connection is lost.
+func (w *Worker) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		w.conn.Close()
+	}()
+	var mining sync.WaitGroup
+	defer mining.Wait()
+	stopJob := func() {}
+	defer func() { stopJob() }()
+	for w.scanner.Scan() {
+		var msg message
+		if err := json.Unmarshal(w.scanner.Bytes(), &msg); err != nil {
+			if ctx.Err() != nil {
+				return nil // the last line was cut off by closing the connection
+			}
+			return fmt.Errorf("malformed message: %w", err)
+		}
+		if msg.ID != nil {
+			w.response(&msg)
+			continue
+		}
+		if msg.Method != methodNotify {
+			continue
+		}
+		var p notifyParams
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return fmt.Errorf("malformed job: %w", err)
+		}
+		job, shareTarget, err := p.job()
+		if err != nil {
+			return fmt.Errorf("malformed job: %w", err)
+		}
+		// A new job always replaces the current one.
+		stopJob()
+		jobCtx, cancelJob := context.WithCancel(ctx)
+		stopJob = cancelJob
+		mining.Add(1)
+		go func(id string) {
+			defer mining.Done()
+			w.mine(jobCtx, id, job, shareTarget)
+		}(p.JobID)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := w.scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("connection closed by server")
+}
+
+// Updates the statistics with the response to a submitted share.
+func (w *Worker) response(msg *message) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	shareTarget, ok := w.pending[*msg.ID]
+	if !ok {
+		return
+	}
+	delete(w.pending, *msg.ID)
+	if msg.Error != "" {
+		w.stats.RejectedShares++
+		if msg.Error == ErrStaleJob.Error() {
+			w.stats.StaleShares++
+		}
+		return
+	}
+	var result submitResult
+	json.Unmarshal(msg.Result, &result)
+	w.stats.AcceptedShares++
+	w.stats.LastShare = time.Now()
+	w.stats.Work += expectedHashes(shareTarget)
+	if result.Block {
+		w.stats.Blocks++
+	}
+}
+
+// Searches shares for `job` until `ctx` is cancelled or a block is found.
+// After a block the server always sends a new job.
+// Every extranonce2 gives a new header; its nonces are divided among the mining goroutines.
+func (w *Worker) mine(ctx context.Context, id string, job *blockchain.MiningJob, shareTarget *big.Int) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	target := job.Target()
+	extraNonce := make([]byte, blockchain.ExtraNonceSize)
+	copy(extraNonce, w.extraNonce1)
+	for en2 := uint64(0); en2 < 1<<(8*blockchain.ExtraNonce2Size) && ctx.Err() == nil; en2++ {
+		binary.BigEndian.PutUint32(extraNonce[blockchain.ExtraNonce1Size:], uint32(en2))
+		header, err := job.Header(extraNonce, job.Timestamp, 0)
+		if err != nil {
+			return
+		}
+		extraNonce2 := hex.EncodeToString(extraNonce[blockchain.ExtraNonce1Size:])
+		var wg sync.WaitGroup
+		for i := 0; i < w.Threads; i++ {
+			wg.Add(1)
+			go func(first uint64) {
+				defer wg.Done()
+				data := header.Serialize()
+				nonce := data[len(data)-4:]
+				var intHash big.Int
+				for n := first; n < 1<<32; n += uint64(w.Threads) {
+					if (n-first)%hashesPerCheck == 0 && ctx.Err() != nil {
+						return
+					}
+					binary.LittleEndian.PutUint32(nonce, uint32(n))
+					hash := sha256.Sum256(data)
+					hash = sha256.Sum256(hash[:])
+					if intHash.SetBytes(hash[:]).Cmp(shareTarget) < 0 {
+						w.submit(id, extraNonce2, job.Timestamp, uint32(n), shareTarget)
+						if intHash.Cmp(target) < 0 {
+							stop()
+							return
+						}
+					}
+				}
+			}(uint64(i))
+		}
+		wg.Wait()
+	}
+}
+
+// Submits a share.
+func (w *Worker) submit(id, extraNonce2 string, timestamp int64, nonce uint32, shareTarget *big.Int) {
+	params, _ := json.Marshal(submitParams{JobID: id, ExtraNonce2: extraNonce2, Time: timestamp, Nonce: nonce})
+	w.request(methodSubmit, params, shareTarget)
+}
+
+// Sends a request and returns its ID. Submitted shares are remembered with their `shareTarget`.
+func (w *Worker) request(method string, params json.RawMessage, shareTarget *big.Int) (uint64, error) {
+	w.mu.Lock()
+	w.nextID++
+	id := w.nextID
+	if shareTarget != nil {
+		w.pending[id] = shareTarget
+	}
+	w.mu.Unlock()
+	data, _ := json.Marshal(message{ID: &id, Method: method, Params: params})
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	_, err := w.conn.Write(append(data, '\n'))
+	return id, err
+}
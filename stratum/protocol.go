@@ -0,0 +1,127 @@
+// Package stratum implements a Stratum-like job protocol between a node and external mining workers.
+//
+// Messages are JSON objects, one per line. Requests carry an id, notifications have none:
+//
+//	worker: {"id":1,"method":"mining.subscribe","params":{"worker":"rig-1"}}
+//	server: {"id":1,"result":{"extranonce1":"00000001","extranonce2_size":4}}
+//	server: {"id":null,"method":"mining.notify","params":{"job_id":"1", ...}}
+//	worker: {"id":2,"method":"mining.submit","params":{"job_id":"1","extranonce2":"00000000","time":..,"nonce":..}}
+//	server: {"id":2,"result":{"block":false}}
+//
+// Every worker gets its own extranonce1, so workers never search the same headers.
+// Shares are hashes below the share target of a job, which is easier than the block target.
+package stratum
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+)
+
+// Methods of the protocol.
+const (
+	methodSubscribe = "mining.subscribe"
+	methodNotify    = "mining.notify"
+	methodSubmit    = "mining.submit"
+)
+
+// message is a request, response or notification.
+type message struct {
+	ID     *uint64         `json:"id"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type subscribeParams struct {
+	Worker string `json:"worker"`
+}
+
+type subscribeResult struct {
+	ExtraNonce1     string `json:"extranonce1"`
+	ExtraNonce2Size int    `json:"extranonce2_size"`
+}
+
+// notifyParams describes a job.
+type notifyParams struct {
+	JobID        string   `json:"job_id"`
+	PrevHash     string   `json:"prevhash"`
+	Height       uint64   `json:"height"`
+	Version      uint32   `json:"version"`
+	Bits         uint32   `json:"bits"`
+	Time         int64    `json:"time"`
+	Coinbase     string   `json:"coinbase"` // serialized coinbase without extra-nonce
+	MerkleBranch []string `json:"merkle_branch"`
+	ShareTarget  string   `json:"share_target"`
+	CleanJobs    bool     `json:"clean_jobs"` // previous jobs are stale
+}
+
+type submitParams struct {
+	JobID       string `json:"job_id"`
+	ExtraNonce2 string `json:"extranonce2"`
+	Time        int64  `json:"time"`
+	Nonce       uint32 `json:"nonce"`
+}
+
+type submitResult struct {
+	Block bool `json:"block"` // the share is a valid block
+}
+
+// Returns the notification of `job`.
+func newNotifyParams(id string, job *blockchain.MiningJob, shareTarget *big.Int, clean bool) notifyParams {
+	p := notifyParams{
+		JobID:       id,
+		PrevHash:    hex.EncodeToString(job.PrevHash),
+		Height:      job.Height,
+		Version:     job.Version,
+		Bits:        job.Bits,
+		Time:        job.Timestamp,
+		Coinbase:    hex.EncodeToString(job.Coinbase.Serialize()),
+		ShareTarget: fmt.Sprintf("%064x", shareTarget),
+		CleanJobs:   clean,
+	}
+	for _, h := range job.MerkleBranch {
+		p.MerkleBranch = append(p.MerkleBranch, hex.EncodeToString(h))
+	}
+	return p
+}
+
+// Returns the job and the share target of a notification.
+func (p *notifyParams) job() (*blockchain.MiningJob, *big.Int, error) {
+	prevHash, err := hex.DecodeString(p.PrevHash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("prevhash: %w", err)
+	}
+	data, err := hex.DecodeString(p.Coinbase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("coinbase: %w", err)
+	}
+	coinbase, err := blockchain.DeserializeTransaction(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	job := &blockchain.MiningJob{
+		Version:   p.Version,
+		PrevHash:  prevHash,
+		Height:    p.Height,
+		Timestamp: p.Time,
+		Bits:      p.Bits,
+		Coinbase:  &coinbase,
+	}
+	for _, s := range p.MerkleBranch {
+		h, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("merkle branch: %w", err)
+		}
+		job.MerkleBranch = append(job.MerkleBranch, h)
+	}
+	shareTarget, ok := new(big.Int).SetString(p.ShareTarget, 16)
+	if !ok {
+		return nil, nil, fmt.Errorf("malformed share target %q", p.ShareTarget)
+	}
+	return job, shareTarget, nil
+}
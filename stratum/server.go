@@ -0,0 +1,408 @@
+package stratum
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+)
+
+// DefaultShareShift makes shares 16 times easier than blocks.
+const DefaultShareShift = 4
+
+// maxTimeOffset is how far the timestamp of a share may lie in the future.
+const maxTimeOffset = 2 * time.Hour
+
+// maxJobs is the number of jobs on the current tip for which shares are accepted.
+const maxJobs = 8
+
+// Reasons for rejecting a share.
+var (
+	ErrNotSubscribed  = errors.New("not subscribed")
+	ErrStaleJob       = errors.New("stale job")
+	ErrBadExtraNonce  = errors.New("bad extranonce2")
+	ErrBadTime        = errors.New("time out of range")
+	ErrDuplicateShare = errors.New("duplicate share")
+	ErrLowDifficulty  = errors.New("low difficulty share")
+	ErrBlockRejected  = errors.New("block rejected")
+)
+
+// WorkerStats are the statistics of a worker.
+type WorkerStats struct {
+	Name           string
+	Connected      time.Time
+	AcceptedShares uint64
+	RejectedShares uint64
+	StaleShares    uint64 // part of the rejected shares
+	Blocks         uint64
+	LastShare      time.Time
+	Work           float64 // expected number of hashes for the accepted shares
+}
+
+// Hashrate returns the estimated hashes per second of the worker since it connected.
+func (s WorkerStats) Hashrate() float64 {
+	elapsed := time.Since(s.Connected).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return s.Work / elapsed
+}
+
+// A job handed out to the workers.
+type job struct {
+	id          string
+	seq         uint64 // jobs are numbered in the order of creation
+	tmpl        *blockchain.BlockTemplate
+	work        *blockchain.MiningJob
+	shareTarget *big.Int
+	shares      map[string]bool // submitted shares, for detecting duplicates
+}
+
+// A connected worker.
+type session struct {
+	conn        net.Conn
+	writeMu     sync.Mutex
+	job         *job // last job sent, guarded by writeMu
+	extraNonce1 []byte
+	stats       *WorkerStats // nil until subscribed
+}
+
+// Server hands out jobs built from block templates to workers and accepts their shares.
+// Blocks found by workers are added to the blockchain.
+type Server struct {
+	chain      *blockchain.BlockChain
+	address    string                           // the coinbase pays to this address
+	txs        func() []*blockchain.Transaction // transactions for the block templates
+	ShareShift uint                             // shares are 2^ShareShift times easier than blocks
+	OnBlock    func(*blockchain.Block)          // called for every block found by a worker
+
+	mu              sync.Mutex
+	jobs            map[string]*job // jobs on top of the current tip
+	current         *job
+	nextJobID       uint64
+	nextExtraNonce1 uint32
+	sessions        map[*session]bool
+	stats           map[string]*WorkerStats // by worker name
+}
+
+// NewServer creates a job server. The coinbase of every block pays to `address`;
+// the transactions of the blocks come from `txs`.
+func NewServer(chain *blockchain.BlockChain, address string, txs func() []*blockchain.Transaction) *Server {
+	return &Server{
+		chain:      chain,
+		address:    address,
+		txs:        txs,
+		ShareShift: DefaultShareShift,
+		jobs:       make(map[string]*job),
+		sessions:   make(map[*session]bool),
+		stats:      make(map[string]*WorkerStats),
+	}
+}
+
+// Serve accepts workers on `ln` until `ctx` is cancelled.
+// Returns after all connections are closed.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	if err := s.Refresh(); err != nil {
+		return err
+	}
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		s.mu.Lock()
+		for sess := range s.sessions {
+			sess.conn.Close()
+		}
+		s.mu.Unlock()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		sess := &session{conn: conn}
+		s.mu.Lock()
+		if ctx.Err() != nil {
+			// The connections were closed already.
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.sessions[sess] = true
+		s.mu.Unlock()
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			s.handle(sess)
+		}()
+	}
+}
+
+// Refresh builds a new job and sends it to all workers.
+// Jobs on top of an older tip become stale, as do all but the last maxJobs jobs.
+func (s *Server) Refresh() error {
+	tmpl, err := s.chain.NewBlockTemplate(s.address, s.txs())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.current == nil || !bytes.Equal(s.current.tmpl.Block.PrevHash, tmpl.Block.PrevHash) {
+		s.jobs = make(map[string]*job)
+	}
+	s.nextJobID++
+	j := &job{
+		id:          strconv.FormatUint(s.nextJobID, 16),
+		seq:         s.nextJobID,
+		tmpl:        tmpl,
+		work:        tmpl.Job(),
+		shareTarget: shareTarget(tmpl.Block.Bits, s.ShareShift),
+		shares:      make(map[string]bool),
+	}
+	s.jobs[j.id] = j
+	if s.nextJobID > maxJobs {
+		delete(s.jobs, strconv.FormatUint(s.nextJobID-maxJobs, 16))
+	}
+	s.current = j
+	var sessions []*session
+	for sess := range s.sessions {
+		if sess.stats != nil {
+			sessions = append(sessions, sess)
+		}
+	}
+	s.mu.Unlock()
+	// A slow worker must not hold up the others.
+	for _, sess := range sessions {
+		s.notify(sess, j)
+	}
+	return nil
+}
+
+// Returns the target of shares: the block target times 2^`shift`, at most 2^256-1.
+func shareTarget(bits uint32, shift uint) *big.Int {
+	target := new(big.Int).Lsh(blockchain.CompactToBig(bits), shift)
+	max := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	if target.Cmp(max) > 0 {
+		return max
+	}
+	return target
+}
+
+// Stats returns the statistics of all workers ever connected, ordered by name.
+func (s *Server) Stats() []WorkerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stats []WorkerStats
+	for _, st := range s.stats {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// Reads the requests of a worker until it disconnects.
+func (s *Server) handle(sess *session) {
+	defer func() {
+		sess.conn.Close()
+		s.mu.Lock()
+		delete(s.sessions, sess)
+		s.mu.Unlock()
+	}()
+	scanner := bufio.NewScanner(sess.conn)
+	for scanner.Scan() {
+		var req message
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil || req.ID == nil {
+			fmt.Printf("Stratum: malformed request from %s\n", sess.conn.RemoteAddr())
+			return
+		}
+		var result any
+		var err error
+		switch req.Method {
+		case methodSubscribe:
+			result, err = s.subscribe(sess, req.Params)
+		case methodSubmit:
+			result, err = s.submit(sess, req.Params)
+		default:
+			err = fmt.Errorf("unknown method %q", req.Method)
+		}
+		resp := message{ID: req.ID}
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Result, _ = json.Marshal(result)
+		}
+		if err := sess.send(resp); err != nil {
+			return
+		}
+		if req.Method == methodSubscribe && err == nil {
+			s.mu.Lock()
+			j := s.current
+			s.mu.Unlock()
+			s.notify(sess, j)
+		}
+	}
+}
+
+// Assigns an extranonce1 to the worker.
+func (s *Server) subscribe(sess *session, params json.RawMessage) (any, error) {
+	var p subscribeParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess.stats != nil {
+		return nil, errors.New("already subscribed")
+	}
+	s.nextExtraNonce1++
+	sess.extraNonce1 = make([]byte, blockchain.ExtraNonce1Size)
+	binary.BigEndian.PutUint32(sess.extraNonce1, s.nextExtraNonce1)
+	if p.Worker == "" {
+		p.Worker = sess.conn.RemoteAddr().String()
+	}
+	stats, ok := s.stats[p.Worker]
+	if !ok {
+		stats = &WorkerStats{Name: p.Worker, Connected: time.Now()}
+		s.stats[p.Worker] = stats
+	}
+	sess.stats = stats
+	return subscribeResult{hex.EncodeToString(sess.extraNonce1), blockchain.ExtraNonce2Size}, nil
+}
+
+// Validates a share. Shares which are blocks are added to the blockchain.
+func (s *Server) submit(sess *session, params json.RawMessage) (any, error) {
+	var p submitParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	b, err := s.checkShare(sess, &p)
+	if err != nil {
+		if sess.stats != nil {
+			sess.stats.RejectedShares++
+			if err == ErrStaleJob {
+				sess.stats.StaleShares++
+			}
+		}
+		s.mu.Unlock()
+		return nil, err
+	}
+	sess.stats.AcceptedShares++
+	sess.stats.LastShare = time.Now()
+	sess.stats.Work += expectedHashes(s.jobs[p.JobID].shareTarget)
+	stats := sess.stats
+	s.mu.Unlock()
+	if b == nil {
+		return submitResult{}, nil
+	}
+	// Workers stop mining a job after finding a block, so they get a new job in any case.
+	defer func() {
+		if err := s.Refresh(); err != nil {
+			fmt.Printf("Stratum: %s\n", err)
+		}
+	}()
+	if err := s.chain.AddBlock(b); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBlockRejected, err)
+	}
+	fmt.Printf("Stratum: worker %s found block %x\n", stats.Name, b.Hash)
+	s.mu.Lock()
+	stats.Blocks++
+	s.mu.Unlock()
+	if s.OnBlock != nil {
+		s.OnBlock(b)
+	}
+	return submitResult{Block: true}, nil
+}
+
+// Checks a share against its job. Returns the block if the share is a valid block.
+// Must be called with the lock held.
+func (s *Server) checkShare(sess *session, p *submitParams) (*blockchain.Block, error) {
+	if sess.stats == nil {
+		return nil, ErrNotSubscribed
+	}
+	j, ok := s.jobs[p.JobID]
+	if !ok {
+		return nil, ErrStaleJob
+	}
+	extraNonce2, err := hex.DecodeString(p.ExtraNonce2)
+	if err != nil || len(extraNonce2) != blockchain.ExtraNonce2Size {
+		return nil, ErrBadExtraNonce
+	}
+	if p.Time < j.work.Timestamp || time.Unix(p.Time, 0).After(time.Now().Add(maxTimeOffset)) {
+		return nil, ErrBadTime
+	}
+	extraNonce := append(append([]byte{}, sess.extraNonce1...), extraNonce2...)
+	key := fmt.Sprintf("%x:%d:%d", extraNonce, p.Time, p.Nonce)
+	if j.shares[key] {
+		return nil, ErrDuplicateShare
+	}
+	header, err := j.work.Header(extraNonce, p.Time, p.Nonce)
+	if err != nil {
+		return nil, ErrBadExtraNonce
+	}
+	hash := new(big.Int).SetBytes(header.CalcHash())
+	if hash.Cmp(j.shareTarget) >= 0 {
+		return nil, ErrLowDifficulty
+	}
+	j.shares[key] = true
+	if hash.Cmp(j.work.Target()) >= 0 {
+		return nil, nil // a share but not a block
+	}
+	return j.tmpl.Solution(extraNonce, p.Time, p.Nonce)
+}
+
+// Returns the expected number of hashes for finding a hash below `target`: 2^256 / (target+1).
+func expectedHashes(target *big.Int) float64 {
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	work, _ := new(big.Float).Quo(new(big.Float).SetInt(new(big.Int).Lsh(big.NewInt(1), 256)), new(big.Float).SetInt(denominator)).Float64()
+	return work
+}
+
+// Sends job `j` to the worker unless it got a newer job already. The worker is told to drop
+// its current job if `j` builds on another tip. Must be called without the lock held.
+func (s *Server) notify(sess *session, j *job) {
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	if sess.job != nil && sess.job.seq >= j.seq {
+		return
+	}
+	clean := sess.job == nil || !bytes.Equal(sess.job.tmpl.Block.PrevHash, j.tmpl.Block.PrevHash)
+	sess.job = j
+	params, _ := json.Marshal(newNotifyParams(j.id, j.work, j.shareTarget, clean))
+	if err := sess.write(message{Method: methodNotify, Params: params}); err != nil {
+		sess.conn.Close()
+	}
+}
+
+// Writes a message to the worker.
+func (sess *session) send(msg message) error {
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	return sess.write(msg)
+}
+
+// Writes a message to the worker. Must be called with writeMu held.
+func (sess *session) write(msg message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	sess.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = sess.conn.Write(append(data, '\n'))
+	return err
+}
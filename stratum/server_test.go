@@ -0,0 +1,230 @@
+package stratum
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mkohlhaas/gobc/blockchain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Starts a job server with `shareShift` on a new regtest blockchain in a temporary directory.
+// Returns the server and its address.
+func newTestServer(t *testing.T, shareShift uint) (*Server, string) {
+	params := blockchain.RegTestParams
+	params.DataDir = t.TempDir()
+	old := blockchain.Params
+	blockchain.Params = &params
+	t.Cleanup(func() { blockchain.Params = old })
+	address := string(blockchain.MakeWallet().Address())
+	chain := blockchain.CreateBlockChain(address, "test")
+	t.Cleanup(func() { chain.Database.Close() })
+
+	s := NewServer(chain, address, func() []*blockchain.Transaction { return nil })
+	s.ShareShift = shareShift
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, s.Serve(ctx, ln))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s, ln.Addr().String()
+}
+
+// A worker speaking the protocol by hand.
+type testConn struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+	nextID  uint64
+	job     *notifyParams // last job received
+}
+
+func dialTestConn(t *testing.T, addr string) *testConn {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, scanner: bufio.NewScanner(conn)}
+}
+
+// Sends a request and returns the response. Remembers jobs received in between.
+func (c *testConn) call(method string, params any) message {
+	c.nextID++
+	data, err := json.Marshal(params)
+	require.NoError(c.t, err)
+	data, err = json.Marshal(message{ID: &c.nextID, Method: method, Params: data})
+	require.NoError(c.t, err)
+	_, err = c.conn.Write(append(data, '\n'))
+	require.NoError(c.t, err)
+	for {
+		msg := c.read()
+		if msg.ID != nil && *msg.ID == c.nextID {
+			return msg
+		}
+	}
+}
+
+// Reads the next message. Remembers jobs.
+func (c *testConn) read() message {
+	require.True(c.t, c.scanner.Scan())
+	var msg message
+	require.NoError(c.t, json.Unmarshal(c.scanner.Bytes(), &msg))
+	if msg.Method == methodNotify {
+		c.job = &notifyParams{}
+		require.NoError(c.t, json.Unmarshal(msg.Params, c.job))
+	}
+	return msg
+}
+
+// Returns the first nonce for extranonce2 0 of the last job whose header hash is a block or not.
+func (c *testConn) findNonce(extraNonce1 []byte, block bool) uint32 {
+	job, _, err := c.job.job()
+	require.NoError(c.t, err)
+	extraNonce := append(append([]byte{}, extraNonce1...), make([]byte, blockchain.ExtraNonce2Size)...)
+	for nonce := uint32(0); ; nonce++ {
+		header, err := job.Header(extraNonce, job.Timestamp, nonce)
+		require.NoError(c.t, err)
+		if new(big.Int).SetBytes(header.CalcHash()).Cmp(job.Target()) < 0 == block {
+			return nonce
+		}
+	}
+}
+
+func TestServerValidatesShares(t *testing.T) {
+	s, addr := newTestServer(t, DefaultShareShift)
+	c := dialTestConn(t, addr)
+
+	resp := c.call(methodSubmit, submitParams{JobID: "1"})
+	assert.Equal(t, ErrNotSubscribed.Error(), resp.Error)
+
+	resp = c.call(methodSubscribe, subscribeParams{Worker: "rig"})
+	require.Empty(t, resp.Error)
+	var sub subscribeResult
+	require.NoError(t, json.Unmarshal(resp.Result, &sub))
+	assert.Equal(t, "00000001", sub.ExtraNonce1)
+	assert.Equal(t, blockchain.ExtraNonce2Size, sub.ExtraNonce2Size)
+	c.read()
+	require.NotNil(t, c.job)
+	assert.True(t, c.job.CleanJobs)
+	assert.Equal(t, uint64(1), c.job.Height)
+	extraNonce1 := []byte{0, 0, 0, 1}
+
+	share := submitParams{JobID: c.job.JobID, ExtraNonce2: "00000000", Time: c.job.Time, Nonce: c.findNonce(extraNonce1, false)}
+	for _, test := range []struct {
+		name   string
+		params submitParams
+		err    error
+	}{
+		{"Unknown job", submitParams{JobID: "ff", ExtraNonce2: "00000000", Time: c.job.Time}, ErrStaleJob},
+		{"Short extranonce2", submitParams{JobID: c.job.JobID, ExtraNonce2: "0000", Time: c.job.Time}, ErrBadExtraNonce},
+		{"Time before job", submitParams{JobID: c.job.JobID, ExtraNonce2: "00000000", Time: c.job.Time - 1}, ErrBadTime},
+		{"Share", share, nil},
+		{"Duplicate share", share, ErrDuplicateShare},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := c.call(methodSubmit, test.params)
+			if test.err != nil {
+				assert.Equal(t, test.err.Error(), resp.Error)
+				return
+			}
+			require.Empty(t, resp.Error)
+			assert.JSONEq(t, `{"block":false}`, string(resp.Result))
+		})
+	}
+
+	oldJob := c.job.JobID
+	blockShare := submitParams{JobID: oldJob, ExtraNonce2: "00000000", Time: c.job.Time, Nonce: c.findNonce(extraNonce1, true)}
+	resp = c.call(methodSubmit, blockShare)
+	require.Empty(t, resp.Error)
+	assert.JSONEq(t, `{"block":true}`, string(resp.Result))
+	assert.Equal(t, uint64(1), s.chain.BestHeight())
+	// The new job was sent before the response.
+	assert.True(t, c.job.CleanJobs)
+	assert.Equal(t, uint64(2), c.job.Height)
+	resp = c.call(methodSubmit, share)
+	assert.Equal(t, ErrStaleJob.Error(), resp.Error)
+
+	stats := s.Stats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, "rig", stats[0].Name)
+	assert.Equal(t, uint64(2), stats[0].AcceptedShares)
+	assert.Equal(t, uint64(5), stats[0].RejectedShares)
+	assert.Equal(t, uint64(2), stats[0].StaleShares)
+	assert.Equal(t, uint64(1), stats[0].Blocks)
+	assert.Greater(t, stats[0].Work, 0.0)
+}
+
+func TestRefreshKeepsLastJobs(t *testing.T) {
+	s, _ := newTestServer(t, 0)
+	for i := 0; i < 2*maxJobs; i++ {
+		require.NoError(t, s.Refresh())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Len(t, s.jobs, maxJobs)
+	assert.Contains(t, s.jobs, s.current.id)
+}
+
+func TestSlowWorkerDoesNotBlockServer(t *testing.T) {
+	s, _ := newTestServer(t, 0)
+	// A subscribed worker which never reads.
+	conn, peer := net.Pipe()
+	sess := &session{conn: conn, stats: &WorkerStats{Name: "slow"}}
+	s.mu.Lock()
+	s.sessions[sess] = true
+	s.mu.Unlock()
+	refreshed := make(chan error)
+	go func() { refreshed <- s.Refresh() }()
+	time.Sleep(100 * time.Millisecond)
+
+	stats := make(chan []WorkerStats)
+	go func() { stats <- s.Stats() }()
+	select {
+	case <-stats:
+	case <-time.After(time.Second):
+		t.Fatal("server blocked by a slow worker")
+	}
+	peer.Close()
+	assert.NoError(t, <-refreshed)
+}
+
+func TestShareTarget(t *testing.T) {
+	bits := blockchain.BigToCompact(new(big.Int).Lsh(big.NewInt(1), 200))
+	assert.Equal(t, new(big.Int).Lsh(big.NewInt(1), 204), shareTarget(bits, 4))
+	max := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	assert.Equal(t, max, shareTarget(blockchain.RegTestParams.PowLimitBits, 4))
+}
+
+func TestWorkerMinesBlocks(t *testing.T) {
+	s, addr := newTestServer(t, 0)
+	w, err := Dial(addr, "rig", 2)
+	require.NoError(t, err)
+	defer w.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+
+	require.Eventually(t, func() bool { return s.chain.BestHeight() >= 3 }, 10*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return w.Stats().Blocks >= 3 }, 10*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	stats := s.Stats()
+	require.Len(t, stats, 1)
+	assert.GreaterOrEqual(t, stats[0].Blocks, uint64(3))
+	assert.GreaterOrEqual(t, stats[0].AcceptedShares, stats[0].Blocks)
+	assert.Greater(t, stats[0].Hashrate(), 0.0)
+	assert.Equal(t, w.Stats().Name, stats[0].Name)
+}
@@ -0,0 +1,273 @@
+// Package wire provides the binary encoding used for storing and sending blocks, transactions and messages.
+//
+// The encoding is deterministic: every value has exactly one representation.
+//   - Fixed size integers are little endian.
+//   - Counts and lengths are Bitcoin's CompactSize integers.
+//   - Byte slices and strings are prefixed with their length.
+//
+// Every top-level object starts with a version byte.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version is the current version of the encoding.
+const Version = 1
+
+// MaxVarBytes is the maximum length of a byte slice, string or list we accept while decoding.
+const MaxVarBytes = 32 * 1024 * 1024
+
+var (
+	// ErrUnexpectedEOF is returned when the data ends before the object is completely decoded.
+	ErrUnexpectedEOF = errors.New("wire: unexpected end of data")
+	// ErrNonCanonical is returned when a CompactSize integer is not minimally encoded.
+	ErrNonCanonical = errors.New("wire: non-canonical CompactSize integer")
+)
+
+// Writer encodes values into a byte slice.
+type Writer struct {
+	buf []byte
+}
+
+// NewWriter creates a new Writer.
+func NewWriter() *Writer {
+	return &Writer{}
+}
+
+// Bytes returns the encoded data.
+func (w *Writer) Bytes() []byte {
+	return w.buf
+}
+
+// WriteVersion writes the version byte of the encoding.
+func (w *Writer) WriteVersion() {
+	w.WriteUint8(Version)
+}
+
+// WriteUint8 writes a single byte.
+func (w *Writer) WriteUint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+// WriteBool writes a boolean as a single byte.
+func (w *Writer) WriteBool(v bool) {
+	if v {
+		w.WriteUint8(1)
+	} else {
+		w.WriteUint8(0)
+	}
+}
+
+// WriteUint32 writes a 4 byte integer.
+func (w *Writer) WriteUint32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+// WriteUint64 writes an 8 byte integer.
+func (w *Writer) WriteUint64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+// WriteInt64 writes an 8 byte signed integer (two's complement).
+func (w *Writer) WriteInt64(v int64) {
+	w.WriteUint64(uint64(v))
+}
+
+// WriteVarInt writes a CompactSize integer.
+func (w *Writer) WriteVarInt(v uint64) {
+	switch {
+	case v < 0xfd:
+		w.WriteUint8(uint8(v))
+	case v <= 0xffff:
+		w.WriteUint8(0xfd)
+		var b [2]byte
+		binary.LittleEndian.PutUint16(b[:], uint16(v))
+		w.buf = append(w.buf, b[:]...)
+	case v <= 0xffffffff:
+		w.WriteUint8(0xfe)
+		w.WriteUint32(uint32(v))
+	default:
+		w.WriteUint8(0xff)
+		w.WriteUint64(v)
+	}
+}
+
+// WriteVarBytes writes a byte slice prefixed with its length.
+func (w *Writer) WriteVarBytes(b []byte) {
+	w.WriteVarInt(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// WriteFixedBytes writes exactly `n` bytes: `b` padded with zeros or truncated.
+// Used for fixed size fields like hashes.
+func (w *Writer) WriteFixedBytes(b []byte, n int) {
+	fixed := make([]byte, n)
+	copy(fixed, b)
+	w.buf = append(w.buf, fixed...)
+}
+
+// WriteString writes a string prefixed with its length.
+func (w *Writer) WriteString(s string) {
+	w.WriteVarBytes([]byte(s))
+}
+
+// Reader decodes values from a byte slice.
+// The first error is sticky: all following reads return zero values.
+type Reader struct {
+	data []byte
+	err  error
+}
+
+// NewReader creates a new Reader on `data`.
+func NewReader(data []byte) *Reader {
+	return &Reader{data: data}
+}
+
+// Err returns the first error which occurred while reading.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Finish returns the first error which occurred while reading or an error if there is data left.
+func (r *Reader) Finish() error {
+	if r.err == nil && len(r.data) > 0 {
+		r.err = fmt.Errorf("wire: %d trailing bytes", len(r.data))
+	}
+	return r.err
+}
+
+// Returns the next `n` bytes.
+func (r *Reader) next(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.data)) < n {
+		r.err = ErrUnexpectedEOF
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// ReadVersion reads the version byte and checks that we support it.
+func (r *Reader) ReadVersion() {
+	if v := r.ReadUint8(); r.err == nil && v != Version {
+		r.err = fmt.Errorf("wire: unsupported version %d", v)
+	}
+}
+
+// ReadUint8 reads a single byte.
+func (r *Reader) ReadUint8() uint8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// ReadBool reads a boolean.
+func (r *Reader) ReadBool() bool {
+	switch v := r.ReadUint8(); v {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("wire: invalid boolean %d", v)
+		}
+		return false
+	}
+}
+
+// ReadUint32 reads a 4 byte integer.
+func (r *Reader) ReadUint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// ReadUint64 reads an 8 byte integer.
+func (r *Reader) ReadUint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// ReadInt64 reads an 8 byte signed integer.
+func (r *Reader) ReadInt64() int64 {
+	return int64(r.ReadUint64())
+}
+
+// ReadVarInt reads a CompactSize integer.
+func (r *Reader) ReadVarInt() uint64 {
+	var v, least uint64
+	switch prefix := r.ReadUint8(); prefix {
+	case 0xfd:
+		b := r.next(2)
+		if b == nil {
+			return 0
+		}
+		v, least = uint64(binary.LittleEndian.Uint16(b)), 0xfd
+	case 0xfe:
+		v, least = uint64(r.ReadUint32()), 0x10000
+	case 0xff:
+		v, least = r.ReadUint64(), 0x100000000
+	default:
+		return uint64(prefix)
+	}
+	if r.err == nil && v < least {
+		r.err = ErrNonCanonical
+		return 0
+	}
+	return v
+}
+
+// ReadCount reads a CompactSize integer used as the number of elements of a list.
+func (r *Reader) ReadCount() int {
+	n := r.ReadVarInt()
+	if n > MaxVarBytes {
+		if r.err == nil {
+			r.err = fmt.Errorf("wire: list too long (%d elements)", n)
+		}
+		return 0
+	}
+	return int(n)
+}
+
+// ReadVarBytes reads a byte slice prefixed with its length.
+// Returns nil for an empty byte slice.
+func (r *Reader) ReadVarBytes() []byte {
+	n := uint64(r.ReadCount())
+	b := r.next(n)
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// ReadFixedBytes reads exactly `n` bytes.
+func (r *Reader) ReadFixedBytes(n int) []byte {
+	b := r.next(uint64(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// ReadString reads a string prefixed with its length.
+func (r *Reader) ReadString() string {
+	return string(r.ReadVarBytes())
+}
@@ -0,0 +1,48 @@
+package wire
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVarInt(t *testing.T) {
+	tests := []struct {
+		value   uint64
+		encoded string
+	}{
+		{0, "00"},
+		{0xfc, "fc"},
+		{0xfd, "fdfd00"},
+		{0xffff, "fdffff"},
+		{0x10000, "fe00000100"},
+		{0xffffffff, "feffffffff"},
+		{0x100000000, "ff0000000001000000"},
+	}
+	for _, test := range tests {
+		w := NewWriter()
+		w.WriteVarInt(test.value)
+		assert.Equal(t, test.encoded, hex.EncodeToString(w.Bytes()))
+		r := NewReader(w.Bytes())
+		assert.Equal(t, test.value, r.ReadVarInt())
+		assert.NoError(t, r.Finish())
+	}
+}
+
+func TestVarIntRejectsNonCanonical(t *testing.T) {
+	for _, encoded := range []string{"fd0100", "fe00ff0000", "ffffffffff00000000"} {
+		data, _ := hex.DecodeString(encoded)
+		r := NewReader(data)
+		r.ReadVarInt()
+		assert.ErrorIs(t, r.Err(), ErrNonCanonical, encoded)
+	}
+}
+
+func TestReaderErrorsAreSticky(t *testing.T) {
+	r := NewReader([]byte{0x05, 0x01})
+	assert.Nil(t, r.ReadVarBytes())
+	assert.ErrorIs(t, r.Err(), ErrUnexpectedEOF)
+	assert.Equal(t, uint32(0), r.ReadUint32())
+	assert.ErrorIs(t, r.Finish(), ErrUnexpectedEOF)
+}